@@ -2,9 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/blit/advlight/config"
 	"github.com/blit/advlight/tickets"
@@ -16,12 +18,44 @@ import (
 )
 
 func main() {
-	flag.BoolVar(&tickets.CAPTCHADisabled, "nocaptcha", false, "disabled captcha")
+	var (
+		noCAPTCHA    bool
+		runRetention bool
+		dryRun       bool
+		retention    string
+	)
+	flag.BoolVar(&noCAPTCHA, "nocaptcha", false, "disabled captcha (same as ADVLIGHT_CAPTCHA=none)")
+	flag.BoolVar(&runRetention, "retention", false, "anonymize guests past the retention period and exit")
+	flag.BoolVar(&dryRun, "dryrun", false, "with -retention, report what would be anonymized without changing anything")
+	flag.StringVar(&retention, "retention-period", "", "with -retention, overrides ADVLIGHT_RETENTION (ie 180d)")
 	flag.Parse()
+	if noCAPTCHA {
+		tickets.CAPTCHA = tickets.NoCAPTCHA{}
+	}
+	if runRetention {
+		applyRetention(retention, dryRun)
+		return
+	}
 	runServer()
 	//addTickets()
 }
 
+func applyRetention(period string, dryRun bool) {
+	retention := tickets.Retention
+	if period != "" {
+		var err error
+		retention, err = tickets.ParseRetention(period)
+		if err != nil {
+			log.Fatalln("invalid -retention-period", err)
+		}
+	}
+	report, err := tickets.Repo.ApplyRetention(tickets.SystemActor("retention_cli"), retention, time.Now(), dryRun)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(report)
+}
+
 func addTickets() {
 	slots, err := tickets.Repo.GetSlotsStats()
 	if err != nil {
@@ -32,7 +66,7 @@ func addTickets() {
 			continue
 		}
 		if s.AvailableTickets == 0 {
-			tickets.Repo.CreateSlots("grace", int(s.Slot.Unix()), 50)
+			tickets.Repo.CreateSlots(tickets.SystemActor("addTickets"), "grace", int(s.Slot.Unix()), 50)
 			log.Println(s.Slot, s.AvailableTickets)
 		}
 	}
@@ -55,16 +89,73 @@ func runServer() {
 	r.Post("/admin", views.TicketAdminHandler)
 
 	r.Get("/admin/run_expired", views.TicketAdminExpiresHandler)
+	r.Get("/admin/run_retention", views.TicketAdminRetentionHandler)
+	r.Get("/admin/slots", views.TicketAdminSlotsHandler)
+	r.Post("/admin/slots", views.TicketAdminSlotsHandler)
+	r.Get("/admin/guests", views.TicketAdminGuestsHandler)
+	r.Post("/admin/guests", views.TicketAdminGuestsHandler)
+	r.Get("/admin/audit", views.TicketAdminAuditHandler)
+	r.Post("/admin/audit", views.TicketAdminAuditHandler)
+	r.Get("/admin/suspicious", views.TicketAdminSuspiciousHandler)
+	r.Post("/admin/suspicious", views.TicketAdminSuspiciousHandler)
+	r.Get("/admin/eventcodes", views.TicketAdminEventCodesHandler)
+	r.Post("/admin/eventcodes", views.TicketAdminEventCodesHandler)
+	r.Get("/admin/blocklist", views.TicketAdminBlocklistHandler)
+	r.Post("/admin/blocklist", views.TicketAdminBlocklistHandler)
+	r.Get("/admin/artwork", views.TicketAdminArtworkHandler)
+	r.Post("/admin/artwork", views.TicketAdminArtworkHandler)
+	r.Get("/admin/theme", views.TicketAdminThemeHandler)
+	r.Post("/admin/theme", views.TicketAdminThemeHandler)
+	r.Get("/admin/emails", views.TicketAdminEmailsHandler)
+	r.Post("/admin/emails", views.TicketAdminEmailsHandler)
+	r.Post("/admin/emails/preview", views.TicketAdminEmailPreviewHandler)
+	r.Get("/admin/tickettypes", views.TicketAdminTicketTypesHandler)
+	r.Post("/admin/tickettypes", views.TicketAdminTicketTypesHandler)
+	r.Get("/admin/donations", views.TicketAdminDonationsHandler)
+	r.Post("/admin/donations", views.TicketAdminDonationsHandler)
+	r.Get("/admin/groups", views.TicketAdminGroupsHandler)
+	r.Post("/admin/groups", views.TicketAdminGroupsHandler)
+
+	r.Post("/payments/webhook", views.PaymentWebhookHandler)
+	r.Get("/payments/fake/{ref}", views.FakeCheckoutHandler)
+	r.Post("/payments/fake/{ref}", views.FakeCheckoutHandler)
+
+	r.Get("/donate", views.DonateHandler)
+	r.Get("/events/slots", views.SlotEventsHandler)
+	r.Get("/groups/{token}", views.GroupPortalHandler)
+	r.Post("/groups/{token}", views.GroupPortalHandler)
+	r.Get("/kiosk", views.KioskHandler)
+	r.Post("/kiosk", views.KioskHandler)
+	r.Post("/kiosk/capacity", views.KioskCapacityHandler)
+	r.Get("/kiosk/door", views.DoorHandler)
+	r.Get("/kiosk/door-sw.js", views.DoorServiceWorkerHandler)
+	r.Post("/kiosk/door/manifest", views.DoorManifestHandler)
+	r.Post("/kiosk/door/sync", views.DoorSyncHandler)
 
 	r.Get("/{guestID}", views.TicketIndexHandler)
 	r.Post("/{guestID}", views.TicketIndexHandler)
 	r.Get("/{guestID}/ticket/{ticketID}", views.TicketShowHandler)
+	r.Get("/{guestID}/ticket/{ticketID}/calendar.ics", views.TicketCalendarHandler)
+	r.Get("/{guestID}/ticket/{ticketID}/ticket.pdf", views.TicketPDFHandler)
+	r.Get("/{guestID}/ticket/{ticketID}/ticket.pkpass", views.TicketApplePassHandler)
+	r.Get("/{guestID}/ticket/{ticketID}/googlewallet", views.TicketGoogleWalletHandler)
+	r.Get("/{guestID}/checkout/{slot}", views.GuestCheckoutHandler)
+	r.Get("/{guestID}/donate", views.DonateHandler)
+	r.Get("/{guestID}/calendar.ics", views.GuestCalendarHandler)
+	r.Get("/{guestID}/tickets.pdf", views.GuestPDFHandler)
+	r.Get("/{guestID}/account", views.GuestAccountHandler)
+	r.Post("/{guestID}/account", views.GuestAccountHandler)
+	r.Get("/{guestID}/account/email", views.GuestEmailChangeHandler)
+	r.Get("/{guestID}/account/export", views.GuestExportHandler)
 	r.Get("/assets/img/{imageID}", views.AssetImageHandler)
+	r.Get("/static/*", views.StaticHandler)
+	r.Get("/assets/artwork/{name}", views.ArtworkImageHandler)
 	r.Get("/ticketfaces", views.TicketFacesHandler)
 	if tickets.DatabaseURL == "" {
 		log.Println(os.Getenv("ADVLIGHT_DATABASE_URL"))
 		log.Fatal("ADVLIGHT_DATABASE_URL is not set; try export ADVLIGHT_DATABASE_URL=postgres://postgres@localhost/advlight?sslmode=disable")
 	}
-	log.Println(tickets.HostName, tickets.DatabaseURL, "CAPTCHADisabled:", tickets.CAPTCHADisabled)
+	log.Println(tickets.HostName, tickets.DatabaseURL, "CAPTCHA:", tickets.CAPTCHA.Widget().Provider)
+	tickets.ListenEvents()
 	log.Fatalln(http.ListenAndServe(config.Port, r))
 }
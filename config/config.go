@@ -1,6 +1,11 @@
 package config
 
-import "os"
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
 
 var HostName = os.Getenv("ADVLIGHT_HOSTNAME")
 var Port = os.Getenv("ADVLIGHT_PORT")
@@ -12,3 +17,36 @@ var EventLogo = os.Getenv("ADVLIGHT_EVENTLOGO")
 var EventAddress = os.Getenv("ADVLIGHT_EVENTADDRESS")
 var DonateLink = os.Getenv("ADVLIGHT_DONATELINK")
 var FavICO = os.Getenv("ADVLIGHT_FAVICON")
+
+// KioskPassword signs volunteers in to the walk-up kiosk at /kiosk without the admin password (ADVLIGHT_KIOSK_PASSWORD)
+var KioskPassword = os.Getenv("ADVLIGHT_KIOSK_PASSWORD")
+
+// DonatePrompt asks guests to donate after they book, with the DonateLink (ADVLIGHT_DONATE_PROMPT=true)
+var DonatePrompt = strings.EqualFold(os.Getenv("ADVLIGHT_DONATE_PROMPT"), "true")
+
+// Production serves templates and static files from the binary, otherwise wwwroot is read from disk and templates reload when they change
+var Production = strings.EqualFold(os.Getenv("ADVLIGHT_ENV"), "production")
+
+// AssetsDir overrides embedded templates and static files with the files in this directory (ADVLIGHT_ASSETS_DIR)
+var AssetsDir = os.Getenv("ADVLIGHT_ASSETS_DIR")
+
+// ThemeDir is a theme with a theme.json, templates and images to brand the site and emails (ADVLIGHT_THEME_DIR)
+var ThemeDir = os.Getenv("ADVLIGHT_THEME_DIR")
+
+// Secret signs values handed to guests (captcha challenges, links), must be the same on every instance
+var Secret = os.Getenv("ADVLIGHT_SECRET")
+
+// Location is the time zone new slots are created in (ADVLIGHT_TIMEZONE, defaults to America/Los_Angeles)
+var Location = loadLocation(os.Getenv("ADVLIGHT_TIMEZONE"))
+
+func loadLocation(name string) *time.Location {
+	if name == "" {
+		name = "America/Los_Angeles"
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("invalid ADVLIGHT_TIMEZONE %s, using UTC: %v", name, err)
+		return time.UTC
+	}
+	return loc
+}
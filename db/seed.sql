@@ -6,10 +6,42 @@ create table guests (
   created_at timestamptz not null default current_timestamp,
   email citext not null,
   verified bool not null default false,
-  ip_address inet
+  ip_address inet,
+  anonymized_at timestamptz, -- set by the retention job, email and ip_address are no longer the guest's
+  language text -- i18n language for emails, null for the default
 );
 create unique index guests_email_key on guests(email);
 
+-- ticket types guests choose from, priced types are paid for at checkout; tickets without a type are free general admission
+create table ticket_types (
+  code citext primary key,
+  name text not null,
+  description text not null default '',
+  price_cents integer not null default 0 check (price_cents >= 0),
+  active bool not null default true,
+  created_at timestamptz not null default current_timestamp
+);
+
+-- a guest's checkout for priced tickets, the tickets are held for the guest until hold_until while it is pending
+create table payments (
+  id bigserial primary key,
+  guest_id uuid references guests(id) on delete set null on update cascade,
+  slot timestamptz not null,
+  amount_cents integer not null,
+  currency text not null,
+  provider text not null,
+  provider_ref text, -- the provider's checkout id
+  provider_payment text, -- the provider's payment id, refunds are made against it
+  checkout_url text, -- where the guest pays, reused until the hold runs out
+  status text not null default 'pending' check (status in ('pending','paid','failed','expired','cancelled','refunded')),
+  hold_until timestamptz not null,
+  created_at timestamptz not null default current_timestamp,
+  updated_at timestamptz not null default current_timestamp
+);
+create unique index payments_provider_ref on payments(provider, provider_ref);
+create index payments_guest_id_fkey on payments(guest_id);
+create index payments_pending on payments(hold_until) where status = 'pending';
+
 -- timestampslot ensures that a timeslot time is either top of hour or half hour
 CREATE DOMAIN timestampslot AS timestamptz
 CHECK(
@@ -22,9 +54,175 @@ create table tickets (
   updated_at timestamptz not null default current_timestamp,
   guest_id uuid references guests(id) on delete set null on update cascade,
   event_code citext,
+  booked_at timestamptz,
+  booked_ip inet,
+  booked_user_agent text not null default '',
+  category text not null default 'standard' check (category in ('standard','accessible','companion')),
+  ticket_type citext references ticket_types(code) on update cascade, -- null for free general admission
+  price_cents integer not null default 0, -- the type's price when the ticket was created
+  payment_id bigint references payments(id) on delete set null,
+  checked_in_at timestamptz, -- set at the gate by the kiosk or a door client
+  checked_in_gate text, -- the kiosk or door client gate that checked the ticket in
   PRIMARY KEY (slot,num)
 );
 create index tickets_guest_id_fkey on tickets(guest_id);
+create index tickets_booked_at on tickets(booked_at) where booked_at is not null;
+
+-- emails sent to guests, shown in the admin guest console
+create table emails (
+  id bigserial primary key,
+  created_at timestamptz not null default current_timestamp,
+  guest_id uuid references guests(id) on delete cascade on update cascade,
+  address citext not null,
+  subject text not null,
+  error text
+);
+create index emails_guest_id_fkey on emails(guest_id);
+
+-- append-only history of bookings, cancellations and admin actions
+-- guest_id is not a foreign key so history survives guests being merged or deleted
+create table audit_log (
+  id bigserial primary key,
+  created_at timestamptz not null default current_timestamp,
+  actor_kind text not null,
+  actor_name text not null default '',
+  ip_address inet,
+  request_id text not null default '',
+  action text not null,
+  guest_id uuid,
+  guest_email citext not null default '',
+  slot timestamptz,
+  ticket_num integer,
+  event_code citext,
+  before_state text not null default '',
+  after_state text not null default ''
+);
+create index audit_log_guest_id on audit_log(guest_id);
+create index audit_log_slot on audit_log(slot);
+create rule audit_log_no_delete as on delete to audit_log do instead nothing;
+
+-- optional settings for event codes, codes without a row have no restrictions
+create table event_codes (
+  code citext primary key,
+  created_at timestamptz not null default current_timestamp,
+  email_domains text[] not null default '{}'
+);
+
+-- failed event code attempts, used for lockouts
+create table eventcode_attempts (
+  id bigserial primary key,
+  created_at timestamptz not null default current_timestamp,
+  code citext not null,
+  guest_id uuid,
+  ip_address inet,
+  user_agent text not null default '',
+  request_id text not null default ''
+);
+create index eventcode_attempts_created_at on eventcode_attempts(created_at);
+
+-- disposable email domains guests can not book with, subdomains are blocked too
+create table blocked_email_domains (
+  domain citext primary key,
+  created_at timestamptz not null default current_timestamp,
+  note text not null default ''
+);
+insert into blocked_email_domains(domain,note) values
+  ('mailinator.com','disposable'),
+  ('guerrillamail.com','disposable'),
+  ('10minutemail.com','disposable'),
+  ('temp-mail.org','disposable'),
+  ('yopmail.com','disposable'),
+  ('trashmail.com','disposable'),
+  ('sharklasers.com','disposable'),
+  ('getnada.com','disposable'),
+  ('dispostable.com','disposable'),
+  ('maildrop.cc','disposable');
+
+-- uploaded ticket artwork (unless ADVLIGHT_ARTWORK_DIR is set)
+create table artwork (
+  name text primary key,
+  content_type text not null,
+  data bytea not null,
+  updated_at timestamptz not null default current_timestamp
+);
+
+-- artwork shown on tickets for a day, an event code or both; neither is the default for all tickets
+create table artwork_assignments (
+  id bigserial primary key,
+  day date,
+  event_code citext,
+  artwork text not null,
+  created_at timestamptz not null default current_timestamp
+);
+create unique index artwork_assignments_key on artwork_assignments(coalesce(day,'1970-01-01'::date), coalesce(event_code,''));
+
+-- email wording edited in admin, every save is a new version and the newest is sent
+create table email_templates (
+  id bigserial primary key,
+  name text not null,
+  lang text not null,
+  version int not null,
+  subject text not null,
+  intro text not null default '',
+  instructions text not null default '',
+  button text not null,
+  button_color text not null default '',
+  outro text not null default '',
+  created_at timestamptz not null default current_timestamp,
+  created_by text not null default '',
+  unique (name, lang, version)
+);
+
+-- outbound clicks on the donate link, guest_id is null for visitors that are not signed in
+create table donation_clicks (
+  id bigserial primary key,
+  guest_id uuid references guests(id) on delete set null on update cascade,
+  source text not null,
+  event_code citext,
+  created_at timestamptz not null default current_timestamp
+);
+create index donation_clicks_guest_id on donation_clicks(guest_id);
+
+-- donations imported from the donation processor's csv, matched to guests by email
+create table donations (
+  id bigserial primary key,
+  external_id text not null unique,
+  email citext not null,
+  amount_cents bigint not null,
+  donated_at timestamptz not null,
+  guest_id uuid references guests(id) on delete set null on update cascade,
+  imported_at timestamptz not null default current_timestamp
+);
+create index donations_guest_id on donations(guest_id);
+create index donations_email on donations(email);
+
+-- group bookings, the coordinator reserves seats in a slot which are tickets moved to the group's event code
+create table booking_groups (
+  id uuid primary key default gen_random_uuid(),
+  created_at timestamptz not null default current_timestamp,
+  name text not null,
+  coordinator_email citext not null,
+  event_code citext not null unique,
+  max_seats integer not null,
+  slot timestamptz, -- null until seats are reserved
+  release_at timestamptz, -- unclaimed seats go back to general admission then (run_expired)
+  released_at timestamptz
+);
+
+-- emails a group coordinator invited, members claim seats by booking with the group's link
+create table group_invites (
+  group_id uuid not null references booking_groups(id) on delete cascade,
+  email citext not null,
+  invited_at timestamptz not null default current_timestamp,
+  primary key (group_id, email)
+);
+
+-- token buckets for rate limiting, shared by all instances
+create table rate_limits (
+  key text primary key,
+  tokens double precision not null,
+  updated_at timestamptz not null default current_timestamp
+);
 
 with days as (
 select day from generate_series(
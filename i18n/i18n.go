@@ -0,0 +1,192 @@
+// Package i18n translates guest pages and emails.  Messages are in catalogs/<lang>.json, English is the default
+// and every catalog must have the same keys (see TestCatalogs).
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default is the language used when a guest has no preference and for missing messages
+const Default = "en"
+
+//go:embed catalogs/*.json
+var catalogFiles embed.FS
+
+// catalogs maps language -> message key -> message, loaded once at startup
+var catalogs = make(map[string]map[string]string)
+
+func init() {
+	files, err := catalogFiles.ReadDir("catalogs")
+	if err != nil {
+		log.Fatalln("i18n", err)
+	}
+	for _, f := range files {
+		b, err := catalogFiles.ReadFile("catalogs/" + f.Name())
+		if err != nil {
+			log.Fatalln("i18n", f.Name(), err)
+		}
+		messages := make(map[string]string)
+		err = json.Unmarshal(b, &messages)
+		if err != nil {
+			log.Fatalln("i18n", f.Name(), err)
+		}
+		catalogs[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = messages
+	}
+}
+
+// Language is a supported language for the language toggle
+type Language struct {
+	Code string // ie es
+	Name string // the language's own name, ie Español
+}
+
+// Languages are the supported languages, the default first
+func Languages() []Language {
+	langs := make([]Language, 0, len(catalogs))
+	for code := range catalogs {
+		langs = append(langs, Language{Code: code, Name: T(code, "language.name")})
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		if langs[i].Code == Default || langs[j].Code == Default {
+			return langs[i].Code == Default
+		}
+		return langs[i].Code < langs[j].Code
+	})
+	return langs
+}
+
+// Supported is true when there is a catalog for lang
+func Supported(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok
+}
+
+// T translates a message, args are formatted into it like fmt.Sprintf.  Missing messages fall back to
+// English and then the key itself so a page never breaks.
+func T(lang, key string, args ...interface{}) string {
+	msg, ok := catalogs[lang][key]
+	if !ok {
+		msg, ok = catalogs[Default][key]
+	}
+	if !ok {
+		log.Printf("[ERROR] i18n missing message %s", key)
+		return key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Error is an error shown to guests, translated with Message
+type Error struct {
+	Key  string
+	Args []interface{}
+}
+
+// Errorf returns an Error for a catalog message
+func Errorf(key string, args ...interface{}) error {
+	return &Error{Key: key, Args: args}
+}
+
+func (e *Error) Error() string {
+	return T(Default, e.Key, e.Args...)
+}
+
+// Translate is the error in lang
+func (e *Error) Translate(lang string) string {
+	return T(lang, e.Key, e.Args...)
+}
+
+// Translated is an error that can be shown in the guest's language, like Error
+type Translated interface {
+	error
+	Translate(lang string) string
+}
+
+// Message is the error in lang when it is Translated, other errors are not translated
+func Message(lang string, err error) string {
+	if e, ok := err.(Translated); ok {
+		return e.Translate(lang)
+	}
+	return err.Error()
+}
+
+// Match picks the best supported language from an Accept-Language header (ie "es-MX,es;q=0.9,en;q=0.8")
+func Match(acceptLanguage string) string {
+	best, bestQ := Default, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				q, _ = strconv.ParseFloat(f[2:], 64)
+			}
+		}
+		// es-MX matches es
+		if i := strings.Index(tag, "-"); i > 0 {
+			tag = tag[:i]
+		}
+		if Supported(tag) && q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// dateTokens are the layout tokens FormatTime translates, longest first so January is not read as Jan
+var dateTokens = []string{"January", "Monday", "Jan", "Mon"}
+
+// FormatTime formats t with the layout in the catalog message key (ie "format.slot"), month and day names are translated
+func FormatTime(lang string, t time.Time, key string) string {
+	layout := T(lang, key)
+	names := map[string]string{
+		"January": list(lang, "date.months", int(t.Month())-1),
+		"Jan":     list(lang, "date.months_short", int(t.Month())-1),
+		"Monday":  list(lang, "date.days", int(t.Weekday())),
+		"Mon":     list(lang, "date.days_short", int(t.Weekday())),
+	}
+	// names are swapped for placeholders so they are not read as layout tokens, then put back after formatting
+	var sb strings.Builder
+	subs := make([]string, 0)
+	for i := 0; i < len(layout); {
+		matched := false
+		for _, tok := range dateTokens {
+			if strings.HasPrefix(layout[i:], tok) {
+				sb.WriteByte(0)
+				subs = append(subs, names[tok])
+				i += len(tok)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			sb.WriteByte(layout[i])
+			i++
+		}
+	}
+	s := t.Format(sb.String())
+	for _, sub := range subs {
+		s = strings.Replace(s, "\x00", sub, 1)
+	}
+	return s
+}
+
+// list is the i'th entry of a space separated catalog message
+func list(lang, key string, i int) string {
+	items := strings.Fields(T(lang, key))
+	if i < 0 || i >= len(items) {
+		return ""
+	}
+	return items[i]
+}
@@ -0,0 +1,76 @@
+package i18n
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var verbRe = regexp.MustCompile(`%[a-z]`)
+
+// TestCatalogs fails when a catalog is missing a message, has one English does not, or has different format verbs
+func TestCatalogs(t *testing.T) {
+	assert.True(t, Supported(Default))
+	assert.True(t, len(catalogs) > 1)
+	for lang, messages := range catalogs {
+		for key, msg := range catalogs[Default] {
+			translated, ok := messages[key]
+			if !assert.True(t, ok, "%s is missing %s", lang, key) {
+				continue
+			}
+			assert.Equal(t, verbRe.FindAllString(msg, -1), verbRe.FindAllString(translated, -1), "%s %s format verbs", lang, key)
+		}
+		for key := range messages {
+			_, ok := catalogs[Default][key]
+			assert.True(t, ok, "%s has %s which is not in %s", lang, key, Default)
+		}
+		assert.Equal(t, 12, len(strings.Fields(messages["date.months"])), lang)
+		assert.Equal(t, 12, len(strings.Fields(messages["date.months_short"])), lang)
+		assert.Equal(t, 7, len(strings.Fields(messages["date.days"])), lang)
+		assert.Equal(t, 7, len(strings.Fields(messages["date.days_short"])), lang)
+	}
+}
+
+func TestT(t *testing.T) {
+	assert.Equal(t, "Reservar", T("es", "index.reserve"))
+	assert.Equal(t, "(3 disp.)", T("es", "index.available", 3))
+	// unknown languages and keys fall back to English, then the key
+	assert.Equal(t, "Reserve", T("xx", "index.reserve"))
+	assert.Equal(t, "no.such.key", T("es", "no.such.key"))
+
+	err := Errorf("error.sold_out")
+	assert.Equal(t, T(Default, "error.sold_out"), err.Error())
+	assert.Equal(t, T("es", "error.sold_out"), Message("es", err))
+}
+
+func TestMatch(t *testing.T) {
+	assert.Equal(t, "es", Match("es-MX,es;q=0.9,en;q=0.8"))
+	assert.Equal(t, "en", Match("en-US,en;q=0.9,es;q=0.8"))
+	assert.Equal(t, "es", Match("fr-FR,fr;q=0.9,es;q=0.5"))
+	assert.Equal(t, Default, Match("fr"))
+	assert.Equal(t, Default, Match(""))
+}
+
+func TestFormatTime(t *testing.T) {
+	slot := time.Date(2019, 12, 2, 19, 30, 0, 0, time.UTC)
+	assert.Equal(t, "Dec 02, 7:30pm", FormatTime("en", slot, "format.slot"))
+	assert.Equal(t, "02 dic, 19:30", FormatTime("es", slot, "format.slot"))
+	// May is the same long and short in English but not in Spanish
+	may := time.Date(2019, 5, 6, 9, 0, 0, 0, time.UTC)
+	assert.Equal(t, "06 may, 09:00", FormatTime("es", may, "format.slot"))
+}
+
+func TestLanguages(t *testing.T) {
+	langs := Languages()
+	assert.Equal(t, Default, langs[0].Code)
+	codes := make([]string, 0)
+	for _, l := range langs {
+		codes = append(codes, l.Code)
+	}
+	assert.True(t, sort.StringsAreSorted(codes[1:]))
+	assert.Contains(t, codes, "es")
+}
@@ -0,0 +1,185 @@
+// Package theme brands the site and emails for a deployment.  A theme directory (ADVLIGHT_THEME_DIR) has a
+// theme.json and may replace templates and images with its own templates/ and img/ directories.
+package theme
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/blit/advlight/config"
+)
+
+// Theme is the branding for a deployment, urls may be absolute or a path in the theme directory (ie img/logo.png)
+type Theme struct {
+	Name       string            `json:"name"`
+	Logo       string            `json:"logo"`
+	Banner     string            `json:"banner"`
+	Favicon    string            `json:"favicon"`
+	Stylesheet string            `json:"stylesheet"` // css file in the theme directory, included after the colors
+	Colors     map[string]string `json:"colors"`     // css variables, ie "header-bg" is var(--header-bg)
+	Email      Email             `json:"email"`
+}
+
+// Email is the copy and colors used in emails
+type Email struct {
+	Intro       string `json:"intro"`     // extra paragraph at the top of every email
+	Signature   string `json:"signature"` // empty for the translated "Merry Christmas!"
+	Copyright   string `json:"copyright"`
+	ButtonColor string `json:"buttonColor"` // the main button in each email
+}
+
+// DefaultColors are the css variables used by the built in templates
+var DefaultColors = map[string]string{
+	"header-bg":   "#0f1515",
+	"heading":     "#0f1515",
+	"body-bg":     "#ffffff",
+	"ticket-time": "#4c991a",
+}
+
+// AssetURL is the url of a file in the theme directory, the views package sets it to the content hashed url
+var AssetURL = func(name string) string {
+	return "/static/" + name
+}
+
+var current = struct {
+	sync.RWMutex
+	theme *Theme
+}{}
+
+func init() {
+	err := Reload()
+	if err != nil {
+		log.Printf("[ERROR] theme %s: %v, using the default theme", config.ThemeDir, err)
+		current.theme = Default()
+	}
+}
+
+// Current is the loaded theme
+func Current() *Theme {
+	current.RLock()
+	defer current.RUnlock()
+	return current.theme
+}
+
+// Reload reads the theme directory again, the current theme is kept when it has an error
+func Reload() error {
+	t, err := Load(config.ThemeDir)
+	if err != nil {
+		return err
+	}
+	current.Lock()
+	current.theme = t
+	current.Unlock()
+	return nil
+}
+
+// Default is the theme from the ADVLIGHT_EVENTLOGO, ADVLIGHT_EVENTBANNER and ADVLIGHT_FAVICON settings
+func Default() *Theme {
+	colors := make(map[string]string)
+	for k, v := range DefaultColors {
+		colors[k] = v
+	}
+	return &Theme{
+		Name:    "default",
+		Logo:    config.EventLogo,
+		Banner:  config.EventBanner,
+		Favicon: config.FavICO,
+		Colors:  colors,
+		Email: Email{
+			Copyright:   "Sent with Love from your friends at " + config.ChurchName,
+			ButtonColor: "#4CAF50",
+		},
+	}
+}
+
+// Load reads dir/theme.json over the Default theme, settings missing from theme.json keep their default
+func Load(dir string) (*Theme, error) {
+	t := Default()
+	if dir == "" {
+		return t, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "theme.json"))
+	if os.IsNotExist(err) {
+		// a theme can be only template overrides
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defaults := t.Colors
+	t.Colors = nil
+	err = json.Unmarshal(b, t)
+	if err != nil {
+		return nil, fmt.Errorf("theme.json: %v", err)
+	}
+	for k, v := range t.Colors {
+		defaults[k] = v
+	}
+	t.Colors = defaults
+	return t, t.Validate()
+}
+
+var cssNameRe = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+var cssValueRe = regexp.MustCompile(`^[#(),.%a-zA-Z0-9 -]+$`)
+
+// ValidColor reports whether v is safe to write into a style, ie #4CAF50 or rgb(0, 0, 0)
+func ValidColor(v string) bool {
+	return cssValueRe.MatchString(v)
+}
+
+// Validate checks colors are plain css values, they are written into a style tag
+func (t *Theme) Validate() error {
+	for k, v := range t.Colors {
+		if !cssNameRe.MatchString(k) {
+			return fmt.Errorf("theme color %q is not a valid name, use lowercase letters and dashes", k)
+		}
+		if !cssValueRe.MatchString(v) {
+			return fmt.Errorf("theme color %s has an invalid value %q", k, v)
+		}
+	}
+	if t.Email.ButtonColor != "" && !cssValueRe.MatchString(t.Email.ButtonColor) {
+		return fmt.Errorf("theme email buttonColor has an invalid value %q", t.Email.ButtonColor)
+	}
+	return nil
+}
+
+// CSS declares the colors as css variables
+func (t *Theme) CSS() string {
+	names := make([]string, 0, len(t.Colors))
+	for k := range t.Colors {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString(":root {")
+	for _, k := range names {
+		fmt.Fprintf(&sb, " --%s: %s;", k, t.Colors[k])
+	}
+	sb.WriteString(" }")
+	return sb.String()
+}
+
+// URL resolves a theme url, paths in the theme directory are served as static files
+func URL(u string) string {
+	if u == "" || strings.HasPrefix(u, "/") || strings.Contains(u, "://") || strings.HasPrefix(u, "data:") {
+		return u
+	}
+	return AssetURL(u)
+}
+
+// AbsoluteURL is URL with the host added to local paths, for emails
+func AbsoluteURL(host, u string) string {
+	u = URL(u)
+	if strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") {
+		return strings.TrimSuffix(host, "/") + u
+	}
+	return u
+}
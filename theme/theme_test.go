@@ -0,0 +1,51 @@
+package theme
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "theme")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a directory with only template overrides uses the default theme
+	th, err := Load(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), th)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "theme.json"), []byte(`{
+		"name": "easter",
+		"logo": "img/logo.png",
+		"colors": {"header-bg": "#ffe4e1", "accent": "rgb(1, 2, 3)"},
+		"email": {"signature": "Happy Easter!"}
+	}`), 0644)
+	assert.NoError(t, err)
+	th, err = Load(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "easter", th.Name)
+	assert.Equal(t, "Happy Easter!", th.Email.Signature)
+	assert.Equal(t, Default().Email.Copyright, th.Email.Copyright)
+	assert.Equal(t, "#ffe4e1", th.Colors["header-bg"])
+	assert.Equal(t, DefaultColors["heading"], th.Colors["heading"])
+	assert.Contains(t, th.CSS(), "--accent: rgb(1, 2, 3);")
+
+	err = ioutil.WriteFile(filepath.Join(dir, "theme.json"), []byte(`{"colors": {"header-bg": "red;}</style><script>"}}`), 0644)
+	assert.NoError(t, err)
+	_, err = Load(dir)
+	assert.Error(t, err)
+}
+
+func TestURL(t *testing.T) {
+	assert.Equal(t, "", URL(""))
+	assert.Equal(t, "https://example.com/logo.png", URL("https://example.com/logo.png"))
+	assert.Equal(t, "/logo.png", URL("/logo.png"))
+	assert.Equal(t, "/static/img/logo.png", URL("img/logo.png"))
+	assert.Equal(t, "https://tickets.example.com/static/img/logo.png", AbsoluteURL("https://tickets.example.com/", "img/logo.png"))
+	assert.Equal(t, "https://example.com/logo.png", AbsoluteURL("https://tickets.example.com", "https://example.com/logo.png"))
+}
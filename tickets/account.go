@@ -0,0 +1,387 @@
+package tickets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/lib/pq"
+)
+
+// EmailChangeMaxAge is how long the link sent to verify a new email address works
+var EmailChangeMaxAge = 24 * time.Hour
+
+// ErrInvalidLink is returned for email change links that are tampered with or belong to another guest
+var ErrInvalidLink = i18n.Errorf("error.email_link_invalid")
+
+// AnonymizedEmail replaces the email of deleted and anonymized guests in the audit log
+const AnonymizedEmail = "anonymized"
+
+// GuestExport is everything stored about a guest, downloaded by the guest as JSON
+type GuestExport struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	ID         string           `json:"id"`
+	Email      string           `json:"email"`
+	Verified   bool             `json:"verified"`
+	CreatedAt  time.Time        `json:"created_at"`
+	IPAddress  string           `json:"ip_address"`
+	Tickets    []ExportTicket   `json:"tickets"`
+	Emails     []ExportEmail    `json:"emails"`
+	Donations  []ExportDonation `json:"donations"`
+	History    []ExportActivity `json:"history"`
+}
+
+// ExportTicket is a ticket in a GuestExport
+type ExportTicket struct {
+	Slot      time.Time `json:"slot"`
+	Number    int64     `json:"number"`
+	EventCode string    `json:"event_code,omitempty"`
+	Category  string    `json:"category"`
+	Type      string    `json:"ticket_type,omitempty"`
+	Price     int64     `json:"price_cents,omitempty"`
+	BookedAt  time.Time `json:"booked_at,omitempty"`
+	BookedIP  string    `json:"booked_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// ExportEmail is an email sent to the guest in a GuestExport
+type ExportEmail struct {
+	SentAt  time.Time `json:"sent_at"`
+	Address string    `json:"address"`
+	Subject string    `json:"subject"`
+}
+
+// ExportDonation is a donation matched to the guest in a GuestExport
+type ExportDonation struct {
+	DonatedAt   time.Time `json:"donated_at"`
+	AmountCents int64     `json:"amount_cents"`
+}
+
+// ExportActivity is an audit log entry about the guest in a GuestExport
+type ExportActivity struct {
+	At        time.Time `json:"at"`
+	Action    string    `json:"action"`
+	By        string    `json:"by"`
+	IPAddress string    `json:"ip_address,omitempty"`
+	Slot      time.Time `json:"slot,omitempty"`
+	Before    string    `json:"before,omitempty"`
+	After     string    `json:"after,omitempty"`
+}
+
+// ExportGuest collects everything stored about the guest
+func (r *repo) ExportGuest(a Actor, guestID string) (*GuestExport, error) {
+	log.Printf("ExportGuest %s %s", a, guestID)
+	e := &GuestExport{ExportedAt: time.Now(), Tickets: make([]ExportTicket, 0), Emails: make([]ExportEmail, 0), Donations: make([]ExportDonation, 0), History: make([]ExportActivity, 0)}
+	err := r.db.QueryRow(`select id,email,verified,created_at,coalesce(host(ip_address),'') from guests where id=$1;`, guestID).
+		Scan(&e.ID, &e.Email, &e.Verified, &e.CreatedAt, &e.IPAddress)
+	if err == sql.ErrNoRows {
+		return nil, i18n.Errorf("error.guest_not_found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(`select slot,num,coalesce(event_code,''),category,coalesce(ticket_type,''),price_cents,booked_at,coalesce(host(booked_ip),''),booked_user_agent from tickets where guest_id=$1 order by slot;`, e.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			t   ExportTicket
+			bat pq.NullTime
+		)
+		err = rows.Scan(&t.Slot, &t.Number, &t.EventCode, &t.Category, &t.Type, &t.Price, &bat, &t.BookedIP, &t.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		t.BookedAt = bat.Time
+		e.Tickets = append(e.Tickets, t)
+	}
+	rows.Close()
+
+	emails, err := r.GetGuestEmails(e.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range emails {
+		e.Emails = append(e.Emails, ExportEmail{SentAt: m.CreatedAt, Address: m.Address, Subject: m.Subject})
+	}
+
+	rows, err = r.db.Query(`select donated_at,amount_cents from donations where guest_id=$1 order by donated_at;`, e.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d ExportDonation
+		err = rows.Scan(&d.DonatedAt, &d.AmountCents)
+		if err != nil {
+			return nil, err
+		}
+		e.Donations = append(e.Donations, d)
+	}
+	rows.Close()
+
+	entries, err := r.GetAudit(AuditFilter{Guest: e.ID, Limit: 10000})
+	if err != nil {
+		return nil, err
+	}
+	for _, ae := range entries {
+		e.History = append(e.History, ExportActivity{
+			At:        ae.CreatedAt,
+			Action:    ae.Action,
+			By:        ae.Actor.Kind,
+			IPAddress: ae.Actor.IPAddress,
+			Slot:      ae.Slot,
+			Before:    ae.Before,
+			After:     ae.After,
+		})
+	}
+
+	r.Audit(a, AuditEntry{Action: AuditExportGuest, GuestID: e.ID, Email: e.Email})
+	return e, nil
+}
+
+// EmailChangeToken signs a request to change the guest's email, sent to the new address to prove the guest owns it
+func EmailChangeToken(guestID, email string, expires time.Time) string {
+	data := base64.RawURLEncoding.EncodeToString([]byte(guestID + "|" + email + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	return data + "." + signEmailChange(data)
+}
+
+func signEmailChange(data string) string {
+	mac := hmac.New(sha256.New, signingKey())
+	mac.Write([]byte("email:" + data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseEmailChangeToken returns the guest and new email from a token created by EmailChangeToken
+func ParseEmailChangeToken(token string, now time.Time) (guestID, email string, err error) {
+	parts := strings.SplitN(strings.TrimSpace(token), ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signEmailChange(parts[0]))) {
+		return "", "", ErrInvalidLink
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", ErrInvalidLink
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return "", "", ErrInvalidLink
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || now.After(time.Unix(expires, 0)) {
+		return "", "", i18n.Errorf("error.email_link_expired")
+	}
+	return fields[0], fields[1], nil
+}
+
+// ChangeEmail moves the guest to a new (already verified) email address
+func (r *repo) ChangeEmail(a Actor, g *Guest, email string) error {
+	log.Printf("ChangeEmail %s %s %s -> %s", a, g.ID, g.Email, email)
+	email, err := ParseEmail(email)
+	if err != nil {
+		return err
+	}
+	if email == strings.ToLower(g.Email) {
+		return nil
+	}
+	var inUse bool
+	err = r.db.QueryRow(`select exists(select 1 from guests where email=$1 and id!=$2);`, email, g.ID).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return i18n.Errorf("error.email_in_use", email)
+	}
+	// the new address was verified by following the emailed link
+	_, err = r.db.Exec(`update guests set email=$2, verified=true where id=$1;`, g.ID, email)
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{
+		Action:  AuditChangeEmail,
+		GuestID: g.ID,
+		Email:   email,
+		Before:  g.Email,
+		After:   email,
+	})
+	g.Email = email
+	g.Verified = true
+	return nil
+}
+
+// SetGuestLanguage saves the language the guest picked, emails are sent in it
+func (r *repo) SetGuestLanguage(a Actor, g *Guest, lang string) error {
+	log.Printf("SetGuestLanguage %s %s %s -> %s", a, g.ID, g.Language, lang)
+	if lang == g.Language {
+		return nil
+	}
+	if !i18n.Supported(lang) {
+		return fmt.Errorf("%q is not a supported language", lang)
+	}
+	_, err := r.db.Exec(`update guests set language=$2 where id=$1;`, g.ID, lang)
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{
+		Action:  AuditSetLanguage,
+		GuestID: g.ID,
+		Email:   g.Email,
+		Before:  g.Language,
+		After:   lang,
+	})
+	g.Language = lang
+	return nil
+}
+
+// DeleteGuest releases the guest's tickets, deletes the guest and their email history and anonymizes
+// the audit log so only the guest id remains
+func (r *repo) DeleteGuest(a Actor, g *Guest) error {
+	log.Printf("DeleteGuest %s %s %s", a, g.ID, g.Email)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`
+		with released as (
+			select slot,num,payment_id from tickets where guest_id=$1 for update
+		) update tickets t set guest_id = null, payment_id = null, updated_at = current_timestamp, booked_at = null, booked_ip = null, booked_user_agent = '', checked_in_at = null, checked_in_gate = null
+		from released where t.slot=released.slot and t.num=released.num
+		returning t.slot,t.num,coalesce(t.event_code,''),coalesce(released.payment_id,0);`, g.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	released := make([]AuditEntry, 0)
+	payments := make([]int64, 0)
+	for rows.Next() {
+		var paymentID int64
+		e := AuditEntry{Action: AuditDeleteGuest, GuestID: g.ID, Before: "guest=" + AnonymizedEmail, After: "available"}
+		rows.Scan(&e.Slot, &e.Number, &e.EventCode, &paymentID)
+		released = append(released, e)
+		if paymentID > 0 {
+			payments = append(payments, paymentID)
+		}
+	}
+	rows.Close()
+	for _, stmt := range []string{
+		`update eventcode_attempts set guest_id=null where guest_id=$1;`,
+		`update donations set email='` + AnonymizedEmail + `' where guest_id=$1;`,
+		`delete from group_invites where email=(select email from guests where id=$1);`,
+		`delete from guests where id=$1;`,
+	} {
+		_, err = tx.Exec(stmt, g.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = anonymizeAudit(tx, g.ID, g.Email)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// the deletion itself is recorded without the guest's details
+	a = anonymizeActor(a)
+	for _, e := range released {
+		r.Audit(a, e)
+	}
+	r.Audit(a, AuditEntry{Action: AuditDeleteGuest, GuestID: g.ID, Before: "guest", After: "deleted"})
+	// paid tickets are refunded
+	r.settlePayments(a, payments)
+	r.ClearCache()
+	return nil
+}
+
+// anonymizeActor strips a guest actor's email and address
+func anonymizeActor(a Actor) Actor {
+	if a.Kind == ActorGuest {
+		a.Name = AnonymizedEmail
+		a.IPAddress = ""
+		a.UserAgent = ""
+	}
+	return a
+}
+
+// auditExecer is a *sql.DB or *sql.Tx
+type auditExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// anonymizeAudit removes the guest's emails and addresses from their audit log entries, the guest id, slots and
+// actions are kept so the history still adds up.  Every email the guest has used is removed, not just the current
+// one, see guestAuditEmails.
+func anonymizeAudit(db auditExecer, guestID, email string) (int64, error) {
+	emails, err := guestAuditEmails(db, guestID, email)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(`
+		update audit_log set
+			guest_email = case when guest_id = $1::uuid or lower(guest_email::text) = any($2) then $4 else guest_email end,
+			actor_name = case when actor_kind = 'guest' and (guest_id = $1::uuid or lower(actor_name) = any($2)) then $4 else actor_name end,
+			ip_address = case when actor_kind = 'guest' then null else ip_address end,
+			before_state = regexp_replace(before_state, $3, $4, 'gi'),
+			after_state = regexp_replace(after_state, $3, $4, 'gi')
+		where guest_id = $1::uuid or lower(guest_email::text) = any($2) or (actor_kind = 'guest' and lower(actor_name) = any($2));`,
+		guestID, pq.Array(emails), emailsPattern(emails), AnonymizedEmail)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// guestAuditEmails is the guest's current email and the earlier ones in their audit log entries, from changed
+// emails and the emails entries were written under
+func guestAuditEmails(db auditExecer, guestID, email string) ([]string, error) {
+	rows, err := db.Query(`
+		select distinct lower(e) from (
+			select guest_email::text as e from audit_log where guest_id=$1::uuid
+			union select actor_name from audit_log where guest_id=$1::uuid and actor_kind='guest'
+			union select before_state from audit_log where guest_id=$1::uuid and action=$2
+			union select after_state from audit_log where guest_id=$1::uuid and action=$2
+		) x where e like '%@%';`, guestID, AuditChangeEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := make([]string, 0)
+	if email != "" {
+		emails = append(emails, strings.ToLower(email))
+	}
+	for rows.Next() {
+		var e string
+		rows.Scan(&e)
+		if len(emails) == 0 || e != emails[0] {
+			emails = append(emails, e)
+		}
+	}
+	return emails, rows.Err()
+}
+
+// emailsPattern is a regular expression matching any of the emails, for regexp_replace
+func emailsPattern(emails []string) string {
+	if len(emails) == 0 {
+		return `x\Ax` // matches nothing
+	}
+	quoted := make([]string, len(emails))
+	for i, e := range emails {
+		quoted[i] = regexp.QuoteMeta(e)
+	}
+	return strings.Join(quoted, "|")
+}
@@ -0,0 +1,79 @@
+package tickets
+
+import (
+	"database/sql"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailChangeToken(t *testing.T) {
+	now := time.Date(2019, 12, 1, 18, 0, 0, 0, time.UTC)
+	token := EmailChangeToken("guest-id", "new@example.com", now.Add(EmailChangeMaxAge))
+
+	guestID, email, err := ParseEmailChangeToken(token, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "guest-id", guestID)
+	assert.Equal(t, "new@example.com", email)
+
+	_, _, err = ParseEmailChangeToken(token, now.Add(EmailChangeMaxAge+time.Second))
+	assert.Error(t, err, "expired")
+
+	other := EmailChangeToken("guest-id", "attacker@example.com", now.Add(EmailChangeMaxAge))
+	forged := other[:len(other)-43] + token[len(token)-43:]
+	_, _, err = ParseEmailChangeToken(forged, now)
+	assert.Equal(t, ErrInvalidLink, err)
+
+	_, _, err = ParseEmailChangeToken("garbage", now)
+	assert.Equal(t, ErrInvalidLink, err)
+}
+
+func TestAnonymizeActor(t *testing.T) {
+	a := anonymizeActor(Actor{Kind: ActorGuest, Name: "guest@example.com", IPAddress: "10.0.0.1", UserAgent: "ua", RequestID: "r1"})
+	assert.Equal(t, Actor{Kind: ActorGuest, Name: AnonymizedEmail, RequestID: "r1"}, a)
+
+	admin := Actor{Kind: ActorAdmin, Name: "admin", IPAddress: "10.0.0.2"}
+	assert.Equal(t, admin, anonymizeActor(admin))
+}
+
+func TestEmailsPattern(t *testing.T) {
+	re := regexp.MustCompile("(?i)" + emailsPattern([]string{"old+xmas@example.com", "new@example.com"}))
+	assert.Equal(t, "anonymized -> anonymized", re.ReplaceAllString("Old+Xmas@example.com -> new@example.com", AnonymizedEmail))
+	assert.Equal(t, "oldxmas@example.com", re.ReplaceAllString("oldxmas@example.com", AnonymizedEmail))
+	assert.False(t, regexp.MustCompile(emailsPattern(nil)).MatchString("guest@example.com"))
+}
+
+// testRepo is a repo on ADVLIGHT_TEST_DATABASE_URL, a database with db/seed.sql loaded.  Tests that need one are
+// skipped without it.
+func testRepo(t *testing.T) *repo {
+	url := os.Getenv("ADVLIGHT_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("ADVLIGHT_TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &repo{db: db}
+}
+
+func TestDeleteGuestAnonymizesEarlierEmails(t *testing.T) {
+	r := testRepo(t)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	old, changed := "old-"+suffix+"@example.com", "new-"+suffix+"@example.com"
+	g := &Guest{Email: old}
+	assert.NoError(t, r.CreateGuest(g))
+	r.Audit(Actor{Kind: ActorGuest, Name: old}, AuditEntry{Action: AuditVerify, GuestID: g.ID, Email: old, Before: "verified=false", After: "verified=true"})
+	assert.NoError(t, r.ChangeEmail(Actor{Kind: ActorGuest, Name: changed}, g, changed))
+	assert.NoError(t, r.DeleteGuest(Actor{Kind: ActorGuest, Name: changed}, g))
+
+	var n int
+	err := r.db.QueryRow(`select count(*) from audit_log where guest_email in ($1,$2) or actor_name in ($1,$2) or before_state ~* $3 or after_state ~* $3;`,
+		old, changed, emailsPattern([]string{old, changed})).Scan(&n)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "the old email is removed from the audit log")
+}
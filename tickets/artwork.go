@@ -0,0 +1,441 @@
+package tickets
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"golang.org/x/image/draw"
+)
+
+// AssetLoader reads embedded assets (ie img/bgimg-1.jpg), set by the views package
+var AssetLoader func(name string) ([]byte, error)
+
+// AssetURL is the url of an embedded asset, the views package sets it to the content hashed url
+var AssetURL = func(name string) string {
+	return "/static/" + name
+}
+
+// MaxArtworkSize limits uploaded ticket artwork
+var MaxArtworkSize int64 = 5 << 20
+
+// ThumbnailWidths are the widths images can be resized to, requests for other widths use the next size up
+var ThumbnailWidths = []int{150, 300, 600}
+
+// artworkTypes are the image types accepted for ticket artwork
+var artworkTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+// Artwork is an uploaded ticket image
+type Artwork struct {
+	Name        string
+	ContentType string
+	Size        int64
+	UpdatedAt   time.Time
+	Data        []byte // not loaded by List
+}
+
+// ArtworkStore stores uploaded ticket artwork
+type ArtworkStore interface {
+	Get(name string) (*Artwork, error)
+	Put(a Artwork) error
+	Delete(name string) error
+	List() ([]Artwork, error)
+}
+
+// ArtworkImages stores uploaded artwork in the database, or in ADVLIGHT_ARTWORK_DIR when set (set in tickets.go init)
+var ArtworkImages ArtworkStore
+
+// ErrArtworkNotFound is returned by ArtworkStore.Get for unknown artwork
+var ErrArtworkNotFound = fmt.Errorf("artwork not found")
+
+// newArtworkStore picks the artwork store from ADVLIGHT_ARTWORK_DIR
+func newArtworkStore(db *sql.DB) ArtworkStore {
+	if dir := os.Getenv("ADVLIGHT_ARTWORK_DIR"); dir != "" {
+		return &dirArtworkStore{dir: dir}
+	}
+	return &dbArtworkStore{db: db}
+}
+
+type dbArtworkStore struct {
+	db *sql.DB
+}
+
+func (s *dbArtworkStore) Get(name string) (*Artwork, error) {
+	a := &Artwork{}
+	err := s.db.QueryRow(`select name,content_type,length(data),updated_at,data from artwork where name=$1;`, name).
+		Scan(&a.Name, &a.ContentType, &a.Size, &a.UpdatedAt, &a.Data)
+	if err == sql.ErrNoRows {
+		return nil, ErrArtworkNotFound
+	}
+	return a, err
+}
+
+func (s *dbArtworkStore) Put(a Artwork) error {
+	_, err := s.db.Exec(`
+		insert into artwork(name,content_type,data) values($1,$2,$3)
+		on conflict (name) do update set content_type=excluded.content_type, data=excluded.data, updated_at=current_timestamp;`,
+		a.Name, a.ContentType, a.Data)
+	return err
+}
+
+func (s *dbArtworkStore) Delete(name string) error {
+	_, err := s.db.Exec(`delete from artwork where name=$1;`, name)
+	return err
+}
+
+func (s *dbArtworkStore) List() ([]Artwork, error) {
+	rows, err := s.db.Query(`select name,content_type,length(data),updated_at from artwork order by name;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]Artwork, 0)
+	for rows.Next() {
+		a := Artwork{}
+		err = rows.Scan(&a.Name, &a.ContentType, &a.Size, &a.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, nil
+}
+
+// dirArtworkStore keeps artwork as files, the content type is detected from the file
+type dirArtworkStore struct {
+	dir string
+}
+
+func (s *dirArtworkStore) path(name string) (string, error) {
+	if !ValidArtworkName(name) {
+		return "", ErrArtworkNotFound
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *dirArtworkStore) Get(name string) (*Artwork, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrArtworkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return &Artwork{Name: name, ContentType: http.DetectContentType(data), Size: fi.Size(), UpdatedAt: fi.ModTime(), Data: data}, nil
+}
+
+func (s *dirArtworkStore) Put(a Artwork) error {
+	p, err := s.path(a.Name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return err
+	}
+	// write then rename so a request never reads a half written image
+	tmp := p + ".tmp"
+	err = ioutil.WriteFile(tmp, a.Data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *dirArtworkStore) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *dirArtworkStore) List() ([]Artwork, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []Artwork{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Artwork, 0)
+	for _, fi := range infos {
+		if fi.IsDir() || !ValidArtworkName(fi.Name()) {
+			continue
+		}
+		list = append(list, Artwork{Name: fi.Name(), Size: fi.Size(), UpdatedAt: fi.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+var artworkNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+var artworkNameCleaner = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// ValidArtworkName checks an artwork name is safe to use in urls and as a file name
+func ValidArtworkName(name string) bool {
+	return len(name) <= 100 && artworkNameRe.MatchString(name) && !strings.HasSuffix(name, ".tmp")
+}
+
+// ArtworkName makes an artwork name from an uploaded file name, ie "Night 1.JPG" -> "night-1.jpg"
+func ArtworkName(filename string) string {
+	name := strings.Trim(artworkNameCleaner.ReplaceAllString(strings.ToLower(filepath.Base(filename)), "-"), "-.")
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	return name
+}
+
+// ArtworkAssignment shows artwork on tickets for a day, an event code, both or (neither) by default
+type ArtworkAssignment struct {
+	ID        int64
+	Day       string // 2006-01-02, "" for any day
+	EventCode string // "" for any event code
+	Artwork   string
+}
+
+// matches scores how specifically the assignment matches the ticket, -1 when it does not match
+func (aa ArtworkAssignment) matches(t Ticket) int {
+	score := 0
+	if aa.Day != "" {
+		if t.Slot.In(config.Location).Format("2006-01-02") != aa.Day {
+			return -1
+		}
+		score++
+	}
+	if aa.EventCode != "" {
+		if !strings.EqualFold(aa.EventCode, t.EventCode) {
+			return -1
+		}
+		score += 2
+	}
+	return score
+}
+
+// UploadArtwork validates and stores ticket artwork
+func (r *repo) UploadArtwork(a Actor, name string, data []byte) error {
+	log.Printf("UploadArtwork %s %s %d", a, name, len(data))
+	if !ValidArtworkName(name) {
+		return fmt.Errorf("%q is not a valid artwork name, use letters, numbers, dots and dashes", name)
+	}
+	if int64(len(data)) > MaxArtworkSize {
+		return fmt.Errorf("artwork must be smaller than %dMB", MaxArtworkSize>>20)
+	}
+	contentType := http.DetectContentType(data)
+	if !artworkTypes[contentType] {
+		return fmt.Errorf("artwork must be a jpeg, png or gif image, not %s", contentType)
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("unable to read image: %v", err)
+	}
+	err := ArtworkImages.Put(Artwork{Name: name, ContentType: contentType, Data: data})
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{Action: AuditArtwork, After: "upload " + name})
+	return nil
+}
+
+// DeleteArtwork removes artwork and any assignments using it
+func (r *repo) DeleteArtwork(a Actor, name string) error {
+	log.Printf("DeleteArtwork %s %s", a, name)
+	_, err := r.db.Exec(`delete from artwork_assignments where artwork=$1;`, name)
+	if err != nil {
+		return err
+	}
+	err = ArtworkImages.Delete(name)
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{Action: AuditArtwork, Before: name, After: "deleted"})
+	r.ClearCache()
+	return nil
+}
+
+// GetArtworkAssignments returns the artwork assignments, cached until ClearCache
+func (r *repo) GetArtworkAssignments() ([]ArtworkAssignment, error) {
+	r.sync.Lock()
+	cached := r.cache.artwork
+	r.sync.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	rows, err := r.db.Query(`select id,coalesce(to_char(day,'YYYY-MM-DD'),''),coalesce(event_code,''),artwork from artwork_assignments order by day nulls first,event_code nulls first;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]ArtworkAssignment, 0)
+	for rows.Next() {
+		aa := ArtworkAssignment{}
+		err = rows.Scan(&aa.ID, &aa.Day, &aa.EventCode, &aa.Artwork)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, aa)
+	}
+	r.sync.Lock()
+	r.cache.artwork = list
+	r.sync.Unlock()
+	return list, nil
+}
+
+// AssignArtwork shows artwork on tickets for the day and/or event code, replacing any existing assignment.
+// With no day and no event code the artwork is the default for all tickets.
+func (r *repo) AssignArtwork(a Actor, aa ArtworkAssignment) error {
+	log.Printf("AssignArtwork %s %+v", a, aa)
+	aa.EventCode = strings.TrimSpace(strings.ToLower(aa.EventCode))
+	if aa.Day != "" {
+		if _, err := time.Parse("2006-01-02", aa.Day); err != nil {
+			return fmt.Errorf("invalid day %s", aa.Day)
+		}
+	}
+	if _, err := ArtworkImages.Get(aa.Artwork); err != nil {
+		return fmt.Errorf("%s: %v", aa.Artwork, err)
+	}
+	_, err := r.db.Exec(`delete from artwork_assignments where day is not distinct from $1::date and event_code is not distinct from $2;`,
+		sql.NullString{String: aa.Day, Valid: aa.Day != ""}, sql.NullString{String: aa.EventCode, Valid: aa.EventCode != ""})
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`insert into artwork_assignments(day,event_code,artwork) values($1::date,$2,$3);`,
+		sql.NullString{String: aa.Day, Valid: aa.Day != ""}, sql.NullString{String: aa.EventCode, Valid: aa.EventCode != ""}, aa.Artwork)
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{Action: AuditArtwork, EventCode: aa.EventCode, Before: "day=" + aa.Day, After: "assign " + aa.Artwork})
+	r.ClearCache()
+	return nil
+}
+
+// UnassignArtwork removes an artwork assignment
+func (r *repo) UnassignArtwork(a Actor, id int64) error {
+	log.Printf("UnassignArtwork %s %d", a, id)
+	var aa ArtworkAssignment
+	err := r.db.QueryRow(`delete from artwork_assignments where id=$1 returning coalesce(to_char(day,'YYYY-MM-DD'),''),coalesce(event_code,''),artwork;`, id).
+		Scan(&aa.Day, &aa.EventCode, &aa.Artwork)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{Action: AuditArtwork, EventCode: aa.EventCode, Before: "assign " + aa.Artwork, After: "unassigned day=" + aa.Day})
+	r.ClearCache()
+	return nil
+}
+
+// ArtworkFor returns the name of the artwork assigned to the ticket, "" for the built in day images
+func (r *repo) ArtworkFor(t Ticket) string {
+	assignments, err := r.GetArtworkAssignments()
+	if err != nil {
+		log.Println("ArtworkFor", err)
+		return ""
+	}
+	return bestArtwork(assignments, t)
+}
+
+func bestArtwork(assignments []ArtworkAssignment, t Ticket) string {
+	best, bestScore := "", -1
+	for _, aa := range assignments {
+		if score := aa.matches(t); score > bestScore {
+			best, bestScore = aa.Artwork, score
+		}
+	}
+	return best
+}
+
+// ArtworkURL is the url of uploaded artwork
+func ArtworkURL(name string) string {
+	return "/assets/artwork/" + url.PathEscape(name)
+}
+
+// TicketImageData returns the ticket's image, the assigned artwork or the built in day image
+func TicketImageData(t Ticket) ([]byte, error) {
+	if name := Repo.ArtworkFor(t); name != "" {
+		a, err := ArtworkImages.Get(name)
+		if err == nil {
+			return a.Data, nil
+		}
+		log.Println("TicketImageData", name, err)
+	}
+	if AssetLoader == nil {
+		return nil, fmt.Errorf("ticket images are not available")
+	}
+	return AssetLoader("img/" + t.TicketImage())
+}
+
+// ThumbnailWidth rounds a requested width up to one of the ThumbnailWidths, 0 means the original size
+func ThumbnailWidth(w int) int {
+	if w <= 0 {
+		return 0
+	}
+	for _, tw := range ThumbnailWidths {
+		if w <= tw {
+			return tw
+		}
+	}
+	return 0
+}
+
+// Thumbnail scales an image down to width (keeping its aspect ratio), pngs stay png and everything else is jpeg
+func Thumbnail(data []byte, width int) ([]byte, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	if width <= 0 || width >= b.Dx() {
+		return data, nil
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	}
+	return buf.Bytes(), err
+}
+
+// imageType is the gofpdf image type of an image
+func imageType(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return "PNG"
+	case "image/gif":
+		return "GIF"
+	}
+	return "JPG"
+}
@@ -0,0 +1,86 @@
+package tickets
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBestArtwork(t *testing.T) {
+	slot := time.Date(2019, 12, 2, 19, 0, 0, 0, config.Location)
+	assignments := []ArtworkAssignment{
+		{Artwork: "default.jpg"},
+		{Day: "2019-12-02", Artwork: "day.jpg"},
+		{EventCode: "church", Artwork: "code.jpg"},
+		{Day: "2019-12-02", EventCode: "church", Artwork: "both.jpg"},
+	}
+	assert.Equal(t, "both.jpg", bestArtwork(assignments, Ticket{Slot: slot, EventCode: "CHURCH"}))
+	assert.Equal(t, "code.jpg", bestArtwork(assignments, Ticket{Slot: slot.Add(24 * time.Hour), EventCode: "church"}))
+	assert.Equal(t, "day.jpg", bestArtwork(assignments, Ticket{Slot: slot}))
+	assert.Equal(t, "default.jpg", bestArtwork(assignments, Ticket{Slot: slot.Add(24 * time.Hour), EventCode: "school"}))
+	assert.Equal(t, "", bestArtwork(assignments[1:2], Ticket{Slot: slot.Add(24 * time.Hour)}))
+}
+
+func TestArtworkName(t *testing.T) {
+	assert.Equal(t, "night-1.jpg", ArtworkName("Night 1.JPG"))
+	assert.Equal(t, "passwd", ArtworkName("../../etc/passwd"))
+	assert.True(t, ValidArtworkName("night-1.jpg"))
+	for _, name := range []string{"", ".hidden", "../x.jpg", "a/b.jpg", "Night.jpg", "x.tmp"} {
+		assert.False(t, ValidArtworkName(name), name)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	assert.Equal(t, 0, ThumbnailWidth(0))
+	assert.Equal(t, 150, ThumbnailWidth(100))
+	assert.Equal(t, 300, ThumbnailWidth(151))
+	assert.Equal(t, 0, ThumbnailWidth(5000))
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 800, 400))))
+	thumb, err := Thumbnail(buf.Bytes(), 300)
+	assert.NoError(t, err)
+	img, format, err := image.Decode(bytes.NewReader(thumb))
+	assert.NoError(t, err)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	assert.Equal(t, 150, img.Bounds().Dy())
+
+	// never scaled up
+	same, err := Thumbnail(buf.Bytes(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, buf.Bytes(), same)
+}
+
+func TestDirArtworkStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artwork")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := &dirArtworkStore{dir: dir}
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+	assert.NoError(t, s.Put(Artwork{Name: "night.png", Data: buf.Bytes()}))
+	assert.Error(t, s.Put(Artwork{Name: "../night.png", Data: buf.Bytes()}))
+
+	a, err := s.Get("night.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", a.ContentType)
+	assert.Equal(t, buf.Bytes(), a.Data)
+
+	list, err := s.List()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, "night.png", list[0].Name)
+
+	assert.NoError(t, s.Delete("night.png"))
+	_, err = s.Get("night.png")
+	assert.Equal(t, ErrArtworkNotFound, err)
+}
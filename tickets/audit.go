@@ -0,0 +1,174 @@
+package tickets
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// actor kinds recorded in the audit log
+const (
+	ActorGuest  = "guest"
+	ActorAdmin  = "admin"
+	ActorSystem = "system"
+	ActorKiosk  = "kiosk" // a volunteer at the gate
+)
+
+// audit log actions
+const (
+	AuditAssign       = "assign"
+	AuditCancel       = "cancel"
+	AuditRebook       = "rebook_cancel" // ticket released because the guest booked another slot the same day
+	AuditVerify       = "verify"
+	AuditCreateSlots  = "create_slots"
+	AuditRemoveSlots  = "remove_slots"
+	AuditMoveSlots    = "move_slots"
+	AuditMergeGuests  = "merge_guests"
+	AuditResendEmail  = "resend_confirmation"
+	AuditExpireTicket = "expire"
+
+	AuditEventCodeDomains  = "eventcode_domains"
+	AuditBlockDomain       = "block_email_domain"
+	AuditUnblockDomain     = "unblock_email_domain"
+	AuditChangeEmail       = "change_email"
+	AuditExportGuest       = "export_guest"
+	AuditDeleteGuest       = "delete_guest"
+	AuditRetention         = "retention"
+	AuditArtwork           = "artwork"
+	AuditSetLanguage       = "set_language"
+	AuditEmailTemplate     = "email_template"
+	AuditReleaseAccessible = "release_accessible"
+	AuditTicketType        = "ticket_type"
+	AuditPayment           = "payment"
+	AuditImportDonations   = "import_donations"
+	AuditCreateGroup       = "create_group"
+	AuditReserveGroup      = "reserve_group"
+	AuditReleaseGroup      = "release_group"
+	AuditInviteGroup       = "invite_group"
+	AuditWalkup            = "walkup"
+	AuditCheckIn           = "check_in"
+	AuditDoorConflict      = "door_conflict"
+)
+
+// Actor is who made a change and where the request came from, recorded with every audit entry
+type Actor struct {
+	Kind      string // ActorGuest, ActorAdmin, ActorSystem or ActorKiosk
+	Name      string // guest email, admin, the system job name or the kiosk
+	IPAddress string
+	UserAgent string
+	RequestID string
+}
+
+// SystemActor returns an actor for changes made by a background job (expiry sweep, etc)
+func SystemActor(job string) Actor {
+	return Actor{Kind: ActorSystem, Name: job}
+}
+
+func (a Actor) String() string {
+	return fmt.Sprintf("%s:%s", a.Kind, a.Name)
+}
+
+// AuditEntry is a single append-only record of a booking, cancellation or admin action
+type AuditEntry struct {
+	ID        int64
+	CreatedAt time.Time
+	Actor     Actor
+	Action    string
+	GuestID   string
+	Email     string
+	Slot      time.Time
+	Number    int64
+	EventCode string
+	Before    string
+	After     string
+}
+
+// AuditFilter limits the audit entries returned by GetAudit, empty fields are ignored
+type AuditFilter struct {
+	Guest string // guest id or partial email
+	Slot  time.Time
+	Actor string // actor kind or partial name
+	Limit int
+}
+
+// Audit appends an entry to the audit log.  Failures are logged and returned but should not undo the change being audited.
+func (r *repo) Audit(a Actor, e AuditEntry) error {
+	var (
+		slot  pq.NullTime
+		num   sql.NullInt64
+		ecode sql.NullString
+		guest sql.NullString
+	)
+	if !e.Slot.IsZero() {
+		slot = pq.NullTime{Time: e.Slot, Valid: true}
+	}
+	if e.Number > 0 {
+		num = sql.NullInt64{Int64: e.Number, Valid: true}
+	}
+	if e.EventCode != "" {
+		ecode = sql.NullString{String: e.EventCode, Valid: true}
+	}
+	if e.GuestID != "" {
+		guest = sql.NullString{String: e.GuestID, Valid: true}
+	}
+	_, err := r.db.Exec(`
+		insert into audit_log(actor_kind,actor_name,ip_address,request_id,action,guest_id,guest_email,slot,ticket_num,event_code,before_state,after_state)
+		values($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12);`,
+		a.Kind, a.Name, nullIP(a.IPAddress), a.RequestID, e.Action, guest, e.Email, slot, num, ecode, e.Before, e.After)
+	if err != nil {
+		log.Printf("[ERROR] Audit %s %s %+v: %v", a, e.Action, e, err)
+	}
+	return err
+}
+
+// GetAudit returns audit entries matching the filter, newest first
+func (r *repo) GetAudit(f AuditFilter) ([]AuditEntry, error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if guest := strings.TrimSpace(strings.ToLower(f.Guest)); guest != "" {
+		p := arg(likeEscaper.Replace(guest))
+		where = append(where, fmt.Sprintf("(guest_id::text=%s or guest_email like '%%' || %s || '%%')", p, p))
+	}
+	if !f.Slot.IsZero() {
+		where = append(where, "slot="+arg(f.Slot))
+	}
+	if actor := strings.TrimSpace(strings.ToLower(f.Actor)); actor != "" {
+		p := arg(likeEscaper.Replace(actor))
+		where = append(where, fmt.Sprintf("(actor_kind=%s or lower(actor_name) like '%%' || %s || '%%')", p, p))
+	}
+	if f.Limit < 1 {
+		f.Limit = 500
+	}
+	query := `select id,created_at,actor_kind,actor_name,coalesce(host(ip_address),''),request_id,action,coalesce(guest_id::text,''),guest_email,slot,coalesce(ticket_num,0),coalesce(event_code,''),before_state,after_state from audit_log`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += " order by id desc limit " + arg(f.Limit)
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var (
+			e    AuditEntry
+			slot pq.NullTime
+		)
+		err = rows.Scan(&e.ID, &e.CreatedAt, &e.Actor.Kind, &e.Actor.Name, &e.Actor.IPAddress, &e.Actor.RequestID, &e.Action, &e.GuestID, &e.Email, &slot, &e.Number, &e.EventCode, &e.Before, &e.After)
+		if err != nil {
+			return nil, err
+		}
+		e.Slot = slot.Time
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
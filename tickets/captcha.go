@@ -0,0 +1,155 @@
+package tickets
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/blit/advlight/config"
+)
+
+// CAPTCHA providers selectable with ADVLIGHT_CAPTCHA
+const (
+	CAPTCHAReCAPTCHA   = "recaptcha"  // Google reCAPTCHA v2 invisible
+	CAPTCHAReCAPTCHAv3 = "recaptcha3" // Google reCAPTCHA v3 with a score threshold
+	CAPTCHAHCaptcha    = "hcaptcha"
+	CAPTCHATurnstile   = "turnstile" // Cloudflare Turnstile
+	CAPTCHAProofOfWork = "pow"       // self hosted proof-of-work, no third party
+	CAPTCHANone        = "none"
+)
+
+// CAPTCHAWidget is what the templates need to render a provider's challenge
+type CAPTCHAWidget struct {
+	Provider      string
+	ScriptURL     string
+	SiteKey       string
+	ResponseField string
+	Challenge     string // proof-of-work only
+	Difficulty    int    // proof-of-work only
+}
+
+// CAPTCHAVerifier checks a guest's response to a challenge
+type CAPTCHAVerifier interface {
+	// Widget returns the data needed to render the challenge, proof-of-work issues a new challenge on each call
+	Widget() CAPTCHAWidget
+	// ResponseField is the form field the response is posted in
+	ResponseField() string
+	// Verify returns an error if the response is not valid
+	Verify(response, remoteip string) error
+}
+
+// ErrCAPTCHAFailed is returned when a response was checked and rejected
+var ErrCAPTCHAFailed = errors.New("please complete the verification and try again")
+
+// CAPTCHA is the verifier used for bookings, selected by ADVLIGHT_CAPTCHA (defaults to reCAPTCHA)
+var CAPTCHA CAPTCHAVerifier
+
+// defaultReCAPTCHASiteKey is the site key used before ADVLIGHT_CAPTCHA_SITEKEY existed
+const defaultReCAPTCHASiteKey = "6Lc6LjwUAAAAAIyx69oeyja-Lf1vXmL1z-W_CeO8"
+
+func init() {
+	var err error
+	CAPTCHA, err = NewCAPTCHA(os.Getenv("ADVLIGHT_CAPTCHA"))
+	if err != nil {
+		log.Panicf("invalid ADVLIGHT_CAPTCHA config: %v", err)
+	}
+}
+
+// NewCAPTCHA builds the verifier for provider from the ADVLIGHT_CAPTCHA_* environment
+func NewCAPTCHA(provider string) (CAPTCHAVerifier, error) {
+	siteKey := os.Getenv("ADVLIGHT_CAPTCHA_SITEKEY")
+	secret := os.Getenv("ADVLIGHT_CAPTCHA_SECRET")
+	if secret == "" {
+		secret = os.Getenv("ADVLIGHT_RECAPTCHA_SECRET")
+	}
+	switch strings.TrimSpace(strings.ToLower(provider)) {
+	case "", CAPTCHAReCAPTCHA:
+		if siteKey == "" {
+			siteKey = defaultReCAPTCHASiteKey
+		}
+		return NewReCAPTCHA(siteKey, secret), nil
+	case CAPTCHAReCAPTCHAv3:
+		minScore := 0.5
+		if s := os.Getenv("ADVLIGHT_CAPTCHA_MINSCORE"); s != "" {
+			var err error
+			minScore, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("ADVLIGHT_CAPTCHA_MINSCORE: %v", err)
+			}
+		}
+		return NewReCAPTCHAv3(siteKey, secret, minScore), nil
+	case CAPTCHAHCaptcha:
+		return NewHCaptcha(siteKey, secret), nil
+	case CAPTCHATurnstile:
+		return NewTurnstile(siteKey, secret), nil
+	case CAPTCHAProofOfWork:
+		difficulty := 16
+		if s := os.Getenv("ADVLIGHT_CAPTCHA_DIFFICULTY"); s != "" {
+			var err error
+			difficulty, err = strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("ADVLIGHT_CAPTCHA_DIFFICULTY: %v", err)
+			}
+		}
+		return NewProofOfWork(signingKey(), difficulty), nil
+	case CAPTCHANone:
+		return NoCAPTCHA{}, nil
+	}
+	return nil, fmt.Errorf("unknown captcha provider %q", provider)
+}
+
+var generatedKey []byte
+
+// signingKey is config.Secret, or a random key if it is not set (which will not work across instances or restarts)
+func signingKey() []byte {
+	if config.Secret != "" {
+		return []byte(config.Secret)
+	}
+	if generatedKey == nil {
+		log.Println("ADVLIGHT_SECRET is not set, using a random key; signed values will not survive a restart")
+		generatedKey = make([]byte, 32)
+		rand.Read(generatedKey)
+	}
+	return generatedKey
+}
+
+// NoCAPTCHA accepts everything, used with the -nocaptcha flag in development
+type NoCAPTCHA struct{}
+
+func (NoCAPTCHA) Widget() CAPTCHAWidget {
+	return CAPTCHAWidget{Provider: CAPTCHANone}
+}
+
+func (NoCAPTCHA) ResponseField() string {
+	return "captcha-response"
+}
+
+func (NoCAPTCHA) Verify(response, remoteip string) error {
+	return nil
+}
+
+// FakeCAPTCHA is a verifier for tests, only Response is accepted
+type FakeCAPTCHA struct {
+	Response string
+	Calls    int
+}
+
+func (f *FakeCAPTCHA) Widget() CAPTCHAWidget {
+	return CAPTCHAWidget{Provider: "fake", ResponseField: f.ResponseField()}
+}
+
+func (f *FakeCAPTCHA) ResponseField() string {
+	return "captcha-response"
+}
+
+func (f *FakeCAPTCHA) Verify(response, remoteip string) error {
+	f.Calls++
+	if response == "" || response != f.Response {
+		return ErrCAPTCHAFailed
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package tickets
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func siteVerifyServer(t *testing.T, resp Response) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.FormValue("secret"))
+		assert.Equal(t, "10.0.0.1", r.FormValue("remoteip"))
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestSiteVerifier(t *testing.T) {
+	srv := siteVerifyServer(t, Response{Success: true})
+	defer srv.Close()
+
+	for _, v := range []CAPTCHAVerifier{
+		NewReCAPTCHA("site", "secret"),
+		NewHCaptcha("site", "secret"),
+		NewTurnstile("site", "secret"),
+	} {
+		v.(*siteVerifier).verificationURL = srv.URL
+		assert.NoError(t, v.Verify("token", "10.0.0.1"), v.Widget().Provider)
+		assert.Equal(t, ErrCAPTCHAFailed, v.Verify("", "10.0.0.1"), v.Widget().Provider)
+		assert.Equal(t, "site", v.Widget().SiteKey)
+		assert.NotEmpty(t, v.ResponseField())
+	}
+
+	failed := siteVerifyServer(t, Response{Success: false, ErrorCodes: []string{"invalid-input-response"}})
+	defer failed.Close()
+	v := NewReCAPTCHA("site", "secret")
+	v.(*siteVerifier).verificationURL = failed.URL
+	assert.EqualError(t, v.Verify("token", "10.0.0.1"), "invalid-input-response")
+}
+
+func TestReCAPTCHAv3Score(t *testing.T) {
+	low := siteVerifyServer(t, Response{Success: true, Score: 0.3, Action: "book"})
+	defer low.Close()
+	high := siteVerifyServer(t, Response{Success: true, Score: 0.9, Action: "book"})
+	defer high.Close()
+
+	v := NewReCAPTCHAv3("site", "secret", 0.5)
+	v.(*siteVerifier).verificationURL = low.URL
+	assert.Equal(t, ErrCAPTCHAFailed, v.Verify("token", "10.0.0.1"))
+	v.(*siteVerifier).verificationURL = high.URL
+	assert.NoError(t, v.Verify("token", "10.0.0.1"))
+	assert.Contains(t, v.Widget().ScriptURL, "render=site")
+}
+
+func TestProofOfWork(t *testing.T) {
+	now := time.Date(2019, 12, 1, 18, 0, 0, 0, time.UTC)
+	pow := NewProofOfWork([]byte("key"), 8).(*proofOfWork)
+	pow.now = func() time.Time { return now }
+
+	w := pow.Widget()
+	assert.Equal(t, CAPTCHAProofOfWork, w.Provider)
+	assert.Equal(t, 8, w.Difficulty)
+
+	response := SolveProofOfWork(w.Challenge, w.Difficulty)
+	assert.NoError(t, pow.Verify(response, ""))
+	assert.Error(t, pow.Verify(response, ""), "challenges can only be used once")
+
+	// signed by another key
+	other := NewProofOfWork([]byte("other"), 8).(*proofOfWork)
+	other.now = pow.now
+	assert.Error(t, pow.Verify(SolveProofOfWork(other.NewChallenge(), 8), ""))
+
+	// not enough work
+	easy := SolveProofOfWork(pow.NewChallenge(), 0)
+	for LeadingZeroBits(sha256.Sum256([]byte(easy))) >= 8 {
+		easy = SolveProofOfWork(pow.NewChallenge(), 0)
+	}
+	assert.Equal(t, ErrCAPTCHAFailed, pow.Verify(easy, ""))
+
+	// expired
+	response = SolveProofOfWork(pow.NewChallenge(), 8)
+	now = now.Add(PoWMaxAge + time.Second)
+	assert.Error(t, pow.Verify(response, ""))
+
+	assert.Equal(t, ErrCAPTCHAFailed, pow.Verify("garbage", ""))
+}
+
+func TestFakeCAPTCHA(t *testing.T) {
+	f := &FakeCAPTCHA{Response: "ok"}
+	assert.NoError(t, f.Verify("ok", ""))
+	assert.Error(t, f.Verify("nope", ""))
+	assert.Error(t, f.Verify("", ""))
+	assert.Equal(t, 3, f.Calls)
+	assert.NoError(t, NoCAPTCHA{}.Verify("", ""))
+}
+
+func TestNewCAPTCHA(t *testing.T) {
+	for _, provider := range []string{"", "recaptcha", "recaptcha3", "hcaptcha", "turnstile", "pow", "none"} {
+		v, err := NewCAPTCHA(provider)
+		assert.NoError(t, err, provider)
+		assert.NotNil(t, v, provider)
+	}
+	_, err := NewCAPTCHA("nope")
+	assert.Error(t, err)
+}
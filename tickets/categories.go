@@ -0,0 +1,220 @@
+package tickets
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ticket categories, every ticket row has one
+const (
+	CategoryStandard   = "standard"
+	CategoryAccessible = "accessible" // wheelchair accessible viewing spot
+	CategoryCompanion  = "companion"  // spot next to an accessible one, for the accessible guest's companion
+)
+
+// TicketCategories are the categories in the order they are shown
+var TicketCategories = []string{CategoryStandard, CategoryAccessible, CategoryCompanion}
+
+// AccessibleRelease is how long before a slot its unclaimed accessible and companion tickets are released to
+// the general pool by the expire sweep.  Set with ADVLIGHT_ACCESSIBLE_RELEASE=2h (or 1d), defaults to 2 hours,
+// "off" keeps them reserved.
+var AccessibleRelease = 2 * time.Hour
+
+func init() {
+	if cfg := strings.TrimSpace(os.Getenv("ADVLIGHT_ACCESSIBLE_RELEASE")); cfg == "off" {
+		AccessibleRelease = 0
+	} else if cfg != "" {
+		d, err := ParseRetention(cfg)
+		if err != nil {
+			log.Panicf("invalid ADVLIGHT_ACCESSIBLE_RELEASE(%v): %s", err, cfg)
+		}
+		AccessibleRelease = d
+	}
+}
+
+// countTickets describes n tickets for the audit log, ie "12 tickets" or "2 accessible tickets"
+func countTickets(n int64, category string) string {
+	if category == "" || category == CategoryStandard {
+		return fmt.Sprintf("%d tickets", n)
+	}
+	return fmt.Sprintf("%d %s tickets", n, category)
+}
+
+// ticketKind is the category, or the ticket type for typed tickets, used to describe tickets in the audit log
+func ticketKind(category, ticketType string) string {
+	if ticketType != "" {
+		return ticketType
+	}
+	return category
+}
+
+// ParseCategory normalizes a ticket category, "" is standard
+func ParseCategory(s string) (string, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" {
+		return CategoryStandard, nil
+	}
+	for _, c := range TicketCategories {
+		if c == s {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown ticket category %q", s)
+}
+
+// TicketRequest is the tickets a guest asks for in one slot
+type TicketRequest struct {
+	Accessible bool   // an accessible spot instead of a standard ticket
+	Companion  bool   // and a companion spot next to it
+	TicketType string // a TicketType code, "" for general admission
+}
+
+// Categories are the tickets the request books, sorted.  Ticket types are booked as a single standard ticket.
+func (tr TicketRequest) Categories() []string {
+	if !tr.Accessible || tr.TicketType != "" {
+		return []string{CategoryStandard}
+	}
+	if tr.Companion {
+		return []string{CategoryAccessible, CategoryCompanion}
+	}
+	return []string{CategoryAccessible}
+}
+
+// sameCategories reports whether the guest's tickets in a slot are what was requested, a ticket booked in one of
+// the requested category's fallbacks (see categoryFallbacks) counts as that category
+func sameCategories(have, want []string) bool {
+	if len(have) != len(want) {
+		return false
+	}
+	left := append([]string{}, have...)
+	take := func(c string) bool {
+		for i := range left {
+			if left[i] == c {
+				left = append(left[:i], left[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+	// exact matches first, so a fallback does not take a ticket another requested category needs
+	unmatched := make([]string, 0)
+	for _, c := range want {
+		if !take(c) {
+			unmatched = append(unmatched, c)
+		}
+	}
+	for _, c := range unmatched {
+		found := false
+		for _, f := range categoryFallbacks(c)[1:] {
+			if take(f) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// categoryFallbacks are the categories tried, in order, for a requested category.  A companion without a
+// companion spot left gets a standard ticket, accessible guests are never given a standard ticket instead.
+func categoryFallbacks(category string) []string {
+	if category == CategoryCompanion {
+		return []string{CategoryCompanion, CategoryStandard}
+	}
+	return []string{category}
+}
+
+// Available is the unassigned tickets in the category
+func (s Slot) Available(category string) int64 {
+	switch category {
+	case CategoryAccessible:
+		return s.AccessibleTickets
+	case CategoryCompanion:
+		return s.CompanionTickets
+	}
+	return s.AvailableTickets
+}
+
+// take counts a booked ticket against the cached availability
+func (s *Slot) take(category, ticketType string) {
+	switch {
+	case ticketType != "":
+		s.TypeTickets[ticketType]--
+	case category == CategoryAccessible:
+		s.AccessibleTickets--
+	case category == CategoryCompanion:
+		s.CompanionTickets--
+	default:
+		s.AvailableTickets--
+	}
+}
+
+// empty is true when nothing is left to book in the slot
+func (s Slot) empty() bool {
+	for _, n := range s.TypeTickets {
+		if n > 0 {
+			return false
+		}
+	}
+	return s.AvailableTickets < 1 && s.AccessibleTickets < 1 && s.CompanionTickets < 1
+}
+
+// ReleaseAccessible moves unclaimed accessible and companion tickets in slots starting within AccessibleRelease
+// of now to the general pool, run by the expire sweep
+func (r *repo) ReleaseAccessible(a Actor, now time.Time) (int64, error) {
+	if AccessibleRelease <= 0 {
+		return 0, nil
+	}
+	log.Printf("ReleaseAccessible %s %s", a, now.Add(AccessibleRelease))
+	rows, err := r.db.Query(`
+		update tickets set category='standard', updated_at=current_timestamp
+		where guest_id is null and category!='standard' and slot>$1 and slot<=$2
+		returning slot,coalesce(event_code,''),category;`, now, now.Add(AccessibleRelease))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	// one audit entry per slot and event code
+	type key struct {
+		slot      time.Time
+		eventCode string
+	}
+	released := make(map[key]int)
+	order := make([]key, 0)
+	var total int64
+	for rows.Next() {
+		var (
+			k        key
+			category string
+		)
+		err = rows.Scan(&k.slot, &k.eventCode, &category)
+		if err != nil {
+			return total, err
+		}
+		if _, ok := released[k]; !ok {
+			order = append(order, k)
+		}
+		released[k]++
+		total++
+	}
+	rows.Close()
+	for _, k := range order {
+		r.Audit(a, AuditEntry{
+			Action:    AuditReleaseAccessible,
+			Slot:      k.slot,
+			EventCode: k.eventCode,
+			Before:    fmt.Sprintf("%d accessible/companion tickets", released[k]),
+			After:     "standard",
+		})
+	}
+	if total > 0 {
+		r.ClearCache()
+	}
+	return total, nil
+}
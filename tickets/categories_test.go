@@ -0,0 +1,49 @@
+package tickets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCategory(t *testing.T) {
+	for in, want := range map[string]string{"": CategoryStandard, " Accessible ": CategoryAccessible, "companion": CategoryCompanion} {
+		c, err := ParseCategory(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, want, c, in)
+	}
+	_, err := ParseCategory("vip")
+	assert.Error(t, err)
+}
+
+func TestTicketRequest(t *testing.T) {
+	assert.Equal(t, []string{CategoryStandard}, TicketRequest{}.Categories())
+	assert.Equal(t, []string{CategoryStandard}, TicketRequest{Companion: true}.Categories(), "companions come with an accessible spot")
+	assert.Equal(t, []string{CategoryAccessible}, TicketRequest{Accessible: true}.Categories())
+	assert.Equal(t, []string{CategoryAccessible, CategoryCompanion}, TicketRequest{Accessible: true, Companion: true}.Categories())
+
+	assert.True(t, sameCategories([]string{CategoryCompanion, CategoryAccessible}, []string{CategoryAccessible, CategoryCompanion}))
+	assert.False(t, sameCategories([]string{CategoryStandard}, []string{CategoryAccessible}))
+	assert.False(t, sameCategories(nil, []string{CategoryStandard}))
+	// a companion booked as standard when the companion spots were gone
+	assert.True(t, sameCategories([]string{CategoryStandard, CategoryAccessible}, []string{CategoryAccessible, CategoryCompanion}))
+	assert.False(t, sameCategories([]string{CategoryStandard, CategoryStandard}, []string{CategoryAccessible, CategoryCompanion}))
+	assert.False(t, sameCategories([]string{CategoryCompanion}, []string{CategoryStandard}))
+
+	assert.Equal(t, []string{CategoryCompanion, CategoryStandard}, categoryFallbacks(CategoryCompanion))
+	assert.Equal(t, []string{CategoryAccessible}, categoryFallbacks(CategoryAccessible), "accessible guests never get a standard ticket instead")
+}
+
+func TestSlotCategories(t *testing.T) {
+	s := Slot{AvailableTickets: 1, AccessibleTickets: 1, CompanionTickets: 1}
+	assert.Equal(t, int64(1), s.Available(CategoryAccessible))
+	s.take(CategoryStandard, "")
+	s.take(CategoryAccessible, "")
+	assert.Equal(t, int64(0), s.Available(CategoryStandard))
+	assert.False(t, s.empty(), "the companion spot is still available")
+	s.take(CategoryCompanion, "")
+	assert.True(t, s.empty())
+
+	assert.Equal(t, "3 tickets", countTickets(3, CategoryStandard))
+	assert.Equal(t, "2 accessible tickets", countTickets(2, CategoryAccessible))
+}
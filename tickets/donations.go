@@ -0,0 +1,303 @@
+package tickets
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/config"
+)
+
+// where a donate link was clicked, recorded with each click
+const (
+	DonateSourceIndex   = "index"   // the donate button on the tickets page
+	DonateSourceBooking = "booking" // the prompt shown after booking, see config.DonatePrompt
+	DonateSourceEmail   = "email"   // the confirmation email
+	DonateSourceTicket  = "ticket"  // the ticket page
+)
+
+// DonateSources are the click sources accepted by RecordDonationClick
+var DonateSources = []string{DonateSourceIndex, DonateSourceBooking, DonateSourceEmail, DonateSourceTicket}
+
+// DonateURL is the tracked donate link for the guest (g may be nil), "" when there is no config.DonateLink.
+// It redirects to config.DonateLink after recording the click.
+func DonateURL(g *Guest, source string) string {
+	if config.DonateLink == "" {
+		return ""
+	}
+	path := "/donate"
+	if g != nil && g.ID != "" {
+		path = "/" + g.GetToken() + "/donate"
+	}
+	return HostName + path + "?src=" + url.QueryEscape(source)
+}
+
+// RecordDonationClick records an outbound click on the donate link, g is nil for guests that are not signed in
+func (r *repo) RecordDonationClick(g *Guest, source, eventCode string) error {
+	valid := false
+	for _, s := range DonateSources {
+		valid = valid || s == source
+	}
+	if !valid {
+		source = DonateSourceIndex
+	}
+	var guestID interface{}
+	if g != nil && g.ID != "" {
+		guestID = g.ID
+	}
+	_, err := r.db.Exec(`insert into donation_clicks(guest_id,source,event_code) values($1,$2,NULLIF($3,''));`,
+		guestID, source, strings.TrimSpace(strings.ToLower(eventCode)))
+	return err
+}
+
+// Donation is a donation imported from the donation processor
+type Donation struct {
+	ExternalID  string // the processor's id, or a hash of the row when the csv has no id column
+	Email       string
+	AmountCents int64
+	DonatedAt   time.Time
+	GuestID     string // the guest with the same email, "" when there is none
+}
+
+// Amount is the formatted amount, ie $25.00
+func (d Donation) Amount() string {
+	return FormatPrice(d.AmountCents, Currency)
+}
+
+// donationColumns are the csv headers recognized for each field, lower case
+var donationColumns = map[string][]string{
+	"id":     {"id", "transaction id", "donation id", "payment id", "reference"},
+	"email":  {"email", "email address", "donor email", "customer email", "payer email"},
+	"amount": {"amount", "gross", "total", "donation amount", "net"},
+	"date":   {"date", "created", "created (utc)", "donated at", "donation date", "created at"},
+}
+
+// donationDateFormats are the date formats accepted in a donation csv, interpreted in config.Location
+var donationDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"01/02/2006 15:04:05",
+	"01/02/2006 15:04",
+	"01/02/2006",
+	"1/2/2006 15:04",
+	"1/2/2006",
+}
+
+// ParseDonationsCSV reads a donation processor's export.  The header row must have email, amount and date columns
+// (see donationColumns), an id column is used to skip donations already imported.
+func ParseDonationsCSV(in io.Reader) ([]Donation, error) {
+	rd := csv.NewReader(in)
+	rd.FieldsPerRecord = -1
+	rd.TrimLeadingSpace = true
+	header, err := rd.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the csv is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	cols := map[string]int{}
+	for idx, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		for field, names := range donationColumns {
+			for _, name := range names {
+				if _, found := cols[field]; !found && h == name {
+					cols[field] = idx
+				}
+			}
+		}
+	}
+	for _, field := range []string{"email", "amount", "date"} {
+		if _, ok := cols[field]; !ok {
+			return nil, fmt.Errorf("the csv has no %s column, expected one of %s", field, strings.Join(donationColumns[field], ", "))
+		}
+	}
+	donations := make([]Donation, 0)
+	for line := 2; ; line++ {
+		rec, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := func(field string) string {
+			idx, ok := cols[field]
+			if !ok || idx >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[idx])
+		}
+		if strings.Join(rec, "") == "" {
+			continue
+		}
+		d := Donation{ExternalID: value("id")}
+		d.Email, err = ParseEmail(value("email"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		d.AmountCents, err = ParsePrice(strings.Replace(value("amount"), ",", "", -1))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		d.DonatedAt, err = parseDonationDate(value("date"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if d.ExternalID == "" {
+			d.ExternalID = donationHash(d)
+		}
+		donations = append(donations, d)
+	}
+	return donations, nil
+}
+
+func parseDonationDate(s string) (time.Time, error) {
+	for _, layout := range donationDateFormats {
+		if t, err := time.ParseInLocation(layout, s, config.Location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, use a date like 2019-12-01", s)
+}
+
+// donationHash identifies a donation without a processor id, so importing the same csv twice is harmless
+func donationHash(d Donation) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(d.Email) + "|" + strconv.FormatInt(d.AmountCents, 10) + "|" + d.DonatedAt.UTC().Format(time.RFC3339)))
+	return "sha256:" + hex.EncodeToString(sum[:12])
+}
+
+// DonationImport counts the rows of an ImportDonations
+type DonationImport struct {
+	Rows       int
+	Imported   int64
+	Duplicates int64 // already imported
+	Matched    int64 // donations (new or from earlier imports) newly matched to a guest
+}
+
+func (di DonationImport) String() string {
+	return fmt.Sprintf("%d rows: %d imported, %d already imported, %d matched to guests", di.Rows, di.Imported, di.Duplicates, di.Matched)
+}
+
+// ImportDonations saves donations not already imported and matches donations to guests by email.  Donations
+// imported before the donor booked are matched on later imports.
+func (r *repo) ImportDonations(a Actor, donations []Donation) (DonationImport, error) {
+	log.Printf("ImportDonations %s %d", a, len(donations))
+	di := DonationImport{Rows: len(donations)}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return di, err
+	}
+	for _, d := range donations {
+		res, err := tx.Exec(`insert into donations(external_id,email,amount_cents,donated_at) values($1,$2,$3,$4) on conflict (external_id) do nothing;`,
+			d.ExternalID, d.Email, d.AmountCents, d.DonatedAt)
+		if err != nil {
+			tx.Rollback()
+			return di, err
+		}
+		n, _ := res.RowsAffected()
+		di.Imported += n
+	}
+	di.Duplicates = int64(di.Rows) - di.Imported
+	res, err := tx.Exec(`update donations d set guest_id=g.id from guests g where d.guest_id is null and g.email=d.email;`)
+	if err != nil {
+		tx.Rollback()
+		return di, err
+	}
+	di.Matched, _ = res.RowsAffected()
+	err = tx.Commit()
+	if err != nil {
+		return di, err
+	}
+	r.Audit(a, AuditEntry{Action: AuditImportDonations, After: di.String()})
+	return di, nil
+}
+
+// GetDonations returns the newest imported donations, for the admin
+func (r *repo) GetDonations(limit int) ([]Donation, error) {
+	rows, err := r.db.Query(`select external_id,email,amount_cents,donated_at,coalesce(guest_id::text,'') from donations order by donated_at desc limit $1;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	donations := make([]Donation, 0)
+	for rows.Next() {
+		var d Donation
+		err = rows.Scan(&d.ExternalID, &d.Email, &d.AmountCents, &d.DonatedAt, &d.GuestID)
+		if err != nil {
+			return nil, err
+		}
+		donations = append(donations, d)
+	}
+	return donations, nil
+}
+
+// DonationStat is the donation conversion of the guests booked on a day with an event code
+type DonationStat struct {
+	Day         time.Time
+	EventCode   string
+	Guests      int64 // guests with tickets
+	Clicked     int64 // guests who clicked a donate link
+	Donors      int64 // guests matched to a donation
+	AmountCents int64 // donated by the donors, a guest booked on several days counts on each day
+}
+
+// Amount is the formatted total, ie $250.00
+func (ds DonationStat) Amount() string {
+	return FormatPrice(ds.AmountCents, Currency)
+}
+
+// ClickRate is the percent of guests who clicked a donate link
+func (ds DonationStat) ClickRate() float64 {
+	return percent(ds.Clicked, ds.Guests)
+}
+
+// Conversion is the percent of guests who donated
+func (ds DonationStat) Conversion() float64 {
+	return percent(ds.Donors, ds.Guests)
+}
+
+func percent(n, of int64) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(of)
+}
+
+// GetDonationStats reports donation conversion by booking day and event code, not cached because it is behind an admin screen
+func (r *repo) GetDonationStats() ([]DonationStat, error) {
+	log.Println("GetDonationStats")
+	rows, err := r.db.Query(`
+		with booked as (
+			select distinct (slot at time zone $1)::date as day, coalesce(event_code,'') as event_code, guest_id from tickets where guest_id is not null
+		), clicked as (
+			select distinct guest_id from donation_clicks where guest_id is not null
+		), donated as (
+			select guest_id, sum(amount_cents) as amount from donations where guest_id is not null group by guest_id
+		) select b.day, b.event_code, count(*), count(c.guest_id), count(d.guest_id), coalesce(sum(d.amount),0)
+		from booked b left join clicked c on c.guest_id=b.guest_id left join donated d on d.guest_id=b.guest_id
+		group by b.day, b.event_code order by b.day, b.event_code;`, config.Location.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := make([]DonationStat, 0)
+	for rows.Next() {
+		var ds DonationStat
+		err = rows.Scan(&ds.Day, &ds.EventCode, &ds.Guests, &ds.Clicked, &ds.Donors, &ds.AmountCents)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, ds)
+	}
+	return stats, nil
+}
@@ -0,0 +1,71 @@
+package tickets
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDonateURL(t *testing.T) {
+	defer func(link string) { config.DonateLink = link }(config.DonateLink)
+
+	config.DonateLink = ""
+	assert.Equal(t, "", DonateURL(&Guest{ID: "abc-def"}, DonateSourceEmail))
+
+	config.DonateLink = "https://give.example.com/lights"
+	assert.Equal(t, HostName+"/abcdef/donate?src=email", DonateURL(&Guest{ID: "abc-def"}, DonateSourceEmail))
+	assert.Equal(t, HostName+"/donate?src=index", DonateURL(nil, DonateSourceIndex))
+	assert.Equal(t, HostName+"/donate?src=booking", DonateURL(&Guest{}, DonateSourceBooking))
+}
+
+func TestParseDonationsCSV(t *testing.T) {
+	in := "\ufeffTransaction ID,Created (UTC),Donor Email,Gross,Note\n" +
+		"ch_1,2019-12-02 19:45:00,Guest@Example.com,\"1,000.00\",thanks\n" +
+		"\n" +
+		"ch_2,12/03/2019,other@example.com,$25,\n"
+	donations, err := ParseDonationsCSV(strings.NewReader(in))
+	assert.NoError(t, err)
+	assert.Equal(t, []Donation{
+		{ExternalID: "ch_1", Email: "guest@example.com", AmountCents: 100000, DonatedAt: time.Date(2019, 12, 2, 19, 45, 0, 0, config.Location)},
+		{ExternalID: "ch_2", Email: "other@example.com", AmountCents: 2500, DonatedAt: time.Date(2019, 12, 3, 0, 0, 0, 0, config.Location)},
+	}, donations)
+	assert.Equal(t, "$1000.00", donations[0].Amount())
+
+	// without an id column the same row always hashes to the same id, so importing twice is harmless
+	in = "email,amount,date\nguest@example.com,25.00,2019-12-02\nguest@example.com,25.00,2019-12-02\nguest@example.com,10.00,2019-12-02\n"
+	donations, err = ParseDonationsCSV(strings.NewReader(in))
+	assert.NoError(t, err)
+	assert.Len(t, donations, 3)
+	assert.True(t, strings.HasPrefix(donations[0].ExternalID, "sha256:"))
+	assert.Equal(t, donations[0].ExternalID, donations[1].ExternalID)
+	assert.NotEqual(t, donations[0].ExternalID, donations[2].ExternalID)
+}
+
+func TestParseDonationsCSVErrors(t *testing.T) {
+	for in, msg := range map[string]string{
+		"": "the csv is empty",
+		"email,date\nguest@example.com,2019-12-02":             "no amount column",
+		"email,amount,date\nnot an email,25,2019-12-02":        "line 2",
+		"email,amount,date\nguest@example.com,lots,2019-12-02": "line 2",
+		"email,amount,date\nguest@example.com,25,yesterday":    "invalid date",
+	} {
+		_, err := ParseDonationsCSV(strings.NewReader(in))
+		if assert.Error(t, err, in) {
+			assert.Contains(t, err.Error(), msg, in)
+		}
+	}
+}
+
+func TestDonationStat(t *testing.T) {
+	ds := DonationStat{Guests: 40, Clicked: 10, Donors: 4, AmountCents: 10000}
+	assert.Equal(t, 25.0, ds.ClickRate())
+	assert.Equal(t, 10.0, ds.Conversion())
+	assert.Equal(t, "$100.00", ds.Amount())
+	assert.Equal(t, 0.0, DonationStat{}.Conversion())
+
+	di := DonationImport{Rows: 3, Imported: 2, Duplicates: 1, Matched: 1}
+	assert.Equal(t, "3 rows: 2 imported, 1 already imported, 1 matched to guests", di.String())
+}
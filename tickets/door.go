@@ -0,0 +1,354 @@
+package tickets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/lib/pq"
+)
+
+// door sync results
+const (
+	DoorCheckedIn = "checked_in" // the scan checked the party in, or replaced a later scan at another gate
+	DoorSynced    = "synced"     // the scan was already synced, a retry after a lost response
+	DoorDuplicate = "duplicate"  // the party was checked in earlier, at this or another gate
+	DoorNotFound  = "not_found"  // the tickets were cancelled or moved after the manifest was downloaded
+	DoorInvalid   = "invalid"    // the scan is not from a manifest entry
+)
+
+// MaxDoorScans is the most scans synced in one request, door clients send the rest in the next
+const MaxDoorScans = 500
+
+// DoorClockSkew is how far a gate's clock may be off, scans later than now or outside the token's night by more
+// are rejected
+var DoorClockSkew = 10 * time.Minute
+
+// ErrInvalidDoorToken is returned for door tokens that are tampered with or from a past night
+var ErrInvalidDoorToken = fmt.Errorf("This door login has expired, log in again")
+
+var gateRegexp = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+// DoorManifest is a night's booked tickets, downloaded by a door client to check guests in without a connection
+type DoorManifest struct {
+	Date        string      `json:"date"` // the night, 2006-01-02 in config.Location
+	Gate        string      `json:"gate"`
+	Token       string      `json:"token"` // authenticates the gate's syncs and manifest refreshes
+	GeneratedAt int64       `json:"generated_at"`
+	Entries     []DoorEntry `json:"entries"`
+}
+
+// DoorEntry is a party, the guest's tickets in a slot that are checked in together by the ticket's QR code
+type DoorEntry struct {
+	Guest     string  `json:"guest"` // DoorGuest of the guest's token, the token itself logs in as the guest
+	Slot      int64   `json:"slot"`
+	Numbers   []int64 `json:"numbers"`
+	CheckedIn int64   `json:"checked_in,omitempty"` // unix ms, when already checked in
+	Gate      string  `json:"gate,omitempty"`
+	Sig       string  `json:"sig"` // sent back with the scan, only entries from a manifest can be synced
+}
+
+// DoorScan is a check-in queued by a door client
+type DoorScan struct {
+	ID        string `json:"id"`    // the client's id for the scan, echoed in its result
+	Guest     string `json:"guest"` // DoorGuest of the scanned token, as in the manifest
+	Slot      int64  `json:"slot"`
+	Sig       string `json:"sig"`
+	ScannedAt int64  `json:"scanned_at"` // unix ms on the gate's clock
+}
+
+// DoorResult is what became of a synced scan
+type DoorResult struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	CheckedInAt int64  `json:"checked_in_at,omitempty"` // unix ms of the scan that counts
+	Gate        string `json:"gate,omitempty"`          // the gate of the scan that counts
+	Conflict    string `json:"conflict,omitempty"`      // set when another gate scanned the same party
+}
+
+// ParseGate normalizes a door client's gate name, ie "North Gate" is north-gate
+func ParseGate(s string) (string, error) {
+	gate := strings.Join(strings.Fields(strings.ToLower(s)), "-")
+	if !gateRegexp.MatchString(gate) || gate == KioskGate {
+		return "", fmt.Errorf("%q is not a gate name, use letters, numbers and dashes", s)
+	}
+	return gate, nil
+}
+
+func signDoor(parts ...string) string {
+	mac := hmac.New(sha256.New, signingKey())
+	mac.Write([]byte("door:" + strings.Join(parts, ":")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// doorDay is the start and end of the night date in config.Location
+func doorDay(date string) (time.Time, time.Time, error) {
+	day, err := time.ParseInLocation("2006-01-02", date, config.Location)
+	if err != nil {
+		return day, day, err
+	}
+	return day, day.AddDate(0, 0, 1), nil
+}
+
+// DoorToken authenticates a gate for the night date
+func DoorToken(gate, date string) string {
+	return gate + "." + date + "." + signDoor("token", gate, date)
+}
+
+// ParseDoorToken returns the gate and night of a token created by DoorToken, tokens work until the end of the next day
+// so check-ins queued late at night can still be synced
+func ParseDoorToken(token string, now time.Time) (gate, date string, err error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(signDoor("token", parts[0], parts[1]))) {
+		return "", "", ErrInvalidDoorToken
+	}
+	_, end, err := doorDay(parts[1])
+	if err != nil || !now.Before(end.AddDate(0, 0, 1)) {
+		return "", "", ErrInvalidDoorToken
+	}
+	return parts[0], parts[1], nil
+}
+
+// DoorGuest is the SHA-256 of a guest's token (hex), manifests hold it instead of the token so a manifest kept on
+// a gate's device can not be used to manage the guests' bookings.  Door clients hash the scanned token to match it.
+func DoorGuest(token string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.Replace(token, "-", "", -1))))
+	return hex.EncodeToString(sum[:])
+}
+
+// doorEntrySig signs a party in the manifest
+func doorEntrySig(guest string, slot int64) string {
+	return signDoor("entry", guest, fmt.Sprint(slot))
+}
+
+// GetDoorManifest returns the booked tickets of the night date for gate, priced tickets only once they are paid
+func (r *repo) GetDoorManifest(gate, date string, now time.Time) (*DoorManifest, error) {
+	from, to, err := doorDay(date)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.Query(`
+		select t.guest_id, t.slot, t.num, t.checked_in_at, coalesce(t.checked_in_gate,'')
+		from tickets t left join payments p on (p.id=t.payment_id)
+		where t.guest_id is not null and t.slot>=$1 and t.slot<$2 and (t.payment_id is null or p.status='paid')
+		order by t.slot, t.guest_id, t.num;`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := &DoorManifest{Date: date, Gate: gate, Token: DoorToken(gate, date), GeneratedAt: unixMilli(now), Entries: make([]DoorEntry, 0)}
+	for rows.Next() {
+		var (
+			guestID string
+			slot    time.Time
+			num     int64
+			checked pq.NullTime
+			tgate   string
+		)
+		err = rows.Scan(&guestID, &slot, &num, &checked, &tgate)
+		if err != nil {
+			return nil, err
+		}
+		guest := DoorGuest(guestID)
+		last := len(m.Entries) - 1
+		if last < 0 || m.Entries[last].Guest != guest || m.Entries[last].Slot != slot.Unix() {
+			m.Entries = append(m.Entries, DoorEntry{Guest: guest, Slot: slot.Unix(), Sig: doorEntrySig(guest, slot.Unix())})
+			last++
+		}
+		e := &m.Entries[last]
+		e.Numbers = append(e.Numbers, num)
+		if checked.Valid && (e.CheckedIn == 0 || unixMilli(checked.Time) < e.CheckedIn) {
+			e.CheckedIn, e.Gate = unixMilli(checked.Time), tgate
+		}
+	}
+	return m, nil
+}
+
+// SyncDoorScans checks in the scans a door client queued at gate.  When gates scan the same party the earliest scan
+// counts (the lower gate name on a tie), whatever order the gates sync in, and the other scans are reported as
+// conflicts.  Syncing a scan again is harmless.
+func (r *repo) SyncDoorScans(a Actor, gate, date string, scans []DoorScan, now time.Time) ([]DoorResult, error) {
+	log.Printf("SyncDoorScans %s %s %s %d", a, gate, date, len(scans))
+	if len(scans) > MaxDoorScans {
+		return nil, fmt.Errorf("sync at most %d scans at once", MaxDoorScans)
+	}
+	from, to, err := doorDay(date)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]DoorScan, len(scans))
+	copy(sorted, scans)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].ScannedAt != sorted[j].ScannedAt {
+			return sorted[i].ScannedAt < sorted[j].ScannedAt
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	results := make(map[string]DoorResult, len(scans))
+	for _, s := range sorted {
+		res, err := r.syncDoorScan(a, gate, s, from, to, now)
+		if err != nil {
+			return nil, err
+		}
+		results[s.ID] = res
+	}
+	// results in the order the client sent the scans
+	ordered := make([]DoorResult, 0, len(scans))
+	for _, s := range scans {
+		ordered = append(ordered, results[s.ID])
+	}
+	return ordered, nil
+}
+
+// syncDoorScan checks in a scan of the night [from, to)
+func (r *repo) syncDoorScan(a Actor, gate string, s DoorScan, from, to, now time.Time) (DoorResult, error) {
+	res := DoorResult{ID: s.ID, Status: DoorInvalid}
+	scannedAt := time.Unix(0, s.ScannedAt*int64(time.Millisecond))
+	slot := time.Unix(s.Slot, 0)
+	if !hmac.Equal([]byte(s.Sig), []byte(doorEntrySig(s.Guest, s.Slot))) || !validDoorScan(slot, scannedAt, from, to, now) {
+		return res, nil
+	}
+	guestID, err := r.doorGuestID(s.Guest, slot)
+	if err != nil || guestID == "" {
+		res.Status = DoorNotFound
+		return res, err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return res, err
+	}
+	rows, err := tx.Query(`
+		select g.email, t.checked_in_at, coalesce(t.checked_in_gate,'')
+		from tickets t join guests g on (g.id=t.guest_id) left join payments p on (p.id=t.payment_id)
+		where t.guest_id=$1 and t.slot=$2 and (t.payment_id is null or p.status='paid') for update of t;`, guestID, slot)
+	if err != nil {
+		tx.Rollback()
+		return res, err
+	}
+	var (
+		email    string
+		found    bool
+		earliest time.Time
+		egate    string
+	)
+	for rows.Next() {
+		var checked pq.NullTime
+		var tgate string
+		rows.Scan(&email, &checked, &tgate)
+		found = true
+		if checked.Valid && (earliest.IsZero() || checked.Time.Before(earliest)) {
+			earliest, egate = checked.Time, tgate
+		}
+	}
+	rows.Close()
+	if !found {
+		tx.Rollback()
+		res.Status = DoorNotFound
+		return res, nil
+	}
+
+	// the earliest scan, then the lower gate, is kept on every ticket of the party
+	res.Status, res.CheckedInAt, res.Gate = doorStatus(scannedAt, gate, earliest, egate), s.ScannedAt, gate
+	switch res.Status {
+	case DoorCheckedIn:
+		if !earliest.IsZero() {
+			res.Conflict = fmt.Sprintf("replaced the later scan at %s %s", egate, earliest.In(config.Location).Format("3:04:05pm"))
+		}
+	case DoorDuplicate:
+		res.CheckedInAt, res.Gate = unixMilli(earliest), egate
+		res.Conflict = fmt.Sprintf("already checked in at %s %s", egate, earliest.In(config.Location).Format("3:04:05pm"))
+	}
+	winner := scannedAt
+	if res.Status == DoorDuplicate {
+		winner = earliest
+	}
+	rows, err = tx.Query(`
+		update tickets set checked_in_at=$3, checked_in_gate=$4
+		where guest_id=$1 and slot=$2 and (checked_in_at is null or checked_in_at<>$3 or coalesce(checked_in_gate,'')<>$4)
+		and (payment_id is null or exists (select 1 from payments p where p.id=payment_id and p.status='paid'))
+		returning num, coalesce(event_code,'');`, guestID, slot, winner, res.Gate)
+	if err != nil {
+		tx.Rollback()
+		return res, err
+	}
+	checked := make([]AuditEntry, 0)
+	for rows.Next() {
+		e := AuditEntry{Action: AuditCheckIn, GuestID: guestID, Email: email, Slot: slot, Before: "booked", After: "checked in at " + res.Gate}
+		if res.Status == DoorCheckedIn && egate != "" {
+			e.Before = "checked in at " + egate
+		}
+		rows.Scan(&e.Number, &e.EventCode)
+		checked = append(checked, e)
+	}
+	rows.Close()
+	err = tx.Commit()
+	if err != nil {
+		return res, err
+	}
+
+	if res.Conflict != "" {
+		r.Audit(a, AuditEntry{Action: AuditDoorConflict, GuestID: guestID, Email: email, Slot: slot,
+			Before: egate + " " + earliest.Format(time.RFC3339Nano),
+			After:  gate + " " + scannedAt.Format(time.RFC3339Nano) + " " + res.Status})
+	}
+	for _, e := range checked {
+		r.Audit(a, e)
+	}
+	return res, nil
+}
+
+// validDoorScan is true for a scan of a slot in the night [from, to), scanned that night by a clock that is not off
+// by more than DoorClockSkew.  A gate whose clock reset to 1970 would otherwise win every conflict.
+func validDoorScan(slot, scannedAt, from, to, now time.Time) bool {
+	if slot.Before(from) || !slot.Before(to) {
+		return false
+	}
+	return !scannedAt.Before(from.Add(-DoorClockSkew)) && !scannedAt.After(to.Add(DoorClockSkew)) && !scannedAt.After(now.Add(DoorClockSkew))
+}
+
+// doorGuestID finds the guest with tickets in slot whose token hashes to guest, "" when none do
+func (r *repo) doorGuestID(guest string, slot time.Time) (string, error) {
+	rows, err := r.db.Query(`select distinct guest_id from tickets where slot=$1 and guest_id is not null;`, slot)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return "", err
+		}
+		if DoorGuest(id) == guest {
+			return id, nil
+		}
+	}
+	return "", rows.Err()
+}
+
+// doorStatus compares a scan to the party's earliest check-in (zero when there is none), the earlier scan counts and
+// the lower gate name breaks ties
+func doorStatus(scannedAt time.Time, gate string, earliest time.Time, egate string) string {
+	switch {
+	case earliest.IsZero():
+		return DoorCheckedIn
+	case earliest.Equal(scannedAt) && egate == gate:
+		return DoorSynced
+	case scannedAt.Before(earliest) || (scannedAt.Equal(earliest) && gate < egate):
+		return DoorCheckedIn
+	}
+	return DoorDuplicate
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
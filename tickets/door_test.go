@@ -0,0 +1,92 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGate(t *testing.T) {
+	gate, err := ParseGate("  North  Gate ")
+	assert.NoError(t, err)
+	assert.Equal(t, "north-gate", gate)
+
+	_, err = ParseGate("")
+	assert.Error(t, err)
+	_, err = ParseGate("gate.1")
+	assert.Error(t, err)
+	// the kiosk records its own check-ins
+	_, err = ParseGate("Kiosk")
+	assert.Error(t, err)
+}
+
+func TestDoorToken(t *testing.T) {
+	defer func(l *time.Location) { config.Location = l }(config.Location)
+	config.Location = time.UTC
+	night := time.Date(2019, 12, 14, 18, 0, 0, 0, time.UTC)
+
+	gate, date, err := ParseDoorToken(DoorToken("north", "2019-12-14"), night)
+	assert.NoError(t, err)
+	assert.Equal(t, "north", gate)
+	assert.Equal(t, "2019-12-14", date)
+
+	// late check-ins sync the next day, not the day after
+	_, _, err = ParseDoorToken(DoorToken("north", "2019-12-14"), night.Add(24*time.Hour))
+	assert.NoError(t, err)
+	_, _, err = ParseDoorToken(DoorToken("north", "2019-12-14"), night.Add(30*time.Hour))
+	assert.Equal(t, ErrInvalidDoorToken, err)
+
+	_, _, err = ParseDoorToken("south.2019-12-14."+signDoor("token", "north", "2019-12-14"), night)
+	assert.Equal(t, ErrInvalidDoorToken, err)
+	_, _, err = ParseDoorToken("north.2019-12-15."+signDoor("token", "north", "2019-12-14"), night)
+	assert.Equal(t, ErrInvalidDoorToken, err)
+	_, _, err = ParseDoorToken("north", night)
+	assert.Equal(t, ErrInvalidDoorToken, err)
+
+	assert.Equal(t, doorEntrySig("6f1c2f5e5d3a4d7b9a531e2b3c4d5e6f", 1576346400), doorEntrySig("6f1c2f5e5d3a4d7b9a531e2b3c4d5e6f", 1576346400))
+	assert.NotEqual(t, doorEntrySig("6f1c2f5e5d3a4d7b9a531e2b3c4d5e6f", 1576346400), doorEntrySig("6f1c2f5e5d3a4d7b9a531e2b3c4d5e6f", 1576348200))
+}
+
+func TestDoorStatus(t *testing.T) {
+	at := time.Date(2019, 12, 14, 18, 5, 0, 0, time.UTC)
+	later := at.Add(time.Minute)
+
+	assert.Equal(t, DoorCheckedIn, doorStatus(at, "north", time.Time{}, ""))
+	assert.Equal(t, DoorSynced, doorStatus(at, "north", at, "north"))
+	// the earlier scan counts whichever gate syncs first
+	assert.Equal(t, DoorCheckedIn, doorStatus(at, "south", later, "north"))
+	assert.Equal(t, DoorDuplicate, doorStatus(later, "north", at, "south"))
+	assert.Equal(t, DoorDuplicate, doorStatus(later, "north", at, "north"))
+	// the lower gate name breaks ties
+	assert.Equal(t, DoorCheckedIn, doorStatus(at, "north", at, "south"))
+	assert.Equal(t, DoorDuplicate, doorStatus(at, "south", at, "north"))
+}
+
+func TestDoorGuest(t *testing.T) {
+	g := Guest{ID: "6f1c2f5e-5d3a-4d7b-9a53-1e2b3c4d5e6f"}
+	// sha-256 of the token, as the door client hashes the scanned ticket
+	assert.Equal(t, "705a6ee8d19f841844095ed6b8d0c48bc92e55b3ea3eee435fddcebd8f60cb0f", DoorGuest(g.GetToken()))
+	assert.Equal(t, DoorGuest(g.GetToken()), DoorGuest(g.ID))
+}
+
+func TestValidDoorScan(t *testing.T) {
+	defer func(l *time.Location) { config.Location = l }(config.Location)
+	config.Location = time.UTC
+	from, to, err := doorDay("2019-12-14")
+	assert.NoError(t, err)
+	slot := time.Date(2019, 12, 14, 18, 0, 0, 0, time.UTC)
+	now := time.Date(2019, 12, 14, 21, 0, 0, 0, time.UTC)
+
+	assert.True(t, validDoorScan(slot, slot.Add(5*time.Minute), from, to, now))
+	assert.True(t, validDoorScan(slot, from.Add(-5*time.Minute), from, to, now))
+	// a gate clock that reset would win every conflict
+	assert.False(t, validDoorScan(slot, time.Unix(0, 0), from, to, now))
+	assert.False(t, validDoorScan(slot, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), from, to, now))
+	assert.False(t, validDoorScan(slot, now.Add(time.Hour), from, to, now))
+	assert.False(t, validDoorScan(slot, to.Add(time.Hour), from, to, to.Add(2*time.Hour)))
+	// tonight's token does not check in other nights
+	assert.False(t, validDoorScan(slot.AddDate(0, 0, 1), slot, from, to, now))
+	assert.False(t, validDoorScan(slot.AddDate(0, 0, -1), slot, from, to, now))
+}
@@ -2,6 +2,7 @@ package tickets
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
@@ -10,17 +11,30 @@ import (
 	"time"
 
 	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/theme"
 	"github.com/matcornic/hermes"
 	gomail "gopkg.in/gomail.v2"
 )
 
-var mailer *hermes.Hermes
 var smtpConfig *smtpconfig
 var Mailer *mailerHelper
 
 func init() {
 	Mailer = &mailerHelper{}
-	mailer = &hermes.Hermes{
+	smtpConfig = &smtpconfig{} // empty config will log emails (useful for dev)
+	if os.Getenv("ADVLIGHT_SMTP") != "" {
+		err := smtpConfig.Parse(os.Getenv("ADVLIGHT_SMTP"))
+		if err != nil {
+			log.Panicf("invalid SMTP config(%v): %s ", err, os.Getenv("ADVLIGHT_SMTP"))
+		}
+	}
+}
+
+// newMailer builds the email generator from the current theme, so a reloaded theme applies to the next email
+func newMailer(lang string) *hermes.Hermes {
+	t := theme.Current()
+	return &hermes.Hermes{
 		// Optional Theme
 		Theme: new(hermes.Flat),
 		Product: hermes.Product{
@@ -28,75 +42,216 @@ func init() {
 			Name: config.EventName,
 			Link: config.EventLink,
 			// Optional product logo
-			Logo:      config.EventLogo,
-			Copyright: "Sent with Love from your friends at " + config.ChurchName,
+			Logo:        theme.AbsoluteURL(HostName, t.Logo),
+			Copyright:   t.Email.Copyright,
+			TroubleText: i18n.T(lang, "email.trouble"),
 		},
 	}
-	smtpConfig = &smtpconfig{} // empty config will log emails (useful for dev)
-	if os.Getenv("ADVLIGHT_SMTP") != "" {
-		err := smtpConfig.Parse(os.Getenv("ADVLIGHT_SMTP"))
-		if err != nil {
-			log.Panicf("invalid SMTP config(%v): %s ", err, os.Getenv("ADVLIGHT_SMTP"))
-		}
+}
+
+// EmailHTML renders an email as it is sent, for previews
+func EmailHTML(lang string, email hermes.Email) (string, error) {
+	return newMailer(lang).GenerateHTML(email)
+}
+
+// intros puts the theme's intro before an email's own intros
+func intros(lines ...string) []string {
+	if intro := theme.Current().Email.Intro; intro != "" {
+		return append([]string{intro}, lines...)
+	}
+	return lines
+}
+
+// buttonColor is the theme's color for the main button in an email
+func buttonColor() string {
+	return theme.Current().Email.ButtonColor
+}
+
+// signature is the theme's sign off, the translated "Merry Christmas!" when the theme has none
+func signature(lang string) string {
+	if s := theme.Current().Email.Signature; s != "" {
+		return s
 	}
+	return i18n.T(lang, "email.signature")
+}
+
+// ConfirmationSubject is the subject line of the ConfirmationEmail
+func ConfirmationSubject(g Guest, slot time.Time) string {
+	return emailTemplate(EmailConfirmation, g, slot).Subject
 }
 
+// ConfirmationEmail is in the guest's language, worded by the confirmation EmailTemplate
 func ConfirmationEmail(g Guest, slot time.Time) hermes.Email {
-	actions := []hermes.Action{
-		{
-			Instructions: "Click the button below to confirm/view your ticket:",
+	return confirmationEmail(emailTemplate(EmailConfirmation, g, slot), g, slot)
+}
+
+// confirmationEmail adds the wallet and donate buttons to a rendered confirmation template
+func confirmationEmail(et EmailTemplate, g Guest, slot time.Time) hermes.Email {
+	lang := g.Language
+	actions := []hermes.Action{}
+	if ApplePass != nil {
+		actions = append(actions, hermes.Action{
 			Button: hermes.Button{
-				Color: "#4CAF50",
-				Text:  "Confirm | View Ticket",
-				Link:  g.GetTicketURL(slot),
+				Color: "#000000",
+				Text:  i18n.T(lang, "email.apple_wallet"),
+				Link:  g.GetTicketURL(slot) + "/ticket.pkpass",
 			},
-		},
+		})
+	}
+	if GooglePass != nil {
+		actions = append(actions, hermes.Action{
+			Button: hermes.Button{
+				Color: "#000000",
+				Text:  i18n.T(lang, "email.google_wallet"),
+				Link:  g.GetTicketURL(slot) + "/googlewallet",
+			},
+		})
 	}
 	if config.DonateLink != "" {
 		actions = append(actions, hermes.Action{
 			Button: hermes.Button{
 				Color: "#2196F3",
-				Text:  "Donate",
-				Link:  config.DonateLink,
+				Text:  i18n.T(lang, "email.donate"),
+				Link:  DonateURL(&g, DonateSourceEmail),
 			},
 		})
 	}
+	return et.Email(g, g.GetTicketURL(slot), actions...)
+}
+
+// ConfirmationAttachments are attached to the ConfirmationEmail, a calendar event and (with EmailPDFTickets) a PDF of the ticket
+func ConfirmationAttachments(g Guest, slot time.Time) []Attachment {
+	t := Ticket{Slot: slot, GuestID: g.ID}
+	for _, gt := range g.Tickets {
+		if gt.Slot.Equal(slot) {
+			t = gt
+		}
+	}
+	attachments := []Attachment{
+		{Name: "ticket.ics", ContentType: "text/calendar; charset=utf-8; method=PUBLISH", Data: ICalendar(g, []Ticket{t}, time.Now())},
+	}
+	if EmailPDFTickets {
+		pdf, err := TicketsPDF(g, []Ticket{t})
+		if err != nil {
+			log.Println("ConfirmationAttachments.pdf", g.ID, err)
+		} else {
+			attachments = append(attachments, Attachment{Name: "ticket.pdf", ContentType: "application/pdf", Data: pdf})
+		}
+	}
+	return attachments
+}
+
+// ExpirationSubject is the subject line of the ExpirationEmail
+func ExpirationSubject(g Guest, slot time.Time) string {
+	return emailTemplate(EmailExpiration, g, slot).Subject
+}
+
+// ExpirationEmail is in the guest's language, worded by the expiration EmailTemplate
+func ExpirationEmail(g Guest, slot time.Time) hermes.Email {
+	return emailTemplate(EmailExpiration, g, slot).Email(g, g.GetGuestURL())
+}
+
+// PreviewEmail renders an unsaved template for a guest, as it would be sent
+func PreviewEmail(et EmailTemplate, g Guest, slot time.Time) (subject string, email hermes.Email, err error) {
+	out, err := et.Render(NewEmailData(g, slot))
+	if err != nil {
+		return "", email, err
+	}
+	if et.Name == EmailConfirmation {
+		return out.Subject, confirmationEmail(out, g, slot), nil
+	}
+	return out.Subject, out.Email(g, g.GetGuestURL()), nil
+}
+
+// EmailChangeSubject is the subject line of the EmailChangeEmail
+func EmailChangeSubject(lang string) string {
+	return i18n.T(lang, "email.change.subject", config.EventName)
+}
+
+// EmailChangeEmail is sent to the new address when a guest changes their email, link confirms the change
+func EmailChangeEmail(lang, newEmail, link string) hermes.Email {
 	return hermes.Email{
 		Body: hermes.Body{
-			Name: g.Email,
-			Intros: []string{
-				"You have received this email to confirm your ticket for " + config.EventName,
+			Name:     newEmail,
+			Greeting: i18n.T(lang, "email.greeting"),
+			Intros: intros(
+				i18n.T(lang, "email.change.intro", config.EventName),
+			),
+			Actions: []hermes.Action{
+				{
+					Instructions: i18n.T(lang, "email.change.instructions"),
+					Button: hermes.Button{
+						Color: buttonColor(),
+						Text:  i18n.T(lang, "email.change.button"),
+						Link:  link,
+					},
+				},
 			},
-			Actions: actions,
 			Outros: []string{
-				"If you did not request this reservation no further action is required on your part and you will not be sent further emails or added to an email list.",
+				i18n.T(lang, "email.change.outro"),
 			},
-			Signature: "Merry Christmas!",
+			Signature: signature(lang),
 		},
 	}
 }
 
-func ExpirationEmail(g Guest, slot time.Time) hermes.Email {
+// GroupCoordinatorSubject is the subject line of the GroupCoordinatorEmail
+func GroupCoordinatorSubject(lang string, g Group) string {
+	return i18n.T(lang, "email.group_coordinator.subject", g.Name, config.EventName)
+}
+
+// GroupCoordinatorEmail sends the coordinator the link to their group's portal
+func GroupCoordinatorEmail(lang string, g Group) hermes.Email {
 	return hermes.Email{
 		Body: hermes.Body{
-			Name: g.Email,
-			Intros: []string{
-				fmt.Sprintf("Your %s ticket request for %s has expired.  If you would still like a ticket, use the link below to select a ticket and then be sure to click the confirmation link sent to you.  If you do not click the confirmation link, your ticket will expire.", config.EventName, slot.Format("Jan 02, 3:04pm")),
-			},
+			Name:     g.CoordinatorEmail,
+			Greeting: i18n.T(lang, "email.greeting"),
+			Intros: intros(
+				i18n.T(lang, "email.group_coordinator.intro", g.Name, g.MaxSeats, config.EventName),
+			),
 			Actions: []hermes.Action{
 				{
-					Instructions: "To get another ticket, or to view your tickets:",
+					Instructions: i18n.T(lang, "email.group_coordinator.instructions"),
 					Button: hermes.Button{
-						Color: "#0F8A5F",
-						Text:  "Get | View Tickets",
-						Link:  g.GetGuestURL(),
+						Color: buttonColor(),
+						Text:  i18n.T(lang, "email.group_coordinator.button"),
+						Link:  g.GetPortalURL(),
 					},
 				},
 			},
 			Outros: []string{
-				"If you did not request this ticket no further action is required on your part and you will not be sent further emails or added to an email list.",
+				i18n.T(lang, "email.group_coordinator.outro"),
+			},
+			Signature: signature(lang),
+		},
+	}
+}
+
+// GroupInviteSubject is the subject line of the GroupInviteEmail
+func GroupInviteSubject(lang string, g Group) string {
+	return i18n.T(lang, "email.group_invite.subject", g.Name, config.EventName)
+}
+
+// GroupInviteEmail invites a member to claim one of the group's seats
+func GroupInviteEmail(lang string, g Group, email string) hermes.Email {
+	return hermes.Email{
+		Body: hermes.Body{
+			Name:     email,
+			Greeting: i18n.T(lang, "email.greeting"),
+			Intros: intros(
+				i18n.T(lang, "email.group_invite.intro", g.Name, config.EventName, i18n.FormatTime(lang, g.Slot.In(config.Location), "format.slot")),
+			),
+			Actions: []hermes.Action{
+				{
+					Instructions: i18n.T(lang, "email.group_invite.instructions"),
+					Button: hermes.Button{
+						Color: buttonColor(),
+						Text:  i18n.T(lang, "email.group_invite.button"),
+						Link:  g.GetShareURL(),
+					},
+				},
 			},
-			Signature: "Merry Christmas!",
+			Signature: signature(lang),
 		},
 	}
 }
@@ -107,8 +262,17 @@ type mailerHelper struct {
 	sender gomail.SendCloser
 }
 
-func (m *mailerHelper) Send(address, subject string, email hermes.Email) error {
+// Attachment is a file attached to an email
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Send emails address, lang is the language of the email's footer
+func (m *mailerHelper) Send(lang, address, subject string, email hermes.Email, attachments ...Attachment) error {
 	// Generate an HTML email with the provided contents (for modern clients)
+	mailer := newMailer(lang)
 	htmlpart, err := mailer.GenerateHTML(email)
 	if err != nil {
 		return err
@@ -124,6 +288,15 @@ func (m *mailerHelper) Send(address, subject string, email hermes.Email) error {
 	msg.SetHeader("Subject", subject)
 	msg.SetBody("text/plain", textpart)
 	msg.AddAlternative("text/html", htmlpart)
+	for _, a := range attachments {
+		data := a.Data
+		msg.Attach(a.Name,
+			gomail.SetHeader(map[string][]string{"Content-Type": {a.ContentType}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}))
+	}
 
 	log.Println("sending email to ", msg.GetHeader("To"))
 	if smtpConfig.Hostname == "" {
@@ -154,12 +327,19 @@ func (m *mailerHelper) Send(address, subject string, email hermes.Email) error {
 		m.sender.Close()
 		m.sender = nil
 		m.sync.Unlock()
-		return m.Send(address, subject, email)
+		return m.Send(lang, address, subject, email, attachments...)
 	}
 	m.sync.Unlock()
 	return err
 }
 
+// SendGuest sends an email to the guest and records it in the guest's email history
+func (m *mailerHelper) SendGuest(g Guest, subject string, email hermes.Email, attachments ...Attachment) error {
+	err := m.Send(g.Language, g.Email, subject, email, attachments...)
+	Repo.LogEmail(g.ID, g.Email, subject, err)
+	return err
+}
+
 type smtpconfig struct {
 	Hostname, Username, Password string
 	Port                         int
@@ -0,0 +1,270 @@
+package tickets
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/lib/pq"
+)
+
+// EmailError is returned when an email address is rejected, Suggestion is set when the domain looks like a typo
+type EmailError struct {
+	Key        string // the i18n catalog message
+	Args       []interface{}
+	Suggestion string
+}
+
+func (e *EmailError) Error() string {
+	return i18n.T(i18n.Default, e.Key, e.Args...)
+}
+
+// Translate is the error in lang, see i18n.Message
+func (e *EmailError) Translate(lang string) string {
+	return i18n.T(lang, e.Key, e.Args...)
+}
+
+// CommonEmailDomains are checked for typos, ie gmial.com suggests gmail.com
+var CommonEmailDomains = []string{
+	"gmail.com", "yahoo.com", "hotmail.com", "outlook.com", "icloud.com", "aol.com", "live.com",
+	"msn.com", "me.com", "mac.com", "comcast.net", "sbcglobal.net", "att.net", "verizon.net",
+	"cox.net", "charter.net", "protonmail.com", "ymail.com", "rocketmail.com",
+}
+
+// MXResolver looks up mail servers (and the addresses of domains without any) for a domain,
+// net.DefaultResolver satisfies it
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// EmailResolver checks email domains accept mail, nil (the default) skips the check.
+// Enable with ADVLIGHT_EMAIL_MX=true
+var EmailResolver MXResolver
+
+// EmailResolverTimeout limits how long an MX lookup can hold up a booking
+var EmailResolverTimeout = 3 * time.Second
+
+func init() {
+	if os.Getenv("ADVLIGHT_EMAIL_MX") == "true" {
+		EmailResolver = net.DefaultResolver
+	}
+}
+
+// ParseEmail parses an RFC 5322 address (without a display name) and returns it lower cased
+func ParseEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || !strings.EqualFold(addr.Address, email) {
+		return "", &EmailError{Key: "error.email_invalid"}
+	}
+	domain := emailDomain(addr.Address)
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, "[") || strings.HasSuffix(domain, ".") {
+		return "", &EmailError{Key: "error.email_domain_invalid"}
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// SuggestEmail returns the email with a common domain when its domain looks like a typo of one, or ""
+func SuggestEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	domain := strings.ToLower(email[at+1:])
+	best, bestDist := "", 3
+	for _, d := range CommonEmailDomains {
+		if domain == d {
+			return ""
+		}
+		if dist := editDistance(domain, d); dist < bestDist {
+			best, bestDist = d, dist
+		}
+	}
+	// short domains are too close to each other to guess (ie me.com vs mac.com)
+	if best == "" || (bestDist > 1 && len(domain) < 8) {
+		return ""
+	}
+	return email[:at+1] + best
+}
+
+// editDistance is the Damerau-Levenshtein (optimal string alignment) distance, so swapped letters count once
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func minInt(n int, rest ...int) int {
+	for _, m := range rest {
+		if m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+func emailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+// CheckEmailMX returns an error if the resolver says the email domain does not accept mail.  A domain without MX
+// records receives mail at its A/AAAA address (RFC 5321 5.1), so it is only rejected when that is not found either.
+// Lookup failures other than not found let the email through, DNS trouble should not stop bookings.
+func CheckEmailMX(resolver MXResolver, email string) error {
+	if resolver == nil {
+		return nil
+	}
+	domain := emailDomain(email)
+	ctx, cancel := context.WithTimeout(context.Background(), EmailResolverTimeout)
+	defer cancel()
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		_, err = resolver.LookupHost(ctx, domain)
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return &EmailError{Key: "error.email_no_mail", Args: []interface{}{domain}}
+		}
+		if err != nil {
+			log.Printf("CheckEmailMX %s %v", domain, err)
+		}
+		return nil
+	}
+	if err != nil {
+		log.Printf("CheckEmailMX %s %v", domain, err)
+		return nil
+	}
+	// a null MX (RFC 7505) means the domain never accepts mail
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return &EmailError{Key: "error.email_no_mail", Args: []interface{}{domain}}
+	}
+	return nil
+}
+
+// FakeResolver is an MXResolver for tests, domains not in MX or Hosts are not found
+type FakeResolver struct {
+	MX    map[string][]*net.MX
+	Hosts map[string][]string
+}
+
+func (f *FakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := f.MX[strings.TrimSuffix(name, ".")]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mxs, nil
+}
+
+func (f *FakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, ok := f.Hosts[strings.TrimSuffix(host, ".")]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// BlockedDomain is a disposable or abusive email domain guests can not book with
+type BlockedDomain struct {
+	Domain    string
+	CreatedAt time.Time
+	Note      string
+}
+
+// GetBlockedDomains returns the email domain blocklist
+func (r *repo) GetBlockedDomains() ([]BlockedDomain, error) {
+	rows, err := r.db.Query(`select domain,created_at,note from blocked_email_domains order by domain;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	domains := make([]BlockedDomain, 0)
+	for rows.Next() {
+		d := BlockedDomain{}
+		err = rows.Scan(&d.Domain, &d.CreatedAt, &d.Note)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// BlockDomains adds domains to the blocklist, existing domains have their note updated
+func (r *repo) BlockDomains(a Actor, domains []string, note string) error {
+	log.Printf("BlockDomains %s %v %s", a, domains, note)
+	for _, d := range domains {
+		_, err := r.db.Exec(`
+			insert into blocked_email_domains(domain,note) values($1,$2)
+			on conflict (domain) do update set note=excluded.note;`, d, note)
+		if err != nil {
+			return err
+		}
+		r.Audit(a, AuditEntry{Action: AuditBlockDomain, After: d})
+	}
+	return nil
+}
+
+// UnblockDomain removes a domain from the blocklist
+func (r *repo) UnblockDomain(a Actor, domain string) error {
+	log.Printf("UnblockDomain %s %s", a, domain)
+	res, err := r.db.Exec(`delete from blocked_email_domains where domain=$1;`, domain)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		r.Audit(a, AuditEntry{Action: AuditUnblockDomain, Before: domain})
+	}
+	return nil
+}
+
+// domainBlocked checks the domain and its parents (a blocked mailinator.com blocks x.mailinator.com)
+func (r *repo) domainBlocked(domain string) (bool, error) {
+	parents := []string{domain}
+	for i := strings.Index(domain, "."); i >= 0 && strings.Contains(domain[i+1:], "."); i = strings.Index(domain, ".") {
+		domain = domain[i+1:]
+		parents = append(parents, domain)
+	}
+	var blocked bool
+	err := r.db.QueryRow(`select exists(select 1 from blocked_email_domains where domain = any($1::citext[]));`,
+		pq.Array(parents)).Scan(&blocked)
+	return blocked, err
+}
+
+// CheckEmail parses the email and checks it against the blocklist and (when enabled) its mail servers,
+// returning the normalized address
+func (r *repo) CheckEmail(email string) (string, error) {
+	email, err := ParseEmail(email)
+	if err != nil {
+		return "", err
+	}
+	blocked, err := r.domainBlocked(emailDomain(email))
+	if err != nil {
+		return "", err
+	}
+	if blocked {
+		return "", &EmailError{Key: "error.email_disposable"}
+	}
+	return email, CheckEmailMX(EmailResolver, email)
+}
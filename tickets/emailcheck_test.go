@@ -0,0 +1,77 @@
+package tickets
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEmail(t *testing.T) {
+	for in, want := range map[string]string{
+		"Guest@Example.com ":      "guest@example.com",
+		"first.last+xmas@a.b.org": "first.last+xmas@a.b.org",
+	} {
+		got, err := ParseEmail(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	for _, in := range []string{"", "guest", "guest@", "@example.com", "guest@localhost", "a@b@example.com",
+		"Guest <guest@example.com>", "guest@example.com.", "guest@[127.0.0.1]", "guest@example..com", `"quoted name"@example.com`} {
+		_, err := ParseEmail(in)
+		assert.Error(t, err, in)
+		assert.IsType(t, &EmailError{}, err, in)
+	}
+	// email errors are shown in the guest's language
+	_, err := ParseEmail("guest")
+	assert.Equal(t, "invalid email address", err.Error())
+	assert.Equal(t, "correo electrónico inválido", i18n.Message("es", err))
+}
+
+func TestSuggestEmail(t *testing.T) {
+	for in, want := range map[string]string{
+		"guest@gmial.com":     "guest@gmail.com",
+		"guest@gmail.con":     "guest@gmail.com",
+		"guest@yaho.com":      "guest@yahoo.com",
+		"guest@hotmial.com":   "guest@hotmail.com",
+		"guest@outlok.com":    "guest@outlook.com",
+		"guest@gmail.com":     "",
+		"guest@example.com":   "",
+		"guest@adventure.org": "",
+		"guest@mac.com":       "",
+		"guest@me.org":        "",
+	} {
+		assert.Equal(t, want, SuggestEmail(in), in)
+	}
+	assert.Equal(t, 1, editDistance("gmial", "gmail"))
+	assert.Equal(t, 0, editDistance("", ""))
+	assert.Equal(t, 3, editDistance("abc", ""))
+}
+
+type errResolver struct{}
+
+func (errResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, fmt.Errorf("timeout")
+}
+
+func (errResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, fmt.Errorf("timeout")
+}
+
+func TestCheckEmailMX(t *testing.T) {
+	resolver := &FakeResolver{MX: map[string][]*net.MX{
+		"example.com": {{Host: "mx.example.com.", Pref: 10}},
+		"nomail.com":  {{Host: ".", Pref: 0}},
+	}, Hosts: map[string][]string{
+		"addressonly.com": {"192.0.2.1"},
+	}}
+	assert.NoError(t, CheckEmailMX(nil, "guest@missing.com"), "no resolver skips the check")
+	assert.NoError(t, CheckEmailMX(resolver, "guest@example.com"))
+	assert.Error(t, CheckEmailMX(resolver, "guest@missing.com"))
+	assert.Error(t, CheckEmailMX(resolver, "guest@nomail.com"))
+	assert.NoError(t, CheckEmailMX(resolver, "guest@addressonly.com"), "domains without MX records receive mail at their address")
+	assert.NoError(t, CheckEmailMX(errResolver{}, "guest@example.com"), "lookup errors should not block guests")
+}
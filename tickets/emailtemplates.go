@@ -0,0 +1,297 @@
+package tickets
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/theme"
+	"github.com/matcornic/hermes"
+)
+
+// email templates organizers can edit in admin
+const (
+	EmailConfirmation = "confirmation"
+	EmailExpiration   = "expiration"
+)
+
+// EmailTemplateNames are the editable emails
+var EmailTemplateNames = []string{EmailConfirmation, EmailExpiration}
+
+// EmailTemplate is the wording of an email in one language.  Fields are text/template with EmailData,
+// ie "Your {{.EventName}} ticket for {{.Slot}}", intros and outros are split into paragraphs on blank lines.
+type EmailTemplate struct {
+	ID           int64
+	Name         string // EmailConfirmation or EmailExpiration
+	Lang         string
+	Version      int // 0 is the built in default
+	Subject      string
+	Intro        string
+	Instructions string
+	Button       string
+	ButtonColor  string // "" for the theme's button color
+	Outro        string
+	CreatedAt    time.Time
+	CreatedBy    string
+}
+
+// EmailData are the placeholders available in email templates
+type EmailData struct {
+	Email        string // the guest's email
+	EventName    string
+	EventAddress string
+	Slot         string // the ticket time in the guest's language, ie Dec 02, 7:30pm
+	TicketURL    string
+	GuestURL     string // the guest's tickets
+	DonateLink   string // tracked, see DonateURL
+}
+
+// NewEmailData fills in the placeholders for the guest's ticket
+func NewEmailData(g Guest, slot time.Time) EmailData {
+	return EmailData{
+		Email:        g.Email,
+		EventName:    config.EventName,
+		EventAddress: config.EventAddress,
+		Slot:         i18n.FormatTime(g.Language, slot, "format.slot"),
+		TicketURL:    g.GetTicketURL(slot),
+		GuestURL:     g.GetGuestURL(),
+		DonateLink:   DonateURL(&g, DonateSourceEmail),
+	}
+}
+
+// DefaultEmailTemplate is the built in wording from the i18n catalog
+func DefaultEmailTemplate(name, lang string) EmailTemplate {
+	et := EmailTemplate{Name: name, Lang: lang}
+	switch name {
+	case EmailConfirmation:
+		et.Subject = i18n.T(lang, "email.confirm.subject", "{{.EventName}}")
+		et.Intro = i18n.T(lang, "email.confirm.intro", "{{.EventName}}")
+		et.Instructions = i18n.T(lang, "email.confirm.instructions")
+		et.Button = i18n.T(lang, "email.confirm.button")
+		et.Outro = i18n.T(lang, "email.confirm.outro")
+	case EmailExpiration:
+		et.Subject = i18n.T(lang, "email.expired.subject", "{{.EventName}}", "{{.Slot}}")
+		et.Intro = i18n.T(lang, "email.expired.intro", "{{.EventName}}", "{{.Slot}}")
+		et.Instructions = i18n.T(lang, "email.expired.instructions")
+		et.Button = i18n.T(lang, "email.expired.button")
+		et.Outro = i18n.T(lang, "email.expired.outro")
+	}
+	return et
+}
+
+// fields are the editable fields, for parsing and rendering them together
+func (et *EmailTemplate) fields() []*string {
+	return []*string{&et.Subject, &et.Intro, &et.Instructions, &et.Button, &et.Outro}
+}
+
+// Render fills in the placeholders
+func (et EmailTemplate) Render(data EmailData) (EmailTemplate, error) {
+	out := et
+	for _, f := range out.fields() {
+		t, err := template.New(et.Name).Option("missingkey=error").Parse(*f)
+		if err != nil {
+			return et, err
+		}
+		var buf bytes.Buffer
+		err = t.Execute(&buf, data)
+		if err != nil {
+			return et, err
+		}
+		*f = buf.String()
+	}
+	return out, nil
+}
+
+// Validate checks the template is complete and renders with sample data
+func (et EmailTemplate) Validate() error {
+	if !isEmailTemplate(et.Name) {
+		return fmt.Errorf("unknown email %q", et.Name)
+	}
+	if !i18n.Supported(et.Lang) {
+		return fmt.Errorf("%q is not a supported language", et.Lang)
+	}
+	if strings.TrimSpace(et.Subject) == "" || strings.TrimSpace(et.Button) == "" {
+		return fmt.Errorf("a subject and button text are required")
+	}
+	if et.ButtonColor != "" && !theme.ValidColor(et.ButtonColor) {
+		return fmt.Errorf("invalid button color %q, use a color like #4CAF50", et.ButtonColor)
+	}
+	_, err := et.Render(SampleEmailData(et.Lang))
+	return err
+}
+
+// SampleEmailData is used to validate and preview templates
+func SampleEmailData(lang string) EmailData {
+	g := Guest{ID: "00000000-0000-0000-0000-000000000000", Email: "guest@example.com", Language: lang}
+	y := time.Now().In(config.Location).Year()
+	return NewEmailData(g, time.Date(y, 12, 10, 19, 0, 0, 0, config.Location))
+}
+
+func isEmailTemplate(name string) bool {
+	for _, n := range EmailTemplateNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// paragraphs splits text on blank lines
+func paragraphs(text string) []string {
+	list := make([]string, 0)
+	for _, p := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// Email builds the hermes email from a rendered template, link is the main button's link
+func (et EmailTemplate) Email(g Guest, link string, extra ...hermes.Action) hermes.Email {
+	color := et.ButtonColor
+	if color == "" {
+		color = buttonColor()
+	}
+	actions := append([]hermes.Action{
+		{
+			Instructions: et.Instructions,
+			Button: hermes.Button{
+				Color: color,
+				Text:  et.Button,
+				Link:  link,
+			},
+		},
+	}, extra...)
+	return hermes.Email{
+		Body: hermes.Body{
+			Name:      g.Email,
+			Greeting:  i18n.T(g.Language, "email.greeting"),
+			Intros:    intros(paragraphs(et.Intro)...),
+			Actions:   actions,
+			Outros:    paragraphs(et.Outro),
+			Signature: signature(g.Language),
+		},
+	}
+}
+
+// GetEmailTemplate returns the newest version of an email in lang, or the default when organizers have not edited it.
+// Guests without a supported language (ie "" for guests from before languages, or walk-ups) get the default
+// language's.  Cached until ClearCache.
+func (r *repo) GetEmailTemplate(name, lang string) (EmailTemplate, error) {
+	if !i18n.Supported(lang) {
+		lang = i18n.Default
+	}
+	key := name + "/" + lang
+	r.sync.Lock()
+	cached, ok := r.cache.emailTemplates[key]
+	r.sync.Unlock()
+	if ok {
+		return cached, nil
+	}
+	versions, err := r.getEmailTemplates(name, lang, 1)
+	if err != nil {
+		return EmailTemplate{}, err
+	}
+	et := DefaultEmailTemplate(name, lang)
+	if len(versions) > 0 {
+		et = versions[0]
+	}
+	r.sync.Lock()
+	if r.cache.emailTemplates == nil {
+		r.cache.emailTemplates = make(map[string]EmailTemplate)
+	}
+	r.cache.emailTemplates[key] = et
+	r.sync.Unlock()
+	return et, nil
+}
+
+// GetEmailTemplateVersions returns the saved versions of an email in lang, newest first
+func (r *repo) GetEmailTemplateVersions(name, lang string) ([]EmailTemplate, error) {
+	return r.getEmailTemplates(name, lang, 100)
+}
+
+func (r *repo) getEmailTemplates(name, lang string, limit int) ([]EmailTemplate, error) {
+	rows, err := r.db.Query(`select id,name,lang,version,subject,intro,instructions,button,button_color,outro,created_at,created_by
+		from email_templates where name=$1 and lang=$2 order by version desc limit $3;`, name, lang, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]EmailTemplate, 0)
+	for rows.Next() {
+		var et EmailTemplate
+		err = rows.Scan(&et.ID, &et.Name, &et.Lang, &et.Version, &et.Subject, &et.Intro, &et.Instructions, &et.Button, &et.ButtonColor, &et.Outro, &et.CreatedAt, &et.CreatedBy)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, et)
+	}
+	return list, nil
+}
+
+// SaveEmailTemplate validates and saves the template as a new version, which is used from now on
+func (r *repo) SaveEmailTemplate(a Actor, et EmailTemplate) (EmailTemplate, error) {
+	log.Printf("SaveEmailTemplate %s %s %s", a, et.Name, et.Lang)
+	err := et.Validate()
+	if err != nil {
+		return et, err
+	}
+	err = r.db.QueryRow(`insert into email_templates(name,lang,version,subject,intro,instructions,button,button_color,outro,created_by)
+		select $1,$2,coalesce(max(version),0)+1,$3,$4,$5,$6,$7,$8,$9 from email_templates where name=$1 and lang=$2
+		returning id,version,created_at;`,
+		et.Name, et.Lang, et.Subject, et.Intro, et.Instructions, et.Button, et.ButtonColor, et.Outro, a.String()).
+		Scan(&et.ID, &et.Version, &et.CreatedAt)
+	if err != nil {
+		return et, err
+	}
+	et.CreatedBy = a.String()
+	r.Audit(a, AuditEntry{Action: AuditEmailTemplate, Before: et.Name + "/" + et.Lang, After: fmt.Sprintf("version %d", et.Version)})
+	r.ClearCache()
+	return et, nil
+}
+
+// RestoreEmailTemplate rolls back to an earlier version by saving a copy of it as the newest version,
+// version 0 restores the built in default
+func (r *repo) RestoreEmailTemplate(a Actor, name, lang string, version int) (EmailTemplate, error) {
+	log.Printf("RestoreEmailTemplate %s %s %s %d", a, name, lang, version)
+	et := DefaultEmailTemplate(name, lang)
+	if version > 0 {
+		versions, err := r.GetEmailTemplateVersions(name, lang)
+		if err != nil {
+			return et, err
+		}
+		found := false
+		for _, v := range versions {
+			if v.Version == version {
+				et, found = v, true
+			}
+		}
+		if !found {
+			return et, fmt.Errorf("%s version %d not found", name, version)
+		}
+	}
+	return r.SaveEmailTemplate(a, et)
+}
+
+// emailTemplate renders the organizer's template (or the default) for the guest.  A template that fails
+// to render falls back to the default so the email is still sent.
+func emailTemplate(name string, g Guest, slot time.Time) EmailTemplate {
+	data := NewEmailData(g, slot)
+	et, err := Repo.GetEmailTemplate(name, g.Language)
+	if err != nil {
+		log.Println("emailTemplate", name, g.Language, err)
+		et = DefaultEmailTemplate(name, g.Language)
+	}
+	out, err := et.Render(data)
+	if err != nil {
+		log.Printf("[ERROR] emailTemplate %s %s version %d: %v", name, g.Language, et.Version, err)
+		out, _ = DefaultEmailTemplate(name, g.Language).Render(data)
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultEmailTemplates(t *testing.T) {
+	for _, l := range i18n.Languages() {
+		for _, name := range EmailTemplateNames {
+			et := DefaultEmailTemplate(name, l.Code)
+			assert.NoError(t, et.Validate(), name+"/"+l.Code)
+		}
+	}
+	// the defaults read the same as the catalog once filled in
+	slot := time.Date(2019, 12, 2, 19, 30, 0, 0, config.Location)
+	g := Guest{ID: "00000000-0000-0000-0000-000000000000", Email: "guest@example.com", Language: "es"}
+	out, err := DefaultEmailTemplate(EmailExpiration, "es").Render(NewEmailData(g, slot))
+	assert.NoError(t, err)
+	assert.Equal(t, i18n.T("es", "email.expired.subject", config.EventName, i18n.FormatTime("es", slot, "format.slot")), out.Subject)
+	// without a database the default is sent
+	assert.Equal(t, out.Subject, ExpirationSubject(g, slot))
+}
+
+func TestGetEmailTemplateUnsupportedLanguage(t *testing.T) {
+	// the organizer's template saved in the default language, from the cache so no database is needed
+	saved := DefaultEmailTemplate(EmailConfirmation, i18n.Default)
+	saved.Subject = "Your tickets are ready"
+	r := &repo{}
+	r.cache.emailTemplates = map[string]EmailTemplate{EmailConfirmation + "/" + i18n.Default: saved}
+	for _, lang := range []string{"", "xx"} {
+		et, err := r.GetEmailTemplate(EmailConfirmation, lang)
+		assert.NoError(t, err, lang)
+		assert.Equal(t, saved.Subject, et.Subject, lang)
+	}
+}
+
+func TestEmailTemplateRender(t *testing.T) {
+	slot := time.Date(2019, 12, 2, 19, 30, 0, 0, config.Location)
+	g := Guest{ID: "00000000-0000-0000-0000-000000000000", Email: "guest@example.com"}
+	et := EmailTemplate{
+		Name:    EmailConfirmation,
+		Lang:    "en",
+		Subject: "Your {{.EventName}} ticket for {{.Slot}}",
+		Intro:   "Hi {{.Email}}!\n\nSee you at {{.EventAddress}}.",
+		Button:  "Open",
+		Outro:   "<b>bye</b>",
+	}
+	out, err := et.Render(NewEmailData(g, slot))
+	assert.NoError(t, err)
+	assert.Equal(t, "Your "+config.EventName+" ticket for Dec 02, 7:30pm", out.Subject)
+
+	email := out.Email(g, g.GetTicketURL(slot))
+	assert.Equal(t, []string{"Hi guest@example.com!", "See you at " + config.EventAddress + "."}, email.Body.Intros)
+	assert.Equal(t, g.GetTicketURL(slot), email.Body.Actions[0].Button.Link)
+	assert.Equal(t, buttonColor(), email.Body.Actions[0].Button.Color)
+
+	html, err := EmailHTML("en", email)
+	assert.NoError(t, err)
+	assert.NotContains(t, html, "<b>bye</b>", "template text is escaped")
+}
+
+func TestEmailTemplateValidate(t *testing.T) {
+	et := DefaultEmailTemplate(EmailConfirmation, "en")
+	et.Subject = "{{.Nope}}"
+	assert.Error(t, et.Validate(), "unknown placeholder")
+	et.Subject = "{{.EventName"
+	assert.Error(t, et.Validate(), "unclosed placeholder")
+	et = DefaultEmailTemplate(EmailConfirmation, "en")
+	et.ButtonColor = "red;}body{display:none"
+	assert.Error(t, et.Validate())
+	et.ButtonColor = "#4CAF50"
+	assert.NoError(t, et.Validate())
+	et.Lang = "xx"
+	assert.Error(t, et.Validate())
+	assert.Error(t, DefaultEmailTemplate("welcome", "en").Validate())
+}
+
+func TestParagraphs(t *testing.T) {
+	assert.Equal(t, []string{"one\ntwo", "three"}, paragraphs("one\r\ntwo\r\n\r\n\r\n  three  \n"))
+	assert.Empty(t, paragraphs(" \n\n "))
+}
@@ -0,0 +1,232 @@
+package tickets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/lib/pq"
+)
+
+// EventCodeMaxFailures is the number of invalid event codes an address (or guest) may try within
+// EventCodeLockout before code entry is locked
+var EventCodeMaxFailures = 5
+
+// EventCodeLockout is the window failures are counted in, and how long a lockout lasts
+var EventCodeLockout = 30 * time.Minute
+
+// ErrEventCodeLockedOut is returned when too many invalid event codes have been tried
+var ErrEventCodeLockedOut = i18n.Errorf("error.event_code_locked_out")
+
+// EventCode is an event code with its settings and ticket counts, for the admin screens
+type EventCode struct {
+	Code             string
+	EmailDomains     []string
+	NumberTickets    int64
+	AvailableTickets int64
+}
+
+// EventCodeAttempt is a failed attempt to use an event code
+type EventCodeAttempt struct {
+	CreatedAt time.Time
+	Code      string
+	GuestID   string
+	IPAddress string
+	UserAgent string
+	RequestID string
+}
+
+// RecordEventCodeFailure logs an invalid event code attempt, used for lockouts and the admin screens
+func (r *repo) RecordEventCodeFailure(a Actor, guestID, code string) error {
+	log.Printf("RecordEventCodeFailure %s %s %s", a, guestID, code)
+	_, err := r.db.Exec(`insert into eventcode_attempts(code,guest_id,ip_address,user_agent,request_id) values($1,NULLIF($2,'')::uuid,$3,$4,$5);`,
+		code, guestID, nullIP(a.IPAddress), a.UserAgent, a.RequestID)
+	return err
+}
+
+// EventCodeLockedOut checks if the address or guest has too many recent failed event code attempts
+func (r *repo) EventCodeLockedOut(ip, guestID string) (bool, error) {
+	var failures int
+	err := r.db.QueryRow(`
+		select count(*) from eventcode_attempts
+		where created_at > current_timestamp - $1 * interval '1 second'
+		and (ip_address = $2 or guest_id = NULLIF($3,'')::uuid);`,
+		int64(EventCodeLockout.Seconds()), nullIP(ip), guestID).Scan(&failures)
+	if err != nil {
+		return false, err
+	}
+	return failures >= EventCodeMaxFailures, nil
+}
+
+// GetEventCodeAttempts returns the most recent failed event code attempts
+func (r *repo) GetEventCodeAttempts(limit int) ([]EventCodeAttempt, error) {
+	rows, err := r.db.Query(`select created_at,code,coalesce(guest_id::text,''),coalesce(host(ip_address),''),user_agent,request_id from eventcode_attempts order by created_at desc limit $1;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := make([]EventCodeAttempt, 0)
+	for rows.Next() {
+		a := EventCodeAttempt{}
+		err = rows.Scan(&a.CreatedAt, &a.Code, &a.GuestID, &a.IPAddress, &a.UserAgent, &a.RequestID)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, nil
+}
+
+// GetEventCodes returns every event code used by tickets or configured in event_codes
+func (r *repo) GetEventCodes() ([]EventCode, error) {
+	rows, err := r.db.Query(`
+		select c.code, coalesce(e.email_domains,'{}'), coalesce(t.tickets,0), coalesce(t.available,0)
+		from (select event_code as code from tickets where event_code is not null union select code from event_codes) c
+		left join event_codes e on e.code=c.code
+		left join (
+			select event_code, count(*) as tickets, count(*) filter (where guest_id is null) as available
+			from tickets where event_code is not null group by event_code
+		) t on t.event_code=c.code
+		order by c.code;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	codes := make([]EventCode, 0)
+	for rows.Next() {
+		c := EventCode{}
+		err = rows.Scan(&c.Code, pq.Array(&c.EmailDomains), &c.NumberTickets, &c.AvailableTickets)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, nil
+}
+
+// ParseEmailDomains parses a comma or space separated list of domains (@ prefixes are ignored)
+func ParseEmailDomains(s string) []string {
+	domains := make([]string, 0)
+	for _, d := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		d = strings.TrimPrefix(strings.TrimSpace(strings.ToLower(d)), "@")
+		if d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// SetEventCodeDomains limits the event code to guests with emails at the domains, no domains removes the limit
+func (r *repo) SetEventCodeDomains(a Actor, code string, domains []string) error {
+	code = strings.TrimSpace(strings.ToLower(code))
+	log.Printf("SetEventCodeDomains %s %s %v", a, code, domains)
+	if code == "" {
+		return fmt.Errorf("event code is required")
+	}
+	var before []string
+	err := r.db.QueryRow(`select email_domains from event_codes where code=$1;`, code).Scan(pq.Array(&before))
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	_, err = r.db.Exec(`
+		insert into event_codes(code,email_domains) values($1,$2)
+		on conflict (code) do update set email_domains=excluded.email_domains;`, code, pq.Array(domains))
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{
+		Action:    AuditEventCodeDomains,
+		EventCode: code,
+		Before:    strings.Join(before, ","),
+		After:     strings.Join(domains, ","),
+	})
+	return nil
+}
+
+// CheckEventCodeEmail returns an error if the event code is limited to email domains the email is not at
+func (r *repo) CheckEventCodeEmail(code, email string) error {
+	code = strings.TrimSpace(strings.ToLower(code))
+	if code == "" {
+		return nil
+	}
+	var domains []string
+	err := r.db.QueryRow(`select email_domains from event_codes where code=$1;`, code).Scan(pq.Array(&domains))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return emailInDomains(email, domains)
+}
+
+func emailInDomains(email string, domains []string) error {
+	if len(domains) == 0 {
+		return nil
+	}
+	at := strings.LastIndex(email, "@")
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return nil
+		}
+	}
+	return i18n.Errorf("error.email_domain_limited", strings.Join(domains, ", @"))
+}
+
+// eventCodeCipher encrypts event codes in shareable links so the code itself is not shown
+func eventCodeCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte("eventcode:"), signingKey()...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EventCodeToken returns a signed, encrypted token for the event code, used in shareable links
+func EventCodeToken(code string) (string, error) {
+	aead, err := eventCodeCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, []byte(strings.TrimSpace(strings.ToLower(code))), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// ParseEventCodeToken returns the event code in a token created by EventCodeToken
+func ParseEventCodeToken(token string) (string, error) {
+	aead, err := eventCodeCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid event link")
+	}
+	code, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid event link")
+	}
+	return string(code), nil
+}
+
+// EventCodeLink is a shareable link that applies the event code without showing it
+func EventCodeLink(code string) (string, error) {
+	token, err := EventCodeToken(code)
+	if err != nil {
+		return "", err
+	}
+	return HostName + "/?ec=" + url.QueryEscape(token), nil
+}
@@ -0,0 +1,36 @@
+package tickets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventCodeToken(t *testing.T) {
+	token, err := EventCodeToken(" Staff ")
+	assert.NoError(t, err)
+	assert.NotContains(t, token, "staff")
+
+	code, err := ParseEventCodeToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "staff", code)
+
+	other, _ := EventCodeToken("staff")
+	assert.NotEqual(t, token, other, "tokens should not be guessable from each other")
+
+	_, err = ParseEventCodeToken(token[:len(token)-2] + "xx")
+	assert.Error(t, err)
+	_, err = ParseEventCodeToken("staff")
+	assert.Error(t, err)
+}
+
+func TestEventCodeDomains(t *testing.T) {
+	domains := ParseEmailDomains("@School.org, troop12.org\nexample.com")
+	assert.Equal(t, []string{"school.org", "troop12.org", "example.com"}, domains)
+
+	assert.NoError(t, emailInDomains("a@school.org", domains))
+	assert.NoError(t, emailInDomains("a@mail.school.org", domains))
+	assert.Error(t, emailInDomains("a@notschool.org", domains))
+	assert.Error(t, emailInDomains("a@gmail.com", domains))
+	assert.NoError(t, emailInDomains("a@gmail.com", nil))
+}
@@ -0,0 +1,122 @@
+package tickets
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TopicSlots is published when ticket availability may have changed, tickets assigned, released, created or expired
+const TopicSlots = "slots"
+
+// notifyChannel is the Postgres channel instances tell each other about changes on, see ListenEvents
+const notifyChannel = "advlight_events"
+
+// instanceID tells this process's notifications from other instances'
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Events is the in-process event bus, live pages subscribe to it
+var Events = &eventBus{subs: make(map[chan struct{}]string)}
+
+type eventBus struct {
+	sync.Mutex
+	subs map[chan struct{}]string // channel to topic
+}
+
+// Subscribe returns a channel that receives a value after one or more events on topic, events that happen while
+// the subscriber is busy are coalesced.  Call cancel when done.
+func (b *eventBus) Subscribe(topic string) (events <-chan struct{}, cancel func()) {
+	ch := make(chan struct{}, 1)
+	b.Lock()
+	b.subs[ch] = topic
+	b.Unlock()
+	return ch, func() {
+		b.Lock()
+		delete(b.subs, ch)
+		b.Unlock()
+	}
+}
+
+// Publish tells the topic's subscribers in this process, see repo.publish for every instance
+func (b *eventBus) Publish(topic string) {
+	b.Lock()
+	defer b.Unlock()
+	for ch, t := range b.subs {
+		if t != topic {
+			continue
+		}
+		select {
+		case ch <- struct{}{}:
+		default: // the subscriber has not handled the last event yet
+		}
+	}
+}
+
+// publish tells the topic's subscribers in this and, through Postgres NOTIFY, every other instance
+func (r *repo) publish(topic string) {
+	Events.Publish(topic)
+	_, err := r.db.Exec(`select pg_notify($1, $2);`, notifyChannel, topic+" "+instanceID)
+	if err != nil {
+		log.Println("publish", topic, err)
+	}
+}
+
+// ListenEvents relays the events other instances publish to this instance's subscribers, and drops the caches
+// they made stale.  It runs until the process exits, call it once from main.
+func ListenEvents() {
+	l := pq.NewListener(DatabaseURL, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("ListenEvents", ev, err)
+		}
+	})
+	err := l.Listen(notifyChannel)
+	if err != nil {
+		log.Println("ListenEvents", err)
+	}
+	go func() {
+		for {
+			select {
+			case n := <-l.Notify:
+				if n == nil {
+					// the connection was re-established, events may have been missed
+					Repo.relay(TopicSlots)
+					continue
+				}
+				topic, from := splitNotification(n.Extra)
+				if from != instanceID {
+					Repo.relay(topic)
+				}
+			case <-time.After(90 * time.Second):
+				go l.Ping()
+			}
+		}
+	}()
+}
+
+// relay publishes an event from another instance to this instance's subscribers
+func (r *repo) relay(topic string) {
+	if topic == TopicSlots {
+		r.clearCache() // the other instance changed the database under our cache
+	}
+	Events.Publish(topic)
+}
+
+// splitNotification is the topic and instance of a notification payload
+func splitNotification(payload string) (topic, from string) {
+	i := strings.LastIndex(payload, " ")
+	if i < 0 {
+		return payload, ""
+	}
+	return payload[:i], payload[i+1:]
+}
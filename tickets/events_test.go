@@ -0,0 +1,35 @@
+package tickets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	slots, cancel := Events.Subscribe(TopicSlots)
+	other, cancelOther := Events.Subscribe("other")
+	defer cancelOther()
+
+	// events published while the subscriber is busy are coalesced
+	Events.Publish(TopicSlots)
+	Events.Publish(TopicSlots)
+	assert.Len(t, slots, 1)
+	<-slots
+	assert.Len(t, slots, 0)
+	assert.Len(t, other, 0)
+
+	cancel()
+	Events.Publish(TopicSlots)
+	assert.Len(t, slots, 0)
+}
+
+func TestSplitNotification(t *testing.T) {
+	topic, from := splitNotification("slots " + instanceID)
+	assert.Equal(t, TopicSlots, topic)
+	assert.Equal(t, instanceID, from)
+
+	topic, from = splitNotification("slots")
+	assert.Equal(t, TopicSlots, topic)
+	assert.Equal(t, "", from)
+}
@@ -0,0 +1,85 @@
+package tickets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// FakePayments is a payment provider for development and tests, nothing is charged.  Its checkout is a local
+// page (/payments/fake/{ref}) with pay and decline buttons that post the webhook event.
+type FakePayments struct {
+	sync      sync.Mutex
+	checkouts map[string]Payment
+	refunds   []int64
+	next      int
+}
+
+// NewFakePayments creates an empty fake provider
+func NewFakePayments() *FakePayments {
+	return &FakePayments{checkouts: make(map[string]Payment)}
+}
+
+func (f *FakePayments) Name() string {
+	return "fake"
+}
+
+// CreateCheckout records the payment, url is the local fake checkout page
+func (f *FakePayments) CreateCheckout(p Payment, successURL, cancelURL string) (string, string, error) {
+	f.sync.Lock()
+	defer f.sync.Unlock()
+	f.next++
+	ref := "fake_" + strconv.Itoa(f.next)
+	f.checkouts[ref] = p
+	q := url.Values{"success": {successURL}, "cancel": {cancelURL}}
+	return ref, HostName + "/payments/fake/" + ref + "?" + q.Encode(), nil
+}
+
+// Checkout returns the payment of a checkout created by CreateCheckout
+func (f *FakePayments) Checkout(ref string) (Payment, bool) {
+	f.sync.Lock()
+	defer f.sync.Unlock()
+	p, ok := f.checkouts[ref]
+	return p, ok
+}
+
+// Event is the webhook body for a checkout being paid (or declined)
+func (f *FakePayments) Event(ref string, paid bool) []byte {
+	ev := PaymentEvent{Ref: ref, PaymentRef: "pay_" + ref, Status: PaymentFailed}
+	if paid {
+		ev.Status = PaymentPaid
+	}
+	body, _ := json.Marshal(ev)
+	return body
+}
+
+// ParseWebhook decodes a body from Event, fake events are not signed
+func (f *FakePayments) ParseWebhook(header http.Header, body []byte) (PaymentEvent, error) {
+	var ev PaymentEvent
+	err := json.Unmarshal(body, &ev)
+	if err != nil {
+		return ev, err
+	}
+	if _, ok := f.Checkout(ev.Ref); !ok {
+		return ev, fmt.Errorf("fake: unknown checkout %q", ev.Ref)
+	}
+	return ev, nil
+}
+
+// Refund records the refund
+func (f *FakePayments) Refund(p Payment) error {
+	f.sync.Lock()
+	defer f.sync.Unlock()
+	f.refunds = append(f.refunds, p.ID)
+	return nil
+}
+
+// Refunds are the ids of the payments refunded
+func (f *FakePayments) Refunds() []int64 {
+	f.sync.Lock()
+	defer f.sync.Unlock()
+	return append([]int64{}, f.refunds...)
+}
@@ -0,0 +1,441 @@
+package tickets
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/lib/pq"
+)
+
+// ErrInvalidGroupLink is returned for coordinator links that are tampered with
+var ErrInvalidGroupLink = i18n.Errorf("error.group_link_invalid")
+
+// MaxGroupSeats is the most seats an admin can give a group
+var MaxGroupSeats int64 = 500
+
+// MaxGroupInvites is the most emails a coordinator can invite at once
+var MaxGroupInvites = 100
+
+// GroupRelease is how long before the slot a group's unclaimed seats go back to general admission (run_expired),
+// coordinators can reserve seats until then.  Set with ADVLIGHT_GROUP_RELEASE=2d (or 12h), defaults to 2 days,
+// "off" keeps seats reserved until the slot.
+var GroupRelease = 48 * time.Hour
+
+func init() {
+	if cfg := strings.TrimSpace(os.Getenv("ADVLIGHT_GROUP_RELEASE")); cfg == "off" {
+		GroupRelease = 0
+	} else if cfg != "" {
+		d, err := ParseRetention(cfg)
+		if err != nil {
+			log.Panicf("invalid ADVLIGHT_GROUP_RELEASE(%v): %s", err, cfg)
+		}
+		GroupRelease = d
+	}
+}
+
+// Group is a church, school or troop booking together.  The coordinator reserves seats in a slot, which are general
+// admission tickets moved to the group's event code, and members claim them by booking with the group's link.
+type Group struct {
+	ID               string
+	CreatedAt        time.Time
+	Name             string
+	CoordinatorEmail string
+	EventCode        string
+	MaxSeats         int64     // set by the admin
+	Slot             time.Time // zero until seats are reserved
+	ReleaseAt        time.Time // unclaimed seats are released then, zero until seats are reserved
+	ReleasedAt       time.Time // zero until the unclaimed seats were released
+
+	Seats   int64 // reserved tickets, claimed or not
+	Claimed int64
+}
+
+// GroupMember is an invited email, a guest who claimed a seat, or both
+type GroupMember struct {
+	Email     string
+	InvitedAt time.Time // zero for guests who were sent the link by someone else
+	Claimed   bool
+	BookedAt  time.Time
+}
+
+// Unclaimed is the number of reserved seats no member has booked
+func (g Group) Unclaimed() int64 {
+	return g.Seats - g.Claimed
+}
+
+// Released is true once the group's unclaimed seats were returned at the deadline, no more seats can be reserved
+func (g Group) Released() bool {
+	return !g.ReleasedAt.IsZero()
+}
+
+// GetToken signs the group id for the coordinator's portal link
+func (g Group) GetToken() string {
+	return g.ID + "." + signGroup(g.ID)
+}
+
+// GetPortalURL is the coordinator's page to reserve seats, invite members and release seats
+func (g Group) GetPortalURL() string {
+	return HostName + "/groups/" + g.GetToken()
+}
+
+// GetShareURL is the link members book with, it applies the group's event code without showing it
+func (g Group) GetShareURL() string {
+	link, err := EventCodeLink(g.EventCode)
+	if err != nil {
+		log.Println("GetShareURL", g.ID, err)
+	}
+	return link
+}
+
+func signGroup(id string) string {
+	mac := hmac.New(sha256.New, signingKey())
+	mac.Write([]byte("group:" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseGroupToken returns the group id in a token created by Group.GetToken
+func ParseGroupToken(token string) (string, error) {
+	parts := strings.SplitN(strings.TrimSpace(token), ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signGroup(parts[0]))) {
+		return "", ErrInvalidGroupLink
+	}
+	return parts[0], nil
+}
+
+// newGroupCode is a random event code for a group, ie grp-k3x9q2ma
+func newGroupCode() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	return "grp-" + strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+// Validate normalizes the group's name and coordinator email
+func (g *Group) Validate() error {
+	g.Name = strings.TrimSpace(g.Name)
+	if g.Name == "" {
+		return fmt.Errorf("a group name is required")
+	}
+	email, err := ParseEmail(g.CoordinatorEmail)
+	if err != nil {
+		return err
+	}
+	g.CoordinatorEmail = email
+	if g.MaxSeats < 1 || g.MaxSeats > MaxGroupSeats {
+		return fmt.Errorf("groups can have 1 to %d seats", MaxGroupSeats)
+	}
+	return nil
+}
+
+// checkReserve returns an error if the coordinator can not reserve more seats in the slot
+func (g Group) checkReserve(slot time.Time, seats int64, now time.Time) error {
+	if g.Released() {
+		return i18n.Errorf("error.group_released", g.Name)
+	}
+	if seats < 1 {
+		return i18n.Errorf("error.group_reserve_one")
+	}
+	if g.Seats+seats > g.MaxSeats {
+		return i18n.Errorf("error.group_max_seats", g.Name, g.MaxSeats, g.Seats)
+	}
+	if g.Seats > 0 && !slot.Equal(g.Slot) {
+		return i18n.Errorf("error.group_moved")
+	}
+	if !now.Before(slot) {
+		return i18n.Errorf("error.group_time_passed")
+	}
+	if !now.Before(slot.Add(-GroupRelease)) {
+		return i18n.Errorf("error.group_deadline", int(GroupRelease.Hours()))
+	}
+	return nil
+}
+
+const groupColumns = `g.id,g.created_at,g.name,g.coordinator_email,g.event_code,g.max_seats,g.slot,g.release_at,g.released_at,count(t.num),count(t.guest_id)`
+
+func scanGroup(rows *sql.Rows) (Group, error) {
+	var (
+		g                         Group
+		slot, release, releasedAt pq.NullTime
+	)
+	err := rows.Scan(&g.ID, &g.CreatedAt, &g.Name, &g.CoordinatorEmail, &g.EventCode, &g.MaxSeats, &slot, &release, &releasedAt, &g.Seats, &g.Claimed)
+	g.Slot, g.ReleaseAt, g.ReleasedAt = slot.Time, release.Time, releasedAt.Time
+	return g, err
+}
+
+// GetGroups returns every group with its seat counts, newest first
+func (r *repo) GetGroups() ([]Group, error) {
+	rows, err := r.db.Query(`select ` + groupColumns + ` from booking_groups g left join tickets t on t.event_code=g.event_code
+		group by g.id order by g.created_at desc;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make([]Group, 0)
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// GetGroup returns the group with its seat counts
+func (r *repo) GetGroup(id string) (*Group, error) {
+	rows, err := r.db.Query(`select `+groupColumns+` from booking_groups g left join tickets t on t.event_code=g.event_code
+		where g.id=$1::uuid group by g.id;`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, i18n.Errorf("error.group_not_found")
+	}
+	g, err := scanGroup(rows)
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// CreateGroup saves a new group with its own event code, the coordinator reserves the seats from their portal
+func (r *repo) CreateGroup(a Actor, g *Group) error {
+	log.Printf("CreateGroup %s %s %s %d", a, g.Name, g.CoordinatorEmail, g.MaxSeats)
+	err := g.Validate()
+	if err != nil {
+		return err
+	}
+	g.EventCode = newGroupCode()
+	err = r.db.QueryRow(`insert into booking_groups(name,coordinator_email,event_code,max_seats) values($1,$2,$3,$4) returning id,created_at;`,
+		g.Name, g.CoordinatorEmail, g.EventCode, g.MaxSeats).Scan(&g.ID, &g.CreatedAt)
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{
+		Action:    AuditCreateGroup,
+		Email:     g.CoordinatorEmail,
+		EventCode: g.EventCode,
+		After:     fmt.Sprintf("%s, up to %d seats", g.Name, g.MaxSeats),
+	})
+	return nil
+}
+
+// ReserveGroupSeats moves seats general admission tickets in the slot to the group's event code
+func (r *repo) ReserveGroupSeats(a Actor, g *Group, slot time.Time, seats int64, now time.Time) error {
+	log.Printf("ReserveGroupSeats %s %s %s %d", a, g.ID, slot, seats)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	// checked against the group as it is now, locked so concurrent reserves (a double submit) wait for this one
+	err = lockGroup(tx, g)
+	if err == nil {
+		err = g.checkReserve(slot, seats, now)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec(`
+		update tickets set event_code=$1, updated_at=current_timestamp where (slot,num) in (
+			select slot,num from tickets where slot=$2 and event_code is null and guest_id is null and category='standard' and ticket_type is null
+			order by num limit $3 for update skip locked
+		);`, g.EventCode, slot, seats)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n < seats {
+		tx.Rollback()
+		return i18n.Errorf("error.group_seats_left", n)
+	}
+	var releaseAt interface{}
+	if GroupRelease > 0 {
+		releaseAt = slot.Add(-GroupRelease)
+	}
+	_, err = tx.Exec(`update booking_groups set slot=$2, release_at=$3 where id=$1;`, g.ID, slot, releaseAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{
+		Action:    AuditReserveGroup,
+		Slot:      slot,
+		EventCode: g.EventCode,
+		Before:    fmt.Sprintf("%d tickets", seats),
+		After:     g.Name,
+	})
+	g.Slot = slot
+	g.Seats += seats
+	if GroupRelease > 0 {
+		g.ReleaseAt = slot.Add(-GroupRelease)
+	}
+	r.ClearCache()
+	return nil
+}
+
+// lockGroup locks the group's row for the rest of tx and reloads its slot, deadlines and seat counts
+func lockGroup(tx *sql.Tx, g *Group) error {
+	var slot, release, releasedAt pq.NullTime
+	err := tx.QueryRow(`select max_seats,slot,release_at,released_at from booking_groups where id=$1 for update;`, g.ID).
+		Scan(&g.MaxSeats, &slot, &release, &releasedAt)
+	if err == sql.ErrNoRows {
+		return i18n.Errorf("error.group_not_found")
+	}
+	if err != nil {
+		return err
+	}
+	g.Slot, g.ReleaseAt, g.ReleasedAt = slot.Time, release.Time, releasedAt.Time
+	return tx.QueryRow(`select count(*), count(guest_id) from tickets where event_code=$1;`, g.EventCode).Scan(&g.Seats, &g.Claimed)
+}
+
+// ReleaseGroupSeats returns up to count (all when count is 0) unclaimed seats to general admission
+func (r *repo) ReleaseGroupSeats(a Actor, g *Group, count int64) (int64, error) {
+	log.Printf("ReleaseGroupSeats %s %s %d", a, g.ID, count)
+	limit := sql.NullInt64{Int64: count, Valid: count > 0}
+	res, err := r.db.Exec(`
+		update tickets set event_code=null, updated_at=current_timestamp where (slot,num) in (
+			select slot,num from tickets where event_code=$1 and guest_id is null order by num desc limit $2 for update
+		);`, g.EventCode, limit)
+	if err != nil {
+		return 0, err
+	}
+	released, _ := res.RowsAffected()
+	if released == 0 {
+		return 0, nil
+	}
+	r.Audit(a, AuditEntry{
+		Action:    AuditReleaseGroup,
+		Slot:      g.Slot,
+		EventCode: g.EventCode,
+		Before:    g.Name,
+		After:     fmt.Sprintf("%d tickets", released),
+	})
+	g.Seats -= released
+	r.ClearCache()
+	return released, nil
+}
+
+// ReleaseExpiredGroups releases the unclaimed seats of groups whose deadline has passed, for the expire sweep.  A
+// group is only marked released once its seats are, so a failed release is retried on the next sweep.
+func (r *repo) ReleaseExpiredGroups(a Actor, now time.Time) (int64, error) {
+	rows, err := r.db.Query(`select id from booking_groups where released_at is null and release_at<=$1;`, now)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	var total int64
+	for _, id := range ids {
+		g, err := r.GetGroup(id)
+		if err != nil {
+			return total, err
+		}
+		released, err := r.ReleaseGroupSeats(a, g, 0)
+		if err != nil {
+			return total, err
+		}
+		total += released
+		_, err = r.db.Exec(`update booking_groups set released_at=$2 where id=$1 and released_at is null;`, id, now)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ParseInvites splits a list of emails separated by commas, spaces or lines, every email must be valid
+func ParseInvites(s string) ([]string, error) {
+	emails := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, e := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' || r == ' ' || r == '\n' || r == '\r' || r == '\t' }) {
+		email, err := ParseEmail(e)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	if len(emails) == 0 {
+		return nil, i18n.Errorf("error.group_invite_none")
+	}
+	if len(emails) > MaxGroupInvites {
+		return nil, i18n.Errorf("error.group_invite_max", MaxGroupInvites)
+	}
+	return emails, nil
+}
+
+// InviteGroupMembers records the invited emails and returns the ones not already invited, which are emailed the group's link
+func (r *repo) InviteGroupMembers(a Actor, g *Group, emails []string) ([]string, error) {
+	log.Printf("InviteGroupMembers %s %s %d", a, g.ID, len(emails))
+	invited := make([]string, 0)
+	for _, email := range emails {
+		res, err := r.db.Exec(`insert into group_invites(group_id,email) values($1,$2) on conflict do nothing;`, g.ID, email)
+		if err != nil {
+			return invited, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			invited = append(invited, email)
+		}
+	}
+	if len(invited) > 0 {
+		r.Audit(a, AuditEntry{
+			Action:    AuditInviteGroup,
+			EventCode: g.EventCode,
+			Before:    g.Name,
+			After:     fmt.Sprintf("%d invited", len(invited)),
+		})
+	}
+	return invited, nil
+}
+
+// GetGroupMembers lists the invited emails and the guests who claimed seats, claimed first
+func (r *repo) GetGroupMembers(g *Group) ([]GroupMember, error) {
+	rows, err := r.db.Query(`
+		with invited as (
+			select email, invited_at from group_invites where group_id=$1
+		), claimed as (
+			select gu.email, t.booked_at from tickets t join guests gu on gu.id=t.guest_id where t.event_code=$2
+		) select coalesce(c.email,i.email), i.invited_at, c.email is not null, c.booked_at
+		from invited i full join claimed c on c.email=i.email
+		order by c.email is null, c.booked_at, i.invited_at, 1;`, g.ID, g.EventCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]GroupMember, 0)
+	for rows.Next() {
+		var (
+			m                 GroupMember
+			invitedAt, booked pq.NullTime
+		)
+		err = rows.Scan(&m.Email, &invitedAt, &m.Claimed, &booked)
+		if err != nil {
+			return nil, err
+		}
+		m.InvitedAt, m.BookedAt = invitedAt.Time, booked.Time
+		members = append(members, m)
+	}
+	return members, nil
+}
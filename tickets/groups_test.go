@@ -0,0 +1,76 @@
+package tickets
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupValidate(t *testing.T) {
+	g := Group{Name: " Troop 42 ", CoordinatorEmail: " Leader@Example.com ", MaxSeats: 20}
+	assert.NoError(t, g.Validate())
+	assert.Equal(t, "Troop 42", g.Name)
+	assert.Equal(t, "leader@example.com", g.CoordinatorEmail)
+
+	assert.Error(t, (&Group{CoordinatorEmail: "leader@example.com", MaxSeats: 20}).Validate())
+	assert.Error(t, (&Group{Name: "Troop 42", CoordinatorEmail: "leader", MaxSeats: 20}).Validate())
+	assert.Error(t, (&Group{Name: "Troop 42", CoordinatorEmail: "leader@example.com"}).Validate())
+	assert.Error(t, (&Group{Name: "Troop 42", CoordinatorEmail: "leader@example.com", MaxSeats: MaxGroupSeats + 1}).Validate())
+
+	assert.True(t, regexp.MustCompile(`^grp-[a-z2-7]{8}$`).MatchString(newGroupCode()))
+	assert.NotEqual(t, newGroupCode(), newGroupCode())
+}
+
+func TestGroupCheckReserve(t *testing.T) {
+	defer func(d time.Duration) { GroupRelease = d }(GroupRelease)
+	GroupRelease = 48 * time.Hour
+	now := time.Date(2019, 12, 1, 12, 0, 0, 0, time.UTC)
+	slot := now.Add(7 * 24 * time.Hour)
+
+	g := Group{Name: "Troop 42", MaxSeats: 20}
+	assert.NoError(t, g.checkReserve(slot, 20, now))
+	assert.Error(t, g.checkReserve(slot, 0, now))
+	assert.Error(t, g.checkReserve(slot, 21, now))
+	// seats are reserved until the release deadline
+	assert.Error(t, g.checkReserve(now.Add(24*time.Hour), 1, now))
+	assert.Error(t, g.checkReserve(now.Add(-time.Hour), 1, now))
+
+	// more seats are added to the same time
+	g.Slot, g.Seats = slot, 15
+	assert.NoError(t, g.checkReserve(slot, 5, now))
+	assert.EqualError(t, g.checkReserve(slot, 6, now), "Troop 42 can reserve up to 20 seats, 15 are reserved")
+	assert.Error(t, g.checkReserve(slot.Add(30*time.Minute), 1, now))
+
+	g.ReleasedAt = now
+	assert.Error(t, g.checkReserve(slot, 1, now))
+	assert.True(t, g.Released())
+
+	GroupRelease = 0
+	assert.NoError(t, Group{MaxSeats: 1}.checkReserve(now.Add(time.Hour), 1, now))
+}
+
+func TestGroupToken(t *testing.T) {
+	g := Group{ID: "6f1c2f5e-5d3a-4d7b-9a53-1e2b3c4d5e6f"}
+	id, err := ParseGroupToken(g.GetToken())
+	assert.NoError(t, err)
+	assert.Equal(t, g.ID, id)
+	assert.Contains(t, g.GetPortalURL(), "/groups/"+g.ID+".")
+
+	_, err = ParseGroupToken(g.ID)
+	assert.Equal(t, ErrInvalidGroupLink, err)
+	_, err = ParseGroupToken("7f1c2f5e-5d3a-4d7b-9a53-1e2b3c4d5e6f." + signGroup(g.ID))
+	assert.Equal(t, ErrInvalidGroupLink, err)
+}
+
+func TestParseInvites(t *testing.T) {
+	emails, err := ParseInvites("One@example.com, two@example.com\nthree@example.com;one@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one@example.com", "two@example.com", "three@example.com"}, emails)
+
+	_, err = ParseInvites(" \n ")
+	assert.Error(t, err)
+	_, err = ParseInvites("one@example.com, not-an-email")
+	assert.Error(t, err)
+}
@@ -0,0 +1,195 @@
+package tickets
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MaxGuestSearchResults limits the guests returned by SearchGuests
+var MaxGuestSearchResults = 50
+
+// EmailLog is an email sent (or attempted) to a guest
+type EmailLog struct {
+	CreatedAt time.Time
+	Address   string
+	Subject   string
+	Error     string
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchGuests finds guests with a partial email match, including their tickets
+func (r *repo) SearchGuests(email string) ([]*Guest, error) {
+	log.Println(`SearchGuests`, email)
+	email = strings.TrimSpace(strings.ToLower(email))
+	if email == "" {
+		return nil, fmt.Errorf("enter part of an email address to search")
+	}
+	rows, err := r.db.Query(`
+		select g.id,g.email,g.verified,g.created_at,coalesce(host(g.ip_address),''),coalesce(g.language,''),t.slot,t.num,t.event_code,coalesce(t.category,''),t.booked_at,coalesce(host(t.booked_ip),''),coalesce(t.booked_user_agent,'')
+		from guests g left join tickets t on (g.id=t.guest_id)
+		where g.id in (select id from guests where email like '%' || $1 || '%' order by email limit $2)
+		order by g.email,g.id,t.slot;`, likeEscaper.Replace(email), MaxGuestSearchResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	guests := make([]*Guest, 0)
+	for rows.Next() {
+		var (
+			tslot  pq.NullTime
+			tnum   sql.NullInt64
+			tevent sql.NullString
+			tcat   string
+			bat    pq.NullTime
+			bip    string
+			bua    string
+		)
+		g := &Guest{
+			Tickets: make([]Ticket, 0),
+		}
+		err = rows.Scan(&(g.ID), &(g.Email), &(g.Verified), &(g.CreatedAt), &(g.IPAddress), &(g.Language), &tslot, &tnum, &tevent, &tcat, &bat, &bip, &bua)
+		if err != nil {
+			return nil, err
+		}
+		if len(guests) > 0 && guests[len(guests)-1].ID == g.ID {
+			g = guests[len(guests)-1]
+		} else {
+			guests = append(guests, g)
+		}
+		if tslot.Valid {
+			g.Tickets = append(g.Tickets, Ticket{
+				Slot:            tslot.Time,
+				Number:          tnum.Int64,
+				GuestID:         g.ID,
+				EventCode:       tevent.String,
+				Category:        tcat,
+				BookedAt:        bat.Time,
+				BookedIP:        bip,
+				BookedUserAgent: bua,
+			})
+		}
+	}
+	return guests, nil
+}
+
+// LogEmail records an email sent to a guest, err is the send error if any
+func (r *repo) LogEmail(guestID, address, subject string, sendErr error) error {
+	var errMsg sql.NullString
+	if sendErr != nil {
+		errMsg = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	_, err := r.db.Exec(`insert into emails(guest_id,address,subject,error) values(NULLIF($1,'')::uuid,$2,$3,$4);`, guestID, address, subject, errMsg)
+	if err != nil {
+		log.Printf("LogEmail %s %s: %v", address, subject, err)
+	}
+	return err
+}
+
+// GetGuestEmails returns the emails sent to a guest, newest first
+func (r *repo) GetGuestEmails(guestID string) ([]EmailLog, error) {
+	rows, err := r.db.Query(`select created_at,address,subject,coalesce(error,'') from emails where guest_id=$1 order by created_at desc;`, guestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := make([]EmailLog, 0)
+	for rows.Next() {
+		e := EmailLog{}
+		err = rows.Scan(&(e.CreatedAt), &(e.Address), &(e.Subject), &(e.Error))
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+	return emails, nil
+}
+
+// MoveTicket moves a guest's ticket to another slot, the new ticket is assigned before the old one is released
+// so the guest keeps their ticket if the new slot is full.  Accessible and companion tickets stay accessible and companion.
+func (r *repo) MoveTicket(a Actor, g *Guest, from, to time.Time, eventCode string) error {
+	log.Printf("MoveTicket %s %s %s, %v -> %v %s", a, g.ID, g.Email, from, to, eventCode)
+	var req TicketRequest
+	for _, t := range g.Tickets {
+		if t.Slot.Equal(from) {
+			req.Accessible = req.Accessible || t.Category == CategoryAccessible
+			req.Companion = req.Companion || t.Category == CategoryCompanion
+		}
+	}
+	err := r.AssignTickets(a, g, to, eventCode, req)
+	if err != nil {
+		return err
+	}
+	if from.Format("2006-01-02") == to.Format("2006-01-02") {
+		return nil // AssignTicket already released the old ticket for the same day
+	}
+	return r.CancelTicket(a, g, from)
+}
+
+// MergeGuests moves the tickets and email history of a duplicate guest onto the guest being kept
+// and deletes the duplicate.  Duplicate tickets on days the kept guest already has a ticket are released like
+// cancelled tickets, paid ones refunded.
+func (r *repo) MergeGuests(a Actor, keep, duplicate *Guest) error {
+	log.Printf("MergeGuests %s %s %s <- %s %s", a, keep.ID, keep.Email, duplicate.ID, duplicate.Email)
+	if keep.ID == duplicate.ID {
+		return fmt.Errorf("cannot merge a guest into itself")
+	}
+	// release the duplicate's tickets on days the kept guest has tickets, settling their payments
+	rows, err := r.db.Query(`select min(slot) from tickets where guest_id=$2 and slot::date in (select slot::date from tickets where guest_id=$1) group by slot::date;`, keep.ID, duplicate.ID)
+	if err != nil {
+		return err
+	}
+	days := make([]time.Time, 0)
+	for rows.Next() {
+		var day time.Time
+		rows.Scan(&day)
+		days = append(days, day)
+	}
+	rows.Close()
+	for _, day := range days {
+		err = r.releaseTickets(a, duplicate, day, AuditCancel, nil)
+		if err != nil {
+			return err
+		}
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{`update tickets set guest_id=$1, updated_at=current_timestamp where guest_id=$2 and slot::date not in (select slot::date from tickets where guest_id=$1);`, []interface{}{keep.ID, duplicate.ID}},
+		{`update emails set guest_id=$1 where guest_id=$2;`, []interface{}{keep.ID, duplicate.ID}},
+		{`update payments set guest_id=$1 where guest_id=$2;`, []interface{}{keep.ID, duplicate.ID}},
+		{`update donation_clicks set guest_id=$1 where guest_id=$2;`, []interface{}{keep.ID, duplicate.ID}},
+		{`update donations set guest_id=$1 where guest_id=$2;`, []interface{}{keep.ID, duplicate.ID}},
+		{`update guests set verified = verified or (select verified from guests where id=$2) where id=$1;`, []interface{}{keep.ID, duplicate.ID}},
+		{`delete from guests where id=$1;`, []interface{}{duplicate.ID}},
+	} {
+		_, err = tx.Exec(stmt.query, stmt.args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{
+		Action:  AuditMergeGuests,
+		GuestID: keep.ID,
+		Email:   keep.Email,
+		Before:  fmt.Sprintf("duplicate=%s (%s)", duplicate.Email, duplicate.ID),
+		After:   "merged into " + keep.Email,
+	})
+	r.ClearCache()
+	return nil
+}
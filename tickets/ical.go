@@ -0,0 +1,108 @@
+package tickets
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/config"
+)
+
+// SlotDuration is the length of a ticket's calendar event, slots start on the hour and half hour
+var SlotDuration = 30 * time.Minute
+
+// icalEscaper escapes TEXT values (RFC 5545 3.3.11)
+var icalEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// ICalendar returns a VCALENDAR with an event for each ticket.  Event UIDs are stable per guest and ticket
+// so calendar apps update (and with the feed, remove) events when tickets are moved or cancelled.
+func ICalendar(g Guest, tickets []Ticket, now time.Time) []byte {
+	sorted := append([]Ticket(nil), tickets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Slot.Before(sorted[j].Slot) })
+
+	var b strings.Builder
+	line := func(name, value string) {
+		icalFold(&b, name+":"+value)
+	}
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//advlight//tickets//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	line("X-WR-CALNAME", icalEscaper.Replace(config.EventName+" Tickets"))
+	line("X-PUBLISHED-TTL", "PT1H")
+	for _, t := range sorted {
+		line("BEGIN", "VEVENT")
+		line("UID", icalUID(g, t))
+		line("DTSTAMP", icalTime(now))
+		line("DTSTART", icalTime(t.Slot))
+		line("DTEND", icalTime(t.Slot.Add(SlotDuration)))
+		line("SUMMARY", icalEscaper.Replace(config.EventName))
+		if config.EventAddress != "" {
+			line("LOCATION", icalEscaper.Replace(config.EventAddress))
+		}
+		desc := fmt.Sprintf("Ticket for %s.\nPresent your ticket on your mobile device (printed tickets work too).\n%s",
+			t.Slot.In(config.Location).Format("Mon Jan 02, 3:04pm"), g.GetNumberedTicketURL(t))
+		if t.Number > 0 {
+			desc = fmt.Sprintf("Ticket #%d for %s", t.Number, strings.TrimPrefix(desc, "Ticket for "))
+		}
+		line("DESCRIPTION", icalEscaper.Replace(desc))
+		line("URL", g.GetNumberedTicketURL(t))
+		line("STATUS", "CONFIRMED")
+		line("BEGIN", "VALARM")
+		line("ACTION", "DISPLAY")
+		line("DESCRIPTION", icalEscaper.Replace(config.EventName+" today"))
+		line("TRIGGER", "-PT3H")
+		line("END", "VALARM")
+		line("END", "VEVENT")
+	}
+	line("END", "VCALENDAR")
+	return []byte(b.String())
+}
+
+func icalUID(g Guest, t Ticket) string {
+	host := "advlight"
+	if u, err := url.Parse(HostName); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return g.GetToken() + "-" + t.GetTicketID() + "@" + host
+}
+
+func icalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icalFold writes a content line folded at 75 octets without splitting UTF-8 characters (RFC 5545 3.1)
+func icalFold(b *strings.Builder, s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+}
+
+// GetCalendarURL is the guest's iCal feed of all their tickets
+func (g Guest) GetCalendarURL() string {
+	return HostName + "/" + g.GetToken() + "/calendar.ics"
+}
+
+// GetCalendarSubscribeURL is the feed as a webcal:// link, which calendar apps subscribe to instead of importing once
+func (g Guest) GetCalendarSubscribeURL() string {
+	u := g.GetCalendarURL()
+	for _, scheme := range []string{"https://", "http://"} {
+		if strings.HasPrefix(u, scheme) {
+			return "webcal://" + strings.TrimPrefix(u, scheme)
+		}
+	}
+	return u
+}
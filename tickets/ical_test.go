@@ -0,0 +1,52 @@
+package tickets
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestICalendar(t *testing.T) {
+	g := Guest{ID: "2a1e9a3c-0000-4000-8000-000000000001", Email: "guest@example.com"}
+	slot := time.Date(2019, 12, 2, 2, 30, 0, 0, time.UTC)
+	ics := string(ICalendar(g, []Ticket{
+		{Slot: slot.Add(24 * time.Hour), Number: 12},
+		{Slot: slot, Number: 7},
+	}, slot))
+
+	assert.True(t, strings.HasPrefix(ics, "BEGIN:VCALENDAR\r\n"))
+	assert.True(t, strings.HasSuffix(ics, "END:VCALENDAR\r\n"))
+	assert.Equal(t, 2, strings.Count(ics, "BEGIN:VEVENT"))
+	assert.Contains(t, ics, "DTSTART:20191202T023000Z\r\n")
+	assert.Contains(t, ics, "DTEND:20191202T030000Z\r\n")
+	assert.Contains(t, ics, "UID:2a1e9a3c000040008000000000000001-1575253800-7@")
+	assert.True(t, strings.Index(ics, "20191202T023000Z") < strings.Index(ics, "20191203T023000Z"), "events are sorted")
+	for _, line := range strings.Split(ics, "\r\n") {
+		assert.True(t, len(line) <= 75, line)
+	}
+}
+
+func TestICalFold(t *testing.T) {
+	var b strings.Builder
+	icalFold(&b, "DESCRIPTION:"+strings.Repeat("é", 60))
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+	assert.True(t, len(lines) > 1)
+	unfolded := lines[0]
+	for _, l := range lines[1:] {
+		assert.True(t, strings.HasPrefix(l, " "))
+		assert.True(t, len(l) <= 75)
+		unfolded += l[1:]
+	}
+	assert.Equal(t, "DESCRIPTION:"+strings.Repeat("é", 60), unfolded)
+	assert.Equal(t, `a\, b\; c\\n\nd`, icalEscaper.Replace("a, b; c\\n\nd"))
+}
+
+func TestCalendarSubscribeURL(t *testing.T) {
+	old := HostName
+	defer func() { HostName = old }()
+	HostName = "https://tickets.example.com"
+	g := Guest{ID: "abc"}
+	assert.Equal(t, "webcal://tickets.example.com/abc/calendar.ics", g.GetCalendarSubscribeURL())
+}
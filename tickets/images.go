@@ -0,0 +1,43 @@
+package tickets
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+
+	// decoders for ticket artwork
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"golang.org/x/image/draw"
+)
+
+// resizeCover scales src to fill w x h, cropping the edges that do not fit (like css background-size: cover)
+func resizeCover(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	// the largest part of src with the target aspect ratio, centered
+	crop := b
+	if b.Dx()*h > b.Dy()*w {
+		cw := b.Dy() * w / h
+		crop.Min.X = b.Min.X + (b.Dx()-cw)/2
+		crop.Max.X = crop.Min.X + cw
+	} else {
+		ch := b.Dx() * h / w
+		crop.Min.Y = b.Min.Y + (b.Dy()-ch)/2
+		crop.Max.Y = crop.Min.Y + ch
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+// pngCover decodes an image and returns it resized to w x h as a PNG
+func pngCover(data []byte, w, h int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, resizeCover(src, w, h))
+	return buf.Bytes(), err
+}
@@ -0,0 +1,213 @@
+package tickets
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/lib/pq"
+)
+
+// WalkupEventCode holds each slot's walk-up allocation, tickets only the kiosk issues.  Add them with the slot editor.
+const WalkupEventCode = "walkup"
+
+// WalkupEmailDomain is the domain of the placeholder email given to walk-ups who do not leave one, never emailed
+const WalkupEmailDomain = "walkup.invalid"
+
+// KioskGate is the gate recorded on tickets checked in at the kiosk, door clients record their own
+const KioskGate = "kiosk"
+
+// MaxWalkupParty is the most tickets the kiosk issues at once
+var MaxWalkupParty int64 = 12
+
+// SlotCapacity is a slot's live numbers for the gate
+type SlotCapacity struct {
+	Slot            time.Time
+	Tickets         int64 // every ticket in the slot
+	Booked          int64
+	CheckedIn       int64
+	WalkupAvailable int64 // the slot's walk-up allocation left
+	Available       int64 // general admission left, walk-ups get these once the allocation runs out
+}
+
+// ForWalkups is the number of tickets the kiosk can still issue
+func (sc SlotCapacity) ForWalkups() int64 {
+	return sc.WalkupAvailable + sc.Available
+}
+
+// Expected is the number of booked guests who have not arrived
+func (sc SlotCapacity) Expected() int64 {
+	return sc.Booked - sc.CheckedIn
+}
+
+// CurrentSlot is the start of the slot now falls in, the latest slot that day starting at or before now.  A slot is
+// current from its start until the next one, before the day's first slot it is now.
+func (r *repo) CurrentSlot(now time.Time) (time.Time, error) {
+	local := now.In(config.Location)
+	startOfDay := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, config.Location)
+	var slot pq.NullTime
+	err := r.db.QueryRow(`select max(slot) from tickets where slot>=$1 and slot<=$2;`, startOfDay, now).Scan(&slot)
+	if err != nil {
+		return now, err
+	}
+	if !slot.Valid {
+		return now, nil
+	}
+	return slot.Time, nil
+}
+
+// IsWalkupEmail is true for the placeholder emails of walk-ups, they are never emailed
+func IsWalkupEmail(email string) bool {
+	return strings.HasSuffix(strings.ToLower(email), "@"+WalkupEmailDomain)
+}
+
+// GetCapacity returns the live numbers of the slots starting in [from, to)
+func (r *repo) GetCapacity(from, to time.Time) ([]SlotCapacity, error) {
+	rows, err := r.db.Query(`
+		select slot, count(*), count(guest_id), count(checked_in_at),
+			count(*) filter (where guest_id is null and event_code=$3),
+			count(*) filter (where guest_id is null and event_code is null and category='standard' and ticket_type is null)
+		from tickets where slot>=$1 and slot<$2 group by slot order by slot;`, from, to, WalkupEventCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	slots := make([]SlotCapacity, 0)
+	for rows.Next() {
+		var sc SlotCapacity
+		err = rows.Scan(&sc.Slot, &sc.Tickets, &sc.Booked, &sc.CheckedIn, &sc.WalkupAvailable, &sc.Available)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, sc)
+	}
+	return slots, nil
+}
+
+// IssueWalkups books party tickets in slot for walk-ups at the gate, from the slot's walk-up allocation first and
+// then general admission, and checks them in.  Without an email the tickets go to a new guest with a placeholder
+// email, with one they go to the guest with that email (who can be sent the tickets).
+func (r *repo) IssueWalkups(a Actor, slot time.Time, party int64, email string) (*Guest, error) {
+	log.Printf("IssueWalkups %s %s %d %s", a, slot, party, email)
+	if party < 1 || party > MaxWalkupParty {
+		return nil, fmt.Errorf("walk-ups get 1 to %d tickets at once", MaxWalkupParty)
+	}
+	g := &Guest{Email: strings.TrimSpace(email), IPAddress: a.IPAddress}
+	placeholder := g.Email == ""
+	if placeholder {
+		b := make([]byte, 8)
+		rand.Read(b)
+		g.Email = "walkup-" + hex.EncodeToString(b) + "@" + WalkupEmailDomain
+	}
+	err := g.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// the guest is created with the tickets, so a failed issue leaves no guest behind
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`select id from guests where email=$1;`, g.Email).Scan(&g.ID)
+	if err == sql.ErrNoRows {
+		// the volunteer saw the guest, there is no confirmation link to click for a placeholder email.  Typed emails
+		// (new or existing) are only verified by their owner.
+		g.Verified = placeholder
+		err = tx.QueryRow(`insert into guests(email,ip_address,verified) values($1,$2,$3) returning id;`, g.Email, nullIP(g.IPAddress), g.Verified).Scan(&g.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	rows, err := tx.Query(`
+		update tickets t set guest_id=$1, updated_at=current_timestamp, booked_at=current_timestamp, booked_ip=$4, booked_user_agent=$5, checked_in_at=current_timestamp, checked_in_gate=$7
+		where (t.slot,t.num) in (
+			select slot,num from tickets
+			where guest_id is null and slot=$2 and category='standard' and ticket_type is null and (event_code=$6 or event_code is null)
+			order by event_code is null, num limit $3 for update skip locked
+		) returning t.num, coalesce(t.event_code,'');`, g.ID, slot, party, nullIP(a.IPAddress), a.UserAgent, WalkupEventCode, KioskGate)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	issued := make([]AuditEntry, 0)
+	for rows.Next() {
+		e := AuditEntry{Action: AuditWalkup, GuestID: g.ID, Email: g.Email, Slot: slot, Before: "available", After: "guest=" + g.Email + " checked in"}
+		rows.Scan(&e.Number, &e.EventCode)
+		issued = append(issued, e)
+	}
+	rows.Close()
+	if int64(len(issued)) < party {
+		tx.Rollback()
+		return nil, fmt.Errorf("only %d tickets are left at %s", len(issued), slot.In(config.Location).Format("3:04pm"))
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if g.Verified {
+		r.Audit(a, AuditEntry{Action: AuditVerify, GuestID: g.ID, Email: g.Email, Before: "verified=false", After: "verified=true"})
+	}
+	for _, e := range issued {
+		r.Audit(a, e)
+	}
+	r.ClearCache()
+	return r.GetGuest(g.ID)
+}
+
+// ParseTicketLink reads the guest and slot from a ticket link (the QR code on printed tickets), the guest's
+// token or id alone checks in the guest's tickets in the current slot
+func ParseTicketLink(s string) (guestID string, slot time.Time, err error) {
+	s = strings.TrimSpace(s)
+	if u, perr := url.Parse(s); perr == nil && u.Path != "" {
+		s = u.Path
+	}
+	parts := strings.Split(strings.Trim(s, "/"), "/")
+	guestID = parts[0]
+	if len(strings.Replace(guestID, "-", "", -1)) != 32 {
+		return "", slot, fmt.Errorf("%q is not a ticket", s)
+	}
+	if len(parts) >= 3 && parts[1] == "ticket" {
+		slot, _, err = ParseTicketID(parts[2])
+		if err != nil {
+			return "", slot, fmt.Errorf("%q is not a ticket", s)
+		}
+	}
+	return guestID, slot, nil
+}
+
+// CheckIn marks the guest's tickets in slot as arrived and returns how many were checked in, held tickets that are not
+// paid yet are left for the guest to pay
+func (r *repo) CheckIn(a Actor, g *Guest, slot time.Time, now time.Time) (int64, error) {
+	log.Printf("CheckIn %s %s %s", a, g.ID, slot)
+	rows, err := r.db.Query(`update tickets set checked_in_at=$3, checked_in_gate=$4 where guest_id=$1 and slot=$2 and checked_in_at is null and (payment_id is null or exists (select 1 from payments p where p.id=payment_id and p.status='paid')) returning num, coalesce(event_code,'');`, g.ID, slot, now, KioskGate)
+	if err != nil {
+		return 0, err
+	}
+	checked := make([]AuditEntry, 0)
+	for rows.Next() {
+		e := AuditEntry{Action: AuditCheckIn, GuestID: g.ID, Email: g.Email, Slot: slot, Before: "booked", After: "checked in"}
+		rows.Scan(&e.Number, &e.EventCode)
+		checked = append(checked, e)
+	}
+	rows.Close()
+	if len(checked) == 0 {
+		for _, t := range g.Tickets {
+			if t.Slot.Equal(slot) && !t.CheckedInAt.IsZero() {
+				return 0, fmt.Errorf("%s was already checked in at %s", g.Email, t.CheckedInAt.In(config.Location).Format("3:04pm"))
+			}
+		}
+		return 0, fmt.Errorf("%s has no tickets at %s", g.Email, slot.In(config.Location).Format("Jan 02 3:04pm"))
+	}
+	for _, e := range checked {
+		r.Audit(a, e)
+	}
+	return int64(len(checked)), nil
+}
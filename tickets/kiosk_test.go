@@ -0,0 +1,45 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTicketLink(t *testing.T) {
+	g := Guest{ID: "6f1c2f5e-5d3a-4d7b-9a53-1e2b3c4d5e6f"}
+	slot := time.Date(2019, 12, 14, 2, 30, 0, 0, time.UTC)
+
+	id, s, err := ParseTicketLink(g.GetTicketURL(slot))
+	assert.NoError(t, err)
+	assert.Equal(t, g.GetToken(), id)
+	assert.True(t, s.Equal(slot))
+
+	// the token alone checks in the guest's tickets closest to now
+	id, s, err = ParseTicketLink(" " + g.GetToken() + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, g.GetToken(), id)
+	assert.True(t, s.IsZero())
+
+	id, _, err = ParseTicketLink(g.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, g.ID, id)
+
+	_, _, err = ParseTicketLink("https://example.com/admin")
+	assert.Error(t, err)
+	_, _, err = ParseTicketLink(g.GetToken() + "/ticket/soon")
+	assert.Error(t, err)
+	_, _, err = ParseTicketLink("")
+	assert.Error(t, err)
+}
+
+func TestSlotCapacity(t *testing.T) {
+	sc := SlotCapacity{Tickets: 100, Booked: 70, CheckedIn: 45, WalkupAvailable: 10, Available: 20}
+	assert.Equal(t, int64(30), sc.ForWalkups())
+	assert.Equal(t, int64(25), sc.Expected())
+
+	assert.True(t, IsWalkupEmail("walkup-0123456789abcdef@"+WalkupEmailDomain))
+	assert.True(t, IsWalkupEmail("Walkup-1@WALKUP.invalid"))
+	assert.False(t, IsWalkupEmail("guest@example.com"))
+}
@@ -0,0 +1,620 @@
+package tickets
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
+	"github.com/lib/pq"
+)
+
+// payment statuses
+const (
+	PaymentPending   = "pending"
+	PaymentPaid      = "paid"
+	PaymentFailed    = "failed"
+	PaymentExpired   = "expired"   // the hold ran out before the payment completed
+	PaymentCancelled = "cancelled" // the guest left the checkout or released the held tickets
+	PaymentRefunded  = "refunded"
+)
+
+// PaymentProvider takes payments for priced tickets, ie Stripe
+type PaymentProvider interface {
+	// Name is stored with each payment
+	Name() string
+	// CreateCheckout starts a checkout for the payment, the guest is sent to url to pay.
+	// ref identifies the checkout in webhook events.
+	CreateCheckout(p Payment, successURL, cancelURL string) (ref, url string, err error)
+	// ParseWebhook verifies and decodes a webhook request from the provider
+	ParseWebhook(header http.Header, body []byte) (PaymentEvent, error)
+	// Refund returns a paid payment in full
+	Refund(p Payment) error
+}
+
+// PaymentEvent is a webhook notification about a checkout
+type PaymentEvent struct {
+	Ref        string // the checkout's ref from CreateCheckout
+	PaymentRef string // the provider's payment id, refunds are made against it
+	Status     string // PaymentPaid or PaymentFailed, "" for events that are ignored
+}
+
+// Payments takes payments for priced tickets, nil (the default) disables priced tickets.
+// Selected by ADVLIGHT_PAYMENTS=stripe (with ADVLIGHT_STRIPE_KEY and ADVLIGHT_STRIPE_WEBHOOK_SECRET) or fake.
+var Payments PaymentProvider
+
+// Currency is the ISO currency of ticket prices, set with ADVLIGHT_CURRENCY (defaults to usd)
+var Currency = "usd"
+
+// PaymentHold is how long priced tickets are held for a guest to pay, set with ADVLIGHT_PAYMENT_HOLD (defaults to 30m)
+var PaymentHold = 30 * time.Minute
+
+func init() {
+	var err error
+	Payments, err = NewPaymentProvider(os.Getenv("ADVLIGHT_PAYMENTS"))
+	if err != nil {
+		log.Panicf("invalid ADVLIGHT_PAYMENTS config: %v", err)
+	}
+	if c := strings.TrimSpace(strings.ToLower(os.Getenv("ADVLIGHT_CURRENCY"))); c != "" {
+		Currency = c
+	}
+	if cfg := strings.TrimSpace(os.Getenv("ADVLIGHT_PAYMENT_HOLD")); cfg != "" {
+		PaymentHold, err = time.ParseDuration(cfg)
+		if err != nil || PaymentHold <= 0 {
+			log.Panicf("invalid ADVLIGHT_PAYMENT_HOLD(%v): %s", err, cfg)
+		}
+	}
+}
+
+// NewPaymentProvider builds the provider from the ADVLIGHT_STRIPE_* environment, "" disables payments
+func NewPaymentProvider(provider string) (PaymentProvider, error) {
+	switch strings.TrimSpace(strings.ToLower(provider)) {
+	case "", "off":
+		return nil, nil
+	case "stripe":
+		key := os.Getenv("ADVLIGHT_STRIPE_KEY")
+		secret := os.Getenv("ADVLIGHT_STRIPE_WEBHOOK_SECRET")
+		if key == "" || secret == "" {
+			return nil, fmt.Errorf("stripe requires ADVLIGHT_STRIPE_KEY and ADVLIGHT_STRIPE_WEBHOOK_SECRET")
+		}
+		s := NewStripe(key, secret)
+		if u := os.Getenv("ADVLIGHT_STRIPE_URL"); u != "" {
+			s.APIURL = strings.TrimSuffix(u, "/") // a stripe compatible API
+		}
+		return s, nil
+	case "fake":
+		return NewFakePayments(), nil
+	}
+	return nil, fmt.Errorf("unknown payment provider %q", provider)
+}
+
+// TicketType is a kind of ticket guests choose, ie VIP hot cocoa
+type TicketType struct {
+	Code        string
+	Name        string
+	Description string
+	PriceCents  int64
+	Active      bool
+}
+
+// Price is the formatted price, ie $12.50
+func (tt TicketType) Price() string {
+	return FormatPrice(tt.PriceCents, Currency)
+}
+
+// PriceValue is the price without the currency, ie 12.50, for form inputs
+func (tt TicketType) PriceValue() string {
+	return fmt.Sprintf("%d.%02d", tt.PriceCents/100, tt.PriceCents%100)
+}
+
+var currencySymbols = map[string]string{"usd": "$", "cad": "$", "aud": "$", "eur": "€", "gbp": "£"}
+
+// FormatPrice formats cents, ie $12.50 or 12.50 CHF
+func FormatPrice(cents int64, currency string) string {
+	amount := fmt.Sprintf("%d.%02d", cents/100, cents%100)
+	if sym, ok := currencySymbols[strings.ToLower(currency)]; ok {
+		return sym + amount
+	}
+	return amount + " " + strings.ToUpper(currency)
+}
+
+var priceRe = regexp.MustCompile(`^(\d+)(?:\.(\d{1,2}))?$`)
+
+// ParsePrice parses a price like 12, 12.5 or $12.50 into cents
+func ParsePrice(s string) (int64, error) {
+	s = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s), "$€£"))
+	if s == "" {
+		return 0, nil
+	}
+	m := priceRe.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid price %q, use a price like 12.50", s)
+	}
+	dollars, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	cents := int64(0)
+	if m[2] != "" {
+		cents, _ = strconv.ParseInt((m[2] + "0")[:2], 10, 64)
+	}
+	return dollars*100 + cents, nil
+}
+
+var ticketTypeCodeRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Validate normalizes the code and checks the type is complete
+func (tt *TicketType) Validate() error {
+	tt.Code = strings.TrimSpace(strings.ToLower(tt.Code))
+	tt.Name = strings.TrimSpace(tt.Name)
+	if !ticketTypeCodeRe.MatchString(tt.Code) {
+		return fmt.Errorf("invalid ticket type code %q, use lowercase letters, numbers and dashes", tt.Code)
+	}
+	if tt.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	if tt.PriceCents < 0 {
+		return fmt.Errorf("price can not be negative")
+	}
+	return nil
+}
+
+// GetTicketTypes returns every ticket type, cached until ClearCache
+func (r *repo) GetTicketTypes() ([]TicketType, error) {
+	r.sync.Lock()
+	cached := r.cache.ticketTypes
+	r.sync.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	rows, err := r.db.Query(`select code,name,description,price_cents,active from ticket_types order by price_cents,name;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types := make([]TicketType, 0)
+	for rows.Next() {
+		var tt TicketType
+		err = rows.Scan(&tt.Code, &tt.Name, &tt.Description, &tt.PriceCents, &tt.Active)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, tt)
+	}
+	r.sync.Lock()
+	r.cache.ticketTypes = types
+	r.sync.Unlock()
+	return types, nil
+}
+
+// GetTicketType returns the type with code, the zero TicketType for "" and unknown codes
+func (r *repo) GetTicketType(code string) TicketType {
+	types, err := r.GetTicketTypes()
+	if err != nil {
+		log.Println("GetTicketType", code, err)
+	}
+	for _, tt := range types {
+		if strings.EqualFold(tt.Code, code) {
+			return tt
+		}
+	}
+	return TicketType{}
+}
+
+// SaveTicketType creates or updates a ticket type, the price applies to the type's unbooked tickets
+func (r *repo) SaveTicketType(a Actor, tt TicketType) error {
+	log.Printf("SaveTicketType %s %+v", a, tt)
+	err := tt.Validate()
+	if err != nil {
+		return err
+	}
+	before := r.GetTicketType(tt.Code)
+	_, err = r.db.Exec(`insert into ticket_types(code,name,description,price_cents,active) values($1,$2,$3,$4,$5)
+		on conflict (code) do update set name=$2, description=$3, price_cents=$4, active=$5;`,
+		tt.Code, tt.Name, tt.Description, tt.PriceCents, tt.Active)
+	if err != nil {
+		return err
+	}
+	// booked tickets keep the price they were booked at
+	_, err = r.db.Exec(`update tickets set price_cents=$2 where ticket_type=$1 and guest_id is null;`, tt.Code, tt.PriceCents)
+	if err != nil {
+		return err
+	}
+	r.Audit(a, AuditEntry{Action: AuditTicketType, Before: ticketTypeState(before), After: ticketTypeState(tt)})
+	r.ClearCache()
+	return nil
+}
+
+func ticketTypeState(tt TicketType) string {
+	if tt.Code == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %q %s active=%v", tt.Code, tt.Name, tt.Price(), tt.Active)
+}
+
+// Payment is a guest's checkout for the priced tickets in a slot
+type Payment struct {
+	ID              int64
+	GuestID         string
+	Slot            time.Time
+	AmountCents     int64
+	Currency        string
+	Provider        string
+	ProviderRef     string
+	ProviderPayment string
+	CheckoutURL     string
+	Status          string
+	HoldUntil       time.Time
+	CreatedAt       time.Time
+
+	// for the checkout, not stored
+	Email       string
+	Description string
+}
+
+// Amount is the formatted amount, ie $12.50
+func (p Payment) Amount() string {
+	return FormatPrice(p.AmountCents, p.Currency)
+}
+
+// Revenue is the formatted total of the slot's paid tickets
+func (s SlotStat) Revenue() string {
+	return FormatPrice(s.RevenueCents, Currency)
+}
+
+// paymentColumns are scanned by scanPayment, from payments p
+const paymentColumns = `p.id,coalesce(p.guest_id::text,''),p.slot,p.amount_cents,p.currency,p.provider,coalesce(p.provider_ref,''),coalesce(p.provider_payment,''),coalesce(p.checkout_url,''),p.status,p.hold_until,p.created_at`
+
+func scanPayment(row interface{ Scan(...interface{}) error }) (Payment, error) {
+	var p Payment
+	err := row.Scan(&p.ID, &p.GuestID, &p.Slot, &p.AmountCents, &p.Currency, &p.Provider, &p.ProviderRef, &p.ProviderPayment, &p.CheckoutURL, &p.Status, &p.HoldUntil, &p.CreatedAt)
+	return p, err
+}
+
+// holdTickets creates the pending payment for tickets just booked in tx and links the tickets to it
+func holdTickets(tx *sql.Tx, g *Guest, slot time.Time, nums []int64, amount int64, now time.Time) (int64, error) {
+	if Payments == nil {
+		return 0, i18n.Errorf("error.payments_unavailable")
+	}
+	var id int64
+	err := tx.QueryRow(`insert into payments(guest_id,slot,amount_cents,currency,provider,hold_until) values($1,$2,$3,$4,$5,$6) returning id;`,
+		g.ID, slot, amount, Currency, Payments.Name(), now.Add(PaymentHold)).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`update tickets set payment_id=$1 where slot=$2 and num=any($3);`, id, slot, pq.Array(nums))
+	return id, err
+}
+
+// GetPendingPayment returns the guest's unpaid checkout for slot
+func (r *repo) GetPendingPayment(g *Guest, slot time.Time) (Payment, error) {
+	p, err := scanPayment(r.db.QueryRow(`select `+paymentColumns+` from payments p where p.guest_id=$1 and p.slot=$2 and p.status='pending' order by p.id desc limit 1;`, g.ID, slot))
+	if err == sql.ErrNoRows {
+		return p, i18n.Errorf("error.payment_not_found")
+	}
+	return p, err
+}
+
+// StartCheckout starts the provider's checkout for the guest's held tickets in slot and returns the url to pay at.
+// The tickets are released if the checkout can not be started.
+func (r *repo) StartCheckout(a Actor, g *Guest, slot time.Time) (string, error) {
+	log.Printf("StartCheckout %s %s %s, %v", a, g.ID, g.Email, slot)
+	p, err := r.GetPendingPayment(g, slot)
+	if err != nil {
+		return "", err
+	}
+	if p.CheckoutURL != "" {
+		return p.CheckoutURL, nil // the guest came back to pay
+	}
+	p.Email = g.Email
+	p.Description = r.paymentDescription(p)
+	successURL := g.GetGuestURL() + "?payment=success&slot=" + strconv.FormatInt(slot.Unix(), 10)
+	cancelURL := g.GetGuestURL() + "?payment=cancelled&slot=" + strconv.FormatInt(slot.Unix(), 10)
+	ref, url, err := Payments.CreateCheckout(p, successURL, cancelURL)
+	if err != nil {
+		log.Println("[ERROR] StartCheckout", p.ID, err)
+		r.endPayment(a, p, PaymentFailed)
+		return "", i18n.Errorf("error.payment_failed")
+	}
+	_, err = r.db.Exec(`update payments set provider_ref=$2, checkout_url=$3, updated_at=current_timestamp where id=$1;`, p.ID, ref, url)
+	if err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// paymentDescription is the checkout's line item, ie "VIP Hot Cocoa, Dec 10 7:00pm"
+func (r *repo) paymentDescription(p Payment) string {
+	var code string
+	r.db.QueryRow(`select coalesce(max(ticket_type),'') from tickets where payment_id=$1;`, p.ID).Scan(&code)
+	name := r.GetTicketType(code).Name
+	if name == "" {
+		name = "Ticket"
+	}
+	return name + ", " + p.Slot.In(config.Location).Format("Jan 02 3:04pm")
+}
+
+// HandlePaymentEvent applies a webhook event.  confirmed is true when the event completed the guest's booking,
+// the caller sends the confirmation email.  A payment completed after its hold ran out is refunded.
+func (r *repo) HandlePaymentEvent(a Actor, ev PaymentEvent) (p Payment, confirmed bool, err error) {
+	log.Printf("HandlePaymentEvent %s %+v", a, ev)
+	if ev.Status == "" || ev.Ref == "" {
+		return p, false, nil
+	}
+	p, err = scanPayment(r.db.QueryRow(`select `+paymentColumns+` from payments p where p.provider=$1 and p.provider_ref=$2;`, Payments.Name(), ev.Ref))
+	if err == sql.ErrNoRows {
+		return p, false, fmt.Errorf("payment %s not found", ev.Ref)
+	}
+	if err != nil {
+		return p, false, err
+	}
+	if ev.PaymentRef != "" {
+		p.ProviderPayment = ev.PaymentRef
+		_, err = r.db.Exec(`update payments set provider_payment=$2 where id=$1;`, p.ID, ev.PaymentRef)
+		if err != nil {
+			return p, false, err
+		}
+	}
+	paid := false
+	if ev.Status == PaymentPaid && p.Status == PaymentPending {
+		err = r.setPaymentStatus(a, &p, PaymentPaid)
+		paid = err == nil
+		if err == errPaymentChanged {
+			// the hold expired or was cancelled while the guest paid, p has the new status and is refunded below
+			log.Println("HandlePaymentEvent", p.ID, "paid after it was", p.Status)
+		} else if err != nil {
+			return p, false, err
+		}
+	}
+	switch {
+	case paid:
+		// the booking is complete, release the guest's other tickets that day
+		g := &Guest{ID: p.GuestID}
+		r.db.QueryRow(`select email from guests where id=$1;`, p.GuestID).Scan(&g.Email)
+		keep, err := r.paymentTicketNums(p.ID)
+		if err != nil {
+			return p, false, err
+		}
+		err = r.releaseTickets(a, g, p.Slot, AuditRebook, keep)
+		return p, err == nil, err
+	case ev.Status == PaymentPaid && p.Status != PaymentPaid && p.Status != PaymentRefunded:
+		// paid after the tickets were released
+		err = r.refund(a, &p)
+		return p, false, err
+	case ev.Status == PaymentFailed && p.Status == PaymentPending:
+		err = r.endPayment(a, p, PaymentFailed)
+		if err == errPaymentChanged {
+			err = nil // paid or released meanwhile
+		}
+		return p, false, err
+	}
+	return p, false, nil
+}
+
+// paymentTicketNums are the numbers of the tickets bought with the payment
+func (r *repo) paymentTicketNums(id int64) ([]int64, error) {
+	nums := make([]int64, 0)
+	rows, err := r.db.Query(`select num from tickets where payment_id=$1;`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n int64
+		err = rows.Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		nums = append(nums, n)
+	}
+	return nums, nil
+}
+
+// CancelPendingPayment releases the guest's held tickets in slot when they leave the checkout without paying
+func (r *repo) CancelPendingPayment(a Actor, g *Guest, slot time.Time) error {
+	p, err := r.GetPendingPayment(g, slot)
+	if err != nil {
+		return nil // already paid, failed or expired
+	}
+	err = r.endPayment(a, p, PaymentCancelled)
+	if err == errPaymentChanged {
+		return nil // paid or expired while the guest left the checkout
+	}
+	return err
+}
+
+// ExpireHolds releases the tickets of payments still pending after their hold, run by the expire sweep
+func (r *repo) ExpireHolds(a Actor, now time.Time) (int, error) {
+	rows, err := r.db.Query(`select `+paymentColumns+` from payments p where p.status='pending' and p.hold_until<$1;`, now)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	expired := make([]Payment, 0)
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return 0, err
+		}
+		expired = append(expired, p)
+	}
+	rows.Close()
+	count := 0
+	for _, p := range expired {
+		err = r.endPayment(a, p, PaymentExpired)
+		if err == errPaymentChanged {
+			continue // paid (or cancelled) since it was read
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// endPayment releases a pending payment's held tickets and sets its final status in one transaction, it returns
+// errPaymentChanged (and leaves the tickets) when the payment is no longer pending, ie a webhook marked it paid
+func (r *repo) endPayment(a Actor, p Payment, status string) error {
+	log.Printf("endPayment %s %d %s", a, p.ID, status)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = casPaymentStatus(tx, p, status)
+	if err != nil {
+		tx.Rollback()
+		if err == errPaymentChanged {
+			r.reloadPaymentStatus(&p)
+			log.Println("endPayment", p.ID, "is already", p.Status)
+		}
+		return err
+	}
+	rows, err := tx.Query(`update tickets set guest_id = null, payment_id = null, updated_at = current_timestamp, booked_at = null, booked_ip = null, booked_user_agent = '', checked_in_at = null, checked_in_gate = null
+		where payment_id=$1 returning slot,num,coalesce(event_code,'');`, p.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	released := make([]AuditEntry, 0)
+	for rows.Next() {
+		e := AuditEntry{Action: AuditCancel, GuestID: p.GuestID, Before: "held", After: "available"}
+		rows.Scan(&e.Slot, &e.Number, &e.EventCode)
+		released = append(released, e)
+	}
+	rows.Close()
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	r.Audit(a, paymentAudit(p, status))
+	for _, e := range released {
+		r.Audit(a, e)
+	}
+	r.sync.Lock()
+	r.cache.slots = nil
+	r.sync.Unlock()
+	r.publish(TopicSlots)
+	return nil
+}
+
+// errPaymentChanged is returned when another request changed a payment's status first, ie a webhook and the expire
+// sweep at once
+var errPaymentChanged = fmt.Errorf("the payment's status changed")
+
+// casPaymentStatus changes the payment's status from p.Status to status, errPaymentChanged when it is no longer p.Status
+func casPaymentStatus(q interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, p Payment, status string) error {
+	res, err := q.Exec(`update payments set status=$2, updated_at=current_timestamp where id=$1 and status=$3;`, p.ID, status, p.Status)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errPaymentChanged
+	}
+	return nil
+}
+
+// reloadPaymentStatus reads the payment's current status after errPaymentChanged
+func (r *repo) reloadPaymentStatus(p *Payment) {
+	err := r.db.QueryRow(`select status from payments where id=$1;`, p.ID).Scan(&p.Status)
+	if err != nil {
+		log.Println("[ERROR] reloadPaymentStatus", p.ID, err)
+	}
+}
+
+// paymentAudit is the audit entry for a payment's status change
+func paymentAudit(p Payment, status string) AuditEntry {
+	return AuditEntry{
+		Action:  AuditPayment,
+		GuestID: p.GuestID,
+		Slot:    p.Slot,
+		Before:  fmt.Sprintf("payment %d %s %s", p.ID, p.Amount(), p.Status),
+		After:   status,
+	}
+}
+
+// setPaymentStatus saves and audits a payment's new status.  On errPaymentChanged p has the status it changed to.
+func (r *repo) setPaymentStatus(a Actor, p *Payment, status string) error {
+	err := casPaymentStatus(r.db, *p, status)
+	if err == errPaymentChanged {
+		r.reloadPaymentStatus(p)
+	}
+	if err != nil {
+		return err
+	}
+	r.Audit(a, paymentAudit(*p, status))
+	p.Status = status
+	return nil
+}
+
+// settlePayments refunds paid payments and cancels pending ones whose tickets were all released
+func (r *repo) settlePayments(a Actor, ids []int64) {
+	for _, id := range ids {
+		p, err := scanPayment(r.db.QueryRow(`select `+paymentColumns+` from payments p where p.id=$1 and not exists (select 1 from tickets where payment_id=p.id and guest_id is not null);`, id))
+		if err == sql.ErrNoRows {
+			continue // some of the payment's tickets are still booked
+		}
+		if err != nil {
+			log.Println("[ERROR] settlePayments", id, err)
+			continue
+		}
+		if p.Status == PaymentPending {
+			err = r.setPaymentStatus(a, &p, PaymentCancelled)
+		}
+		if err == errPaymentChanged {
+			err = nil // paid since it was read, p.Status is paid and it is refunded below
+		}
+		if err == nil && p.Status == PaymentPaid {
+			err = r.refund(a, &p)
+		}
+		if err != nil {
+			log.Println("[ERROR] settlePayments", id, err)
+		}
+	}
+}
+
+// refund returns the payment through its provider
+func (r *repo) refund(a Actor, p *Payment) error {
+	log.Printf("refund %s %d %s", a, p.ID, p.Amount())
+	if Payments == nil || Payments.Name() != p.Provider {
+		return fmt.Errorf("payment %d was made with %s, refund it there", p.ID, p.Provider)
+	}
+	err := Payments.Refund(*p)
+	if err != nil {
+		r.Audit(a, AuditEntry{Action: AuditPayment, GuestID: p.GuestID, Slot: p.Slot, Before: fmt.Sprintf("payment %d %s %s", p.ID, p.Amount(), p.Status), After: "refund failed: " + err.Error()})
+		return err
+	}
+	return r.setPaymentStatus(a, p, PaymentRefunded)
+}
+
+// GetPayments returns the newest payments, for the admin
+func (r *repo) GetPayments(limit int) ([]Payment, error) {
+	rows, err := r.db.Query(`select `+paymentColumns+`,coalesce(g.email,'') from payments p left join guests g on g.id=p.guest_id order by p.id desc limit $1;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	payments := make([]Payment, 0)
+	for rows.Next() {
+		var p Payment
+		err = rows.Scan(&p.ID, &p.GuestID, &p.Slot, &p.AmountCents, &p.Currency, &p.Provider, &p.ProviderRef, &p.ProviderPayment, &p.CheckoutURL, &p.Status, &p.HoldUntil, &p.CreatedAt, &p.Email)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, nil
+}
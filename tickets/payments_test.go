@@ -0,0 +1,214 @@
+package tickets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatPrice(t *testing.T) {
+	assert.Equal(t, "$12.50", FormatPrice(1250, "usd"))
+	assert.Equal(t, "€0.05", FormatPrice(5, "EUR"))
+	assert.Equal(t, "20.00 CHF", FormatPrice(2000, "chf"))
+	assert.Equal(t, "12.50", TicketType{PriceCents: 1250}.PriceValue())
+}
+
+func TestParsePrice(t *testing.T) {
+	for in, cents := range map[string]int64{"12": 1200, "12.5": 1250, "$12.50": 1250, " 0.05 ": 5, "": 0} {
+		got, err := ParsePrice(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, cents, got, in)
+	}
+	for _, in := range []string{"12.505", "-1", "twelve", "1,000"} {
+		_, err := ParsePrice(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestTicketTypeValidate(t *testing.T) {
+	tt := TicketType{Code: " VIP ", Name: " VIP Hot Cocoa ", PriceCents: 1250}
+	assert.NoError(t, tt.Validate())
+	assert.Equal(t, "vip", tt.Code)
+	assert.Equal(t, "VIP Hot Cocoa", tt.Name)
+
+	assert.Error(t, (&TicketType{Code: "vip cocoa", Name: "VIP"}).Validate())
+	assert.Error(t, (&TicketType{Code: "vip"}).Validate())
+	assert.Error(t, (&TicketType{Code: "vip", Name: "VIP", PriceCents: -1}).Validate())
+}
+
+func TestTicketRequestTicketType(t *testing.T) {
+	// ticket types are sold as standard tickets
+	assert.Equal(t, []string{CategoryStandard}, TicketRequest{Accessible: true, Companion: true, TicketType: "vip"}.Categories())
+
+	s := Slot{AvailableTickets: 0, TypeTickets: map[string]int64{"vip": 1}}
+	assert.False(t, s.empty())
+	s.take(CategoryStandard, "vip")
+	assert.True(t, s.empty())
+	assert.Equal(t, "2 vip tickets", countTickets(2, ticketKind(CategoryStandard, "vip")))
+}
+
+func TestNewPaymentProvider(t *testing.T) {
+	p, err := NewPaymentProvider("")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	p, err = NewPaymentProvider("fake")
+	assert.NoError(t, err)
+	assert.Equal(t, "fake", p.Name())
+
+	os.Setenv("ADVLIGHT_STRIPE_KEY", "")
+	_, err = NewPaymentProvider("stripe")
+	assert.Error(t, err)
+
+	os.Setenv("ADVLIGHT_STRIPE_KEY", "sk_test")
+	os.Setenv("ADVLIGHT_STRIPE_WEBHOOK_SECRET", "whsec_test")
+	os.Setenv("ADVLIGHT_STRIPE_URL", "http://localhost:12111/")
+	defer func() {
+		os.Unsetenv("ADVLIGHT_STRIPE_KEY")
+		os.Unsetenv("ADVLIGHT_STRIPE_WEBHOOK_SECRET")
+		os.Unsetenv("ADVLIGHT_STRIPE_URL")
+	}()
+	p, err = NewPaymentProvider("Stripe")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:12111", p.(*Stripe).APIURL)
+
+	_, err = NewPaymentProvider("paypal")
+	assert.Error(t, err)
+}
+
+func TestStripeCheckout(t *testing.T) {
+	now := time.Date(2019, 12, 1, 18, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _, _ := r.BasicAuth()
+		assert.Equal(t, "sk_test", key)
+		switch r.URL.Path {
+		case "/v1/checkout/sessions":
+			assert.Equal(t, "payment", r.FormValue("mode"))
+			assert.Equal(t, "42", r.FormValue("metadata[payment_id]"))
+			assert.Equal(t, "1250", r.FormValue("line_items[0][price_data][unit_amount]"))
+			assert.Equal(t, "usd", r.FormValue("line_items[0][price_data][currency]"))
+			assert.Equal(t, "guest@example.com", r.FormValue("customer_email"))
+			// stripe sessions last at least 30 minutes
+			assert.Equal(t, strconv.FormatInt(now.Add(30*time.Minute).Unix(), 10), r.FormValue("expires_at"))
+			w.Write([]byte(`{"id":"cs_test_1","url":"https://checkout.stripe.com/c/pay/cs_test_1"}`))
+		case "/v1/refunds":
+			assert.Equal(t, "pi_1", r.FormValue("payment_intent"))
+			assert.Equal(t, "refund-42", r.Header.Get("Idempotency-Key"))
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Charge has already been refunded."}}`))
+		}
+	}))
+	defer srv.Close()
+
+	s := NewStripe("sk_test", "whsec_test")
+	s.APIURL = srv.URL
+	s.now = func() time.Time { return now }
+	p := Payment{ID: 42, AmountCents: 1250, Currency: "usd", HoldUntil: now.Add(10 * time.Minute), Email: "guest@example.com", Description: "VIP"}
+	ref, url, err := s.CreateCheckout(p, "https://example.com/ok", "https://example.com/cancel")
+	assert.NoError(t, err)
+	assert.Equal(t, "cs_test_1", ref)
+	assert.Equal(t, "https://checkout.stripe.com/c/pay/cs_test_1", url)
+
+	p.ProviderPayment = "pi_1"
+	assert.EqualError(t, s.Refund(p), "stripe: Charge has already been refunded.")
+	assert.Error(t, s.Refund(Payment{ID: 43}))
+}
+
+func stripeSignature(secret string, ts time.Time, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts.Unix(), 10) + "." + body))
+	return "t=" + strconv.FormatInt(ts.Unix(), 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestStripeWebhook(t *testing.T) {
+	now := time.Date(2019, 12, 1, 18, 0, 0, 0, time.UTC)
+	s := NewStripe("sk_test", "whsec_test")
+	s.now = func() time.Time { return now }
+	header := func(sig string) http.Header {
+		h := http.Header{}
+		h.Set("Stripe-Signature", sig)
+		return h
+	}
+
+	body := `{"type":"checkout.session.completed","data":{"object":{"id":"cs_1","payment_intent":"pi_1","payment_status":"paid"}}}`
+	ev, err := s.ParseWebhook(header(stripeSignature("whsec_test", now, body)), []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentEvent{Ref: "cs_1", PaymentRef: "pi_1", Status: PaymentPaid}, ev)
+
+	// delayed payment methods are not paid yet
+	unpaid := strings.Replace(body, `"paid"`, `"unpaid"`, 1)
+	ev, err = s.ParseWebhook(header(stripeSignature("whsec_test", now, unpaid)), []byte(unpaid))
+	assert.NoError(t, err)
+	assert.Equal(t, "", ev.Status)
+
+	expired := `{"type":"checkout.session.expired","data":{"object":{"id":"cs_1"}}}`
+	ev, err = s.ParseWebhook(header(stripeSignature("whsec_test", now, expired)), []byte(expired))
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentFailed, ev.Status)
+
+	_, err = s.ParseWebhook(header(stripeSignature("whsec_other", now, body)), []byte(body))
+	assert.Error(t, err)
+	_, err = s.ParseWebhook(header(stripeSignature("whsec_test", now.Add(-10*time.Minute), body)), []byte(body))
+	assert.Error(t, err)
+	_, err = s.ParseWebhook(header(""), []byte(body))
+	assert.Error(t, err)
+}
+
+func TestFakePayments(t *testing.T) {
+	f := NewFakePayments()
+	ref, url, err := f.CreateCheckout(Payment{ID: 7, AmountCents: 500}, "https://example.com/ok", "https://example.com/cancel")
+	assert.NoError(t, err)
+	assert.Contains(t, url, "/payments/fake/"+ref+"?")
+
+	ev, err := f.ParseWebhook(nil, f.Event(ref, true))
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentEvent{Ref: ref, PaymentRef: "pay_" + ref, Status: PaymentPaid}, ev)
+	ev, err = f.ParseWebhook(nil, f.Event(ref, false))
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentFailed, ev.Status)
+	_, err = f.ParseWebhook(nil, f.Event("fake_99", true))
+	assert.Error(t, err)
+
+	assert.NoError(t, f.Refund(Payment{ID: 7}))
+	assert.Equal(t, []int64{7}, f.Refunds())
+}
+
+// statusExec records a payments status update and affects rows rows
+type statusExec struct {
+	query string
+	args  []interface{}
+	rows  int64
+}
+
+func (e *statusExec) Exec(query string, args ...interface{}) (sql.Result, error) {
+	e.query, e.args = query, args
+	return sql.Result(driverResult(e.rows)), nil
+}
+
+type driverResult int64
+
+func (r driverResult) LastInsertId() (int64, error) { return 0, nil }
+func (r driverResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func TestCasPaymentStatus(t *testing.T) {
+	p := Payment{ID: 7, Status: PaymentPending}
+	e := &statusExec{rows: 1}
+	assert.NoError(t, casPaymentStatus(e, p, PaymentExpired))
+	// only changed from the status it was read with
+	assert.Contains(t, e.query, "status=$3")
+	assert.Equal(t, []interface{}{int64(7), PaymentExpired, PaymentPending}, e.args)
+
+	// a webhook marked it paid first
+	e = &statusExec{rows: 0}
+	assert.Equal(t, errPaymentChanged, casPaymentStatus(e, p, PaymentExpired))
+}
@@ -0,0 +1,90 @@
+package tickets
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
+	"github.com/jung-kurt/gofpdf"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// EmailPDFTickets attaches a printable PDF ticket to confirmation emails, set ADVLIGHT_EMAIL_PDF=true
+var EmailPDFTickets = os.Getenv("ADVLIGHT_EMAIL_PDF") == "true"
+
+// TicketsPDF renders a printable page for each ticket with the day image, slot, ticket number, address
+// and a QR code of the ticket link for scanning at the gate
+func TicketsPDF(g Guest, tickets []Ticket) ([]byte, error) {
+	lang := g.Language
+	if len(tickets) == 0 {
+		return nil, fmt.Errorf("Sorry, no tickets found")
+	}
+	sorted := append([]Ticket(nil), tickets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Slot.Before(sorted[j].Slot) })
+
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetTitle(config.EventName+" Tickets", true)
+	pdf.SetAutoPageBreak(false, 0)
+	tr := pdf.UnicodeTranslatorFromDescriptor("") // core fonts are cp1252
+	pageW, _ := pdf.GetPageSize()
+	left, _, right, _ := pdf.GetMargins()
+	width := pageW - left - right
+
+	for _, t := range sorted {
+		pdf.AddPage()
+		y := 15.0
+
+		// ticket artwork, tickets without an image still print
+		if img, err := TicketImageData(t); err == nil {
+			imgName := fmt.Sprintf("img-%d", t.Slot.Unix())
+			opts := gofpdf.ImageOptions{ImageType: imageType(img)}
+			info := pdf.RegisterImageOptionsReader(imgName, opts, bytes.NewReader(img))
+			if pdf.Ok() && info != nil {
+				h := width * info.Height() / info.Width()
+				if h > 110 {
+					h = 110
+				}
+				pdf.ImageOptions(imgName, left, y, width, h, false, opts, 0, "")
+				y += h + 8
+			}
+		}
+
+		pdf.SetXY(left, y)
+		pdf.SetFont("Helvetica", "B", 22)
+		pdf.CellFormat(width, 10, tr(config.EventName), "", 1, "C", false, 0, "")
+		pdf.SetFont("Helvetica", "B", 30)
+		pdf.SetTextColor(0x4c, 0x99, 0x1a)
+		pdf.CellFormat(width, 16, tr(i18n.FormatTime(lang, t.Slot.In(config.Location), "format.pdf")), "", 1, "C", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+		pdf.SetFont("Helvetica", "", 14)
+		if t.Number > 0 {
+			pdf.CellFormat(width, 8, tr(i18n.T(lang, "pdf.ticket_number", t.Number)), "", 1, "C", false, 0, "")
+		}
+		pdf.CellFormat(width, 8, tr(g.Email), "", 1, "C", false, 0, "")
+		if config.EventAddress != "" {
+			pdf.Ln(2)
+			pdf.MultiCell(width, 7, tr(config.EventAddress), "", "C", false)
+		}
+
+		png, err := qrcode.Encode(g.GetNumberedTicketURL(t), qrcode.Medium, 512)
+		if err != nil {
+			return nil, err
+		}
+		qrName := "qr-" + t.GetTicketID()
+		pdf.RegisterImageOptionsReader(qrName, gofpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+		qrSize := 55.0
+		pdf.ImageOptions(qrName, (pageW-qrSize)/2, pdf.GetY()+6, qrSize, qrSize, false, gofpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+		pdf.SetXY(left, pdf.GetY()+qrSize+8)
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(width, 5, tr(i18n.T(lang, "pdf.present")), "", "C", false)
+	}
+	if err := pdf.Error(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,26 @@
+package tickets
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTicketsPDF(t *testing.T) {
+	defer testAssets()()
+
+	g := Guest{ID: "guest", Email: "guest@example.com"}
+	slot := time.Date(2019, 12, 2, 2, 30, 0, 0, time.UTC)
+	one, err := TicketsPDF(g, []Ticket{{Slot: slot, Number: 7}})
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(one, []byte("%PDF-")))
+
+	two, err := TicketsPDF(g, []Ticket{{Slot: slot, Number: 7}, {Slot: slot.Add(24 * time.Hour), Number: 9}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(two, []byte("/Type /Page\n")))
+
+	_, err = TicketsPDF(g, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+package tickets
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PoWMaxAge is how long a proof-of-work challenge can be used for
+var PoWMaxAge = 10 * time.Minute
+
+// proofOfWork is a self hosted captcha, the browser must find a nonce where sha256(challenge:nonce)
+// starts with Difficulty zero bits.  Challenges are signed so no server side state is needed to issue them.
+type proofOfWork struct {
+	key        []byte
+	difficulty int
+	now        func() time.Time
+
+	sync sync.Mutex
+	used map[string]time.Time // challenges already redeemed, to stop replays
+}
+
+// NewProofOfWork returns a verifier that issues challenges signed with key, difficulty is the number of
+// leading zero bits required (each extra bit doubles the work, 16 takes a second or two on a phone)
+func NewProofOfWork(key []byte, difficulty int) CAPTCHAVerifier {
+	return &proofOfWork{
+		key:        key,
+		difficulty: difficulty,
+		now:        time.Now,
+		used:       make(map[string]time.Time),
+	}
+}
+
+func (p *proofOfWork) Widget() CAPTCHAWidget {
+	return CAPTCHAWidget{
+		Provider:      CAPTCHAProofOfWork,
+		ResponseField: p.ResponseField(),
+		Challenge:     p.NewChallenge(),
+		Difficulty:    p.difficulty,
+	}
+}
+
+func (p *proofOfWork) ResponseField() string {
+	return "pow-response"
+}
+
+// NewChallenge returns a signed challenge: base64(issued unix|random).signature
+func (p *proofOfWork) NewChallenge() string {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload, uint64(p.now().Unix()))
+	rand.Read(payload[8:])
+	data := base64.RawURLEncoding.EncodeToString(payload)
+	return data + "." + p.sign(data)
+}
+
+func (p *proofOfWork) sign(data string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte("pow:" + data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a challenge:nonce response
+func (p *proofOfWork) Verify(response, remoteip string) error {
+	idx := strings.LastIndex(response, ":")
+	if idx < 0 {
+		return ErrCAPTCHAFailed
+	}
+	challenge, nonce := response[:idx], response[idx+1:]
+	parts := strings.SplitN(challenge, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(p.sign(parts[0]))) {
+		return fmt.Errorf("invalid challenge")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) < 8 {
+		return fmt.Errorf("invalid challenge")
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	now := p.now()
+	if now.Sub(issued) > PoWMaxAge {
+		return fmt.Errorf("challenge expired, please try again")
+	}
+	if _, err := strconv.ParseUint(nonce, 10, 64); err != nil {
+		return ErrCAPTCHAFailed
+	}
+	if LeadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < p.difficulty {
+		return ErrCAPTCHAFailed
+	}
+
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	for c, t := range p.used {
+		if now.Sub(t) > PoWMaxAge {
+			delete(p.used, c)
+		}
+	}
+	if _, ok := p.used[challenge]; ok {
+		return fmt.Errorf("challenge already used, please try again")
+	}
+	p.used[challenge] = issued
+	return nil
+}
+
+// LeadingZeroBits counts the zero bits at the start of a hash
+func LeadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// SolveProofOfWork finds a nonce for the challenge, the same search the browser runs (used by tests)
+func SolveProofOfWork(challenge string, difficulty int) string {
+	for nonce := uint64(0); ; nonce++ {
+		n := strconv.FormatUint(nonce, 10)
+		if LeadingZeroBits(sha256.Sum256([]byte(challenge+":"+n))) >= difficulty {
+			return challenge + ":" + n
+		}
+	}
+}
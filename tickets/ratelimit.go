@@ -0,0 +1,191 @@
+package tickets
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket holding up to Burst tokens, refilled at Burst tokens per Per
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// Rate is the number of tokens added to the bucket per second
+func (l Limit) Rate() float64 {
+	return float64(l.Burst) / l.Per.Seconds()
+}
+
+// RetryAfter is how long until an empty bucket has a token again
+func (l Limit) RetryAfter() time.Duration {
+	return time.Duration(float64(time.Second) / l.Rate())
+}
+
+// Limiter takes a token from the bucket for key, returning false when the bucket is empty
+type Limiter interface {
+	Allow(key string, l Limit) (bool, error)
+}
+
+// RateLimits are keyed by action.keytype, override with ADVLIGHT_RATELIMITS=book.ip=60/1h,cancel.guest=10/1h
+// or disable with ADVLIGHT_RATELIMITS=off
+var RateLimits = map[string]Limit{
+	"book.ip":         {Burst: 60, Per: time.Hour},
+	"book.email":      {Burst: 10, Per: time.Hour},
+	"book.guest":      {Burst: 20, Per: time.Hour},
+	"cancel.ip":       {Burst: 60, Per: time.Hour},
+	"cancel.guest":    {Burst: 10, Per: time.Hour},
+	"eventcode.ip":    {Burst: 10, Per: 10 * time.Minute},
+	"eventcode.guest": {Burst: 10, Per: 10 * time.Minute},
+	"account.ip":      {Burst: 20, Per: time.Hour},
+	"account.guest":   {Burst: 5, Per: time.Hour},
+	"group.ip":        {Burst: 30, Per: time.Hour},
+	"group.group":     {Burst: 20, Per: time.Hour},
+	"donate.ip":       {Burst: 30, Per: time.Hour},
+}
+
+// RateLimiter stores the token buckets, set to the database (in tickets.go init) so limits hold across multiple instances
+var RateLimiter Limiter
+
+func init() {
+	cfg := strings.TrimSpace(os.Getenv("ADVLIGHT_RATELIMITS"))
+	if cfg == "off" {
+		RateLimits = map[string]Limit{}
+	} else if cfg != "" {
+		limits, err := ParseRateLimits(cfg)
+		if err != nil {
+			log.Panicf("invalid ADVLIGHT_RATELIMITS(%v): %s", err, cfg)
+		}
+		for name, l := range limits {
+			RateLimits[name] = l
+		}
+	}
+}
+
+// ParseRateLimits parses name=burst/duration pairs, ie book.ip=60/1h,eventcode.ip=5/10m
+func ParseRateLimits(s string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s should be name=burst/duration", part)
+		}
+		bp := strings.SplitN(kv[1], "/", 2)
+		if len(bp) != 2 {
+			return nil, fmt.Errorf("%s should be name=burst/duration", part)
+		}
+		burst, err := strconv.Atoi(bp[0])
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("%s has an invalid burst", part)
+		}
+		per, err := time.ParseDuration(bp[1])
+		if err != nil || per <= 0 {
+			return nil, fmt.Errorf("%s has an invalid duration", part)
+		}
+		limits[strings.TrimSpace(kv[0])] = Limit{Burst: burst, Per: per}
+	}
+	return limits, nil
+}
+
+// RateLimit takes a token for the named limit (book.ip, cancel.guest, ...) and key.  Unknown limits, empty keys
+// and limiter errors are allowed so a database hiccup does not block bookings.
+func RateLimit(name, key string) bool {
+	limit, ok := RateLimits[name]
+	key = strings.TrimSpace(strings.ToLower(key))
+	if !ok || key == "" {
+		return true
+	}
+	allowed, err := RateLimiter.Allow(name+":"+key, limit)
+	if err != nil {
+		log.Printf("[ERROR] RateLimit %s %s: %v", name, key, err)
+		return true
+	}
+	if !allowed {
+		log.Printf("RateLimit exceeded %s %s", name, key)
+	}
+	return allowed
+}
+
+// dbLimiter keeps buckets in the rate_limits table
+type dbLimiter struct {
+	db *sql.DB
+}
+
+func (d *dbLimiter) Allow(key string, l Limit) (bool, error) {
+	// refill the bucket for the time since it was last touched, then take a token if there is one
+	var tokens float64
+	err := d.db.QueryRow(`
+		insert into rate_limits as rl (key, tokens, updated_at) values ($1, $2, current_timestamp)
+		on conflict (key) do update set
+			tokens = least($2, rl.tokens + extract(epoch from current_timestamp - rl.updated_at) * $3),
+			updated_at = current_timestamp
+		returning tokens;`, key, l.Burst, l.Rate()).Scan(&tokens)
+	if err != nil {
+		return false, err
+	}
+	if tokens < 1 {
+		return false, nil
+	}
+	res, err := d.db.Exec(`update rate_limits set tokens = tokens - 1 where key=$1 and tokens >= 1;`, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// PruneRateLimits removes buckets that have not been used in a day, they would be full by now anyway
+func (r *repo) PruneRateLimits() (int64, error) {
+	res, err := r.db.Exec(`delete from rate_limits where updated_at < current_timestamp - interval '1 day';`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// memoryLimiter keeps buckets in process, for tests and single instance development
+type memoryLimiter struct {
+	sync    sync.Mutex
+	now     func() time.Time
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewMemoryLimiter returns a Limiter that keeps its buckets in memory
+func NewMemoryLimiter() Limiter {
+	return &memoryLimiter{now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+func (m *memoryLimiter) Allow(key string, l Limit) (bool, error) {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	now := m.now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), updated: now}
+		m.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * l.Rate()
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
@@ -0,0 +1,52 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("book.ip=60/1h, eventcode.ip=5/10m")
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Burst: 60, Per: time.Hour}, limits["book.ip"])
+	assert.Equal(t, Limit{Burst: 5, Per: 10 * time.Minute}, limits["eventcode.ip"])
+	assert.Equal(t, 2*time.Minute, limits["eventcode.ip"].RetryAfter())
+
+	for _, bad := range []string{"book.ip", "book.ip=60", "book.ip=x/1h", "book.ip=0/1h", "book.ip=6/forever"} {
+		_, err = ParseRateLimits(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	now := time.Date(2019, 12, 1, 18, 0, 0, 0, time.UTC)
+	m := NewMemoryLimiter().(*memoryLimiter)
+	m.now = func() time.Time { return now }
+	l := Limit{Burst: 3, Per: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		ok, err := m.Allow("book.ip:10.0.0.1", l)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, _ := m.Allow("book.ip:10.0.0.1", l)
+	assert.False(t, ok, "bucket should be empty")
+	ok, _ = m.Allow("book.ip:10.0.0.2", l)
+	assert.True(t, ok, "other keys have their own bucket")
+
+	now = now.Add(20 * time.Second) // 1 token
+	ok, _ = m.Allow("book.ip:10.0.0.1", l)
+	assert.True(t, ok)
+	ok, _ = m.Allow("book.ip:10.0.0.1", l)
+	assert.False(t, ok)
+
+	now = now.Add(time.Hour) // refill is capped at burst
+	for i := 0; i < 3; i++ {
+		ok, _ = m.Allow("book.ip:10.0.0.1", l)
+		assert.True(t, ok)
+	}
+	ok, _ = m.Allow("book.ip:10.0.0.1", l)
+	assert.False(t, ok)
+}
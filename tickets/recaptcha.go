@@ -3,24 +3,28 @@ package tickets
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"time"
 )
 
-// defaultVerificationURL is The default URL that's used to verify the user's response to the challenge.
+// verification URLs used to verify the user's response to the challenge
 // @see https://developers.google.com/recaptcha/docs/verify#api-request
-var VerificationURL = "https://www.google.com/recaptcha/api/siteverify"
-var reCAPTCHASecret = ""
-var reClient = &http.Client{Timeout: 20 * time.Second}
+// @see https://docs.hcaptcha.com/#verify-the-user-response-server-side
+// @see https://developers.cloudflare.com/turnstile/get-started/server-side-validation/
+const (
+	ReCAPTCHAVerificationURL = "https://www.google.com/recaptcha/api/siteverify"
+	HCaptchaVerificationURL  = "https://api.hcaptcha.com/siteverify"
+	TurnstileVerificationURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
 
-// CAPTCHADisabled disables captcha requirements if true
-var CAPTCHADisabled = false
+var reClient = &http.Client{Timeout: 20 * time.Second}
 
 // Response is the JSON structure that is returned by the verification API after a challenge response is verified.
+// reCAPTCHA, hCaptcha and Turnstile all share this shape.
 // @see https://developers.google.com/recaptcha/docs/verify#api-response
 type Response struct {
 	Success bool `json:"success"`
@@ -31,62 +35,139 @@ type Response struct {
 	// The hostname of the site where the reCAPTCHA was solved
 	Hostname string `json:"hostname"`
 
+	// Score (reCAPTCHA v3 only) 1.0 is very likely a good interaction, 0.0 is very likely a bot
+	Score float64 `json:"score"`
+
+	// Action name for this request (reCAPTCHA v3 and Turnstile)
+	Action string `json:"action"`
+
 	// Optional list of error codes returned by the service
 	ErrorCodes []string `json:"error-codes"`
 }
 
-// Verify the users's response to the reCAPTCHA challenge with the API server.
-//
-// The parameter response is obtained after the user successfully solves the challenge presented by the JS widget. The
-// remoteip parameter is optional; just send it empty if you don't want to use it.
-//
-// CAPTCHAVerify function will return a boolean that will have the final result returned by the API as well as an optional list
-// of errors. They might be useful for logging purposed but you don't have to show them to the user.
-func CAPTCHAVerify(response string, remoteip string) (Response, error) {
+// siteVerifier verifies responses with a siteverify style API (reCAPTCHA, hCaptcha, Turnstile)
+type siteVerifier struct {
+	widget          CAPTCHAWidget
+	verificationURL string
+	secret          string
+	minScore        float64 // reCAPTCHA v3 only, 0 disables the score check
+	action          string  // reCAPTCHA v3 only, expected action
+}
 
-	resp := Response{Success: false}
-	respStart := time.Now()
+// NewReCAPTCHA verifies Google reCAPTCHA v2 (invisible) responses
+func NewReCAPTCHA(siteKey, secret string) CAPTCHAVerifier {
+	return &siteVerifier{
+		widget: CAPTCHAWidget{
+			Provider:      CAPTCHAReCAPTCHA,
+			ScriptURL:     "https://www.google.com/recaptcha/api.js",
+			SiteKey:       siteKey,
+			ResponseField: "g-recaptcha-response",
+		},
+		verificationURL: ReCAPTCHAVerificationURL,
+		secret:          secret,
+	}
+}
 
-	if CAPTCHADisabled {
-		return resp, errors.New("CAPTCHA Disabled")
+// NewReCAPTCHAv3 verifies Google reCAPTCHA v3 responses, rejecting scores below minScore
+func NewReCAPTCHAv3(siteKey, secret string, minScore float64) CAPTCHAVerifier {
+	return &siteVerifier{
+		widget: CAPTCHAWidget{
+			Provider:      CAPTCHAReCAPTCHAv3,
+			ScriptURL:     "https://www.google.com/recaptcha/api.js?render=" + url.QueryEscape(siteKey),
+			SiteKey:       siteKey,
+			ResponseField: "g-recaptcha-response",
+		},
+		verificationURL: ReCAPTCHAVerificationURL,
+		secret:          secret,
+		minScore:        minScore,
+		action:          "book",
 	}
+}
 
-	params := url.Values{}
+// NewHCaptcha verifies hCaptcha (invisible) responses
+func NewHCaptcha(siteKey, secret string) CAPTCHAVerifier {
+	return &siteVerifier{
+		widget: CAPTCHAWidget{
+			Provider:      CAPTCHAHCaptcha,
+			ScriptURL:     "https://js.hcaptcha.com/1/api.js",
+			SiteKey:       siteKey,
+			ResponseField: "h-captcha-response",
+		},
+		verificationURL: HCaptchaVerificationURL,
+		secret:          secret,
+	}
+}
 
-	if reCAPTCHASecret == "" {
-		reCAPTCHASecret = os.Getenv("ADVLIGHT_RECAPTCHA_SECRET")
+// NewTurnstile verifies Cloudflare Turnstile responses
+func NewTurnstile(siteKey, secret string) CAPTCHAVerifier {
+	return &siteVerifier{
+		widget: CAPTCHAWidget{
+			Provider:      CAPTCHATurnstile,
+			ScriptURL:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+			SiteKey:       siteKey,
+			ResponseField: "cf-turnstile-response",
+		},
+		verificationURL: TurnstileVerificationURL,
+		secret:          secret,
 	}
+}
 
-	params.Set("secret", reCAPTCHASecret)
+func (v *siteVerifier) Widget() CAPTCHAWidget {
+	return v.widget
+}
+
+func (v *siteVerifier) ResponseField() string {
+	return v.widget.ResponseField
+}
+
+// Verify the users's response to the challenge with the API server.
+//
+// The parameter response is obtained after the user successfully solves the challenge presented by the JS widget. The
+// remoteip parameter is optional; just send it empty if you don't want to use it.
+func (v *siteVerifier) Verify(response string, remoteip string) error {
+	resp := Response{Success: false}
+	respStart := time.Now()
 
-	if len(response) > 0 {
-		params.Set("response", response)
+	if response == "" {
+		return ErrCAPTCHAFailed
 	}
 
+	params := url.Values{}
+	params.Set("secret", v.secret)
+	params.Set("response", response)
 	if net.ParseIP(remoteip) != nil {
 		params.Set("remoteip", remoteip)
 	}
 
 	defer func() {
-		log.Printf("CAPTCHAVerify %s %v", time.Now().Sub(respStart), resp)
+		log.Printf("CAPTCHAVerify %s %s %+v", v.widget.Provider, time.Now().Sub(respStart), resp)
 	}()
 
-	r, err := reClient.PostForm(VerificationURL, params)
-
+	r, err := reClient.PostForm(v.verificationURL, params)
 	if err != nil {
-		return resp, err
+		return err
 	}
-
 	defer r.Body.Close()
 
 	if r.StatusCode != 200 {
-		return resp, errors.New(r.Status)
+		return errors.New(r.Status)
 	}
 
-	json.NewDecoder(r.Body).Decode(&resp)
-	if resp.ErrorCodes != nil && len(resp.ErrorCodes) > 0 {
-		return resp, errors.New(resp.ErrorCodes[0])
+	err = json.NewDecoder(r.Body).Decode(&resp)
+	if err != nil {
+		return err
 	}
-	return resp, nil
-
+	if len(resp.ErrorCodes) > 0 {
+		return errors.New(resp.ErrorCodes[0])
+	}
+	if !resp.Success {
+		return ErrCAPTCHAFailed
+	}
+	if v.action != "" && resp.Action != "" && resp.Action != v.action {
+		return fmt.Errorf("unexpected captcha action %q", resp.Action)
+	}
+	if v.minScore > 0 && resp.Score < v.minScore {
+		return ErrCAPTCHAFailed
+	}
+	return nil
 }
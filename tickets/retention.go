@@ -0,0 +1,146 @@
+package tickets
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention is how long after a guest's last ticket (or sign up, for guests without tickets) their email and
+// addresses are kept before being anonymized.  Zero disables the retention job.
+// Set with ADVLIGHT_RETENTION=180d (or any time.Duration, ie 4320h), defaults to off.
+var Retention time.Duration
+
+func init() {
+	if cfg := strings.TrimSpace(os.Getenv("ADVLIGHT_RETENTION")); cfg != "" && cfg != "off" {
+		d, err := ParseRetention(cfg)
+		if err != nil {
+			log.Panicf("invalid ADVLIGHT_RETENTION(%v): %s", err, cfg)
+		}
+		Retention = d
+	}
+}
+
+// ParseRetention parses a duration with an optional day suffix, ie 180d or 4320h
+func ParseRetention(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	var (
+		d   time.Duration
+		err error
+	)
+	if strings.HasSuffix(s, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(s, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("retention must be positive")
+	}
+	return d, nil
+}
+
+// RetentionReport counts what a retention run anonymized (or would anonymize, for a dry run)
+type RetentionReport struct {
+	Cutoff       time.Time
+	DryRun       bool
+	Guests       int64
+	Tickets      int64
+	Emails       int64
+	Donations    int64
+	Groups       int64 // coordinator emails of past groups
+	Invites      int64 // emails invited to past groups, deleted
+	AuditEntries int64
+	Attempts     int64
+}
+
+func (rr RetentionReport) String() string {
+	verb := "anonymized"
+	if rr.DryRun {
+		verb = "would anonymize"
+	}
+	return fmt.Sprintf("retention cutoff %s: %s %d guests, %d tickets, %d emails, %d donations, %d groups, %d group invites, %d audit entries, %d event code attempts",
+		rr.Cutoff.Format(time.RFC3339), verb, rr.Guests, rr.Tickets, rr.Emails, rr.Donations, rr.Groups, rr.Invites, rr.AuditEntries, rr.Attempts)
+}
+
+// ApplyRetention anonymizes guests whose last ticket (or sign up) is before now-retention.  Emails and addresses
+// are removed but guest ids, tickets and slots are kept so ticket counts and stats still add up.
+// A dry run makes the same changes in a transaction that is rolled back, so the report is exact.
+func (r *repo) ApplyRetention(a Actor, retention time.Duration, now time.Time, dryRun bool) (RetentionReport, error) {
+	report := RetentionReport{Cutoff: now.Add(-retention), DryRun: dryRun}
+	log.Printf("ApplyRetention %s %s dryrun=%v", a, report.Cutoff, dryRun)
+	if retention <= 0 {
+		return report, fmt.Errorf("retention is not configured")
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return report, err
+	}
+	_, err = tx.Exec(`
+		create temp table retention_guests on commit drop as
+		select g.id, g.email from guests g
+		where g.anonymized_at is null
+		and greatest(g.created_at, coalesce((select max(slot) from tickets t where t.guest_id=g.id), g.created_at)) < $1;`, report.Cutoff)
+	if err != nil {
+		tx.Rollback()
+		return report, err
+	}
+	// the audit log is scrubbed of every email the guest used, see anonymizeAudit, before the guests' emails go
+	rows, err := tx.Query(`select id, email from retention_guests;`)
+	if err != nil {
+		tx.Rollback()
+		return report, err
+	}
+	guests := make([]Guest, 0)
+	for rows.Next() {
+		var g Guest
+		rows.Scan(&g.ID, &g.Email)
+		guests = append(guests, g)
+	}
+	rows.Close()
+	for _, g := range guests {
+		n, err := anonymizeAudit(tx, g.ID, g.Email)
+		if err != nil {
+			tx.Rollback()
+			return report, err
+		}
+		report.AuditEntries += n
+	}
+	for _, stmt := range []struct {
+		count *int64
+		query string
+		args  []interface{}
+	}{
+		{&report.Tickets, `update tickets set booked_ip=null, booked_user_agent='' where guest_id in (select id from retention_guests) and (booked_ip is not null or booked_user_agent!='');`, nil},
+		{&report.Emails, `update emails set address=$1 where guest_id in (select id from retention_guests) and address!=$1;`, []interface{}{AnonymizedEmail}},
+		{&report.Donations, `update donations set email=$1 where guest_id in (select id from retention_guests) and email!=$1;`, []interface{}{AnonymizedEmail}},
+		{&report.Groups, `update booking_groups set coordinator_email=$1 where coalesce(slot, created_at) < $2 and coordinator_email!=$1;`, []interface{}{AnonymizedEmail, report.Cutoff}},
+		{&report.Invites, `delete from group_invites where group_id in (select id from booking_groups where coalesce(slot, created_at) < $1);`, []interface{}{report.Cutoff}},
+		{&report.Attempts, `update eventcode_attempts set ip_address=null, user_agent='' where created_at < $1 and (ip_address is not null or user_agent!='');`, []interface{}{report.Cutoff}},
+		{&report.Guests, `update guests set email='anonymized-' || id || '@invalid', ip_address=null, anonymized_at=$1 where id in (select id from retention_guests);`, []interface{}{now}},
+	} {
+		res, err := tx.Exec(stmt.query, stmt.args...)
+		if err != nil {
+			tx.Rollback()
+			return report, err
+		}
+		*stmt.count, _ = res.RowsAffected()
+	}
+	if dryRun {
+		return report, tx.Rollback()
+	}
+	err = tx.Commit()
+	if err != nil {
+		return report, err
+	}
+	r.Audit(a, AuditEntry{Action: AuditRetention, Before: "cutoff=" + report.Cutoff.Format(time.RFC3339), After: report.String()})
+	r.ClearCache()
+	return report, nil
+}
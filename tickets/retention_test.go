@@ -0,0 +1,28 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetention(t *testing.T) {
+	d, err := ParseRetention("180d")
+	assert.NoError(t, err)
+	assert.Equal(t, 180*24*time.Hour, d)
+	d, err = ParseRetention(" 4320h ")
+	assert.NoError(t, err)
+	assert.Equal(t, 180*24*time.Hour, d)
+	for _, s := range []string{"", "0d", "-1d", "xd", "soon"} {
+		_, err = ParseRetention(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRetentionReport(t *testing.T) {
+	rr := RetentionReport{Cutoff: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), DryRun: true, Guests: 2, Tickets: 3}
+	assert.Contains(t, rr.String(), "would anonymize 2 guests, 3 tickets")
+	rr.DryRun = false
+	assert.Contains(t, rr.String(), "anonymized 2 guests")
+}
@@ -0,0 +1,242 @@
+package tickets
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/config"
+)
+
+// slot change actions supported by the admin slot editor
+const (
+	SlotActionAdd    = "add"    // add tickets to a slot, creating the slot if needed
+	SlotActionRemove = "remove" // delete unassigned tickets from a slot
+	SlotActionMove   = "move"   // move unassigned tickets to another event code
+)
+
+// MaxSlotChange is the most tickets that can be added, removed or moved in a single slot at once
+var MaxSlotChange = 500
+
+// SlotChangeRequest describes a bulk change to slots across a date range
+type SlotChangeRequest struct {
+	Action      string
+	StartDate   time.Time
+	EndDate     time.Time
+	Times       []string // "18:30" style times of day, in config.Location
+	EventCode   string   // pool the tickets are added to or taken from, "" is public
+	ToEventCode string   // pool the tickets are moved to (move only)
+	Category    string   // CategoryStandard, CategoryAccessible or CategoryCompanion tickets
+	TicketType  string   // a TicketType code, "" for general admission
+	Count       int
+}
+
+// SlotChange is a single change to a single slot, as previewed and applied by the admin
+type SlotChange struct {
+	Action           string
+	Slot             time.Time
+	EventCode        string
+	ToEventCode      string
+	Category         string
+	TicketType       string
+	Count            int   // tickets that will be changed
+	Requested        int   // tickets the admin asked to change
+	NumberTickets    int64 // tickets in the slot/event code pool before the change
+	AvailableTickets int64 // unassigned tickets in the slot/event code pool before the change
+	Applied          int64 // tickets changed when applied
+	Error            string
+}
+
+// ParseSlotTimes parses a comma separated list of times (18:00,18:30) into "15:04" strings
+func ParseSlotTimes(s string) ([]string, error) {
+	times := make([]string, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %s, use 24 hour time like 18:30", part)
+		}
+		if t.Minute() != 0 && t.Minute() != 30 {
+			return nil, fmt.Errorf("invalid time %s, slots must start on the hour or half hour", part)
+		}
+		times = append(times, t.Format("15:04"))
+	}
+	if len(times) == 0 {
+		return nil, fmt.Errorf("at least one time is required")
+	}
+	return times, nil
+}
+
+// Validate checks the request is sane before any slots are looked up
+func (req *SlotChangeRequest) Validate() error {
+	req.EventCode = strings.TrimSpace(strings.ToLower(req.EventCode))
+	req.ToEventCode = strings.TrimSpace(strings.ToLower(req.ToEventCode))
+	category, err := ParseCategory(req.Category)
+	if err != nil {
+		return err
+	}
+	req.Category = category
+	req.TicketType = strings.TrimSpace(strings.ToLower(req.TicketType))
+	if req.TicketType != "" && req.Category != CategoryStandard {
+		return fmt.Errorf("ticket types are only sold as standard tickets")
+	}
+	switch req.Action {
+	case SlotActionAdd, SlotActionRemove:
+	case SlotActionMove:
+		if req.EventCode == req.ToEventCode {
+			return fmt.Errorf("tickets must be moved to a different event code")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", req.Action)
+	}
+	if req.Count < 1 || req.Count > MaxSlotChange {
+		return fmt.Errorf("count must be between 1 and %d", MaxSlotChange)
+	}
+	if req.StartDate.IsZero() || req.EndDate.IsZero() {
+		return fmt.Errorf("start and end dates are required")
+	}
+	if req.EndDate.Before(req.StartDate) {
+		return fmt.Errorf("end date is before start date")
+	}
+	if req.EndDate.Sub(req.StartDate) > 90*24*time.Hour {
+		return fmt.Errorf("date range is limited to 90 days")
+	}
+	if len(req.Times) == 0 {
+		return fmt.Errorf("at least one time is required")
+	}
+	return nil
+}
+
+// slots returns every slot time covered by the request
+func (req *SlotChangeRequest) slots() []time.Time {
+	slots := make([]time.Time, 0)
+	start := time.Date(req.StartDate.Year(), req.StartDate.Month(), req.StartDate.Day(), 0, 0, 0, 0, config.Location)
+	end := time.Date(req.EndDate.Year(), req.EndDate.Month(), req.EndDate.Day(), 0, 0, 0, 0, config.Location)
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		for _, tm := range req.Times {
+			t, err := time.Parse("15:04", tm)
+			if err != nil {
+				continue // validated by ParseSlotTimes
+			}
+			slots = append(slots, time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, config.Location))
+		}
+	}
+	return slots
+}
+
+// PlanSlotChanges builds the list of changes a request would make without changing anything,
+// used for the confirmation preview.  Remove and move are capped to the unassigned tickets in each slot.
+func (r *repo) PlanSlotChanges(req SlotChangeRequest) ([]SlotChange, error) {
+	log.Printf("PlanSlotChanges %+v", req)
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	changes := make([]SlotChange, 0)
+	for _, slot := range req.slots() {
+		change := SlotChange{
+			Action:      req.Action,
+			Slot:        slot,
+			EventCode:   req.EventCode,
+			ToEventCode: req.ToEventCode,
+			Category:    req.Category,
+			TicketType:  req.TicketType,
+			Requested:   req.Count,
+			Count:       req.Count,
+		}
+		err := r.db.QueryRow(`select count(*), count(*) filter (where guest_id is null) from tickets where slot=$1 and coalesce(event_code,'')=$2 and category=$3 and coalesce(ticket_type,'')=$4;`, slot, req.EventCode, req.Category, req.TicketType).Scan(&change.NumberTickets, &change.AvailableTickets)
+		if err != nil {
+			return nil, err
+		}
+		if req.Action != SlotActionAdd {
+			if change.AvailableTickets < int64(change.Count) {
+				change.Count = int(change.AvailableTickets)
+			}
+			if change.Count == 0 {
+				continue // nothing to remove or move for this slot
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// ApplySlotChanges applies previously planned changes, errors are recorded on each change
+func (r *repo) ApplySlotChanges(a Actor, changes []SlotChange) []SlotChange {
+	for idx := range changes {
+		c := &changes[idx]
+		var err error
+		switch c.Action {
+		case SlotActionAdd:
+			err = r.CreateSlotTickets(a, c.EventCode, c.Category, c.TicketType, int(c.Slot.Unix()), c.Count)
+			if err == nil {
+				c.Applied = int64(c.Count)
+			}
+		case SlotActionRemove:
+			c.Applied, err = r.RemoveSlotTickets(a, c.EventCode, c.Category, c.TicketType, c.Slot, c.Count)
+		case SlotActionMove:
+			c.Applied, err = r.MoveSlotTickets(a, c.EventCode, c.ToEventCode, c.Category, c.TicketType, c.Slot, c.Count)
+		default:
+			err = fmt.Errorf("unknown action %q", c.Action)
+		}
+		if err != nil {
+			c.Error = err.Error()
+		}
+	}
+	r.ClearCache()
+	return changes
+}
+
+// RemoveSlotTickets deletes up to count unassigned tickets in the category and ticket type from the slot, highest ticket numbers first
+func (r *repo) RemoveSlotTickets(a Actor, eventCode, category, ticketType string, slot time.Time, count int) (int64, error) {
+	log.Println(`RemoveSlotTickets`, a, eventCode, category, ticketType, slot, count)
+	if count > MaxSlotChange { // safety
+		return 0, fmt.Errorf("%d is too many", count)
+	}
+	eventCode = strings.TrimSpace(strings.ToLower(eventCode))
+	res, err := r.db.Exec(`
+		delete from tickets where (slot,num) in (
+			select slot,num from tickets
+			where slot=$1 and guest_id is null and coalesce(event_code,'')=$2 and category=$4 and coalesce(ticket_type,'')=$5
+			order by num desc limit $3 for update skip locked
+		);`, slot, eventCode, count, category, ticketType)
+	if err != nil {
+		return 0, err
+	}
+	r.ClearCache()
+	n, err := res.RowsAffected()
+	r.Audit(a, AuditEntry{Action: AuditRemoveSlots, Slot: slot, EventCode: eventCode, After: "-" + countTickets(n, ticketKind(category, ticketType))})
+	return n, err
+}
+
+// MoveSlotTickets moves up to count unassigned tickets in the category and ticket type in the slot from one event code pool to another
+func (r *repo) MoveSlotTickets(a Actor, fromEventCode, toEventCode, category, ticketType string, slot time.Time, count int) (int64, error) {
+	log.Println(`MoveSlotTickets`, a, fromEventCode, toEventCode, category, ticketType, slot, count)
+	if count > MaxSlotChange { // safety
+		return 0, fmt.Errorf("%d is too many", count)
+	}
+	fromEventCode = strings.TrimSpace(strings.ToLower(fromEventCode))
+	toEventCode = strings.TrimSpace(strings.ToLower(toEventCode))
+	res, err := r.db.Exec(`
+		update tickets set event_code=NULLIF($3,''), updated_at=current_timestamp where (slot,num) in (
+			select slot,num from tickets
+			where slot=$1 and guest_id is null and coalesce(event_code,'')=$2 and category=$5 and coalesce(ticket_type,'')=$6
+			order by num desc limit $4 for update skip locked
+		);`, slot, fromEventCode, toEventCode, count, category, ticketType)
+	if err != nil {
+		return 0, err
+	}
+	r.ClearCache()
+	n, err := res.RowsAffected()
+	r.Audit(a, AuditEntry{
+		Action:    AuditMoveSlots,
+		Slot:      slot,
+		EventCode: fromEventCode,
+		Before:    fmt.Sprintf("%s in %q", countTickets(n, ticketKind(category, ticketType)), fromEventCode),
+		After:     fmt.Sprintf("%s in %q", countTickets(n, ticketKind(category, ticketType)), toEventCode),
+	})
+	return n, err
+}
@@ -0,0 +1,57 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSlotTimes(t *testing.T) {
+	times, err := ParseSlotTimes("18:00, 18:30,21:00,")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"18:00", "18:30", "21:00"}, times)
+
+	_, err = ParseSlotTimes("18:15")
+	assert.Error(t, err)
+	_, err = ParseSlotTimes("6pm")
+	assert.Error(t, err)
+	_, err = ParseSlotTimes(" ")
+	assert.Error(t, err)
+}
+
+func TestSlotChangeRequest(t *testing.T) {
+	start := time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC)
+	req := SlotChangeRequest{
+		Action:    SlotActionAdd,
+		StartDate: start,
+		EndDate:   start.AddDate(0, 0, 2),
+		Times:     []string{"18:00", "18:30"},
+		EventCode: " Staff ",
+		Count:     10,
+	}
+	assert.NoError(t, req.Validate())
+	assert.Equal(t, "staff", req.EventCode)
+	assert.Equal(t, CategoryStandard, req.Category)
+	slots := req.slots()
+	assert.Len(t, slots, 6)
+	assert.Equal(t, 18, slots[0].Hour())
+	assert.Equal(t, 30, slots[5].Minute())
+	assert.Equal(t, 3, slots[5].Day())
+
+	req.Action = SlotActionMove
+	req.ToEventCode = "STAFF"
+	assert.Error(t, req.Validate())
+
+	req.Action = SlotActionRemove
+	req.Count = MaxSlotChange + 1
+	assert.Error(t, req.Validate())
+
+	req.Count = 10
+	req.Category = "vip"
+	assert.Error(t, req.Validate())
+
+	req.Category = CategoryAccessible
+	req.EndDate = start.AddDate(0, 0, -1)
+	assert.Error(t, req.Validate())
+}
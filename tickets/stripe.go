@@ -0,0 +1,207 @@
+package tickets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StripeAPIURL is Stripe's API, any API compatible with Stripe Checkout Sessions and Refunds works
+// @see https://stripe.com/docs/api/checkout/sessions/create
+const StripeAPIURL = "https://api.stripe.com"
+
+// stripeMinExpiry is the shortest a Stripe checkout session can last
+const stripeMinExpiry = 30 * time.Minute
+
+// stripeTolerance is how old a webhook's signature timestamp can be
+const stripeTolerance = 5 * time.Minute
+
+// Stripe takes payments with Stripe Checkout
+type Stripe struct {
+	APIURL        string
+	Key           string // secret API key
+	WebhookSecret string // the webhook endpoint's signing secret, whsec_...
+
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewStripe creates the provider for the secret API key and webhook signing secret
+func NewStripe(key, webhookSecret string) *Stripe {
+	return &Stripe{
+		APIURL:        StripeAPIURL,
+		Key:           key,
+		WebhookSecret: webhookSecret,
+		client:        &http.Client{Timeout: 20 * time.Second},
+		now:           time.Now,
+	}
+}
+
+func (s *Stripe) Name() string {
+	return "stripe"
+}
+
+// stripeError is the body of a failed API request
+type stripeError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// post calls the API with a form encoded body and decodes the JSON response into out
+func (s *Stripe) post(path, idempotencyKey string, form url.Values, out interface{}) error {
+	req, err := http.NewRequest("POST", s.APIURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.Key, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var se stripeError
+		if json.Unmarshal(body, &se) == nil && se.Error.Message != "" {
+			return fmt.Errorf("stripe: %s", se.Error.Message)
+		}
+		return fmt.Errorf("stripe: %s", resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// CreateCheckout creates a Checkout Session for the payment, ref is the session id
+func (s *Stripe) CreateCheckout(p Payment, successURL, cancelURL string) (string, string, error) {
+	expires := p.HoldUntil
+	if min := s.now().Add(stripeMinExpiry); expires.Before(min) {
+		expires = min
+	}
+	id := strconv.FormatInt(p.ID, 10)
+	form := url.Values{
+		"mode":                                   {"payment"},
+		"success_url":                            {successURL},
+		"cancel_url":                             {cancelURL},
+		"client_reference_id":                    {id},
+		"metadata[payment_id]":                   {id},
+		"expires_at":                             {strconv.FormatInt(expires.Unix(), 10)},
+		"line_items[0][quantity]":                {"1"},
+		"line_items[0][price_data][currency]":    {p.Currency},
+		"line_items[0][price_data][unit_amount]": {strconv.FormatInt(p.AmountCents, 10)},
+		"line_items[0][price_data][product_data][name]": {p.Description},
+	}
+	if p.Email != "" {
+		form.Set("customer_email", p.Email)
+	}
+	var session struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	err := s.post("/v1/checkout/sessions", "checkout-"+id, form, &session)
+	if err != nil {
+		return "", "", err
+	}
+	return session.ID, session.URL, nil
+}
+
+// stripeEvent is the part of a webhook event used
+// @see https://stripe.com/docs/api/events/object
+type stripeEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			ID            string `json:"id"`
+			PaymentIntent string `json:"payment_intent"`
+			PaymentStatus string `json:"payment_status"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+// ParseWebhook verifies the Stripe-Signature header and maps checkout session events to payment statuses
+// @see https://stripe.com/docs/webhooks/signatures
+func (s *Stripe) ParseWebhook(header http.Header, body []byte) (PaymentEvent, error) {
+	err := s.verifySignature(header.Get("Stripe-Signature"), body)
+	if err != nil {
+		return PaymentEvent{}, err
+	}
+	var se stripeEvent
+	err = json.Unmarshal(body, &se)
+	if err != nil {
+		return PaymentEvent{}, err
+	}
+	ev := PaymentEvent{Ref: se.Data.Object.ID, PaymentRef: se.Data.Object.PaymentIntent}
+	switch se.Type {
+	case "checkout.session.completed":
+		// delayed payment methods complete with payment_status=unpaid and send async_payment_succeeded later
+		if se.Data.Object.PaymentStatus == "paid" {
+			ev.Status = PaymentPaid
+		}
+	case "checkout.session.async_payment_succeeded":
+		ev.Status = PaymentPaid
+	case "checkout.session.async_payment_failed", "checkout.session.expired":
+		ev.Status = PaymentFailed
+	}
+	return ev, nil
+}
+
+func (s *Stripe) verifySignature(header string, body []byte) error {
+	var (
+		timestamp  string
+		signatures []string
+	)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return fmt.Errorf("stripe: invalid signature header")
+	}
+	if age := s.now().Sub(time.Unix(ts, 0)); age > stripeTolerance || age < -stripeTolerance {
+		return fmt.Errorf("stripe: signature timestamp is too old")
+	}
+	mac := hmac.New(sha256.New, []byte(s.WebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("stripe: invalid signature")
+}
+
+// Refund refunds the payment's payment intent in full
+func (s *Stripe) Refund(p Payment) error {
+	if p.ProviderPayment == "" {
+		return fmt.Errorf("stripe: payment %d has no payment intent to refund", p.ID)
+	}
+	var refund struct {
+		ID string `json:"id"`
+	}
+	return s.post("/v1/refunds", "refund-"+strconv.FormatInt(p.ID, 10), url.Values{"payment_intent": {p.ProviderPayment}}, &refund)
+}
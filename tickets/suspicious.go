@@ -0,0 +1,101 @@
+package tickets
+
+import (
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// IPActivity is an address that has created many guests or booked tickets for many guests
+type IPActivity struct {
+	IPAddress string
+	Guests    int64
+	Tickets   int64
+	Emails    []string
+}
+
+// SlotBurst is a burst of bookings for the same slot within a short window
+type SlotBurst struct {
+	Slot      time.Time
+	Start     time.Time // start of the window the bookings landed in
+	Bookings  int64
+	Addresses int64 // distinct booking ips in the window
+}
+
+// SuspiciousFilter holds the thresholds used to flag activity in the admin screens
+type SuspiciousFilter struct {
+	Since         time.Duration // how far back to look
+	MinGuests     int           // guests from one ip before it is flagged
+	BurstWindow   time.Duration // size of the window bookings are bucketed into
+	MinBurstCount int           // bookings for one slot in one window before it is flagged
+}
+
+// DefaultSuspiciousFilter is used when the admin does not supply thresholds
+var DefaultSuspiciousFilter = SuspiciousFilter{
+	Since:         7 * 24 * time.Hour,
+	MinGuests:     5,
+	BurstWindow:   5 * time.Minute,
+	MinBurstCount: 20,
+}
+
+// GetIPActivity returns addresses used by at least f.MinGuests guests, either when the guest was created or when
+// a ticket was booked, most guests first
+func (r *repo) GetIPActivity(f SuspiciousFilter) ([]IPActivity, error) {
+	log.Println("GetIPActivity", f)
+	rows, err := r.db.Query(`
+		with activity as (
+			select ip_address as ip, id as guest_id, 0 as tickets from guests
+			where ip_address is not null and created_at > current_timestamp - $1 * interval '1 second'
+			union all
+			select booked_ip, guest_id, 1 from tickets
+			where booked_ip is not null and guest_id is not null and booked_at > current_timestamp - $1 * interval '1 second'
+		)
+		select host(a.ip), count(distinct a.guest_id), sum(a.tickets), array_agg(distinct g.email::text)
+		from activity a join guests g on g.id=a.guest_id
+		group by a.ip having count(distinct a.guest_id) >= $2
+		order by 2 desc, 3 desc limit 100;`, int64(f.Since.Seconds()), f.MinGuests)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	activity := make([]IPActivity, 0)
+	for rows.Next() {
+		a := IPActivity{}
+		err = rows.Scan(&a.IPAddress, &a.Guests, &a.Tickets, pq.Array(&a.Emails))
+		if err != nil {
+			return nil, err
+		}
+		activity = append(activity, a)
+	}
+	return activity, nil
+}
+
+// GetSlotBursts returns windows where a single slot received at least f.MinBurstCount bookings, largest first
+func (r *repo) GetSlotBursts(f SuspiciousFilter) ([]SlotBurst, error) {
+	log.Println("GetSlotBursts", f)
+	window := int64(f.BurstWindow.Seconds())
+	if window < 1 {
+		window = 60
+	}
+	rows, err := r.db.Query(`
+		select slot, to_timestamp(floor(extract(epoch from booked_at) / $2) * $2), count(*), count(distinct booked_ip)
+		from tickets
+		where guest_id is not null and booked_at > current_timestamp - $1 * interval '1 second'
+		group by 1, 2 having count(*) >= $3
+		order by 3 desc limit 100;`, int64(f.Since.Seconds()), window, f.MinBurstCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bursts := make([]SlotBurst, 0)
+	for rows.Next() {
+		b := SlotBurst{}
+		err = rows.Scan(&b.Slot, &b.Start, &b.Bookings, &b.Addresses)
+		if err != nil {
+			return nil, err
+		}
+		bursts = append(bursts, b)
+	}
+	return bursts, nil
+}
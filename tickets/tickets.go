@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
 
 	"github.com/lib/pq"
 )
@@ -29,6 +31,8 @@ func init() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	RateLimiter = &dbLimiter{db: Repo.db}
+	ArtworkImages = newArtworkStore(Repo.db)
 	HostName = strings.TrimSpace(config.HostName)
 	if HostName == "" {
 		HostName = "http://localhost:8080"
@@ -40,14 +44,19 @@ type Guest struct {
 	Email     string
 	Verified  bool
 	IPAddress string
+	CreatedAt time.Time
+	Language  string // i18n language for emails, "" for the default
 
 	Tickets []Ticket
 }
 
+// Validate parses and normalizes the guest's email, see Repo.CheckEmail for the blocklist and MX checks
 func (g *Guest) Validate() error {
-	if !strings.Contains(g.Email, "@") || !strings.Contains(g.Email, ".") {
-		return fmt.Errorf("invalid email address")
+	email, err := ParseEmail(g.Email)
+	if err != nil {
+		return err
 	}
+	g.Email = email
 	return nil
 }
 
@@ -59,44 +68,119 @@ func (g Guest) GetTicketURL(slot time.Time) string {
 	return HostName + "/" + g.GetToken() + "/ticket/" + strconv.Itoa(int(slot.Unix()))
 }
 
+// GetNumberedTicketURL links to one of the guest's tickets, GetTicketURL to the first of their tickets in a slot
+func (g Guest) GetNumberedTicketURL(t Ticket) string {
+	return HostName + "/" + g.GetToken() + "/ticket/" + t.GetTicketID()
+}
+
+// FindTicket is the guest's ticket in slot numbered number, or the first one in slot when number is 0
+func (g *Guest) FindTicket(slot time.Time, number int64) *Ticket {
+	for i, t := range g.Tickets {
+		if t.Slot.Equal(slot) && (number == 0 || t.Number == number) {
+			return &g.Tickets[i]
+		}
+	}
+	return nil
+}
+
 func (g Guest) GetGuestURL() string {
 	return HostName + "/" + g.GetToken()
 }
 
+// GetAccountURL is the guest's self-service page (change email, export, delete)
+func (g Guest) GetAccountURL() string {
+	return HostName + "/" + g.GetToken() + "/account"
+}
+
 type Ticket struct {
 	Slot      time.Time
 	Number    int64
 	GuestID   string
 	EventCode string
+	Category  string // CategoryStandard, CategoryAccessible or CategoryCompanion
+
+	TicketType    string // "" for free general admission
+	PriceCents    int64
+	PaymentStatus string    // the ticket's payment, "" for free tickets
+	CheckedInAt   time.Time // zero until the guest arrives
+
+	// booking request metadata, only loaded for admin screens
+	BookedAt        time.Time
+	BookedIP        string
+	BookedUserAgent string
 }
 
-func (t Ticket) TicketImageURL() string {
+// GetTicketID identifies the ticket in links, the slot's unix time and the ticket number, see ParseTicketID
+func (t Ticket) GetTicketID() string {
+	return strconv.FormatInt(t.Slot.Unix(), 10) + "-" + strconv.FormatInt(t.Number, 10)
+}
+
+// ParseTicketID is the slot and number of a GetTicketID, number is 0 for ids that are only the slot (older links)
+func ParseTicketID(id string) (slot time.Time, number int64, err error) {
+	parts := strings.SplitN(id, "-", 2)
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return slot, 0, fmt.Errorf("%q is not a ticket", id)
+	}
+	if len(parts) == 2 {
+		number, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || number <= 0 {
+			return slot, 0, fmt.Errorf("%q is not a ticket", id)
+		}
+	}
+	return time.Unix(ts, 0), number, nil
+}
+
+// TicketImage is the file name of the day's ticket image in wwwroot/img
+func (t Ticket) TicketImage() string {
 	daynum := t.Slot.Day()
 	if daynum == 9 {
 		daynum = 15 // show the kitty
 	} else if daynum > 16 {
 		daynum = daynum - 16
 	}
-	return fmt.Sprintf("/assets/img/bgimg-%d.jpg", daynum)
+	return fmt.Sprintf("bgimg-%d.jpg", daynum)
+}
+
+// TicketImageURL is the assigned artwork for the ticket, or the built in image for the day
+func (t Ticket) TicketImageURL() string {
+	if name := Repo.ArtworkFor(t); name != "" {
+		return ArtworkURL(name)
+	}
+	return AssetURL("img/" + t.TicketImage())
 }
 
+// Slot is a time with tickets left, AvailableTickets are standard tickets
 type Slot struct {
-	Slot             time.Time
-	AvailableTickets int64
+	Slot              time.Time
+	AvailableTickets  int64
+	AccessibleTickets int64            // unclaimed accessible spots
+	CompanionTickets  int64            // unclaimed companion spots
+	TypeTickets       map[string]int64 // unclaimed tickets of each ticket type by code, not counted above
 }
 
+// SlotStat counts the tickets in a slot, NumberTickets and AvailableTickets include every category
 type SlotStat struct {
-	Slot             time.Time
-	NumberTickets    int64
-	AvailableTickets int64
-	EventCode        string
+	Slot                time.Time
+	NumberTickets       int64
+	AvailableTickets    int64
+	EventCode           string
+	AccessibleTickets   int64
+	AccessibleAvailable int64
+	CompanionTickets    int64
+	CompanionAvailable  int64
+	RevenueCents        int64 // paid tickets
 }
 
 type repo struct {
 	sync  sync.Mutex
 	db    *sql.DB
 	cache struct {
-		slots map[string][]Slot // key is eventcode
+		slots   map[string][]Slot // key is eventcode
+		artwork []ArtworkAssignment
+		// emailTemplates key is name/lang
+		emailTemplates map[string]EmailTemplate
+		ticketTypes    []TicketType
 	}
 }
 
@@ -111,21 +195,38 @@ func (r *repo) GetSlots(eventCode string) ([]Slot, error) {
 			return slots, nil
 		}
 	}
-	rows, err := r.db.Query(`select coalesce(event_code,''),slot,count(*) from tickets where guest_id is null group by event_code,slot order by event_code,slot;`)
+	rows, err := r.db.Query(`select coalesce(event_code,''),slot,coalesce(ticket_type,''),count(*),count(*) filter (where category='standard'),count(*) filter (where category='accessible'),count(*) filter (where category='companion')
+		from tickets where guest_id is null group by event_code,slot,ticket_type order by event_code,slot,ticket_type nulls first;`)
 	if err != nil {
 		return nil, err
 	}
 	r.cache.slots = make(map[string][]Slot)
 	defer rows.Close()
 	for rows.Next() {
-		var ecode string
-		slot := &Slot{}
-		rows.Scan(&ecode, &(slot.Slot), &(slot.AvailableTickets))
-		_, ok := r.cache.slots[ecode]
-		if !ok {
-			r.cache.slots[ecode] = make([]Slot, 0)
+		var (
+			ecode, ttype string
+			total        int64
+		)
+		slot := &Slot{TypeTickets: make(map[string]int64)}
+		rows.Scan(&ecode, &(slot.Slot), &ttype, &total, &(slot.AvailableTickets), &(slot.AccessibleTickets), &(slot.CompanionTickets))
+		if ttype != "" {
+			// priced (or other typed) tickets are only counted by type
+			slot.TypeTickets[ttype] = total
+			slot.AvailableTickets, slot.AccessibleTickets, slot.CompanionTickets = 0, 0, 0
+		}
+		list := r.cache.slots[ecode]
+		if n := len(list); n > 0 && list[n-1].Slot.Equal(slot.Slot) {
+			// another ticket type in the same slot
+			last := &list[n-1]
+			last.AvailableTickets += slot.AvailableTickets
+			last.AccessibleTickets += slot.AccessibleTickets
+			last.CompanionTickets += slot.CompanionTickets
+			for k, v := range slot.TypeTickets {
+				last.TypeTickets[k] = v
+			}
+			continue
 		}
-		r.cache.slots[ecode] = append(r.cache.slots[ecode], *slot)
+		r.cache.slots[ecode] = append(list, *slot)
 	}
 	slots, ok := r.cache.slots[eventCode]
 	if !ok {
@@ -139,34 +240,54 @@ func (r *repo) GetSlots(eventCode string) ([]Slot, error) {
 	return slots, nil
 }
 
-func (r *repo) CreateSlots(eventCode string, ts, count int) error {
-	log.Println(`CreateSlots`, eventCode, ts, count)
-	if count > 100 { // safety
+// CreateSlots adds count standard tickets to the slot at ts
+func (r *repo) CreateSlots(a Actor, eventCode string, ts, count int) error {
+	return r.CreateSlotTickets(a, eventCode, CategoryStandard, "", ts, count)
+}
+
+// CreateSlotTickets adds count tickets in the category and ticket type to the slot at ts, creating the slot if needed.
+// Typed tickets are priced at the type's current price.
+func (r *repo) CreateSlotTickets(a Actor, eventCode, category, ticketType string, ts, count int) error {
+	log.Println(`CreateSlots`, a, eventCode, category, ticketType, ts, count)
+	if count > MaxSlotChange { // safety
 		return fmt.Errorf("%d is too many", count)
 	}
+	category, err := ParseCategory(category)
+	if err != nil {
+		return err
+	}
 	eventCode = strings.TrimSpace(strings.ToLower(eventCode))
-	_, err := r.db.Exec(`
+	ticketType = strings.TrimSpace(strings.ToLower(ticketType))
+	_, err = r.db.Exec(`
 		with slot as (
 		  select TIMESTAMP WITH TIME ZONE 'epoch' + $1 * INTERVAL '1 second' as slot
 		), max_ticket_num as (
-			select max(num)::integer as num from slot,tickets t where t.slot=slot.slot
+			select coalesce(max(num),0)::integer as num from slot left join tickets t on t.slot=slot.slot
 		), ticket_numbers as (
 			select num.num from max_ticket_num,generate_series(max_ticket_num.num+1, max_ticket_num.num+$2) num
-		) insert into tickets(event_code,slot, num) (select NULLIF($3,''), slot.slot, ticket_numbers.num from slot cross join ticket_numbers);
-	`, ts, count, eventCode)
+		) insert into tickets(event_code,slot, num, category, ticket_type, price_cents) (
+			select NULLIF($3,''), slot.slot, ticket_numbers.num, $4, NULLIF($5,''), coalesce((select price_cents from ticket_types where code=$5),0)
+			from slot cross join ticket_numbers
+		);
+	`, ts, count, eventCode, category, ticketType)
 	if err != nil {
 		return err
 	}
+	r.Audit(a, AuditEntry{
+		Action:    AuditCreateSlots,
+		Slot:      time.Unix(int64(ts), 0),
+		EventCode: eventCode,
+		After:     "+" + countTickets(int64(count), ticketKind(category, ticketType)),
+	})
 	// changed the db, so lets blow out the cache
-	r.sync.Lock()
-	r.cache.slots = nil
-	r.sync.Unlock()
+	r.ClearCache()
 	return nil
 }
 
 func (r *repo) GetGuest(guestID string) (*Guest, error) {
 	log.Println(`GetGuest`, guestID)
-	rows, err := r.db.Query(`select g.id,g.email,g.verified,t.slot,t.num,t.event_code from guests g left join tickets t on (g.id=t.guest_id) where g.id=$1 order by t.slot;`, guestID)
+	rows, err := r.db.Query(`select g.id,g.email,g.verified,coalesce(g.language,''),t.slot,t.num,t.event_code,t.category,coalesce(t.ticket_type,''),coalesce(t.price_cents,0),coalesce(p.status,''),t.checked_in_at
+		from guests g left join tickets t on (g.id=t.guest_id) left join payments p on (p.id=t.payment_id) where g.id=$1 order by t.slot,t.num;`, guestID)
 	if err != nil {
 		return nil, err
 	}
@@ -177,6 +298,11 @@ func (r *repo) GetGuest(guestID string) (*Guest, error) {
 			tslot  pq.NullTime
 			tnum   sql.NullInt64
 			tevent sql.NullString
+			tcat   sql.NullString
+			ttype  string
+			tprice int64
+			pstat  string
+			tcheck pq.NullTime
 		)
 
 		if g == nil {
@@ -184,29 +310,36 @@ func (r *repo) GetGuest(guestID string) (*Guest, error) {
 				Tickets: make([]Ticket, 0),
 			}
 		}
-		err = rows.Scan(&(g.ID), &(g.Email), &(g.Verified), &tslot, &tnum, &tevent)
+		err = rows.Scan(&(g.ID), &(g.Email), &(g.Verified), &(g.Language), &tslot, &tnum, &tevent, &tcat, &ttype, &tprice, &pstat, &tcheck)
 		if err != nil {
 			return nil, err
 		}
 		if tslot.Valid {
 			g.Tickets = append(g.Tickets, Ticket{
-				Slot:      tslot.Time,
-				Number:    tnum.Int64,
-				GuestID:   g.ID,
-				EventCode: tevent.String,
+				Slot:          tslot.Time,
+				Number:        tnum.Int64,
+				GuestID:       g.ID,
+				EventCode:     tevent.String,
+				Category:      tcat.String,
+				TicketType:    ttype,
+				PriceCents:    tprice,
+				PaymentStatus: pstat,
+				CheckedInAt:   tcheck.Time,
 			})
 		}
 	}
 	if g == nil {
-		return nil, fmt.Errorf("Unable to locate your guest/ticket ID, please check your link and try again")
+		return nil, i18n.Errorf("error.guest_not_found")
 	}
 
 	return g, nil
 }
 
+// GetExpiredGuests returns unverified guests older than age with their tickets, tickets checked in at the gate
+// (ie walk-ups booked under an unconfirmed email) are never expired
 func (r *repo) GetExpiredGuests(age string) ([]*Guest, error) {
 	log.Println(`GetExpiredGuests`, age)
-	rows, err := r.db.Query(`select g.id,g.email,g.verified,t.slot,t.num,t.event_code from guests g join tickets t on (g.id=t.guest_id) where g.verified = false and g.created_at<(current_timestamp-$1::interval) order by g.id,t.slot;`, age)
+	rows, err := r.db.Query(`select g.id,g.email,g.verified,coalesce(g.language,''),t.slot,t.num,t.event_code,t.category from guests g join tickets t on (g.id=t.guest_id and t.checked_in_at is null) where g.verified = false and g.anonymized_at is null and g.created_at<(current_timestamp-$1::interval) order by g.id,t.slot;`, age)
 	if err != nil {
 		return nil, err
 	}
@@ -217,12 +350,13 @@ func (r *repo) GetExpiredGuests(age string) ([]*Guest, error) {
 			tslot  pq.NullTime
 			tnum   sql.NullInt64
 			tevent sql.NullString
+			tcat   sql.NullString
 		)
 
 		g := &Guest{
 			Tickets: make([]Ticket, 0),
 		}
-		err = rows.Scan(&(g.ID), &(g.Email), &(g.Verified), &tslot, &tnum, &tevent)
+		err = rows.Scan(&(g.ID), &(g.Email), &(g.Verified), &(g.Language), &tslot, &tnum, &tevent, &tcat)
 		if err != nil {
 			return nil, err
 		}
@@ -232,6 +366,7 @@ func (r *repo) GetExpiredGuests(age string) ([]*Guest, error) {
 				Number:    tnum.Int64,
 				GuestID:   g.ID,
 				EventCode: tevent.String,
+				Category:  tcat.String,
 			})
 		}
 		if len(guests) > 0 && guests[len(guests)-1].ID == g.ID {
@@ -294,107 +429,207 @@ func (r *repo) GetGuestsByDate(date string) ([]*Guest, error) {
 
 //select count(*) from guests g join tickets t on g.id=t.guest_id and g.verified is null
 
-func (r *repo) VerifyGuest(g *Guest) error {
-	_, err := r.db.Exec("update guests set verified=true where id=$1 and verified=false", g.ID)
-	if err != nil {
+func (r *repo) VerifyGuest(a Actor, g *Guest) error {
+	res, err := r.db.Exec("update guests set verified=true where id=$1 and verified=false", g.ID)
+	if err == nil {
 		g.Verified = true
+		if n, _ := res.RowsAffected(); n > 0 {
+			r.Audit(a, AuditEntry{Action: AuditVerify, GuestID: g.ID, Email: g.Email, Before: "verified=false", After: "verified=true"})
+		}
 	}
 	log.Printf("VerifyGuest %s %s, %v", g.ID, g.Email, err)
 	return err
 }
 
-func (r *repo) CancelTicket(g *Guest, slot time.Time) error {
-	log.Printf("CancelTicket %s %s, %v", g.ID, g.Email, slot)
+func (r *repo) CancelTicket(a Actor, g *Guest, slot time.Time) error {
+	return r.cancelTicket(a, g, slot, AuditCancel)
+}
+
+// ExpireTicket releases an unverified guest's tickets for the day of slot (expiry sweep)
+func (r *repo) ExpireTicket(a Actor, g *Guest, slot time.Time) error {
+	return r.cancelTicket(a, g, slot, AuditExpireTicket)
+}
+
+// cancelTicket releases the guest's tickets for the day of slot, action is recorded in the audit log
+func (r *repo) cancelTicket(a Actor, g *Guest, slot time.Time, action string) error {
+	return r.releaseTickets(a, g, slot, action, nil)
+}
+
+// releaseTickets releases the guest's tickets for the day of slot except the tickets numbered keep in slot.
+// Paid tickets are refunded and held tickets' payments are cancelled.
+func (r *repo) releaseTickets(a Actor, g *Guest, slot time.Time, action string, keep []int64) error {
+	log.Printf("CancelTicket %s %s %s, %v", a, g.ID, g.Email, slot)
+	if keep == nil {
+		keep = []int64{}
+	}
 	// cancel any tickets the guest would already have on this
-	_, err := r.db.Exec("update tickets set guest_id = null where guest_id=$1 and slot::date = $2::date", g.ID, slot)
+	rows, err := r.db.Query(`
+		with released as (
+			select slot,num,payment_id from tickets
+			where guest_id=$1 and slot::date = $2::date and not (slot=$2 and num=any($3))
+			for update
+		) update tickets t set guest_id = null, payment_id = null, updated_at = current_timestamp, booked_at = null, booked_ip = null, booked_user_agent = '', checked_in_at = null, checked_in_gate = null
+		from released where t.slot=released.slot and t.num=released.num
+		returning t.slot,t.num,coalesce(t.event_code,''),coalesce(released.payment_id,0);`, g.ID, slot, pq.Array(keep))
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+	released := make([]AuditEntry, 0)
+	payments := make([]int64, 0)
+	for rows.Next() {
+		var paymentID int64
+		e := AuditEntry{Action: action, GuestID: g.ID, Email: g.Email}
+		rows.Scan(&e.Slot, &e.Number, &e.EventCode, &paymentID)
+		e.Before = "guest=" + g.Email
+		e.After = "available"
+		released = append(released, e)
+		if paymentID > 0 && (len(payments) == 0 || payments[len(payments)-1] != paymentID) {
+			payments = append(payments, paymentID)
+		}
+	}
+	rows.Close()
+	for _, e := range released {
+		r.Audit(a, e)
+	}
+	r.settlePayments(a, payments)
 	r.sync.Lock()
 	r.cache.slots = nil // bust the cache :(
 	r.sync.Unlock()
+	r.publish(TopicSlots)
 
 	return nil
 }
 
-func (r *repo) AssignTicket(g *Guest, slot time.Time, eventCode string) error {
-	log.Printf("AssignTicket %s %s, %v", g.ID, g.Email, slot)
+// AssignTicket books a standard ticket in slot for the guest
+func (r *repo) AssignTicket(a Actor, g *Guest, slot time.Time, eventCode string) error {
+	return r.AssignTickets(a, g, slot, eventCode, TicketRequest{})
+}
+
+// AssignTickets books the requested tickets in slot for the guest and releases the guest's other tickets that day.
+// Either every requested ticket is booked or none are.  Priced tickets are held for the guest with a pending
+// payment (see StartCheckout) and the other tickets that day are only released once it is paid.
+func (r *repo) AssignTickets(a Actor, g *Guest, slot time.Time, eventCode string, req TicketRequest) error {
+	log.Printf("AssignTickets %s %s %s, %v %+v", a, g.ID, g.Email, slot, req)
+	want := req.Categories()
+	ticketType := strings.TrimSpace(strings.ToLower(req.TicketType))
 	// check to see if guest already has a ticket for this day
-	rows, err := r.db.Query(`select count(*) as tickets, count(*) filter (where slot=$2) as inslot from tickets where guest_id=$1 and slot::date=$2::date;`, g.ID, slot)
+	var (
+		numtix int
+		have   []string
+	)
+	err := r.db.QueryRow(`select count(*), coalesce(array_agg(category) filter (where slot=$2 and coalesce(ticket_type,'')=$3), '{}') from tickets where guest_id=$1 and slot::date=$2::date;`, g.ID, slot, ticketType).
+		Scan(&numtix, pq.Array(&have))
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		// aggregate query should only return 1 row
-		var numtix, slottix int
-		rows.Scan(&numtix, &slottix)
-		if slottix > 0 {
-			return nil // guest already has ticket in slot
-		}
-		if numtix > 0 {
-			// cancel tix for guest
-			err := r.CancelTicket(g, slot)
+	if sameCategories(have, want) {
+		return nil // guest already has the tickets in slot
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	booked := make([]AuditEntry, 0)
+	nums := make([]int64, 0)
+	took := make([]string, 0)
+	var amount int64
+	for _, category := range want {
+		got := ""
+		var tnum, price int64
+		for _, c := range categoryFallbacks(category) {
+			err = tx.QueryRow(`
+				WITH avail AS (
+					SELECT slot,num
+					FROM   tickets
+					WHERE  guest_id is null AND slot=$2 AND coalesce(event_code,'')=$3 AND category=$4 AND coalesce(ticket_type,'')=$7
+					LIMIT  1 FOR UPDATE
+					)
+				 UPDATE tickets t
+				 SET    guest_id = $1, updated_at = current_timestamp, booked_at = current_timestamp, booked_ip = $5, booked_user_agent = $6
+				 FROM   avail
+				 WHERE  t.slot = avail.slot and t.num = avail.num RETURNING t.num, t.price_cents;`, g.ID, slot, eventCode, c, nullIP(a.IPAddress), a.UserAgent, ticketType).
+				Scan(&tnum, &price)
+			if err == sql.ErrNoRows {
+				continue
+			}
 			if err != nil {
+				tx.Rollback()
 				return err
 			}
+			got = c
+			break
+		}
+		if got == "" {
+			tx.Rollback()
+			if category == CategoryAccessible {
+				return i18n.Errorf("error.accessible_sold_out")
+			}
+			return i18n.Errorf("error.sold_out")
+		}
+		after := "guest=" + g.Email
+		if got != CategoryStandard {
+			after += " " + got
+		}
+		if ticketType != "" {
+			after += " " + ticketType
+		}
+		booked = append(booked, AuditEntry{
+			Action:    AuditAssign,
+			GuestID:   g.ID,
+			Email:     g.Email,
+			Slot:      slot,
+			Number:    tnum,
+			EventCode: eventCode,
+			Before:    "available",
+			After:     after,
+		})
+		nums = append(nums, tnum)
+		took = append(took, got)
+		amount += price
+	}
+	if amount > 0 {
+		_, err = holdTickets(tx, g, slot, nums, amount, time.Now())
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
 	}
-	rows.Close()
-
-	if eventCode == "" {
-		rows, err = r.db.Query(`
-			WITH avail AS (
-				SELECT slot,num
-				FROM   tickets
-				WHERE  guest_id is null AND slot=$2 AND event_code IS NULL
-				LIMIT  1 FOR UPDATE          
-				)
-			 UPDATE tickets t
-			 SET    guest_id = $1
-			 FROM   avail
-			 WHERE  t.slot = avail.slot and t.num = avail.num RETURNING t.num;`, g.ID, slot)
-	} else {
-		rows, err = r.db.Query(`
-			WITH avail AS (
-				SELECT slot,num
-				FROM   tickets
-				WHERE  guest_id is null AND slot=$2 AND event_code = $3
-				LIMIT  1 FOR UPDATE          
-				)
-			 UPDATE tickets t
-			 SET    guest_id = $1
-			 FROM   avail
-			 WHERE  t.slot = avail.slot and t.num = avail.num RETURNING t.num;`, g.ID, slot, eventCode)
-	}
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return fmt.Errorf("Sorry, just ran out of tickets.  Please try again in a few moments")
+	for _, e := range booked {
+		r.Audit(a, e)
+	}
+	if numtix > 0 && amount == 0 {
+		// release the guest's other tickets that day (and in slot, when changing categories)
+		err = r.releaseTickets(a, g, slot, AuditRebook, nums)
+		if err != nil {
+			return err
+		}
 	}
-	var tnum int64
-	rows.Scan(&tnum)
+
+	r.sync.Lock()
 	if r.cache.slots != nil {
-		slots, ok := r.cache.slots[eventCode]
-		if ok {
-			for idx, cslot := range slots {
-				if cslot.Slot.Equal(slot) {
-					fmt.Printf("MATCH %v == %v\n", cslot, slot)
-					r.sync.Lock()
-					match := &(slots[idx])
-					match.AvailableTickets = match.AvailableTickets - 1
-					if match.AvailableTickets < 1 {
-						// slot needs to be removed, so we'll just blow out the cache
-						r.cache.slots = nil
-					}
-					r.sync.Unlock()
-					break
+		slots := r.cache.slots[eventCode]
+		for idx := range slots {
+			match := &(slots[idx])
+			if match.Slot.Equal(slot) {
+				for _, c := range took {
+					match.take(c, ticketType)
+				}
+				if match.empty() {
+					// slot needs to be removed, so we'll just blow out the cache
+					r.cache.slots = nil
 				}
+				break
 			}
 		}
 	}
+	r.sync.Unlock()
+	r.publish(TopicSlots)
 	return nil
 }
 
@@ -410,6 +645,7 @@ func (r *repo) CreateGuest(g *Guest) error {
 		return err
 	}
 
+	ip := nullIP(g.IPAddress)
 	rows, err = r.db.Query(`select id from guests where email=$1`, g.Email)
 	if err != nil {
 		return err
@@ -417,16 +653,19 @@ func (r *repo) CreateGuest(g *Guest) error {
 	defer rows.Close()
 	if rows.Next() {
 		rows.Scan(&(g.ID))
-		return nil
+		rows.Close()
+		// guests created before ip addresses (or languages) were recorded get the first one we see
+		_, err = r.db.Exec(`update guests set ip_address=coalesce(ip_address,$2), language=coalesce(language,$3) where id=$1;`, g.ID, ip, nullString(g.Language))
+		return err
 	}
 	rows.Close()
-	rows, err = r.db.Query(`insert into guests(email) values($1) returning id;`, g.Email)
+	rows, err = r.db.Query(`insert into guests(email,ip_address,language) values($1,$2,$3) returning id;`, g.Email, ip, nullString(g.Language))
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		return fmt.Errorf("Unable to create new guest")
+		return i18n.Errorf("error.create_guest")
 	}
 	rows.Scan(&(g.ID))
 	return nil
@@ -435,7 +674,12 @@ func (r *repo) CreateGuest(g *Guest) error {
 // GetSlotsStats gets all slots, not cached because it is behind an admin screen
 func (r *repo) GetSlotsStats() ([]SlotStat, error) {
 	log.Println("GetSlotsStats")
-	rows, err := r.db.Query(`select coalesce(event_code,''),slot,count(*), count(*) filter(where guest_id is null) from tickets where slot>=((now() AT TIME ZONE 'PST')-'30 minutes'::interval) group by event_code,slot order by slot,event_code NULLS LAST;`)
+	rows, err := r.db.Query(`select coalesce(t.event_code,''),t.slot,count(*), count(*) filter(where t.guest_id is null),
+		count(*) filter(where t.category='accessible'), count(*) filter(where t.category='accessible' and t.guest_id is null),
+		count(*) filter(where t.category='companion'), count(*) filter(where t.category='companion' and t.guest_id is null),
+		coalesce(sum(t.price_cents) filter(where p.status='paid'),0)
+		from tickets t left join payments p on p.id=t.payment_id
+		where t.slot>=((now() AT TIME ZONE 'PST')-'30 minutes'::interval) group by t.event_code,t.slot order by t.slot,t.event_code NULLS LAST;`)
 	if err != nil {
 		return nil, err
 	}
@@ -443,7 +687,8 @@ func (r *repo) GetSlotsStats() ([]SlotStat, error) {
 	slots := make([]SlotStat, 0)
 	for rows.Next() {
 		slot := &SlotStat{}
-		rows.Scan(&(slot.EventCode), &(slot.Slot), &(slot.NumberTickets), &(slot.AvailableTickets))
+		rows.Scan(&(slot.EventCode), &(slot.Slot), &(slot.NumberTickets), &(slot.AvailableTickets),
+			&(slot.AccessibleTickets), &(slot.AccessibleAvailable), &(slot.CompanionTickets), &(slot.CompanionAvailable), &(slot.RevenueCents))
 		slots = append(slots, *slot)
 	}
 	return slots, nil
@@ -479,33 +724,57 @@ func (r *repo) GetSlotDates() ([]time.Time, error) {
 // ToCSV writes the database to csv
 func (r *repo) ToCSV(w io.Writer) error {
 	log.Println("Repo ToCSV")
-	rows, err := r.db.Query(`select g.email,g.created_at,t.updated_at,g.verified,coalesce(g.ip_address,'0.0.0.0'),t.slot,coalesce(t.event_code,'') from guests g join tickets t on g.id=t.guest_id;`)
+	rows, err := r.db.Query(`select g.email,g.created_at,t.updated_at,g.verified,coalesce(host(g.ip_address),'0.0.0.0'),t.slot,coalesce(t.event_code,''),coalesce(t.booked_at::text,''),coalesce(host(t.booked_ip),''),t.booked_user_agent,t.category,
+		coalesce(t.ticket_type,''),t.price_cents::text,coalesce(p.status,'') from guests g join tickets t on g.id=t.guest_id left join payments p on p.id=t.payment_id;`)
 	if err != nil {
 		return err
 	}
-	rec := []string{"email", "created", "updated", "verified", "ip_address", "slot", "event_code"}
+	rec := []string{"email", "created", "updated", "verified", "ip_address", "slot", "event_code", "booked_at", "booked_ip", "user_agent", "category", "ticket_type", "price_cents", "payment_status"}
 	wc := csv.NewWriter(w)
 	wc.Write(rec) // write the headers, rec will be reused for rows
 
 	defer rows.Close()
 	defer wc.Flush()
 	for rows.Next() {
-		for i := 0; i < 7; i++ {
-			err := rows.Scan(&rec[0], &rec[1], &rec[2], &rec[3], &rec[4], &rec[5], &rec[6])
-			if err != nil {
-				err = fmt.Errorf("error scanning col %d: %s", i, err.Error())
-				log.Println(err)
-				wc.Write([]string{err.Error()})
-				return err
-			}
+		err := rows.Scan(&rec[0], &rec[1], &rec[2], &rec[3], &rec[4], &rec[5], &rec[6], &rec[7], &rec[8], &rec[9], &rec[10], &rec[11], &rec[12], &rec[13])
+		if err != nil {
+			err = fmt.Errorf("error scanning row: %s", err.Error())
+			log.Println(err)
+			wc.Write([]string{err.Error()})
+			return err
 		}
 		wc.Write(rec)
 	}
 	return nil
 }
 
+// nullIP converts an address to a value for an inet column, invalid addresses are stored as null
+func nullIP(addr string) sql.NullString {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: ip.String(), Valid: true}
+}
+
+// nullString stores empty strings as null
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// ClearCache drops the cached slots, artwork, email templates and ticket types after a change to them and tells
+// live pages (and other instances) that availability may have changed
 func (r *repo) ClearCache() {
+	r.clearCache()
+	r.publish(TopicSlots)
+}
+
+func (r *repo) clearCache() {
 	r.sync.Lock()
 	r.cache.slots = nil
+	r.cache.artwork = nil
+	r.cache.emailTemplates = nil
+	r.cache.ticketTypes = nil
+	getSlotDatesCache = nil // slots may have been added to a new day
 	r.sync.Unlock()
 }
@@ -0,0 +1,38 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNullIP(t *testing.T) {
+	assert.Equal(t, "10.0.0.1", nullIP(" 10.0.0.1 ").String)
+	assert.True(t, nullIP("::1").Valid)
+	assert.False(t, nullIP("10.0.0.1:5432").Valid)
+	assert.False(t, nullIP("").Valid)
+}
+
+func TestParseTicketID(t *testing.T) {
+	g := Guest{Tickets: []Ticket{
+		{Slot: time.Unix(1575253800, 0), Number: 7, Category: CategoryAccessible},
+		{Slot: time.Unix(1575253800, 0), Number: 8, Category: CategoryCompanion},
+	}}
+	slot, number, err := ParseTicketID(g.Tickets[1].GetTicketID())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), number)
+	assert.Equal(t, CategoryCompanion, g.FindTicket(slot, number).Category)
+
+	// links to a slot find the first ticket in it
+	slot, number, err = ParseTicketID("1575253800")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), number)
+	assert.Equal(t, int64(7), g.FindTicket(slot, number).Number)
+
+	assert.Nil(t, g.FindTicket(slot, 9))
+	_, _, err = ParseTicketID("1575253800-x")
+	assert.Error(t, err)
+	_, _, err = ParseTicketID("soon")
+	assert.Error(t, err)
+}
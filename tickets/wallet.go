@@ -0,0 +1,399 @@
+package tickets
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"go.mozilla.org/pkcs7"
+)
+
+// ApplePass signs Apple Wallet passes, nil unless the ADVLIGHT_APPLE_PASS_* settings are set
+var ApplePass *PassSigner
+
+// GooglePass creates Save to Google Wallet links, nil unless the ADVLIGHT_GOOGLE_WALLET_* settings are set
+var GooglePass *GoogleWallet
+
+func init() {
+	if os.Getenv("ADVLIGHT_APPLE_PASS_CERT") != "" {
+		var err error
+		ApplePass, err = LoadPassSigner(
+			os.Getenv("ADVLIGHT_APPLE_PASS_TYPE_ID"),
+			os.Getenv("ADVLIGHT_APPLE_TEAM_ID"),
+			os.Getenv("ADVLIGHT_APPLE_PASS_CERT"),
+			os.Getenv("ADVLIGHT_APPLE_PASS_KEY"),
+			os.Getenv("ADVLIGHT_APPLE_WWDR"))
+		if err != nil {
+			log.Panicf("invalid apple pass config: %v", err)
+		}
+	}
+	if os.Getenv("ADVLIGHT_GOOGLE_WALLET_KEY") != "" {
+		var err error
+		GooglePass, err = LoadGoogleWallet(os.Getenv("ADVLIGHT_GOOGLE_WALLET_ISSUER"), os.Getenv("ADVLIGHT_GOOGLE_WALLET_KEY"))
+		if err != nil {
+			log.Panicf("invalid google wallet config: %v", err)
+		}
+	}
+}
+
+// passSerial identifies a ticket in wallet passes, stable so re-downloading a ticket replaces the pass
+func passSerial(g Guest, t Ticket) string {
+	return g.GetToken() + "-" + t.GetTicketID()
+}
+
+// PassSigner creates signed Apple Wallet (.pkpass) passes
+// @see https://developer.apple.com/documentation/walletpasses/building_a_pass
+type PassSigner struct {
+	PassTypeID string
+	TeamID     string
+	Cert       *x509.Certificate
+	Key        crypto.PrivateKey
+	WWDR       *x509.Certificate // Apple Worldwide Developer Relations intermediate certificate
+}
+
+// LoadPassSigner loads the pass type certificate, its key and the WWDR intermediate from PEM files
+func LoadPassSigner(passTypeID, teamID, certFile, keyFile, wwdrFile string) (*PassSigner, error) {
+	if passTypeID == "" || teamID == "" {
+		return nil, fmt.Errorf("pass type id and team id are required")
+	}
+	cert, err := loadPEMCertificate(certFile)
+	if err != nil {
+		return nil, err
+	}
+	wwdr, err := loadPEMCertificate(wwdrFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePEMKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &PassSigner{PassTypeID: passTypeID, TeamID: teamID, Cert: cert, Key: key, WWDR: wwdr}, nil
+}
+
+func loadPEMCertificate(file string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s is not a PEM certificate", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePEMKey(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// passField is a field on the front or back of a pass
+type passField struct {
+	Key       string `json:"key"`
+	Label     string `json:"label,omitempty"`
+	Value     string `json:"value"`
+	DateStyle string `json:"dateStyle,omitempty"`
+	TimeStyle string `json:"timeStyle,omitempty"`
+}
+
+type passBarcode struct {
+	Format          string `json:"format"`
+	Message         string `json:"message"`
+	MessageEncoding string `json:"messageEncoding"`
+	AltText         string `json:"altText,omitempty"`
+}
+
+type passStructure struct {
+	HeaderFields    []passField `json:"headerFields,omitempty"`
+	PrimaryFields   []passField `json:"primaryFields"`
+	SecondaryFields []passField `json:"secondaryFields,omitempty"`
+	AuxiliaryFields []passField `json:"auxiliaryFields,omitempty"`
+	BackFields      []passField `json:"backFields,omitempty"`
+}
+
+// PassJSON is the pass.json of an event ticket pass
+type PassJSON struct {
+	FormatVersion      int           `json:"formatVersion"`
+	PassTypeIdentifier string        `json:"passTypeIdentifier"`
+	SerialNumber       string        `json:"serialNumber"`
+	TeamIdentifier     string        `json:"teamIdentifier"`
+	OrganizationName   string        `json:"organizationName"`
+	Description        string        `json:"description"`
+	RelevantDate       string        `json:"relevantDate"`
+	ExpirationDate     string        `json:"expirationDate"`
+	BackgroundColor    string        `json:"backgroundColor"`
+	ForegroundColor    string        `json:"foregroundColor"`
+	LabelColor         string        `json:"labelColor"`
+	Barcodes           []passBarcode `json:"barcodes"`
+	EventTicket        passStructure `json:"eventTicket"`
+}
+
+// TicketPassJSON describes the ticket as an Apple Wallet event ticket
+func (s *PassSigner) TicketPassJSON(g Guest, t Ticket) PassJSON {
+	org := config.ChurchName
+	if org == "" {
+		org = config.EventName
+	}
+	p := PassJSON{
+		FormatVersion:      1,
+		PassTypeIdentifier: s.PassTypeID,
+		SerialNumber:       passSerial(g, t),
+		TeamIdentifier:     s.TeamID,
+		OrganizationName:   org,
+		Description:        config.EventName + " Ticket",
+		RelevantDate:       t.Slot.Format(time.RFC3339),
+		// the pass greys out the day after the ticket
+		ExpirationDate:  t.Slot.Add(24 * time.Hour).Format(time.RFC3339),
+		BackgroundColor: "rgb(15,21,21)",
+		ForegroundColor: "rgb(255,255,255)",
+		LabelColor:      "rgb(76,153,26)",
+		Barcodes: []passBarcode{{
+			Format:          "PKBarcodeFormatQR",
+			Message:         g.GetNumberedTicketURL(t),
+			MessageEncoding: "iso-8859-1",
+		}},
+		EventTicket: passStructure{
+			PrimaryFields: []passField{{Key: "event", Label: "EVENT", Value: config.EventName}},
+			SecondaryFields: []passField{{
+				Key:       "slot",
+				Label:     "DATE",
+				Value:     t.Slot.Format(time.RFC3339),
+				DateStyle: "PKDateStyleMedium",
+				TimeStyle: "PKDateStyleShort",
+			}},
+			BackFields: []passField{
+				{Key: "email", Label: "Guest", Value: g.Email},
+				{Key: "link", Label: "Ticket", Value: g.GetNumberedTicketURL(t)},
+			},
+		},
+	}
+	if t.Number > 0 {
+		p.EventTicket.AuxiliaryFields = append(p.EventTicket.AuxiliaryFields, passField{Key: "ticket", Label: "TICKET", Value: "#" + strconv.FormatInt(t.Number, 10)})
+	}
+	if config.EventAddress != "" {
+		p.EventTicket.AuxiliaryFields = append(p.EventTicket.AuxiliaryFields, passField{Key: "location", Label: "LOCATION", Value: config.EventAddress})
+	}
+	return p
+}
+
+// passImages are the pass images (name -> width x height) made from the ticket's day image
+var passImages = []struct {
+	name string
+	w, h int
+}{
+	{"icon.png", 29, 29},
+	{"icon@2x.png", 58, 58},
+	{"strip.png", 375, 123},
+	{"strip@2x.png", 750, 246},
+}
+
+// TicketPass returns a signed .pkpass for the ticket
+func (s *PassSigner) TicketPass(g Guest, t Ticket) ([]byte, error) {
+	passJSON, err := json.Marshal(s.TicketPassJSON(g, t))
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{"pass.json": passJSON}
+	img, err := TicketImageData(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, pi := range passImages {
+		files[pi.name], err = pngCover(img, pi.w, pi.h)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest := make(map[string]string, len(files))
+	for name, data := range files {
+		sum := sha1.Sum(data)
+		manifest[name] = hex.EncodeToString(sum[:])
+	}
+	files["manifest.json"], err = json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	files["signature"], err = s.sign(files["manifest.json"])
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"pass.json", "icon.png", "icon@2x.png", "strip.png", "strip@2x.png", "manifest.json", "signature"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(files[name])
+	}
+	err = zw.Close()
+	return buf.Bytes(), err
+}
+
+// sign creates the detached PKCS#7 signature of the manifest, including the WWDR intermediate
+func (s *PassSigner) sign(manifest []byte) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(manifest)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	err = sd.AddSignerChain(s.Cert, s.Key, []*x509.Certificate{s.WWDR}, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		return nil, err
+	}
+	sd.Detach()
+	return sd.Finish()
+}
+
+// GoogleWallet creates signed Save to Google Wallet links for event tickets
+// @see https://developers.google.com/wallet/tickets/events/web
+type GoogleWallet struct {
+	IssuerID    string
+	ClientEmail string
+	Key         *rsa.PrivateKey
+	Origins     []string
+}
+
+// LoadGoogleWallet loads a service account key (JSON) for the wallet issuer
+func LoadGoogleWallet(issuerID, keyFile string) (*GoogleWallet, error) {
+	if issuerID == "" {
+		return nil, fmt.Errorf("issuer id is required")
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var sa struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	err = json.Unmarshal(data, &sa)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePEMKey([]byte(sa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("google wallet keys must be RSA")
+	}
+	return &GoogleWallet{IssuerID: issuerID, ClientEmail: sa.ClientEmail, Key: rsaKey, Origins: []string{HostName}}, nil
+}
+
+var walletIDCleaner = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// ClassID is the event ticket class shared by every ticket
+func (gw *GoogleWallet) ClassID() string {
+	return gw.IssuerID + "." + walletIDCleaner.ReplaceAllString(config.EventName, "_")
+}
+
+type walletString struct {
+	DefaultValue struct {
+		Language string `json:"language"`
+		Value    string `json:"value"`
+	} `json:"defaultValue"`
+}
+
+func localized(s string) walletString {
+	var ws walletString
+	ws.DefaultValue.Language = "en-US"
+	ws.DefaultValue.Value = s
+	return ws
+}
+
+// TicketClaims are the JWT claims of a Save to Google Wallet link for the ticket
+func (gw *GoogleWallet) TicketClaims(g Guest, t Ticket, now time.Time) map[string]interface{} {
+	class := map[string]interface{}{
+		"id":           gw.ClassID(),
+		"issuerName":   config.ChurchName,
+		"reviewStatus": "UNDER_REVIEW",
+		"eventName":    localized(config.EventName),
+	}
+	if config.EventAddress != "" {
+		class["venue"] = map[string]interface{}{
+			"name":    localized(config.EventName),
+			"address": localized(config.EventAddress),
+		}
+	}
+	object := map[string]interface{}{
+		"id":      gw.IssuerID + "." + passSerial(g, t),
+		"classId": gw.ClassID(),
+		"state":   "ACTIVE",
+		"barcode": map[string]string{
+			"type":  "QR_CODE",
+			"value": g.GetNumberedTicketURL(t),
+		},
+		"ticketHolderName": g.Email,
+		"validTimeInterval": map[string]interface{}{
+			"start": map[string]string{"date": t.Slot.Format(time.RFC3339)},
+			"end":   map[string]string{"date": t.Slot.Add(24 * time.Hour).Format(time.RFC3339)},
+		},
+		"textModulesData": []map[string]string{
+			{"header": "Date", "body": t.Slot.In(config.Location).Format("Mon Jan 02, 3:04pm"), "id": "slot"},
+		},
+	}
+	if t.Number > 0 {
+		object["ticketNumber"] = strconv.FormatInt(t.Number, 10)
+	}
+	return map[string]interface{}{
+		"iss":     gw.ClientEmail,
+		"aud":     "google",
+		"typ":     "savetowallet",
+		"iat":     now.Unix(),
+		"origins": gw.Origins,
+		"payload": map[string]interface{}{
+			"eventTicketClasses": []interface{}{class},
+			"eventTicketObjects": []interface{}{object},
+		},
+	}
+}
+
+// SaveURL returns the Save to Google Wallet link for the ticket, a JWT signed with the service account key
+func (gw *GoogleWallet) SaveURL(g Guest, t Ticket, now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(gw.TicketClaims(g, t, now))
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(nil, gw.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return "https://pay.google.com/gp/v/save/" + signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,153 @@
+package tickets
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/pkcs7"
+)
+
+func testCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+// testAssets loads assets from wwwroot, call the returned func to restore AssetLoader
+func testAssets() func() {
+	old := AssetLoader
+	AssetLoader = func(name string) ([]byte, error) {
+		return ioutil.ReadFile("../wwwroot/" + name)
+	}
+	return func() { AssetLoader = old }
+}
+
+func TestApplePass(t *testing.T) {
+	defer testAssets()()
+	wwdr, wwdrKey := testCertificate(t, "WWDR", nil, nil)
+	cert, key := testCertificate(t, "Pass Type ID: pass.test", wwdr, wwdrKey)
+	signer := &PassSigner{PassTypeID: "pass.test", TeamID: "TEAM", Cert: cert, Key: key, WWDR: wwdr}
+
+	g := Guest{ID: "guest", Email: "guest@example.com"}
+	ticket := Ticket{Slot: time.Date(2019, 12, 2, 2, 30, 0, 0, time.UTC), Number: 7}
+	pkpass, err := signer.TicketPass(g, ticket)
+	assert.NoError(t, err)
+
+	zr, err := zip.NewReader(bytes.NewReader(pkpass), int64(len(pkpass)))
+	assert.NoError(t, err)
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		files[f.Name], _ = ioutil.ReadAll(rc)
+		rc.Close()
+	}
+	for _, name := range []string{"pass.json", "manifest.json", "signature", "icon.png", "icon@2x.png", "strip.png"} {
+		assert.NotEmpty(t, files[name], name)
+	}
+
+	var pass PassJSON
+	assert.NoError(t, json.Unmarshal(files["pass.json"], &pass))
+	assert.Equal(t, 1, pass.FormatVersion)
+	assert.Equal(t, "pass.test", pass.PassTypeIdentifier)
+	assert.Equal(t, "TEAM", pass.TeamIdentifier)
+	assert.Equal(t, "guest-1575253800-7", pass.SerialNumber)
+	assert.Equal(t, "PKBarcodeFormatQR", pass.Barcodes[0].Format)
+	assert.Equal(t, g.GetNumberedTicketURL(ticket), pass.Barcodes[0].Message)
+	assert.Equal(t, "#7", pass.EventTicket.AuxiliaryFields[0].Value)
+
+	// every file except the manifest and signature is in the manifest with its sha1
+	var manifest map[string]string
+	assert.NoError(t, json.Unmarshal(files["manifest.json"], &manifest))
+	assert.Len(t, manifest, len(files)-2)
+	for name, sum := range manifest {
+		want := sha1.Sum(files[name])
+		assert.Equal(t, hex.EncodeToString(want[:]), sum, name)
+	}
+
+	// detached signature of the manifest by the pass certificate, carrying the wwdr intermediate
+	p7, err := pkcs7.Parse(files["signature"])
+	assert.NoError(t, err)
+	p7.Content = files["manifest.json"]
+	assert.NoError(t, p7.Verify())
+	assert.Len(t, p7.Certificates, 2)
+	assert.Equal(t, cert.Raw, p7.GetOnlySigner().Raw)
+}
+
+func TestGoogleWalletSaveURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	gw := &GoogleWallet{IssuerID: "3388000000012345678", ClientEmail: "wallet@example.iam.gserviceaccount.com", Key: key}
+
+	g := Guest{ID: "guest", Email: "guest@example.com"}
+	ticket := Ticket{Slot: time.Date(2019, 12, 2, 2, 30, 0, 0, time.UTC), Number: 7}
+	link, err := gw.SaveURL(g, ticket, time.Unix(1575000000, 0))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(link, "https://pay.google.com/gp/v/save/"))
+
+	parts := strings.Split(strings.TrimPrefix(link, "https://pay.google.com/gp/v/save/"), ".")
+	assert.Len(t, parts, 3)
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.NoError(t, err)
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig))
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.NoError(t, err)
+	var claims struct {
+		Iss     string `json:"iss"`
+		Aud     string `json:"aud"`
+		Typ     string `json:"typ"`
+		Payload struct {
+			Objects []struct {
+				ID           string            `json:"id"`
+				ClassID      string            `json:"classId"`
+				Barcode      map[string]string `json:"barcode"`
+				TicketNumber string            `json:"ticketNumber"`
+			} `json:"eventTicketObjects"`
+			Classes []map[string]interface{} `json:"eventTicketClasses"`
+		} `json:"payload"`
+	}
+	assert.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "google", claims.Aud)
+	assert.Equal(t, "savetowallet", claims.Typ)
+	assert.Equal(t, gw.ClientEmail, claims.Iss)
+	assert.Len(t, claims.Payload.Objects, 1)
+	assert.Equal(t, "3388000000012345678.guest-1575253800-7", claims.Payload.Objects[0].ID)
+	assert.Equal(t, gw.ClassID(), claims.Payload.Objects[0].ClassID)
+	assert.Equal(t, claims.Payload.Classes[0]["id"], gw.ClassID())
+	assert.Equal(t, "QR_CODE", claims.Payload.Objects[0].Barcode["type"])
+	assert.Equal(t, "7", claims.Payload.Objects[0].TicketNumber)
+}
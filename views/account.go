@@ -0,0 +1,127 @@
+package views
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi"
+)
+
+// accountView is the data for account.html
+type accountView struct {
+	ErrorMsg   string
+	SuccessMsg string
+	Guest      *tickets.Guest
+	NewEmail   string
+	Deleted    bool // the guest just deleted their account
+}
+
+// GuestAccountHandler lets a guest change their email, download their data or delete their account
+func GuestAccountHandler(w http.ResponseWriter, r *http.Request) {
+	guestID := chi.URLParam(r, "guestID")
+	data := accountView{}
+	guest, err := tickets.Repo.GetGuest(guestID)
+	if err != nil {
+		lang := requestLang(w, r, nil)
+		data.ErrorMsg = i18n.Message(lang, err)
+		RenderLang(w, lang, "account.html", data)
+		return
+	}
+	data.Guest = guest
+	lang := requestLang(w, r, guest)
+
+	if r.Method == "POST" {
+		if rateLimited(w, r, "account", "ip", clientIP(r), "guest", guest.ID) {
+			return
+		}
+		switch r.FormValue("op") {
+		case "email":
+			data.NewEmail = strings.TrimSpace(r.FormValue("newemail"))
+			email, err := tickets.Repo.CheckEmail(data.NewEmail)
+			if err != nil {
+				data.ErrorMsg = i18n.Message(lang, err)
+				break
+			}
+			token := tickets.EmailChangeToken(guest.ID, email, time.Now().Add(tickets.EmailChangeMaxAge))
+			link := guest.GetAccountURL() + "/email?t=" + url.QueryEscape(token)
+			err = tickets.Mailer.SendGuest(tickets.Guest{ID: guest.ID, Email: email, Language: guest.Language}, tickets.EmailChangeSubject(guest.Language), tickets.EmailChangeEmail(guest.Language, email, link))
+			if err != nil {
+				data.ErrorMsg = i18n.Message(lang, err)
+				break
+			}
+			data.SuccessMsg = i18n.T(lang, "account.email_sent", email)
+		case "delete":
+			// the guest retypes their email so an accidental click does not delete their tickets
+			if !strings.EqualFold(strings.TrimSpace(r.FormValue("confirm")), guest.Email) {
+				data.ErrorMsg = i18n.T(lang, "account.confirm_delete")
+				break
+			}
+			err = tickets.Repo.DeleteGuest(guestActor(r, guest.Email), guest)
+			if err != nil {
+				data.ErrorMsg = i18n.Message(lang, err)
+				break
+			}
+			data.Guest = nil
+			data.Deleted = true
+		}
+	}
+	RenderLang(w, lang, "account.html", data)
+}
+
+// GuestEmailChangeHandler applies an email change once the guest follows the link sent to the new address
+func GuestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	guestID := chi.URLParam(r, "guestID")
+	data := accountView{}
+	guest, err := tickets.Repo.GetGuest(guestID)
+	if err != nil {
+		lang := requestLang(w, r, nil)
+		data.ErrorMsg = i18n.Message(lang, err)
+		RenderLang(w, lang, "account.html", data)
+		return
+	}
+	data.Guest = guest
+	lang := requestLang(w, r, guest)
+
+	tokenGuest, email, err := tickets.ParseEmailChangeToken(r.FormValue("t"), time.Now())
+	if err == nil && tokenGuest != guest.ID {
+		err = tickets.ErrInvalidLink
+	}
+	if err == nil {
+		err = tickets.Repo.ChangeEmail(guestActor(r, email), guest, email)
+	}
+	if err != nil {
+		data.ErrorMsg = i18n.Message(lang, err)
+	} else {
+		data.SuccessMsg = i18n.T(lang, "account.email_changed", guest.Email)
+	}
+	RenderLang(w, lang, "account.html", data)
+}
+
+// GuestExportHandler downloads everything stored about the guest as JSON
+func GuestExportHandler(w http.ResponseWriter, r *http.Request) {
+	guestID := chi.URLParam(r, "guestID")
+	guest, err := tickets.Repo.GetGuest(guestID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	export, err := tickets.Repo.ExportGuest(guestActor(r, guest.Email), guest.ID)
+	if err != nil {
+		RenderError(w, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=my-tickets.json")
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(export)
+	if err != nil {
+		log.Println("GuestExportHandler", guest.ID, err)
+	}
+}
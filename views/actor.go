@@ -0,0 +1,48 @@
+package views
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi/middleware"
+)
+
+// clientIP is the address of the client, middleware.RealIP has already applied X-Forwarded-For/X-Real-IP
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr // RealIP sets RemoteAddr without a port
+	}
+	return host
+}
+
+// guestActor is the audit actor for a change made by a guest
+func guestActor(r *http.Request, email string) tickets.Actor {
+	return tickets.Actor{
+		Kind:      tickets.ActorGuest,
+		Name:      email,
+		IPAddress: clientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+// adminActor is the audit actor for a change made from the admin screens
+func adminActor(r *http.Request) tickets.Actor {
+	return tickets.Actor{
+		Kind:      tickets.ActorAdmin,
+		Name:      "admin",
+		IPAddress: clientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+// systemActor is the audit actor for a background job triggered by a request (cron hitting run_expired)
+func systemActor(r *http.Request, job string) tickets.Actor {
+	a := tickets.SystemActor(job)
+	a.IPAddress = clientIP(r)
+	a.RequestID = middleware.GetReqID(r.Context())
+	return a
+}
@@ -7,11 +7,29 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/blit/advlight/config"
 	"github.com/blit/advlight/tickets"
 )
 
+// adminPages are the admin screens linked from the admin nav, keyed by path
+var adminPages = map[string]string{
+	"/admin":             "Stats",
+	"/admin/slots":       "Slot Editor",
+	"/admin/guests":      "Guests",
+	"/admin/audit":       "Audit Log",
+	"/admin/suspicious":  "Suspicious Activity",
+	"/admin/eventcodes":  "Event Codes",
+	"/admin/blocklist":   "Email Blocklist",
+	"/admin/artwork":     "Ticket Artwork",
+	"/admin/theme":       "Theme",
+	"/admin/emails":      "Email Templates",
+	"/admin/tickettypes": "Ticket Types",
+	"/admin/donations":   "Donations",
+	"/admin/groups":      "Groups",
+}
+
 func TicketAdminHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 	data := struct {
@@ -20,6 +38,7 @@ func TicketAdminHandler(w http.ResponseWriter, r *http.Request) {
 		TotalTickets   int64
 		TotalBooked    int64
 		TotalAvailable int64
+		TotalRevenue   string
 		Password       string
 		AddTickets     string
 	}{
@@ -28,6 +47,7 @@ func TicketAdminHandler(w http.ResponseWriter, r *http.Request) {
 		0,                              // TotalTickets
 		0,                              // TotalBooked
 		9,                              // TotalAvailable
+		"",                             // TotalRevenue
 		os.Getenv("ADVLIGHT_PASSWORD"), // Password
 		"",                             // AddTickets
 	}
@@ -50,7 +70,7 @@ func TicketAdminHandler(w http.ResponseWriter, r *http.Request) {
 				addCount, _ = strconv.Atoi(parts[1])
 			}
 			if addSlot > 0 && addCount > 0 {
-				err := tickets.Repo.CreateSlots("", addSlot, addCount)
+				err := tickets.Repo.CreateSlots(adminActor(r), "", addSlot, addCount)
 				if err != nil {
 					data.ErrorMsg = err.Error()
 				}
@@ -63,10 +83,15 @@ func TicketAdminHandler(w http.ResponseWriter, r *http.Request) {
 				data.ErrorMsg = err.Error()
 			} else {
 				// tally counts
+				var revenue int64
 				for _, s := range data.Stats {
 					data.TotalTickets += s.NumberTickets
 					data.TotalBooked += (s.NumberTickets - s.AvailableTickets)
 					data.TotalAvailable += s.AvailableTickets
+					revenue += s.RevenueCents
+				}
+				if revenue > 0 {
+					data.TotalRevenue = tickets.FormatPrice(revenue, tickets.Currency)
 				}
 				// blow out the cache (use the low-request admin handler as cheap cache invalidation)
 				tickets.Repo.ClearCache()
@@ -89,24 +114,258 @@ func TicketAdminExpiresHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("invalid password"))
 		return
 	}
+	if pruned, err := tickets.Repo.PruneRateLimits(); err != nil {
+		log.Println("PruneRateLimits", err)
+	} else {
+		log.Println("PruneRateLimits", pruned)
+	}
+	if released, err := tickets.Repo.ReleaseAccessible(systemActor(r, "accessible_release"), time.Now()); err != nil {
+		log.Println("ReleaseAccessible", err)
+	} else {
+		w.Write([]byte(fmt.Sprintf("released %d accessible and companion tickets to the general pool\n", released)))
+	}
+	if expired, err := tickets.Repo.ExpireHolds(systemActor(r, "payment_holds"), time.Now()); err != nil {
+		log.Println("ExpireHolds", err)
+	} else {
+		w.Write([]byte(fmt.Sprintf("released the tickets of %d unpaid checkouts\n", expired)))
+	}
+	if released, err := tickets.Repo.ReleaseExpiredGroups(systemActor(r, "group_release"), time.Now()); err != nil {
+		log.Println("ReleaseExpiredGroups", err)
+	} else {
+		w.Write([]byte(fmt.Sprintf("released %d unclaimed group seats\n", released)))
+	}
 	guests, err := tickets.Repo.GetExpiredGuests("1 hour")
 	if err != nil {
 		panic(err)
 	}
+	actor := systemActor(r, "expire_sweep")
 	w.Header().Add("Content-Type", "text/plain")
 	w.Write([]byte(fmt.Sprintf("notifying %d guests of expiration\n\n", len(guests))))
 	for _, g := range guests {
 		slot := g.Tickets[0]
 		em := tickets.ExpirationEmail(*g, slot.Slot)
-		subject := fmt.Sprintf("Your %s ticket request expired (%s)", config.EventName, slot.Slot.Format("Jan 02, 3:04pm"))
-		err = tickets.Mailer.Send(g.Email, subject, em)
+		subject := tickets.ExpirationSubject(*g, slot.Slot)
+		err = tickets.Mailer.SendGuest(*g, subject, em)
 		if err != nil {
 			w.Write([]byte(fmt.Sprintf("ERROR %s %s", g.Email, err.Error())))
 		}
-		err = tickets.Repo.CancelTicket(g, slot.Slot)
+		err = tickets.Repo.ExpireTicket(actor, g, slot.Slot)
 		if err != nil {
 			w.Write([]byte(fmt.Sprintf("DB-ERROR %s %s", g.Email, err.Error())))
 		}
 	}
 
 }
+
+// TicketAdminRetentionHandler anonymizes guests past the retention period (ADVLIGHT_RETENTION), run from cron
+// like run_expired.  Add dryrun=true to report what would change without changing anything.
+func TicketAdminRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain")
+	if !isAdmin(r) {
+		w.Write([]byte("invalid password"))
+		return
+	}
+	dryRun := r.URL.Query().Get("dryrun") == "true"
+	report, err := tickets.Repo.ApplyRetention(systemActor(r, "retention"), tickets.Retention, time.Now(), dryRun)
+	if err != nil {
+		w.Write([]byte("ERROR " + err.Error() + "\n"))
+		return
+	}
+	w.Write([]byte(report.String() + "\n"))
+}
+
+// isAdmin checks the admin password posted with a form (password) or on the query string (pwd)
+func isAdmin(r *http.Request) bool {
+	password := os.Getenv("ADVLIGHT_PASSWORD")
+	if password == "" {
+		return false
+	}
+	return r.FormValue("password") == password || r.URL.Query().Get("pwd") == password
+}
+
+// TicketAdminSlotsHandler previews and applies bulk slot changes (add, remove and move tickets) across a date range
+func TicketAdminSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg    string
+		SuccessMsg  string
+		Password    string
+		Request     tickets.SlotChangeRequest
+		Times       string
+		Changes     []tickets.SlotChange
+		Applied     bool
+		MaxCount    int
+		Categories  []string
+		TicketTypes []tickets.TicketType
+	}{
+		"", // ErrorMsg
+		"", // SuccessMsg
+		"", // Password
+		tickets.SlotChangeRequest{Action: tickets.SlotActionAdd, Count: 10}, // Request
+		"",                       // Times
+		nil,                      // Changes
+		false,                    // Applied
+		tickets.MaxSlotChange,    // MaxCount
+		tickets.TicketCategories, // Categories
+		nil,                      // TicketTypes
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_slots.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+	data.TicketTypes, _ = tickets.Repo.GetTicketTypes()
+
+	defer func() {
+		log.Println("TicketAdminSlotsHandler", data.Request.Action, len(data.Changes), data.Applied, data.ErrorMsg)
+	}()
+
+	if r.FormValue("action") == "" {
+		Render(w, "admin_slots.html", data)
+		return
+	}
+
+	var err error
+	data.Request.Action = r.FormValue("action")
+	data.Request.EventCode = r.FormValue("eventcode")
+	data.Request.ToEventCode = r.FormValue("toeventcode")
+	data.Request.Category = r.FormValue("category")
+	data.Request.TicketType = r.FormValue("tickettype")
+	data.Times = r.FormValue("times")
+	data.Request.Count, _ = strconv.Atoi(r.FormValue("count"))
+	data.Request.StartDate, _ = time.ParseInLocation("2006-01-02", r.FormValue("startdate"), config.Location)
+	data.Request.EndDate, _ = time.ParseInLocation("2006-01-02", r.FormValue("enddate"), config.Location)
+	if data.Request.EndDate.IsZero() {
+		data.Request.EndDate = data.Request.StartDate
+	}
+	data.Request.Times, err = tickets.ParseSlotTimes(data.Times)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+		Render(w, "admin_slots.html", data)
+		return
+	}
+
+	data.Changes, err = tickets.Repo.PlanSlotChanges(data.Request)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+		Render(w, "admin_slots.html", data)
+		return
+	}
+
+	if r.FormValue("apply") == "true" {
+		data.Changes = tickets.Repo.ApplySlotChanges(adminActor(r), data.Changes)
+		data.Applied = true
+		var applied int64
+		var failed int
+		for _, c := range data.Changes {
+			applied += c.Applied
+			if c.Error != "" {
+				failed++
+			}
+		}
+		data.SuccessMsg = fmt.Sprintf("%s %d tickets across %d slots", data.Request.Action, applied, len(data.Changes)-failed)
+		if failed > 0 {
+			data.ErrorMsg = fmt.Sprintf("%d slots failed, see below", failed)
+		}
+	}
+	Render(w, "admin_slots.html", data)
+}
+
+// TicketAdminAuditHandler shows the audit log filtered by guest, slot or actor
+func TicketAdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg string
+		Password string
+		Filter   tickets.AuditFilter
+		SlotStr  string
+		Entries  []tickets.AuditEntry
+	}{
+		"", // ErrorMsg
+		"", // Password
+		tickets.AuditFilter{Guest: r.FormValue("guest"), Actor: r.FormValue("actor")}, // Filter
+		r.FormValue("slot"), // SlotStr
+		nil,                 // Entries
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_audit.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+	if data.SlotStr != "" {
+		// slot may be a unix timestamp (from links) or a datetime-local input
+		if ts, err := strconv.ParseInt(data.SlotStr, 10, 64); err == nil {
+			data.Filter.Slot = time.Unix(ts, 0)
+		} else if slot, err := time.ParseInLocation("2006-01-02T15:04", data.SlotStr, config.Location); err == nil {
+			data.Filter.Slot = slot
+		} else {
+			data.ErrorMsg = fmt.Sprintf("%s is not a valid slot", data.SlotStr)
+		}
+	}
+	var err error
+	data.Entries, err = tickets.Repo.GetAudit(data.Filter)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminAuditHandler", data.Filter, len(data.Entries), data.ErrorMsg)
+	Render(w, "admin_audit.html", data)
+}
+
+// TicketAdminSuspiciousHandler flags many guests from one address and bursts of bookings for the same slot
+func TicketAdminSuspiciousHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg string
+		Password string
+		Days     int
+		Window   int // minutes
+		Filter   tickets.SuspiciousFilter
+		IPs      []tickets.IPActivity
+		Bursts   []tickets.SlotBurst
+	}{
+		"", // ErrorMsg
+		"", // Password
+		int(tickets.DefaultSuspiciousFilter.Since.Hours() / 24),    // Days
+		int(tickets.DefaultSuspiciousFilter.BurstWindow.Minutes()), // Window
+		tickets.DefaultSuspiciousFilter,                            // Filter
+		nil,                                                        // IPs
+		nil,                                                        // Bursts
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_suspicious.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+	if v, err := strconv.Atoi(r.FormValue("days")); err == nil && v > 0 {
+		data.Days = v
+	}
+	if v, err := strconv.Atoi(r.FormValue("window")); err == nil && v > 0 {
+		data.Window = v
+	}
+	if v, err := strconv.Atoi(r.FormValue("minguests")); err == nil && v > 0 {
+		data.Filter.MinGuests = v
+	}
+	if v, err := strconv.Atoi(r.FormValue("minburst")); err == nil && v > 0 {
+		data.Filter.MinBurstCount = v
+	}
+	data.Filter.Since = time.Duration(data.Days) * 24 * time.Hour
+	data.Filter.BurstWindow = time.Duration(data.Window) * time.Minute
+
+	var err error
+	data.IPs, err = tickets.Repo.GetIPActivity(data.Filter)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	data.Bursts, err = tickets.Repo.GetSlotBursts(data.Filter)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminSuspiciousHandler", len(data.IPs), len(data.Bursts), data.ErrorMsg)
+	Render(w, "admin_suspicious.html", data)
+}
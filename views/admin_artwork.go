@@ -0,0 +1,98 @@
+package views
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/blit/advlight/tickets"
+)
+
+// TicketAdminArtworkHandler uploads ticket artwork and assigns it to days and event codes
+func TicketAdminArtworkHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg    string
+		SuccessMsg  string
+		Password    string
+		Artwork     []tickets.Artwork
+		Assignments []tickets.ArtworkAssignment
+		EventCodes  []tickets.EventCode
+	}{
+		"",  // ErrorMsg
+		"",  // SuccessMsg
+		"",  // Password
+		nil, // Artwork
+		nil, // Assignments
+		nil, // EventCodes
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_artwork.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	var err error
+	actor := adminActor(r)
+	switch r.FormValue("op") {
+	case "upload":
+		file, header, ferr := r.FormFile("file")
+		if ferr != nil {
+			err = ferr
+			break
+		}
+		defer file.Close()
+		img, ferr := ioutil.ReadAll(http.MaxBytesReader(w, file, tickets.MaxArtworkSize+1))
+		if ferr != nil {
+			err = ferr
+			break
+		}
+		name := strings.TrimSpace(strings.ToLower(r.FormValue("name")))
+		if name == "" {
+			name = tickets.ArtworkName(header.Filename)
+		}
+		err = tickets.Repo.UploadArtwork(actor, name, img)
+		if err == nil {
+			data.SuccessMsg = "Uploaded " + name
+		}
+	case "delete":
+		err = tickets.Repo.DeleteArtwork(actor, r.FormValue("name"))
+		if err == nil {
+			data.SuccessMsg = "Deleted " + r.FormValue("name")
+		}
+	case "assign":
+		err = tickets.Repo.AssignArtwork(actor, tickets.ArtworkAssignment{
+			Day:       r.FormValue("day"),
+			EventCode: r.FormValue("eventcode"),
+			Artwork:   r.FormValue("name"),
+		})
+		if err == nil {
+			data.SuccessMsg = "Assigned " + r.FormValue("name")
+		}
+	case "unassign":
+		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		err = tickets.Repo.UnassignArtwork(actor, id)
+	}
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+
+	data.Artwork, err = tickets.ArtworkImages.List()
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	data.Assignments, err = tickets.Repo.GetArtworkAssignments()
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	data.EventCodes, err = tickets.Repo.GetEventCodes()
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminArtworkHandler", r.FormValue("op"), len(data.Artwork), len(data.Assignments), data.ErrorMsg)
+	Render(w, "admin_artwork.html", data)
+}
@@ -0,0 +1,58 @@
+package views
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/blit/advlight/tickets"
+)
+
+// TicketAdminBlocklistHandler maintains the disposable email domain blocklist
+func TicketAdminBlocklistHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg   string
+		SuccessMsg string
+		Password   string
+		Domains    []tickets.BlockedDomain
+	}{
+		"",  // ErrorMsg
+		"",  // SuccessMsg
+		"",  // Password
+		nil, // Domains
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_blocklist.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	var err error
+	switch r.FormValue("op") {
+	case "block":
+		domains := tickets.ParseEmailDomains(r.FormValue("domains"))
+		err = tickets.Repo.BlockDomains(adminActor(r), domains, strings.TrimSpace(r.FormValue("note")))
+		if err == nil && len(domains) > 0 {
+			data.SuccessMsg = "Blocked " + strings.Join(domains, ", ")
+		}
+	case "unblock":
+		domain := strings.TrimSpace(strings.ToLower(r.FormValue("domain")))
+		err = tickets.Repo.UnblockDomain(adminActor(r), domain)
+		if err == nil {
+			data.SuccessMsg = "Unblocked " + domain
+		}
+	}
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+
+	data.Domains, err = tickets.Repo.GetBlockedDomains()
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminBlocklistHandler", r.FormValue("op"), len(data.Domains), data.ErrorMsg)
+	Render(w, "admin_blocklist.html", data)
+}
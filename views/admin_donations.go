@@ -0,0 +1,86 @@
+package views
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/tickets"
+)
+
+// MaxDonationsCSVSize limits the donation processor export uploaded to the admin
+const MaxDonationsCSVSize = 10 << 20
+
+// TicketAdminDonationsHandler imports the donation processor's csv and reports donation conversion by day and event code
+func TicketAdminDonationsHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg     string
+		SuccessMsg   string
+		Password     string
+		DonateLink   string
+		DonatePrompt bool
+		Stats        []tickets.DonationStat
+		Total        tickets.DonationStat
+		Donations    []tickets.Donation
+	}{
+		"",                     // ErrorMsg
+		"",                     // SuccessMsg
+		"",                     // Password
+		config.DonateLink,      // DonateLink
+		config.DonatePrompt,    // DonatePrompt
+		nil,                    // Stats
+		tickets.DonationStat{}, // Total
+		nil,                    // Donations
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_donations.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	var err error
+	switch r.FormValue("op") {
+	case "import":
+		file, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			err = ferr
+			break
+		}
+		defer file.Close()
+		donations, ferr := tickets.ParseDonationsCSV(http.MaxBytesReader(w, file, MaxDonationsCSVSize))
+		if ferr != nil {
+			err = ferr
+			break
+		}
+		di, ferr := tickets.Repo.ImportDonations(adminActor(r), donations)
+		if ferr != nil {
+			err = ferr
+			break
+		}
+		data.SuccessMsg = "Imported " + di.String()
+	}
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+
+	data.Stats, err = tickets.Repo.GetDonationStats()
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	// guests booked on several days count once per day, so the total is of the rows
+	for _, ds := range data.Stats {
+		data.Total.Guests += ds.Guests
+		data.Total.Clicked += ds.Clicked
+		data.Total.Donors += ds.Donors
+		data.Total.AmountCents += ds.AmountCents
+	}
+	data.Donations, err = tickets.Repo.GetDonations(100)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminDonationsHandler", r.FormValue("op"), len(data.Stats), len(data.Donations), data.ErrorMsg)
+	Render(w, "admin_donations.html", data)
+}
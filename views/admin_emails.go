@@ -0,0 +1,157 @@
+package views
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/tickets"
+)
+
+// TicketAdminEmailsHandler edits the wording of the emails, every save is a new version that can be rolled back
+func TicketAdminEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg   string
+		SuccessMsg string
+		Password   string
+		Names      []string
+		Languages  []i18n.Language
+		Template   tickets.EmailTemplate
+		Versions   []tickets.EmailTemplate
+		TestEmail  string
+	}{
+		"",                         // ErrorMsg
+		"",                         // SuccessMsg
+		"",                         // Password
+		tickets.EmailTemplateNames, // Names
+		i18n.Languages(),           // Languages
+		tickets.EmailTemplate{},    // Template
+		nil,                        // Versions
+		r.FormValue("test_email"),  // TestEmail
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_emails.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	name, lang := r.FormValue("name"), r.FormValue("lang")
+	if name == "" {
+		name = tickets.EmailConfirmation
+	}
+	if !i18n.Supported(lang) {
+		lang = i18n.Default
+	}
+	et, err := tickets.Repo.GetEmailTemplate(name, lang)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+		et = tickets.DefaultEmailTemplate(name, lang)
+	}
+
+	switch r.FormValue("op") {
+	case "save":
+		et, err = tickets.Repo.SaveEmailTemplate(adminActor(r), emailTemplateForm(r, name, lang))
+		if err != nil {
+			data.ErrorMsg = err.Error()
+		} else {
+			data.SuccessMsg = fmt.Sprintf("Saved %s (%s) version %d", name, lang, et.Version)
+		}
+	case "restore":
+		version, _ := strconv.Atoi(r.FormValue("version"))
+		et, err = tickets.Repo.RestoreEmailTemplate(adminActor(r), name, lang, version)
+		if err != nil {
+			data.ErrorMsg = err.Error()
+		} else {
+			data.SuccessMsg = fmt.Sprintf("Restored version %d of %s (%s) as version %d", version, name, lang, et.Version)
+		}
+	case "sendtest":
+		// the unsaved wording is sent, so an edit can be checked in a real inbox before saving
+		et = emailTemplateForm(r, name, lang)
+		err = sendTestEmail(et, data.TestEmail)
+		if err != nil {
+			data.ErrorMsg = err.Error()
+		} else {
+			data.SuccessMsg = "Sent a test email to " + data.TestEmail
+		}
+	}
+	data.Template = et
+
+	data.Versions, err = tickets.Repo.GetEmailTemplateVersions(name, lang)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminEmailsHandler", r.FormValue("op"), name, lang, data.ErrorMsg)
+	Render(w, "admin_emails.html", data)
+}
+
+// TicketAdminEmailPreviewHandler renders the editor's unsaved template as it would be sent, for the preview iframe
+func TicketAdminEmailPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Invalid password", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	preview, err := emailPreview(emailTemplateForm(r, r.FormValue("name"), r.FormValue("lang")))
+	if err != nil {
+		fmt.Fprintf(w, `<p style="color:#a94442; font-family:sans-serif;">%s</p>`, html.EscapeString(err.Error()))
+		return
+	}
+	w.Write([]byte(preview))
+}
+
+// emailTemplateForm reads the editor's fields
+func emailTemplateForm(r *http.Request, name, lang string) tickets.EmailTemplate {
+	return tickets.EmailTemplate{
+		Name:         name,
+		Lang:         lang,
+		Subject:      r.FormValue("subject"),
+		Intro:        r.FormValue("intro"),
+		Instructions: r.FormValue("instructions"),
+		Button:       r.FormValue("button"),
+		ButtonColor:  r.FormValue("button_color"),
+		Outro:        r.FormValue("outro"),
+	}
+}
+
+// emailPreview is the subject and email html for a sample guest
+func emailPreview(et tickets.EmailTemplate) (string, error) {
+	err := et.Validate()
+	if err != nil {
+		return "", err
+	}
+	g, slot := sampleGuest(et.Lang)
+	subject, email, err := tickets.PreviewEmail(et, g, slot)
+	if err != nil {
+		return "", err
+	}
+	body, err := tickets.EmailHTML(et.Lang, email)
+	if err != nil {
+		return "", err
+	}
+	return `<div style="font-family:sans-serif; padding:8px; border-bottom:1px solid #ccc;"><strong>Subject:</strong> ` +
+		html.EscapeString(subject) + `</div>` + body, nil
+}
+
+// sendTestEmail sends the template, filled in for a sample guest, to address
+func sendTestEmail(et tickets.EmailTemplate, address string) error {
+	address, err := tickets.ParseEmail(address)
+	if err != nil {
+		return err
+	}
+	err = et.Validate()
+	if err != nil {
+		return err
+	}
+	g, slot := sampleGuest(et.Lang)
+	subject, email, err := tickets.PreviewEmail(et, g, slot)
+	if err != nil {
+		return err
+	}
+	return tickets.Mailer.Send(et.Lang, address, "[TEST] "+subject, email)
+}
@@ -0,0 +1,21 @@
+package views
+
+import (
+	"testing"
+
+	"github.com/blit/advlight/tickets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailPreview(t *testing.T) {
+	et := tickets.DefaultEmailTemplate(tickets.EmailExpiration, "es")
+	et.Subject = "Subject for {{.Email}}"
+	preview, err := emailPreview(et)
+	assert.NoError(t, err)
+	assert.Contains(t, preview, "Subject for guest@example.com")
+	assert.Contains(t, preview, "guest@example.com")
+
+	et.Intro = "{{.Missing}}"
+	_, err = emailPreview(et)
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package views
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/blit/advlight/tickets"
+)
+
+// TicketAdminEventCodesHandler lists event codes, limits them to email domains, creates shareable
+// links and shows recent invalid code attempts
+func TicketAdminEventCodesHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg   string
+		SuccessMsg string
+		Password   string
+		Codes      []tickets.EventCode
+		Attempts   []tickets.EventCodeAttempt
+		Link       string
+		LinkCode   string
+	}{
+		"",  // ErrorMsg
+		"",  // SuccessMsg
+		"",  // Password
+		nil, // Codes
+		nil, // Attempts
+		"",  // Link
+		"",  // LinkCode
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_eventcodes.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	var err error
+	code := strings.TrimSpace(strings.ToLower(r.FormValue("code")))
+	switch r.FormValue("op") {
+	case "domains":
+		domains := tickets.ParseEmailDomains(r.FormValue("domains"))
+		err = tickets.Repo.SetEventCodeDomains(adminActor(r), code, domains)
+		if err == nil {
+			data.SuccessMsg = "Updated email domains for " + code
+		}
+	case "link":
+		data.Link, err = tickets.EventCodeLink(code)
+		data.LinkCode = code
+	}
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+
+	data.Codes, err = tickets.Repo.GetEventCodes()
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	data.Attempts, err = tickets.Repo.GetEventCodeAttempts(100)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminEventCodesHandler", r.FormValue("op"), code, len(data.Codes), data.ErrorMsg)
+	Render(w, "admin_eventcodes.html", data)
+}
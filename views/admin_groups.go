@@ -0,0 +1,80 @@
+package views
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/blit/advlight/tickets"
+)
+
+// TicketAdminGroupsHandler creates group bookings, emails coordinators their portal link and releases unclaimed seats
+func TicketAdminGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg   string
+		SuccessMsg string
+		Password   string
+		Release    string
+		Groups     []tickets.Group
+	}{
+		"",                            // ErrorMsg
+		"",                            // SuccessMsg
+		"",                            // Password
+		tickets.GroupRelease.String(), // Release
+		nil,                           // Groups
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_groups.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	var err error
+	actor := adminActor(r)
+	switch r.FormValue("op") {
+	case "create":
+		g := &tickets.Group{Name: r.FormValue("name"), CoordinatorEmail: r.FormValue("email")}
+		g.MaxSeats, err = strconv.ParseInt(strings.TrimSpace(r.FormValue("seats")), 10, 64)
+		if err == nil {
+			err = tickets.Repo.CreateGroup(actor, g)
+		}
+		if err == nil {
+			err = tickets.Mailer.Send("", g.CoordinatorEmail, tickets.GroupCoordinatorSubject("", *g), tickets.GroupCoordinatorEmail("", *g))
+		}
+		if err == nil {
+			data.SuccessMsg = "Created " + g.Name + " and emailed " + g.CoordinatorEmail + " the group's link"
+		}
+	case "resend", "release":
+		var g *tickets.Group
+		g, err = tickets.Repo.GetGroup(r.FormValue("id"))
+		if err != nil {
+			break
+		}
+		if r.FormValue("op") == "resend" {
+			err = tickets.Mailer.Send("", g.CoordinatorEmail, tickets.GroupCoordinatorSubject("", *g), tickets.GroupCoordinatorEmail("", *g))
+			if err == nil {
+				data.SuccessMsg = "Emailed " + g.CoordinatorEmail + " the group's link"
+			}
+			break
+		}
+		var released int64
+		released, err = tickets.Repo.ReleaseGroupSeats(actor, g, 0)
+		if err == nil {
+			data.SuccessMsg = "Released " + strconv.FormatInt(released, 10) + " unclaimed seats of " + g.Name
+		}
+	}
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+
+	data.Groups, err = tickets.Repo.GetGroups()
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminGroupsHandler", r.FormValue("op"), len(data.Groups), data.ErrorMsg)
+	Render(w, "admin_groups.html", data)
+}
@@ -0,0 +1,137 @@
+package views
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/tickets"
+)
+
+// adminGuest is a guest with the extra detail shown in the support console
+type adminGuest struct {
+	*tickets.Guest
+	Emails []tickets.EmailLog
+}
+
+// TicketAdminGuestsHandler is the guest support console, search guests by email and fix their tickets
+func TicketAdminGuestsHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg   string
+		SuccessMsg string
+		Password   string
+		Query      string
+		Guests     []adminGuest
+		Slots      []tickets.SlotStat
+	}{
+		"",               // ErrorMsg
+		"",               // SuccessMsg
+		"",               // Password
+		r.FormValue("q"), // Query
+		nil,              // Guests
+		nil,              // Slots
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_guests.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	if op := r.FormValue("op"); op != "" && r.Method == "POST" {
+		msg, err := adminGuestAction(r, op)
+		log.Println("TicketAdminGuestsHandler", op, r.FormValue("guest"), msg, err)
+		if err != nil {
+			data.ErrorMsg = err.Error()
+		} else {
+			data.SuccessMsg = msg
+		}
+	}
+
+	if strings.TrimSpace(data.Query) != "" {
+		guests, err := tickets.Repo.SearchGuests(data.Query)
+		if err != nil {
+			data.ErrorMsg = err.Error()
+			Render(w, "admin_guests.html", data)
+			return
+		}
+		data.Guests = make([]adminGuest, len(guests))
+		for i, g := range guests {
+			data.Guests[i].Guest = g
+			data.Guests[i].Emails, err = tickets.Repo.GetGuestEmails(g.ID)
+			if err != nil {
+				data.ErrorMsg = err.Error()
+			}
+		}
+		if len(guests) > 0 {
+			data.Slots, err = tickets.Repo.GetSlotsStats()
+			if err != nil {
+				data.ErrorMsg = err.Error()
+			}
+		}
+	}
+	Render(w, "admin_guests.html", data)
+}
+
+// adminGuestAction runs a support console action against the posted guest, returning a success message
+func adminGuestAction(r *http.Request, op string) (string, error) {
+	guest, err := tickets.Repo.GetGuest(r.FormValue("guest"))
+	if err != nil {
+		return "", err
+	}
+	actor := adminActor(r)
+	var slot time.Time
+	if r.FormValue("slot") != "" {
+		ts, err := strconv.ParseInt(r.FormValue("slot"), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s is not a valid slot", r.FormValue("slot"))
+		}
+		slot = time.Unix(ts, 0)
+	}
+
+	switch op {
+	case "resend":
+		if slot.IsZero() {
+			return "", fmt.Errorf("a ticket is required to resend the confirmation")
+		}
+		err = tickets.Mailer.SendGuest(*guest, tickets.ConfirmationSubject(*guest, slot), tickets.ConfirmationEmail(*guest, slot), tickets.ConfirmationAttachments(*guest, slot)...)
+		tickets.Repo.Audit(actor, tickets.AuditEntry{Action: tickets.AuditResendEmail, GuestID: guest.ID, Email: guest.Email, Slot: slot})
+		return "Confirmation sent to " + guest.Email, err
+	case "verify":
+		err = tickets.Repo.VerifyGuest(actor, guest)
+		return guest.Email + " verified", err
+	case "cancel":
+		if slot.IsZero() {
+			return "", fmt.Errorf("a ticket is required to cancel")
+		}
+		err = tickets.Repo.CancelTicket(actor, guest, slot)
+		return fmt.Sprintf("Cancelled %s ticket for %s", guest.Email, slot.Format("Jan 02, 3:04pm")), err
+	case "move":
+		// moveto is slot+eventcode
+		parts := strings.SplitN(r.FormValue("moveto"), "+", 2)
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if slot.IsZero() || err != nil {
+			return "", fmt.Errorf("select a ticket and a slot to move it to")
+		}
+		to := time.Unix(ts, 0)
+		eventCode := ""
+		if len(parts) == 2 {
+			eventCode = parts[1]
+		}
+		err = tickets.Repo.MoveTicket(actor, guest, slot, to, eventCode)
+		return fmt.Sprintf("Moved %s ticket from %s to %s", guest.Email, slot.Format("Jan 02, 3:04pm"), to.Format("Jan 02, 3:04pm")), err
+	case "merge":
+		duplicate, err := tickets.Repo.GetGuest(r.FormValue("merge"))
+		if err != nil {
+			return "", err
+		}
+		err = tickets.Repo.MergeGuests(actor, guest, duplicate)
+		return fmt.Sprintf("Merged %s into %s", duplicate.Email, guest.Email), err
+	}
+	return "", fmt.Errorf("unknown action %q", op)
+}
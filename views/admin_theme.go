@@ -0,0 +1,94 @@
+package views
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/theme"
+	"github.com/blit/advlight/tickets"
+)
+
+// TicketAdminThemeHandler previews the theme on the index and ticket pages and the confirmation email side by side
+func TicketAdminThemeHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg   string
+		SuccessMsg string
+		Password   string
+		Theme      *theme.Theme
+		ThemeDir   string
+		Index      string
+		Ticket     string
+		Email      string
+	}{
+		"",              // ErrorMsg
+		"",              // SuccessMsg
+		"",              // Password
+		nil,             // Theme
+		config.ThemeDir, // ThemeDir
+		"",              // Index
+		"",              // Ticket
+		"",              // Email
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_theme.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	if r.FormValue("op") == "reload" {
+		err := theme.Reload()
+		if err == nil {
+			err = LoadTemplates()
+		}
+		if err != nil {
+			data.ErrorMsg = err.Error()
+		} else {
+			data.SuccessMsg = "Reloaded " + theme.Current().Name
+		}
+	}
+	data.Theme = theme.Current()
+	data.Index, data.Ticket, data.Email = themePreviews()
+	log.Println("TicketAdminThemeHandler", r.FormValue("op"), data.Theme.Name, data.ErrorMsg)
+	Render(w, "admin_theme.html", data)
+}
+
+// themePreviews renders the index and ticket pages and the confirmation email for a sample guest
+func themePreviews() (string, string, string) {
+	g, slot := sampleGuest(i18n.Default)
+	slots := []tickets.Slot{{Slot: slot, AvailableTickets: 12}, {Slot: slot.Add(30 * time.Minute), AvailableTickets: 3}}
+
+	var index, ticket bytes.Buffer
+	// maps so the pages' optional fields are simply empty
+	Render(&index, "index.html", map[string]interface{}{
+		"Guest":        &g,
+		"Email":        g.Email,
+		"Slots":        slots,
+		"SelectedSlot": slot.Unix(),
+		"DonateLink":   config.DonateLink,
+	})
+	Render(&ticket, "ticket.html", map[string]interface{}{
+		"Guest":  &g,
+		"Ticket": &g.Tickets[0],
+	})
+	email, err := tickets.EmailHTML(g.Language, tickets.ConfirmationEmail(g, slot))
+	if err != nil {
+		email = err.Error()
+	}
+	return index.String(), ticket.String(), email
+}
+
+// sampleGuest is a made up guest with a ticket, for previews
+func sampleGuest(lang string) (tickets.Guest, time.Time) {
+	y := time.Now().In(config.Location).Year()
+	slot := time.Date(y, 12, 10, 19, 0, 0, 0, config.Location)
+	g := tickets.Guest{ID: "00000000-0000-0000-0000-000000000000", Email: "guest@example.com", Verified: true, Language: lang}
+	g.Tickets = []tickets.Ticket{{GuestID: g.ID, Slot: slot, Number: 42, Category: tickets.CategoryStandard}}
+	return g, slot
+}
@@ -0,0 +1,15 @@
+package views
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThemePreviews(t *testing.T) {
+	index, ticket, email := themePreviews()
+	assert.Contains(t, index, "--header-bg")
+	assert.Contains(t, index, "guest@example.com")
+	assert.Contains(t, ticket, "--ticket-time")
+	assert.Contains(t, email, "guest@example.com")
+}
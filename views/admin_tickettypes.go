@@ -0,0 +1,73 @@
+package views
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/blit/advlight/tickets"
+)
+
+// TicketAdminTicketTypesHandler creates and edits priced ticket types and lists recent payments
+func TicketAdminTicketTypesHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg    string
+		SuccessMsg  string
+		Password    string
+		Provider    string
+		Currency    string
+		TicketTypes []tickets.TicketType
+		Payments    []tickets.Payment
+	}{
+		"",               // ErrorMsg
+		"",               // SuccessMsg
+		"",               // Password
+		"",               // Provider
+		tickets.Currency, // Currency
+		nil,              // TicketTypes
+		nil,              // Payments
+	}
+	if tickets.Payments != nil {
+		data.Provider = tickets.Payments.Name()
+	}
+	if !isAdmin(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "admin_tickettypes.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	var err error
+	switch r.FormValue("op") {
+	case "save":
+		tt := tickets.TicketType{
+			Code:        r.FormValue("code"),
+			Name:        r.FormValue("name"),
+			Description: strings.TrimSpace(r.FormValue("description")),
+			Active:      r.FormValue("active") == "true",
+		}
+		tt.PriceCents, err = tickets.ParsePrice(r.FormValue("price"))
+		if err == nil {
+			err = tickets.Repo.SaveTicketType(adminActor(r), tt)
+		}
+		if err == nil {
+			data.SuccessMsg = "Saved " + tt.Name
+		}
+	}
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+
+	data.TicketTypes, err = tickets.Repo.GetTicketTypes()
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	data.Payments, err = tickets.Repo.GetPayments(100)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("TicketAdminTicketTypesHandler", r.FormValue("op"), len(data.TicketTypes), len(data.Payments), data.ErrorMsg)
+	Render(w, "admin_tickettypes.html", data)
+}
@@ -1,22 +1,149 @@
 package views
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/blit/advlight/theme"
+	"github.com/blit/advlight/tickets"
 	"github.com/blit/advlight/views/assets"
 	"github.com/go-chi/chi"
 )
 
-func AssetImageHandler(w http.ResponseWriter, r *http.Request) {
+func init() {
+	tickets.AssetLoader = assets.ReadFile
+	tickets.AssetURL = assets.URL
+	theme.AssetURL = assets.URL
+}
 
+// AssetImageHandler serves built in images at their old unhashed urls, which are still in sent emails
+func AssetImageHandler(w http.ResponseWriter, r *http.Request) {
 	imageID := chi.URLParam(r, "imageID")
-	log.Printf("AssetImageHandler.%s\n", imageID)
-	b, err := assets.Asset("wwwroot/img/" + imageID)
+	a, err := assets.Get("img/" + imageID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	serveAsset(w, r, a, "")
+}
+
+// StaticHandler serves files from wwwroot (or the override directory).  Content hashed urls from the asset
+// template func are cached for a year, a new deploy changes the hash.
+func StaticHandler(w http.ResponseWriter, r *http.Request) {
+	name, hash := assets.Unhash(chi.URLParam(r, "*"))
+	if strings.HasPrefix(name, "templates/") {
+		http.NotFound(w, r)
+		return
+	}
+	a, err := assets.Get(name)
 	if err != nil {
-		RenderError(w, err)
+		http.NotFound(w, r)
+		return
+	}
+	serveAsset(w, r, a, hash)
+}
+
+// serveAsset writes a static file with cache headers, compressed when the client accepts it.
+// Images with a w param are resized like artwork.
+func serveAsset(w http.ResponseWriter, r *http.Request, a *assets.Asset, hash string) {
+	maxAge := 24 * 60 * 60
+	if hash == a.Hash {
+		maxAge = 365 * 24 * 60 * 60
+	} else if assets.Live {
+		maxAge = 0
+	}
+	if r.URL.Query().Get("w") != "" && strings.HasPrefix(a.ContentType, "image/") {
+		serveImage(w, r, a.Name, a.Data, maxAge)
 		return
 	}
-	w.Header().Set("Content-Type", http.DetectContentType(b))
-	w.Write(b)
+
+	cacheControl := fmt.Sprintf("public, max-age=%d", maxAge)
+	if hash == a.Hash {
+		cacheControl += ", immutable"
+	} else if maxAge == 0 {
+		cacheControl = "no-cache"
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Vary", "Accept-Encoding")
+	data, etag := a.Data, a.Hash
+	for _, enc := range assets.AcceptedEncodings(r.Header.Get("Accept-Encoding")) {
+		if b := a.Encoded(enc); b != nil {
+			data, etag = b, a.Hash+"-"+enc
+			w.Header().Set("Content-Encoding", enc)
+			break
+		}
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	// ServeContent answers If-None-Match and If-Modified-Since with 304 Not Modified
+	http.ServeContent(w, r, a.Name, a.ModTime, bytes.NewReader(data))
+}
+
+// ArtworkImageHandler serves uploaded ticket artwork, add ?w=300 for a thumbnail
+func ArtworkImageHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	a, err := tickets.ArtworkImages.Get(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// artwork can be replaced, so it is revalidated with the etag more often
+	serveImage(w, r, "artwork/"+name, a.Data, 60*60)
+}
+
+// thumbnails caches resized images by content hash and width
+var thumbnails = struct {
+	sync.Mutex
+	images map[string][]byte
+}{images: make(map[string][]byte)}
+
+// maxThumbnails bounds the thumbnail cache, it is emptied when full
+const maxThumbnails = 500
+
+// serveImage writes an image with cache headers, resized when the request has a w param.
+// The ETag is a hash of the image so unchanged images are answered with 304 Not Modified.
+func serveImage(w http.ResponseWriter, r *http.Request, name string, data []byte, maxAge int) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:8])
+	width, _ := strconv.Atoi(r.URL.Query().Get("w"))
+	width = tickets.ThumbnailWidth(width)
+	etag := fmt.Sprintf(`"%s-%d"`, hash, width)
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if width > 0 {
+		key := hash + strconv.Itoa(width)
+		thumbnails.Lock()
+		thumb, ok := thumbnails.images[key]
+		thumbnails.Unlock()
+		if !ok {
+			var err error
+			thumb, err = tickets.Thumbnail(data, width)
+			if err != nil {
+				log.Println("serveImage.thumbnail", name, err)
+				thumb = data
+			}
+			thumbnails.Lock()
+			if len(thumbnails.images) >= maxThumbnails {
+				thumbnails.images = make(map[string][]byte)
+			}
+			thumbnails.images[key] = thumb
+			thumbnails.Unlock()
+		}
+		data = thumb
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
 }
@@ -0,0 +1,254 @@
+// Package assets reads templates and static files from the embedded wwwroot, with an optional override directory.
+// Files are cached with a content hash for cache busting urls and compressed once for gzip and brotli clients.
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/wwwroot"
+)
+
+// Files is the asset filesystem, paths are relative to wwwroot (ie img/bgimg-1.jpg)
+var Files fs.FS
+
+// Live is true when files are read from disk and can change while running, cached files are checked against their modification time
+var Live bool
+
+// MinCompressSize is the smallest file worth compressing
+const MinCompressSize = 1024
+
+// started is the modification time of embedded files, which have none
+var started = time.Now()
+
+func init() {
+	Files, Live = Layers(config.Production, config.AssetsDir, config.ThemeDir)
+}
+
+// Layers builds the asset filesystem: dirs (first wins, empty ones are skipped) over wwwroot on disk (outside of production) over the embedded files
+func Layers(production bool, dirs ...string) (fs.FS, bool) {
+	layers := overlay{}
+	for _, dir := range dirs {
+		if dir != "" {
+			log.Println("assets: using overrides from", dir)
+			layers = append(layers, os.DirFS(dir))
+		}
+	}
+	if !production {
+		if fi, err := os.Stat("wwwroot"); err == nil && fi.IsDir() {
+			log.Println("assets: using wwwroot from disk")
+			layers = append(layers, os.DirFS("wwwroot"))
+		}
+	}
+	layers = append(layers, wwwroot.FS)
+	return layers, len(layers) > 1
+}
+
+// overlay opens a file from the first filesystem that has it
+type overlay []fs.FS
+
+func (o overlay) Open(name string) (fs.File, error) {
+	for _, l := range o {
+		f, err := l.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadFile reads an asset, ie ReadFile("templates/index.html")
+func ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(Files, name)
+}
+
+// Asset is a static file ready to serve
+type Asset struct {
+	Name        string
+	Data        []byte
+	Hash        string // first 8 bytes of the sha256 in hex
+	ContentType string
+	ModTime     time.Time
+	Size        int64
+
+	mu      sync.Mutex
+	encoded map[string][]byte
+}
+
+var cache = struct {
+	sync.Mutex
+	assets map[string]*Asset
+}{assets: make(map[string]*Asset)}
+
+// Get reads and caches an asset, when Live it is reread after the file changes
+func Get(name string) (*Asset, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	cache.Lock()
+	a, ok := cache.assets[name]
+	cache.Unlock()
+	if ok && !Live {
+		return a, nil
+	}
+	fi, err := fs.Stat(Files, name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	modTime := fi.ModTime()
+	if modTime.IsZero() {
+		modTime = started
+	}
+	if ok && a.ModTime.Equal(modTime) && a.Size == fi.Size() {
+		return a, nil
+	}
+	data, err := fs.ReadFile(Files, name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	a = &Asset{
+		Name:        name,
+		Data:        data,
+		Hash:        hex.EncodeToString(sum[:8]),
+		ContentType: mime.TypeByExtension(path.Ext(name)),
+		ModTime:     modTime,
+		Size:        fi.Size(),
+		encoded:     make(map[string][]byte),
+	}
+	if a.ContentType == "" {
+		a.ContentType = http.DetectContentType(data)
+	}
+	cache.Lock()
+	cache.assets[name] = a
+	cache.Unlock()
+	return a, nil
+}
+
+// URL is the content hashed url of an asset, ie /static/img/bgimg-1.0123456789abcdef.jpg
+func URL(name string) string {
+	a, err := Get(name)
+	if err != nil {
+		log.Println("assets.URL", name, err)
+		return "/static/" + name
+	}
+	return "/static/" + Hashed(a.Name, a.Hash)
+}
+
+// Hashed adds the hash before the file extension
+func Hashed(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+var hashedRe = regexp.MustCompile(`^(.*)\.([0-9a-f]{16})(\.[^./]+)?$`)
+
+// Unhash splits a hashed name into the asset name and hash, names without a hash are returned as is
+func Unhash(name string) (string, string) {
+	m := hashedRe.FindStringSubmatch(name)
+	if m == nil {
+		return name, ""
+	}
+	return m[1] + m[3], m[2]
+}
+
+// compressible is true for text assets big enough to be worth compressing
+func (a *Asset) compressible() bool {
+	if len(a.Data) < MinCompressSize {
+		return false
+	}
+	ct := a.ContentType
+	return strings.HasPrefix(ct, "text/") || strings.Contains(ct, "javascript") || strings.Contains(ct, "json") ||
+		strings.Contains(ct, "xml") || strings.Contains(ct, "svg")
+}
+
+// Encoded returns the asset compressed with "br" or "gzip", nil when it is not worth compressing.
+// A precompressed file next to the asset (ie app.js.br) is used when there is one.
+func (a *Asset) Encoded(encoding string) []byte {
+	if encoding != "br" && encoding != "gzip" || !a.compressible() {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if b, ok := a.encoded[encoding]; ok {
+		return b
+	}
+	ext := map[string]string{"br": ".br", "gzip": ".gz"}[encoding]
+	b, err := fs.ReadFile(Files, a.Name+ext)
+	if err != nil {
+		b, err = compress(a.Data, encoding)
+		if err != nil {
+			log.Println("assets.Encoded", a.Name, encoding, err)
+			b = nil
+		}
+	}
+	if len(b) >= len(a.Data) {
+		b = nil
+	}
+	a.encoded[encoding] = b
+	return b
+}
+
+func compress(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w interface {
+		Write([]byte) (int, error)
+		Close() error
+	}
+	if encoding == "br" {
+		w = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	} else {
+		w, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// AcceptedEncodings lists the encodings we can serve from an Accept-Encoding header, best first
+func AcceptedEncodings(header string) []string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		enc := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				q, _ = strconv.ParseFloat(f[2:], 64)
+			}
+		}
+		accepted[enc] = q > 0
+	}
+	encodings := make([]string, 0, 2)
+	for _, enc := range []string{"br", "gzip"} {
+		if ok, listed := accepted[enc]; ok || !listed && accepted["*"] {
+			encodings = append(encodings, enc)
+		}
+	}
+	return encodings
+}
@@ -0,0 +1,116 @@
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbedded(t *testing.T) {
+	b, err := ReadFile("templates/layout.html")
+	assert.NoError(t, err)
+	assert.True(t, len(b) > 0)
+
+	a, err := Get("img/bgimg-1.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", a.ContentType)
+	assert.Equal(t, "/static/img/bgimg-1."+a.Hash+".jpg", URL("img/bgimg-1.jpg"))
+
+	_, err = Get(".DS_Store")
+	assert.Error(t, err)
+}
+
+func TestOverlay(t *testing.T) {
+	o := overlay{
+		fstest.MapFS{"templates/index.html": {Data: []byte("override")}},
+		fstest.MapFS{"templates/index.html": {Data: []byte("embedded")}, "img/a.jpg": {Data: []byte("a")}},
+	}
+	b, err := fs.ReadFile(o, "templates/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "override", string(b))
+	b, err = fs.ReadFile(o, "img/a.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(b))
+	_, err = fs.ReadFile(o, "img/b.jpg")
+	assert.Error(t, err)
+}
+
+func TestUnhash(t *testing.T) {
+	name, hash := Unhash(Hashed("img/bgimg-1.jpg", "0123456789abcdef"))
+	assert.Equal(t, "img/bgimg-1.jpg", name)
+	assert.Equal(t, "0123456789abcdef", hash)
+	name, hash = Unhash("img/bgimg-1.jpg")
+	assert.Equal(t, "img/bgimg-1.jpg", name)
+	assert.Equal(t, "", hash)
+	name, hash = Unhash("LICENSE.0123456789abcdef")
+	assert.Equal(t, "LICENSE", name)
+	assert.Equal(t, "0123456789abcdef", hash)
+}
+
+func TestLiveReload(t *testing.T) {
+	defer swapFiles(fstest.MapFS{"css/app.css": {Data: []byte("a{}"), ModTime: time.Unix(1, 0)}}, true)()
+	a, err := Get("css/app.css")
+	assert.NoError(t, err)
+	assert.Equal(t, "a{}", string(a.Data))
+
+	Files.(fstest.MapFS)["css/app.css"] = &fstest.MapFile{Data: []byte("b{}"), ModTime: time.Unix(2, 0)}
+	b, err := Get("css/app.css")
+	assert.NoError(t, err)
+	assert.Equal(t, "b{}", string(b.Data))
+	assert.NotEqual(t, a.Hash, b.Hash)
+}
+
+func TestEncoded(t *testing.T) {
+	css := strings.Repeat("body { color: red; }\n", 100)
+	defer swapFiles(fstest.MapFS{
+		"css/app.css":    {Data: []byte(css)},
+		"css/small.css":  {Data: []byte("a{}")},
+		"css/pre.css":    {Data: []byte(css)},
+		"css/pre.css.br": {Data: []byte("precompressed")},
+	}, false)()
+
+	a, err := Get("css/app.css")
+	assert.NoError(t, err)
+	r, err := gzip.NewReader(bytes.NewReader(a.Encoded("gzip")))
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal(t, css, string(b))
+	b, _ = ioutil.ReadAll(brotli.NewReader(bytes.NewReader(a.Encoded("br"))))
+	assert.Equal(t, css, string(b))
+	assert.Nil(t, a.Encoded("deflate"))
+
+	small, _ := Get("css/small.css")
+	assert.Nil(t, small.Encoded("gzip"))
+	pre, _ := Get("css/pre.css")
+	assert.Equal(t, "precompressed", string(pre.Encoded("br")))
+}
+
+func TestAcceptedEncodings(t *testing.T) {
+	assert.Equal(t, []string{"br", "gzip"}, AcceptedEncodings("gzip, deflate, br"))
+	assert.Equal(t, []string{"gzip"}, AcceptedEncodings("gzip;q=0.8, br;q=0"))
+	assert.Equal(t, []string{"br", "gzip"}, AcceptedEncodings("*"))
+	assert.Equal(t, []string{}, AcceptedEncodings(""))
+}
+
+// swapFiles replaces the asset filesystem and empties the cache, call the returned func to restore them
+func swapFiles(files fstest.MapFS, live bool) func() {
+	oldFiles, oldLive := Files, Live
+	Files, Live = files, live
+	cache.Lock()
+	cache.assets = make(map[string]*Asset)
+	cache.Unlock()
+	return func() {
+		Files, Live = oldFiles, oldLive
+		cache.Lock()
+		cache.assets = make(map[string]*Asset)
+		cache.Unlock()
+	}
+}
@@ -0,0 +1,43 @@
+package views
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blit/advlight/views/assets"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticHandler(t *testing.T) {
+	r := chi.NewRouter()
+	r.Get("/static/*", StaticHandler)
+
+	get := func(url string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	url := assets.URL("img/bgimg-1.jpg")
+	w := get(url)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	assert.NotEqual(t, "", w.Header().Get("Last-Modified"))
+
+	w = get(url, "If-None-Match", w.Header().Get("ETag"))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = get("/static/img/bgimg-1.jpg")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=86400", w.Header().Get("Cache-Control"))
+
+	assert.Equal(t, http.StatusNotFound, get("/static/templates/layout.html").Code)
+	assert.Equal(t, http.StatusNotFound, get("/static/img/missing.jpg").Code)
+}
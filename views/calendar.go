@@ -0,0 +1,36 @@
+package views
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi"
+)
+
+// GuestCalendarHandler is the guest's iCal feed, calendar apps subscribed to it pick up moved and cancelled tickets
+func GuestCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	guest, err := tickets.Repo.GetGuest(chi.URLParam(r, "guestID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeCalendar(w, "tickets.ics", tickets.ICalendar(*guest, guest.Tickets, time.Now()))
+}
+
+// TicketCalendarHandler downloads a single ticket as a calendar event (add to calendar)
+func TicketCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	guest, ticket, err := guestTicket(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeCalendar(w, "ticket.ics", tickets.ICalendar(*guest, []tickets.Ticket{*ticket}, time.Now()))
+}
+
+func writeCalendar(w http.ResponseWriter, filename string, ics []byte) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename="+filename)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(ics)
+}
@@ -0,0 +1,46 @@
+package views
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi"
+)
+
+// DonateHandler records a click on a donate link and sends the guest on to config.DonateLink,
+// /{guestID}/donate attributes the click to the guest
+func DonateHandler(w http.ResponseWriter, r *http.Request) {
+	if config.DonateLink == "" {
+		http.NotFound(w, r)
+		return
+	}
+	// each click is a row in the donation report, throttled so it can not be flooded
+	if rateLimited(w, r, "donate", "ip", clientIP(r)) {
+		return
+	}
+	var (
+		guest     *tickets.Guest
+		eventCode = r.FormValue("event")
+	)
+	if guestID := chi.URLParam(r, "guestID"); guestID != "" {
+		g, err := tickets.Repo.GetGuest(guestID)
+		if err != nil {
+			log.Println("DonateHandler.GetGuest", guestID, err)
+		} else {
+			guest = g
+			for _, t := range g.Tickets {
+				if t.EventCode != "" {
+					eventCode = t.EventCode
+				}
+			}
+		}
+	}
+	// the guest is on their way to donate even if the click is lost
+	err := tickets.Repo.RecordDonationClick(guest, r.FormValue("src"), eventCode)
+	if err != nil {
+		log.Println("DonateHandler.RecordDonationClick", err)
+	}
+	http.Redirect(w, r, config.DonateLink, http.StatusFound)
+}
@@ -0,0 +1,124 @@
+package views
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/tickets"
+)
+
+var errInvalidPassword = errors.New("Invalid password")
+
+// maxDoorSyncBody is plenty for tickets.MaxDoorScans scans
+const maxDoorSyncBody = 1 << 20
+
+// doorJSON writes v as the response of a door client api
+func doorJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// doorError is the error response of a door client api
+func doorError(w http.ResponseWriter, status int, err error) {
+	doorJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// DoorHandler is the offline door client.  The page is the same for every gate, it logs in, keeps the night's
+// manifest and the check-ins it has not synced in the browser and works without a connection once loaded.
+func DoorHandler(w http.ResponseWriter, r *http.Request) {
+	Render(w, "door.html", nil)
+}
+
+// DoorServiceWorkerHandler is the service worker that reloads the door client without a connection
+func DoorServiceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(doorServiceWorker))
+}
+
+// DoorManifestHandler downloads the night's manifest, logging in a gate with the kiosk password or refreshing
+// with the token from an earlier download
+func DoorManifestHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var gate, date string
+	var err error
+	if token := r.FormValue("token"); token != "" {
+		gate, date, err = tickets.ParseDoorToken(token, now)
+		if err != nil {
+			doorError(w, http.StatusForbidden, err)
+			return
+		}
+	} else {
+		if !isKiosk(r) {
+			doorError(w, http.StatusForbidden, errInvalidPassword)
+			return
+		}
+		gate, err = tickets.ParseGate(r.FormValue("gate"))
+		if err != nil {
+			doorError(w, http.StatusBadRequest, err)
+			return
+		}
+		date = now.In(config.Location).Format("2006-01-02")
+	}
+	m, err := tickets.Repo.GetDoorManifest(gate, date, now)
+	if err != nil {
+		doorError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Println("DoorManifestHandler", gate, date, len(m.Entries))
+	doorJSON(w, http.StatusOK, m)
+}
+
+// DoorSyncHandler checks in the scans a door client queued, see tickets.Repo.SyncDoorScans for conflicts
+func DoorSyncHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string             `json:"token"`
+		Scans []tickets.DoorScan `json:"scans"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDoorSyncBody)).Decode(&req)
+	if err != nil {
+		doorError(w, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now()
+	gate, date, err := tickets.ParseDoorToken(req.Token, now)
+	if err != nil {
+		doorError(w, http.StatusForbidden, err)
+		return
+	}
+	actor := kioskActor(r)
+	actor.Name = gate
+	results, err := tickets.Repo.SyncDoorScans(actor, gate, date, req.Scans, now)
+	if err != nil {
+		doorError(w, http.StatusInternalServerError, err)
+		return
+	}
+	doorJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// doorServiceWorker serves the door client from the cache when the network fails, its scope is /kiosk/
+const doorServiceWorker = `
+var CACHE = "door-v1";
+self.addEventListener("install", function(e) {
+  e.waitUntil(caches.open(CACHE).then(function(c) { return c.add("/kiosk/door"); }));
+  self.skipWaiting();
+});
+self.addEventListener("activate", function(e) { e.waitUntil(self.clients.claim()); });
+self.addEventListener("fetch", function(e) {
+  var url = new URL(e.request.url);
+  if (e.request.method !== "GET" || url.origin !== location.origin || url.pathname !== "/kiosk/door") {
+    return;
+  }
+  e.respondWith(fetch(e.request).then(function(resp) {
+    var copy = resp.clone();
+    caches.open(CACHE).then(function(c) { c.put("/kiosk/door", copy); });
+    return resp;
+  }).catch(function() { return caches.match("/kiosk/door"); }));
+});
+`
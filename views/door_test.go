@@ -0,0 +1,32 @@
+package views
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoorSyncHandlerInvalidToken(t *testing.T) {
+	// a forged token is rejected before any scan is looked up
+	r := httptest.NewRequest("POST", "/kiosk/door/sync", strings.NewReader(`{"token":"north.2019-12-14.forged","scans":[]}`))
+	w := httptest.NewRecorder()
+	DoorSyncHandler(w, r)
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), "This door login has expired")
+
+	r = httptest.NewRequest("POST", "/kiosk/door/sync", strings.NewReader(`not json`))
+	w = httptest.NewRecorder()
+	DoorSyncHandler(w, r)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestDoorManifestHandlerLogin(t *testing.T) {
+	r := httptest.NewRequest("POST", "/kiosk/door/manifest", strings.NewReader("gate=north&password=nope"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	DoorManifestHandler(w, r)
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid password")
+}
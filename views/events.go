@@ -0,0 +1,123 @@
+package views
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/tickets"
+)
+
+// slotEventsKeepAlive is how often an idle stream sends a comment, so proxies do not close it
+var slotEventsKeepAlive = 25 * time.Second
+
+// liveSlot is a slot's availability as sent to the index page
+type liveSlot struct {
+	Slot       int64  `json:"slot"`
+	Available  int64  `json:"available"`
+	Accessible int64  `json:"accessible"`
+	Label      string `json:"label"` // as the index page shows it, ie "(12 avail)"
+}
+
+// slotEventsURL is the live availability stream for the index page of eventCode
+func slotEventsURL(lang, eventCode string) string {
+	q := url.Values{"lang": {lang}}
+	if eventCode != "" {
+		token, err := tickets.EventCodeToken(eventCode)
+		if err != nil {
+			log.Println("slotEventsURL", err)
+			return ""
+		}
+		q.Set("ec", token)
+	}
+	return "/events/slots?" + q.Encode()
+}
+
+// liveSlots is the availability of the slots the index page offers, slots missing from it are sold out
+func liveSlots(lang string, slots []tickets.Slot, now time.Time) []liveSlot {
+	cutOff := now.Add(-30 * time.Minute)
+	live := make([]liveSlot, 0, len(slots))
+	for _, s := range slots {
+		if s.Slot.Before(cutOff) {
+			continue
+		}
+		ls := liveSlot{Slot: s.Slot.Unix(), Available: s.AvailableTickets, Accessible: s.AccessibleTickets}
+		if s.AccessibleTickets > 0 {
+			ls.Label = i18n.T(lang, "index.available_accessible", s.AvailableTickets, s.AccessibleTickets)
+		} else {
+			ls.Label = i18n.T(lang, "index.available", s.AvailableTickets)
+		}
+		live = append(live, ls)
+	}
+	return live
+}
+
+// SlotEventsHandler streams the index page's slot availability as server-sent events, again whenever tickets are
+// assigned, released, created or expired on any instance.  Private event codes are passed as a signed ec token so
+// the stream can not be used to guess codes.
+func SlotEventsHandler(w http.ResponseWriter, r *http.Request) {
+	eventCode := ""
+	if ec := r.URL.Query().Get("ec"); ec != "" {
+		var err error
+		eventCode, err = tickets.ParseEventCodeToken(ec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if eventCode == tickets.WalkupEventCode {
+		http.Error(w, "invalid event link", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	lang := requestLang(w, r, nil)
+	changes, cancel := tickets.Events.Subscribe(tickets.TopicSlots)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx
+	w.WriteHeader(http.StatusOK)
+
+	last := ""
+	send := func() error {
+		slots, err := tickets.Repo.GetSlots(eventCode)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(map[string]interface{}{"slots": liveSlots(lang, slots, time.Now()), "sold_out": i18n.T(lang, "index.sold_out")})
+		if err != nil {
+			return err
+		}
+		if string(b) == last {
+			return nil // a change to another event code's slots
+		}
+		last = string(b)
+		_, err = fmt.Fprintf(w, "event: slots\ndata: %s\n\n", b)
+		flusher.Flush()
+		return err
+	}
+	keepAlive := time.NewTicker(slotEventsKeepAlive)
+	defer keepAlive.Stop()
+	err := send()
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changes:
+			err = send()
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+	log.Println("SlotEventsHandler", eventCode, err)
+}
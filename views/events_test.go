@@ -0,0 +1,52 @@
+package views
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blit/advlight/tickets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveSlots(t *testing.T) {
+	now := time.Date(2019, 12, 14, 19, 0, 0, 0, time.UTC)
+	slots := []tickets.Slot{
+		{Slot: now.Add(-time.Hour), AvailableTickets: 5},
+		{Slot: now.Add(30 * time.Minute), AvailableTickets: 12},
+		{Slot: now.Add(time.Hour), AvailableTickets: 3, AccessibleTickets: 2},
+	}
+	live := liveSlots("en", slots, now)
+	assert.Equal(t, []liveSlot{
+		{Slot: now.Add(30 * time.Minute).Unix(), Available: 12, Label: "(12 avail)"},
+		{Slot: now.Add(time.Hour).Unix(), Available: 3, Accessible: 2, Label: "(3 avail, 2 accessible)"},
+	}, live)
+	assert.Equal(t, "(3 disp., 2 accesibles)", liveSlots("es", slots[2:], now)[0].Label)
+}
+
+func TestSlotEventsURL(t *testing.T) {
+	assert.Equal(t, "/events/slots?lang=en", slotEventsURL("en", ""))
+
+	u, err := url.Parse(slotEventsURL("es", "troop42"))
+	assert.NoError(t, err)
+	assert.Equal(t, "es", u.Query().Get("lang"))
+	code, err := tickets.ParseEventCodeToken(u.Query().Get("ec"))
+	assert.NoError(t, err)
+	assert.Equal(t, "troop42", code)
+	// the code itself is not in the url
+	assert.False(t, strings.Contains(u.RawQuery, "troop42"))
+}
+
+func TestSlotEventsHandlerInvalidLink(t *testing.T) {
+	w := httptest.NewRecorder()
+	SlotEventsHandler(w, httptest.NewRequest("GET", "/events/slots?ec=forged", nil))
+	assert.Equal(t, 400, w.Code)
+
+	token, err := tickets.EventCodeToken(tickets.WalkupEventCode)
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	SlotEventsHandler(w, httptest.NewRequest("GET", "/events/slots?ec="+token, nil))
+	assert.Equal(t, 400, w.Code)
+}
@@ -0,0 +1,134 @@
+package views
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi"
+)
+
+// groupView is the data for group.html
+type groupView struct {
+	ErrorMsg   string
+	SuccessMsg string
+	Group      *tickets.Group
+	Members    []tickets.GroupMember
+	Slots      []tickets.Slot // general admission times with tickets left, to reserve the group's seats in
+	Invites    string         // the emails to invite, kept when they could not be sent
+}
+
+// GroupPortalHandler is the coordinator's page for a group booking, reached with the signed link emailed to them.
+// The coordinator reserves seats in a slot, invites members or shares the link, sees who claimed seats and
+// releases the seats they will not need.
+func GroupPortalHandler(w http.ResponseWriter, r *http.Request) {
+	data := groupView{}
+	id, err := tickets.ParseGroupToken(chi.URLParam(r, "token"))
+	if err == nil {
+		data.Group, err = tickets.Repo.GetGroup(id)
+	}
+	if err != nil {
+		lang := requestLang(w, r, nil)
+		data.ErrorMsg = i18n.Message(lang, err)
+		RenderLang(w, lang, "group.html", data)
+		return
+	}
+	g := data.Group
+	lang := requestLang(w, r, nil)
+	actor := guestActor(r, g.CoordinatorEmail)
+
+	if r.Method == "POST" {
+		if rateLimited(w, r, "group", "ip", clientIP(r), "group", g.ID) {
+			return
+		}
+		switch r.FormValue("op") {
+		case "reserve":
+			var (
+				ts    int64
+				seats int64
+			)
+			ts, err = strconv.ParseInt(r.FormValue("slot"), 10, 64)
+			if err == nil {
+				seats, err = strconv.ParseInt(r.FormValue("seats"), 10, 64)
+			}
+			if err == nil {
+				err = tickets.Repo.ReserveGroupSeats(actor, g, time.Unix(ts, 0), seats, time.Now())
+			}
+			if err == nil {
+				data.SuccessMsg = i18n.T(lang, "group.reserved_msg", seats)
+			}
+		case "release":
+			// 0 releases every unclaimed seat
+			var seats, released int64
+			if r.FormValue("seats") != "all" {
+				seats, err = strconv.ParseInt(r.FormValue("seats"), 10, 64)
+				if err == nil && seats < 1 {
+					err = i18n.Errorf("error.group_release_one")
+				}
+			}
+			if err == nil {
+				released, err = tickets.Repo.ReleaseGroupSeats(actor, g, seats)
+			}
+			if err == nil {
+				data.SuccessMsg = i18n.T(lang, "group.released_msg", released)
+			}
+		case "invite":
+			data.Invites = r.FormValue("emails")
+			if g.Seats == 0 {
+				data.ErrorMsg = i18n.T(lang, "group.reserve_first")
+				break
+			}
+			var emails []string
+			emails, err = tickets.ParseInvites(data.Invites)
+			if err == nil {
+				emails, err = tickets.Repo.InviteGroupMembers(actor, g, emails)
+			}
+			if err != nil {
+				break
+			}
+			failed := make([]string, 0)
+			for _, email := range emails {
+				if serr := tickets.Mailer.Send(lang, email, tickets.GroupInviteSubject(lang, *g), tickets.GroupInviteEmail(lang, *g, email)); serr != nil {
+					log.Println("GroupPortalHandler.invite", g.ID, email, serr)
+					failed = append(failed, email)
+				}
+			}
+			if len(failed) > 0 {
+				data.ErrorMsg = i18n.T(lang, "group.email_failed", strings.Join(failed, ", "))
+			} else {
+				data.Invites = ""
+			}
+			data.SuccessMsg = i18n.T(lang, "group.invited_msg", len(emails)-len(failed))
+		}
+		if err != nil {
+			data.ErrorMsg = i18n.Message(lang, err)
+		}
+		// reload the seat counts
+		if reloaded, rerr := tickets.Repo.GetGroup(g.ID); rerr == nil {
+			data.Group, g = reloaded, reloaded
+		}
+	}
+
+	data.Members, err = tickets.Repo.GetGroupMembers(g)
+	if err != nil {
+		data.ErrorMsg = i18n.Message(lang, err)
+	}
+	if g.Seats == 0 && !g.Released() {
+		slots, err := tickets.Repo.GetSlots("")
+		if err != nil {
+			data.ErrorMsg = i18n.Message(lang, err)
+		}
+		deadline := time.Now().Add(tickets.GroupRelease)
+		for _, s := range slots {
+			if s.AvailableTickets > 0 && s.Slot.After(deadline) {
+				data.Slots = append(data.Slots, s)
+			}
+		}
+	}
+	log.Println("GroupPortalHandler", g.ID, r.FormValue("op"), g.Seats, g.Claimed, data.ErrorMsg)
+	RenderLang(w, lang, "group.html", data)
+}
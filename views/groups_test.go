@@ -0,0 +1,21 @@
+package views
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupPortalHandlerInvalidLink(t *testing.T) {
+	// a forged link is rejected before the group is looked up
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("token", "6f1c2f5e-5d3a-4d7b-9a53-1e2b3c4d5e6f.forged")
+	r := httptest.NewRequest("GET", "/groups/6f1c2f5e-5d3a-4d7b-9a53-1e2b3c4d5e6f.forged", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	GroupPortalHandler(w, r)
+	assert.Contains(t, w.Body.String(), "This group link is not valid")
+}
@@ -0,0 +1,34 @@
+package views
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/tickets"
+)
+
+// langCookie remembers the language a guest picked with the toggle
+const langCookie = "lang"
+
+// requestLang is the language for a guest page: the ?lang= toggle (remembered in a cookie and saved for the
+// guest's emails), then the cookie, the guest's saved language and the browser's Accept-Language
+func requestLang(w http.ResponseWriter, r *http.Request, g *tickets.Guest) string {
+	if lang := r.URL.Query().Get("lang"); i18n.Supported(lang) {
+		http.SetCookie(w, &http.Cookie{Name: langCookie, Value: lang, Path: "/", MaxAge: 365 * 24 * 60 * 60, HttpOnly: true})
+		if g != nil && g.Language != lang {
+			err := tickets.Repo.SetGuestLanguage(guestActor(r, g.Email), g, lang)
+			if err != nil {
+				log.Println("requestLang", g.ID, lang, err)
+			}
+		}
+		return lang
+	}
+	if c, err := r.Cookie(langCookie); err == nil && i18n.Supported(c.Value) {
+		return c.Value
+	}
+	if g != nil && i18n.Supported(g.Language) {
+		return g.Language
+	}
+	return i18n.Match(r.Header.Get("Accept-Language"))
+}
@@ -0,0 +1,44 @@
+package views
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLang(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "es-MX,es;q=0.9,en;q=0.8")
+	assert.Equal(t, "es", requestLang(httptest.NewRecorder(), r, nil))
+
+	// the toggle wins and is remembered
+	r = httptest.NewRequest("GET", "/?lang=en", nil)
+	r.Header.Set("Accept-Language", "es")
+	w := httptest.NewRecorder()
+	assert.Equal(t, "en", requestLang(w, r, nil))
+	cookies := w.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.Equal(t, "en", cookies[0].Value)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "es")
+	r.AddCookie(&http.Cookie{Name: langCookie, Value: "en"})
+	assert.Equal(t, "en", requestLang(httptest.NewRecorder(), r, nil))
+
+	// unsupported languages are ignored
+	r = httptest.NewRequest("GET", "/?lang=xx", nil)
+	assert.Equal(t, "en", requestLang(httptest.NewRecorder(), r, nil))
+}
+
+func TestRenderLang(t *testing.T) {
+	data := map[string]interface{}{"RetryMinutes": 2, "Back": "/"}
+	var en, es bytes.Buffer
+	RenderLang(&en, "en", "throttled.html", data)
+	RenderLang(&es, "es", "throttled.html", data)
+	assert.Contains(t, en.String(), "Whoa, slow down!")
+	assert.Contains(t, es.String(), "¡Espere un momento!")
+	assert.Contains(t, es.String(), `<html lang="es">`)
+}
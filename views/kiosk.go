@@ -0,0 +1,182 @@
+package views
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi/middleware"
+)
+
+// kioskView is the data for kiosk.html
+type kioskView struct {
+	ErrorMsg   string
+	SuccessMsg string
+	Password   string
+	Now        time.Time
+	MaxParty   int64
+	Capacity   []tickets.SlotCapacity // the current slot through the end of the day
+	Issued     *tickets.Guest         // the walk-up just issued, shown as an on-screen ticket
+	IssuedSlot time.Time
+	Emailed    bool
+}
+
+// isKiosk is true for the gate volunteers' password, or the admin password
+func isKiosk(r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+	return config.KioskPassword != "" && r.FormValue("password") == config.KioskPassword
+}
+
+// kioskActor is the audit actor for a walk-up issued or a guest checked in at the gate
+func kioskActor(r *http.Request) tickets.Actor {
+	return tickets.Actor{
+		Kind:      tickets.ActorKiosk,
+		Name:      "kiosk",
+		IPAddress: clientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+// kioskCapacity is the live numbers from the current slot to the end of the day
+func kioskCapacity(now time.Time) ([]tickets.SlotCapacity, error) {
+	local := now.In(config.Location)
+	endOfDay := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, config.Location)
+	current, err := tickets.Repo.CurrentSlot(now)
+	if err != nil {
+		return nil, err
+	}
+	return tickets.Repo.GetCapacity(current, endOfDay)
+}
+
+// KioskHandler is the gate volunteers' screen.  It issues walk-up tickets from the slot's walk-up allocation (and
+// general admission once that runs out), shown on screen or printed, and checks in guests by their ticket link or
+// the QR code on their ticket.
+func KioskHandler(w http.ResponseWriter, r *http.Request) {
+	data := kioskView{Now: time.Now(), MaxParty: tickets.MaxWalkupParty}
+	if !isKiosk(r) {
+		if r.Method == "POST" {
+			data.ErrorMsg = "Invalid password"
+		}
+		Render(w, "kiosk.html", data)
+		return
+	}
+	data.Password = r.FormValue("password")
+
+	var err error
+	actor := kioskActor(r)
+	switch r.FormValue("op") {
+	case "issue":
+		var ts, party int64
+		ts, err = strconv.ParseInt(r.FormValue("slot"), 10, 64)
+		if err == nil {
+			party, err = strconv.ParseInt(strings.TrimSpace(r.FormValue("party")), 10, 64)
+		}
+		if err != nil {
+			data.ErrorMsg = "Pick a time and the number of tickets"
+			break
+		}
+		slot := time.Unix(ts, 0)
+		var g *tickets.Guest
+		g, err = tickets.Repo.IssueWalkups(actor, slot, party, r.FormValue("email"))
+		if err != nil {
+			break
+		}
+		data.Issued, data.IssuedSlot = g, slot
+		data.SuccessMsg = "Issued " + strconv.FormatInt(party, 10) + " tickets for " + slot.In(config.Location).Format("3:04pm")
+		if !tickets.IsWalkupEmail(g.Email) {
+			err = tickets.Mailer.SendGuest(*g, tickets.ConfirmationSubject(*g, slot), tickets.ConfirmationEmail(*g, slot), tickets.ConfirmationAttachments(*g, slot)...)
+			data.Emailed = err == nil
+		}
+	case "checkin":
+		var (
+			guestID string
+			slot    time.Time
+			g       *tickets.Guest
+			checked int64
+		)
+		guestID, slot, err = tickets.ParseTicketLink(r.FormValue("ticket"))
+		if err == nil {
+			g, err = tickets.Repo.GetGuest(guestID)
+		}
+		if err != nil {
+			break
+		}
+		if slot.IsZero() {
+			var current time.Time
+			current, err = tickets.Repo.CurrentSlot(data.Now)
+			if err != nil {
+				break
+			}
+			slot = kioskSlot(g, data.Now, current)
+		}
+		checked, err = tickets.Repo.CheckIn(actor, g, slot, data.Now)
+		if err == nil {
+			data.SuccessMsg = "Checked in " + strconv.FormatInt(checked, 10) + " tickets for " + g.Email + " at " + slot.In(config.Location).Format("3:04pm")
+		}
+	}
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+
+	data.Capacity, err = kioskCapacity(data.Now)
+	if err != nil {
+		data.ErrorMsg = err.Error()
+	}
+	log.Println("KioskHandler", r.FormValue("op"), data.ErrorMsg)
+	Render(w, "kiosk.html", data)
+}
+
+// kioskSlot is the slot to check a guest in to when only their token was scanned, their ticket closest to now today
+// or the current slot (see tickets.CurrentSlot) when they have none
+func kioskSlot(g *tickets.Guest, now, current time.Time) time.Time {
+	slot := current
+	var best time.Duration = -1
+	for _, t := range g.Tickets {
+		if t.Slot.In(config.Location).Format("2006-01-02") != now.In(config.Location).Format("2006-01-02") {
+			continue
+		}
+		d := t.Slot.Sub(now)
+		if d < 0 {
+			d = -d
+		}
+		if best < 0 || d < best {
+			slot, best = t.Slot, d
+		}
+	}
+	return slot
+}
+
+// KioskCapacityHandler is the live slot capacity polled by the kiosk screen
+func KioskCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	if !isKiosk(r) {
+		http.Error(w, "Invalid password", http.StatusForbidden)
+		return
+	}
+	capacity, err := kioskCapacity(time.Now())
+	if err != nil {
+		RenderError(w, err)
+		return
+	}
+	type slotJSON struct {
+		Slot       int64 `json:"slot"`
+		Booked     int64 `json:"booked"`
+		CheckedIn  int64 `json:"checked_in"`
+		Expected   int64 `json:"expected"`
+		ForWalkups int64 `json:"for_walkups"`
+	}
+	slots := make([]slotJSON, 0, len(capacity))
+	for _, sc := range capacity {
+		slots = append(slots, slotJSON{sc.Slot.Unix(), sc.Booked, sc.CheckedIn, sc.Expected(), sc.ForWalkups()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(slots)
+}
@@ -0,0 +1,64 @@
+package views
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/tickets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsKiosk(t *testing.T) {
+	defer func(p string) { config.KioskPassword = p }(config.KioskPassword)
+	defer os.Setenv("ADVLIGHT_PASSWORD", os.Getenv("ADVLIGHT_PASSWORD"))
+	os.Setenv("ADVLIGHT_PASSWORD", "admin")
+
+	post := func(password string) bool {
+		r := httptest.NewRequest("POST", "/kiosk", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return isKiosk(r)
+	}
+	config.KioskPassword = ""
+	assert.True(t, post("admin"))
+	assert.False(t, post(""))
+
+	config.KioskPassword = "gate"
+	assert.True(t, post("gate"))
+	assert.True(t, post("admin"))
+	assert.False(t, post("nope"))
+
+	// the volunteers' password does not open the admin screens
+	r := httptest.NewRequest("POST", "/admin", strings.NewReader("password=gate"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.False(t, isAdmin(r))
+}
+
+func TestKioskSlot(t *testing.T) {
+	defer func(l *time.Location) { config.Location = l }(config.Location)
+	config.Location = time.UTC
+	at := func(day, hour, min int) time.Time { return time.Date(2019, 12, day, hour, min, 0, 0, time.UTC) }
+	g := &tickets.Guest{Tickets: []tickets.Ticket{
+		{Slot: at(13, 19, 0)},
+		{Slot: at(14, 18, 0)},
+		{Slot: at(14, 19, 30)},
+	}}
+	for _, tc := range []struct {
+		name         string
+		now, current time.Time
+		want         time.Time
+	}{
+		{"the ticket closest to now", at(14, 19, 10), at(14, 19, 0), at(14, 19, 30)},
+		{"an earlier ticket that day", at(14, 18, 20), at(14, 18, 0), at(14, 18, 0)},
+		{"slots need not be on the half hour", at(14, 18, 50), at(14, 18, 45), at(14, 19, 30)},
+		// no ticket today is checked against the current slot, and CheckIn reports it
+		{"no ticket today", at(15, 19, 0), at(15, 18, 45), at(15, 18, 45)},
+		{"before the day's first slot", at(15, 9, 0), at(15, 9, 0), at(15, 9, 0)},
+	} {
+		assert.Equal(t, tc.want, kioskSlot(g, tc.now, tc.current), tc.name)
+	}
+}
@@ -0,0 +1,163 @@
+package views
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/blit/advlight/i18n"
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi"
+)
+
+// maxWebhookBody limits the size of a payment webhook request
+const maxWebhookBody = 1 << 20
+
+// GuestCheckoutHandler sends the guest to the payment provider to pay for the tickets held for them in a slot
+func GuestCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		ErrorMsg string
+		Ticket   *tickets.Ticket
+		Guest    *tickets.Guest
+	}{
+		"",  // ErrorMsg
+		nil, // Ticket
+		nil, // Guest
+	}
+	guest, err := tickets.Repo.GetGuest(chi.URLParam(r, "guestID"))
+	if err != nil {
+		lang := requestLang(w, r, nil)
+		data.ErrorMsg = i18n.Message(lang, err)
+		RenderLang(w, lang, "ticket.html", data)
+		return
+	}
+	data.Guest = guest
+	lang := requestLang(w, r, guest)
+	ts, err := strconv.ParseInt(chi.URLParam(r, "slot"), 10, 64)
+	if err != nil {
+		data.ErrorMsg = i18n.T(lang, "error.invalid_ticket", chi.URLParam(r, "slot"))
+		RenderLang(w, lang, "ticket.html", data)
+		return
+	}
+	if tickets.Payments == nil {
+		data.ErrorMsg = i18n.T(lang, "error.payments_unavailable")
+		RenderLang(w, lang, "ticket.html", data)
+		return
+	}
+	checkoutURL, err := tickets.Repo.StartCheckout(guestActor(r, guest.Email), guest, time.Unix(ts, 0))
+	if err != nil {
+		data.ErrorMsg = i18n.Message(lang, err)
+		RenderLang(w, lang, "ticket.html", data)
+		return
+	}
+	http.Redirect(w, r, checkoutURL, http.StatusSeeOther)
+}
+
+// PaymentWebhookHandler receives payment events from the provider, a paid checkout completes the guest's booking
+// and sends their confirmation email.  Errors return a 500 so the provider retries the event.
+func PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if tickets.Payments == nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ev, err := tickets.Payments.ParseWebhook(r.Header, body)
+	if err != nil {
+		log.Println("PaymentWebhookHandler", err)
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+	err = applyPaymentEvent(r, ev)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// applyPaymentEvent updates the payment and sends the confirmation email once the booking is paid
+func applyPaymentEvent(r *http.Request, ev tickets.PaymentEvent) error {
+	p, confirmed, err := tickets.Repo.HandlePaymentEvent(systemActor(r, "payment_webhook"), ev)
+	log.Println("applyPaymentEvent", ev.Ref, ev.Status, p.ID, confirmed, err)
+	if err != nil || !confirmed {
+		return err
+	}
+	guest, err := tickets.Repo.GetGuest(p.GuestID)
+	if err != nil {
+		return err
+	}
+	em := tickets.ConfirmationEmail(*guest, p.Slot)
+	err = tickets.Mailer.SendGuest(*guest, tickets.ConfirmationSubject(*guest, p.Slot), em, tickets.ConfirmationAttachments(*guest, p.Slot)...)
+	if err != nil {
+		// the payment is recorded, retrying the event would not resend the email
+		log.Println("[ERROR] applyPaymentEvent email", guest.Email, err)
+	}
+	return nil
+}
+
+// FakeCheckoutHandler is the checkout page of the fake payment provider (ADVLIGHT_PAYMENTS=fake), for development.
+// Paying or declining posts the event like a provider's webhook and returns to the site.
+func FakeCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	fake, ok := tickets.Payments.(*tickets.FakePayments)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ref := chi.URLParam(r, "ref")
+	p, ok := fake.Checkout(ref)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		ErrorMsg   string
+		Ref        string
+		Payment    tickets.Payment
+		SuccessURL string
+		CancelURL  string
+	}{
+		"",                     // ErrorMsg
+		ref,                    // Ref
+		p,                      // Payment
+		r.FormValue("success"), // SuccessURL
+		r.FormValue("cancel"),  // CancelURL
+	}
+	if r.Method == "POST" {
+		paid := r.FormValue("op") == "pay"
+		ev, err := fake.ParseWebhook(r.Header, fake.Event(ref, paid))
+		if err == nil {
+			err = applyPaymentEvent(r, ev)
+		}
+		if err != nil {
+			data.ErrorMsg = err.Error()
+			Render(w, "fakecheckout.html", data)
+			return
+		}
+		next := data.CancelURL
+		if paid {
+			next = data.SuccessURL
+		}
+		if u, err := url.Parse(next); err != nil || !sameHost(u) {
+			next = "/"
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	Render(w, "fakecheckout.html", data)
+}
+
+// sameHost is true for relative urls and urls on this site
+func sameHost(u *url.URL) bool {
+	if u.Host == "" {
+		return u.Scheme == ""
+	}
+	site, err := url.Parse(tickets.HostName)
+	return err == nil && site.Host == u.Host
+}
@@ -0,0 +1,46 @@
+package views
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/blit/advlight/tickets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaymentWebhookHandler(t *testing.T) {
+	defer func(p tickets.PaymentProvider) { tickets.Payments = p }(tickets.Payments)
+
+	tickets.Payments = nil
+	w := httptest.NewRecorder()
+	PaymentWebhookHandler(w, httptest.NewRequest("POST", "/payments/webhook", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// events that can not be verified are rejected before anything is looked up
+	tickets.Payments = tickets.NewStripe("sk_test", "whsec_test")
+	w = httptest.NewRecorder()
+	PaymentWebhookHandler(w, httptest.NewRequest("POST", "/payments/webhook", strings.NewReader(`{"type":"checkout.session.completed"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// the fake checkout page only exists for the fake provider
+	w = httptest.NewRecorder()
+	FakeCheckoutHandler(w, httptest.NewRequest("GET", "/payments/fake/fake_1", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSameHost(t *testing.T) {
+	for raw, same := range map[string]bool{
+		"/abc?payment=success":         true,
+		tickets.HostName + "/abc":      true,
+		"https://evil.example.com/abc": false,
+		"//evil.example.com/abc":       false,
+		"javascript:alert(1)":          false,
+	} {
+		u, err := url.Parse(raw)
+		assert.NoError(t, err, raw)
+		assert.Equal(t, same, sameHost(u), raw)
+	}
+}
@@ -0,0 +1,40 @@
+package views
+
+import (
+	"net/http"
+
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi"
+)
+
+// TicketPDFHandler downloads a printable PDF of one ticket
+func TicketPDFHandler(w http.ResponseWriter, r *http.Request) {
+	guest, ticket, err := guestTicket(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writePDF(w, "ticket.pdf", *guest, []tickets.Ticket{*ticket})
+}
+
+// GuestPDFHandler downloads a printable PDF with a page for each of the guest's tickets
+func GuestPDFHandler(w http.ResponseWriter, r *http.Request) {
+	guest, err := tickets.Repo.GetGuest(chi.URLParam(r, "guestID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writePDF(w, "tickets.pdf", *guest, guest.Tickets)
+}
+
+func writePDF(w http.ResponseWriter, filename string, g tickets.Guest, ts []tickets.Ticket) {
+	pdf, err := tickets.TicketsPDF(g, ts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", "inline; filename="+filename)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(pdf)
+}
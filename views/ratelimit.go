@@ -0,0 +1,38 @@
+package views
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi/middleware"
+)
+
+// rateLimited takes a token from the action's limit for each keytype/key pair (ie "ip", clientIP(r), "email", email)
+// and renders the throttled page when one is used up
+func rateLimited(w http.ResponseWriter, r *http.Request, action string, pairs ...string) bool {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		name := action + "." + pairs[i]
+		if tickets.RateLimit(name, pairs[i+1]) {
+			continue
+		}
+		log.Printf("rateLimited %s %s %s", name, pairs[i+1], middleware.GetReqID(r.Context()))
+		retry := tickets.RateLimits[name].RetryAfter()
+		data := struct {
+			ErrorMsg     string
+			RetryMinutes int
+			Back         string
+		}{
+			"",                              // ErrorMsg
+			int(math.Ceil(retry.Minutes())), // RetryMinutes
+			r.URL.Path,                      // Back
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		RenderLang(w, requestLang(w, r, nil), "throttled.html", data)
+		return true
+	}
+	return false
+}
@@ -4,20 +4,52 @@ import (
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"log"
 	"os"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
 
+	"github.com/blit/advlight/theme"
 	"github.com/blit/advlight/tickets"
 
 	"github.com/blit/advlight/views/assets"
 )
 
-var templates map[string]*template.Template = make(map[string]*template.Template)
-var reloadTemplates = false
+var templates = make(map[string]*template.Template)
+var templatesMu sync.RWMutex
+
+// templateNames are the pages in wwwroot/templates, each is parsed with layout.html
+var templateNames = []string{
+	"index.html",
+	"ticket.html",
+	"ticketfaces.html",
+	"throttled.html",
+	"admin.html",
+	"admin_slots.html",
+	"admin_guests.html",
+	"admin_audit.html",
+	"admin_suspicious.html",
+	"admin_eventcodes.html",
+	"admin_blocklist.html",
+	"account.html",
+	"admin_artwork.html",
+	"admin_theme.html",
+	"admin_emails.html",
+	"admin_tickettypes.html",
+	"admin_donations.html",
+	"admin_groups.html",
+	"group.html",
+	"kiosk.html",
+	"door.html",
+	"fakecheckout.html",
+}
+
+// templatesModTime is the newest template when they were parsed, templatesChecked throttles checking for changes
+var templatesModTime, templatesChecked time.Time
 
 func init() {
 
@@ -28,25 +60,15 @@ func init() {
 }
 
 func LoadTemplates() error {
-	tplPath := "wwwroot/templates/"
-	isProduction := strings.EqualFold(os.Getenv("ADVLIGHT_ENV"), "production")
-	log.Println(LoadTemplates, isProduction, tplPath)
+	log.Println("LoadTemplates live:", assets.Live)
 	loader := func(name string) string {
-		path := tplPath + name
-		if isProduction {
-			return string(assets.MustAsset(path))
-		}
-		b, err := ioutil.ReadFile(path)
+		b, err := assets.ReadFile("templates/" + name)
 		if err != nil {
-			panic(fmt.Errorf("unable to load %s: %+v", path, err))
+			panic(fmt.Errorf("unable to load %s: %+v", name, err))
 		}
 		return string(b)
 	}
-	if isProduction {
-		fmt.Println("using production assets: ", assets.AssetNames())
-	} else {
-		reloadTemplates = true
-	}
+	modTime := newestTemplate()
 
 	GAID := os.Getenv("ADVLIGHT_GAID")
 	layout, err := template.New("layout.html").Funcs(
@@ -61,58 +83,155 @@ func LoadTemplates() error {
 				return config.EventLink
 			},
 			"eventBanner": func() string {
-				return config.EventBanner
+				return theme.URL(theme.Current().Banner)
 			},
 			"eventLogo": func() string {
-				return config.EventLogo
+				return theme.URL(theme.Current().Logo)
 			},
 			"eventAddress": func() string {
 				return config.EventAddress
 			},
+			"appleWallet": func() bool {
+				return tickets.ApplePass != nil
+			},
+			"googleWallet": func() bool {
+				return tickets.GooglePass != nil
+			},
+			"artworkURL": tickets.ArtworkURL,
+			"asset":      assets.URL,
 			"favICO": func() string {
-				return config.FavICO
+				return theme.URL(theme.Current().Favicon)
+			},
+			"themeCSS": func() template.CSS {
+				return template.CSS(theme.Current().CSS())
+			},
+			"themeStylesheet": func() string {
+				return theme.URL(theme.Current().Stylesheet)
 			},
-			"CAPTCHADisabled": func() string {
-				if tickets.CAPTCHADisabled {
-					return "true"
-				}
-				return "false"
+			"adminPages": func() map[string]string {
+				return adminPages
 			},
+			"captcha": func() tickets.CAPTCHAWidget {
+				return tickets.CAPTCHA.Widget()
+			},
+			"donateURL": tickets.DonateURL,
+			"ticketType": func(code string) tickets.TicketType {
+				return tickets.Repo.GetTicketType(code)
+			},
+			"languages": i18n.Languages,
 		},
-	).Parse(loader("layout.html"))
+	).Funcs(langFuncs(i18n.Default)).Parse(loader("layout.html"))
 	if err != nil {
 		return err
 	}
 
-	for _, name := range []string{
-		"index.html",
-		"ticket.html",
-		"ticketfaces.html",
-		"admin.html",
-	} {
-		t, err := layout.Clone()
+	// each language gets its own copy of the templates with t, slotTime, etc bound to it
+	pages := make(map[string]string)
+	for _, name := range templateNames {
+		pages[name] = loader(name)
+	}
+	parsed := make(map[string]*template.Template)
+	for _, l := range i18n.Languages() {
+		localized, err := layout.Clone()
 		if err != nil {
 			return err
 		}
-		templates[name] = template.Must(t.Parse(loader(name)))
+		localized.Funcs(langFuncs(l.Code))
+		for _, name := range templateNames {
+			t, err := localized.Clone()
+			if err != nil {
+				return err
+			}
+			parsed[templateKey(l.Code, name)] = template.Must(t.Parse(pages[name]))
+		}
 	}
+	templatesMu.Lock()
+	templates = parsed
+	templatesModTime = modTime
+	templatesMu.Unlock()
 	return nil
 
 }
 
+// langFuncs translate templates into lang
+func langFuncs(lang string) template.FuncMap {
+	return template.FuncMap{
+		"t": func(key string, args ...interface{}) string {
+			return i18n.T(lang, key, args...)
+		},
+		"lang": func() string {
+			return lang
+		},
+		"slotTime": func(t time.Time) string {
+			return i18n.FormatTime(lang, t, "format.slot")
+		},
+		"ticketTime": func(t time.Time) string {
+			return i18n.FormatTime(lang, t, "format.ticket")
+		},
+		"dayTime": func(t time.Time) string {
+			return i18n.FormatTime(lang, t, "format.day")
+		},
+	}
+}
+
+// templateKey is the name of a page in lang, the default language's pages are just their name
+func templateKey(lang, name string) string {
+	if lang == i18n.Default {
+		return name
+	}
+	return lang + "/" + name
+}
+
+// newestTemplate is the modification time of the most recently changed template
+func newestTemplate() time.Time {
+	var newest time.Time
+	for _, name := range append([]string{"layout.html"}, templateNames...) {
+		fi, err := fs.Stat(assets.Files, "templates/"+name)
+		if err == nil && fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest
+}
+
+// templatesChanged is true when live templates were edited since they were parsed, checked at most once a second
+func templatesChanged() bool {
+	if !assets.Live {
+		return false
+	}
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	if time.Since(templatesChecked) < time.Second {
+		return false
+	}
+	templatesChecked = time.Now()
+	return newestTemplate().After(templatesModTime)
+}
+
 func RenderError(wr io.Writer, err error) {
 	wr.Write([]byte(`An error occured: ` + err.Error()))
 }
 
 func Render(wr io.Writer, template string, data interface{}) {
-	if reloadTemplates {
+	RenderLang(wr, i18n.Default, template, data)
+}
+
+// RenderLang renders a guest page in lang, see requestLang
+func RenderLang(wr io.Writer, lang, template string, data interface{}) {
+	if templatesChanged() {
 		err := LoadTemplates()
 		if err != nil {
 			RenderError(wr, err)
 			return
 		}
 	}
-	err := templates[template].Execute(wr, data)
+	templatesMu.RLock()
+	t, ok := templates[templateKey(lang, template)]
+	if !ok {
+		t = templates[template]
+	}
+	templatesMu.RUnlock()
+	err := t.Execute(wr, data)
 	if err != nil {
 		log.Printf("[ERROR] Error rendering %s: %s\n", template, err)
 		RenderError(wr, err)
@@ -1,7 +1,6 @@
 package views
 
 import (
-	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -9,6 +8,7 @@ import (
 	"time"
 
 	"github.com/blit/advlight/config"
+	"github.com/blit/advlight/i18n"
 	"github.com/blit/advlight/tickets"
 	"github.com/go-chi/chi"
 )
@@ -27,39 +27,37 @@ func TicketShowHandler(w http.ResponseWriter, r *http.Request) {
 		nil, // Guest
 	}
 
-	slot, err := strconv.ParseInt(ticketID, 10, 64)
-	slotTime := time.Unix(slot, 0)
+	slotTime, number, err := tickets.ParseTicketID(ticketID)
 	// TODO remolve oopsSlotTime next year (I goofed and made all tickets for 2017 in 2018)
-	oopsSlotTime := time.Unix(slot+(60*60*24*365), 0)
+	oopsSlotTime := slotTime.Add(60 * 60 * 24 * 365 * time.Second)
 	if err != nil {
 		log.Printf("TicketShowHandler.invalid_ticket %s %v", ticketID, err)
-		data.ErrorMsg = fmt.Sprintf("%s is not a valid ticket", ticketID)
-		Render(w, "ticket.html", data)
+		lang := requestLang(w, r, nil)
+		data.ErrorMsg = i18n.T(lang, "error.invalid_ticket", ticketID)
+		RenderLang(w, lang, "ticket.html", data)
 		return
 	}
 
 	guest, err := tickets.Repo.GetGuest(guestID)
 	if err != nil {
-		data.ErrorMsg = err.Error()
-		Render(w, "ticket.html", data)
+		lang := requestLang(w, r, nil)
+		data.ErrorMsg = i18n.Message(lang, err)
+		RenderLang(w, lang, "ticket.html", data)
 		return
 	}
 	data.Guest = guest
-	for idx, t := range guest.Tickets {
-		if t.Slot.Equal(slotTime) || t.Slot.Equal(oopsSlotTime) {
-			data.Ticket = &(guest.Tickets[idx])
-			break
-		}
+	lang := requestLang(w, r, guest)
+	data.Ticket = guest.FindTicket(slotTime, number)
+	if data.Ticket == nil {
+		data.Ticket = guest.FindTicket(oopsSlotTime, number)
 	}
 	if data.Ticket == nil {
-		data.ErrorMsg = `Sorry, no ticket found.  
-		This may be due to selecting a different time for the same day, which will cancel the old ticket. 
-		Click My Tickets below to see a list of tickets assigned to you.`
+		data.ErrorMsg = i18n.T(lang, "error.ticket_not_found")
 	} else if !guest.Verified {
-		tickets.Repo.VerifyGuest(guest)
+		tickets.Repo.VerifyGuest(guestActor(r, guest.Email), guest)
 	}
 
-	Render(w, "ticket.html", data)
+	RenderLang(w, lang, "ticket.html", data)
 	return
 
 }
@@ -75,35 +73,96 @@ func TicketIndexHandler(w http.ResponseWriter, r *http.Request) {
 		SentEmailConfirm bool
 		Email            string
 		EventCode        string
+		EventCodeLink    string
+		EventCodeToken   string // the code accepted on this page, signed for the form so it can not be used to try codes
 		Guest            *tickets.Guest
 		DonateLink       string
+		DonatePrompt     bool
+		EmailError       string
+		EmailSuggestion  string
+		EmailChecked     string
+		Request          tickets.TicketRequest
+		TicketTypes      []tickets.TicketType
+		LiveURL          string // the slots' live availability, see SlotEventsHandler
 	}{
-		nil,                        // Slots
-		0,                          // SelectSlot
-		0,                          // CancelSlot
-		"",                         // ErrorMsg
-		"",                         // SuccessMsg
-		false,                      // SentEmailConfirm
-		"",                         // Email
-		r.URL.Query().Get("event"), // EventCode
-		nil,                        // Guest
-		config.DonateLink,
+		nil,                     // Slots
+		0,                       // SelectSlot
+		0,                       // CancelSlot
+		"",                      // ErrorMsg
+		"",                      // SuccessMsg
+		false,                   // SentEmailConfirm
+		"",                      // Email
+		"",                      // EventCode
+		"",                      // EventCodeLink
+		"",                      // EventCodeToken
+		nil,                     // Guest
+		config.DonateLink,       // DonateLink
+		config.DonatePrompt,     // DonatePrompt
+		"",                      // EmailError
+		"",                      // EmailSuggestion
+		"",                      // EmailChecked
+		tickets.TicketRequest{}, // Request
+		nil,                     // TicketTypes
+		"",                      // LiveURL
 	}
 	// populate view data
+	var guestErr error
 	if guestID != "" {
 		guest, err := tickets.Repo.GetGuest(guestID)
 		if err != nil {
-			data.ErrorMsg = err.Error()
+			guestErr = err
 		} else {
 			// set guest info
 			if !guest.Verified {
-				tickets.Repo.VerifyGuest(guest)
+				tickets.Repo.VerifyGuest(guestActor(r, guest.Email), guest)
 			}
 			data.Email = guest.Email
 			data.Guest = guest
 			if len(guest.Tickets) > 0 {
 				data.SelectedSlot = guest.Tickets[0].Slot.Unix()
 			}
+			// keep the accessible spot and ticket type when the guest changes times
+			for _, t := range guest.Tickets {
+				data.Request.Accessible = data.Request.Accessible || t.Category == tickets.CategoryAccessible
+				data.Request.Companion = data.Request.Companion || t.Category == tickets.CategoryCompanion
+				if t.TicketType != "" {
+					data.Request.TicketType = t.TicketType
+				}
+			}
+		}
+	}
+
+	lang := requestLang(w, r, data.Guest)
+	if guestErr != nil {
+		data.ErrorMsg = i18n.Message(lang, guestErr)
+	}
+	// priced ticket types are only offered when payments are set up
+	if tickets.Payments != nil {
+		types, err := tickets.Repo.GetTicketTypes()
+		if err != nil {
+			log.Println("GetTicketTypes", err)
+		}
+		for _, tt := range types {
+			if tt.Active {
+				data.TicketTypes = append(data.TicketTypes, tt)
+			}
+		}
+	}
+	// back from the payment provider's checkout
+	if data.Guest != nil && r.Method == "GET" {
+		switch r.FormValue("payment") {
+		case "success":
+			data.SuccessMsg = i18n.T(lang, "payment.success")
+		case "cancelled":
+			if ts, err := strconv.ParseInt(r.FormValue("slot"), 10, 64); err == nil {
+				err = tickets.Repo.CancelPendingPayment(guestActor(r, data.Guest.Email), data.Guest, time.Unix(ts, 0))
+				if err != nil {
+					data.ErrorMsg = i18n.Message(lang, err)
+				} else {
+					data.SuccessMsg = i18n.T(lang, "payment.cancelled")
+				}
+				data.Guest, _ = tickets.Repo.GetGuest(data.Guest.ID)
+			}
 		}
 	}
 
@@ -116,33 +175,74 @@ func TicketIndexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		var err error
 		data.Email = strings.TrimSpace(strings.ToLower(r.FormValue("email")))
+		data.Request.Accessible = r.FormValue("accessible") == "true"
+		data.Request.Companion = data.Request.Accessible && r.FormValue("companion") == "true"
+		data.Request.TicketType = r.FormValue("tickettype")
+		if data.Request.TicketType != "" && !activeTicketType(data.TicketTypes, data.Request.TicketType) {
+			data.ErrorMsg = i18n.T(lang, "error.ticket_type_invalid", data.Request.TicketType)
+			data.Request.TicketType = ""
+			RenderLang(w, lang, "index.html", data)
+			return
+		}
 		data.SelectedSlot, err = strconv.ParseInt(r.FormValue("slot"), 10, 64)
 		if err != nil {
-			data.ErrorMsg = err.Error()
-			Render(w, "index.html", data)
+			data.ErrorMsg = i18n.Message(lang, err)
+			RenderLang(w, lang, "index.html", data)
 			return
 		}
 		if r.FormValue("cancelslot") != "" {
 			data.CancelSlot, err = strconv.ParseInt(r.FormValue("cancelslot"), 10, 64)
 		}
 		if err != nil {
-			data.ErrorMsg = err.Error()
-			Render(w, "index.html", data)
+			data.ErrorMsg = i18n.Message(lang, err)
+			RenderLang(w, lang, "index.html", data)
 			return
 		}
 	}
 	// event codes affect the slots so need to be processed before calling GetSlots
 	// get the eventcode & slots
-	if strings.TrimSpace(data.EventCode) == "" {
-		data.EventCode = r.FormValue("eventcode")
+	// the code the guest already entered on this page
+	if token := r.FormValue("ect"); token != "" {
+		if code, err := tickets.ParseEventCodeToken(token); err == nil {
+			data.EventCode = code
+		}
+	}
+	// a shareable event link (ec) applies the event code without showing it to the guest
+	if token := r.FormValue("ec"); token != "" {
+		code, err := tickets.ParseEventCodeToken(token)
+		if err != nil {
+			data.ErrorMsg = i18n.Message(lang, err)
+		} else {
+			data.EventCode = code
+			data.EventCodeLink = token
+		}
 	}
-	// see if the event code is being set to a new one
-	if r.FormValue("seteventcode_new") != "" {
-		data.EventCode = r.FormValue("seteventcode_new")
+	// see if the event code is being set to a new one, typed in or from an ?event= link.  Raw codes are only taken
+	// here, behind the throttle and lockout, so the page can not be used to guess codes.
+	newCode := r.FormValue("seteventcode_new")
+	if newCode == "" {
+		newCode = r.URL.Query().Get("event")
+	}
+	enteredCode := newCode != "" && newCode != "!clr"
+	if enteredCode {
+		if rateLimited(w, r, "eventcode", "ip", clientIP(r), "guest", guestID) {
+			return
+		}
+		locked, err := tickets.Repo.EventCodeLockedOut(clientIP(r), guestID)
+		if err != nil {
+			log.Println("EventCodeLockedOut", err)
+		}
+		if locked {
+			data.ErrorMsg = i18n.Message(lang, tickets.ErrEventCodeLockedOut)
+		} else {
+			data.EventCode = newCode
+			data.EventCodeLink = ""
+		}
 	}
 	// see if the event code is being cleared
 	if r.FormValue("seteventcode_new") == "!clr" {
 		data.EventCode = ""
+		data.EventCodeLink = ""
 	}
 
 	data.EventCode = strings.TrimSpace(strings.ToLower(data.EventCode))
@@ -166,9 +266,19 @@ func TicketIndexHandler(w http.ResponseWriter, r *http.Request) {
 		slots = slots[1:]
 	}
 
-	if len(slots) < 1 && data.EventCode != "" {
-		data.ErrorMsg = fmt.Sprintf("%s is an invalid event code or is no longer valid", data.EventCode)
+	// the walk-up allocation is only issued at the kiosk
+	if (len(slots) < 1 || data.EventCode == tickets.WalkupEventCode) && data.EventCode != "" {
+		if data.EventCodeLink != "" {
+			data.ErrorMsg = i18n.T(lang, "error.event_link_invalid")
+		} else {
+			data.ErrorMsg = i18n.T(lang, "error.event_code_invalid", data.EventCode)
+		}
+		if enteredCode {
+			// only codes typed in by the guest count towards a lockout, not codes that have run out of tickets
+			tickets.Repo.RecordEventCodeFailure(guestActor(r, data.Email), guestID, data.EventCode)
+		}
 		data.EventCode = ""
+		data.EventCodeLink = ""
 		slots, err = tickets.Repo.GetSlots(data.EventCode)
 		if err != nil {
 			RenderError(w, err)
@@ -176,10 +286,18 @@ func TicketIndexHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	data.Slots = slots
+	data.LiveURL = slotEventsURL(lang, data.EventCode)
+	if data.EventCode != "" && data.EventCodeLink == "" {
+		data.EventCodeToken, err = tickets.EventCodeToken(data.EventCode)
+		if err != nil {
+			RenderError(w, err)
+			return
+		}
+	}
 
 	// if we are just setting the event, we can exit now
 	if r.FormValue("seteventcode") != "" {
-		Render(w, "index.html", data)
+		RenderLang(w, lang, "index.html", data)
 		return
 	}
 
@@ -187,81 +305,146 @@ func TicketIndexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" && data.CancelSlot > 0 {
 		if data.Guest == nil {
 			// guest must be set, but we are not going to leak that to the script kiddies
-			Render(w, "index.html", data)
+			RenderLang(w, lang, "index.html", data)
+			return
+		}
+		if rateLimited(w, r, "cancel", "ip", clientIP(r), "guest", guestID) {
 			return
 		}
 		slotTime := time.Unix(int64(data.CancelSlot), 0)
-		err = tickets.Repo.CancelTicket(data.Guest, slotTime)
+		err = tickets.Repo.CancelTicket(guestActor(r, data.Guest.Email), data.Guest, slotTime)
 		log.Printf("TicketIndexHandler::CancelSlot %s %d %v %v", data.Guest.Email, data.CancelSlot, slotTime, err)
 		// reload the guest
 		data.Guest, _ = tickets.Repo.GetGuest(data.Guest.ID)
 		if err != nil {
-			data.ErrorMsg = err.Error()
+			data.ErrorMsg = i18n.Message(lang, err)
 		} else {
-			data.SuccessMsg = "Ticket Cancelled"
+			data.SuccessMsg = i18n.T(lang, "index.cancelled")
 		}
-		Render(w, "index.html", data)
+		RenderLang(w, lang, "index.html", data)
 		return
 	}
 
 	// update or book a slot/ticket
 	if r.Method == "POST" && data.SelectedSlot > 0 {
 		slotTime := time.Unix(int64(data.SelectedSlot), 0)
-		guest := &tickets.Guest{Email: data.Email}
+		guest := &tickets.Guest{Email: data.Email, IPAddress: clientIP(r), Language: lang}
 		err = guest.Validate()
 		log.Printf("TicketIndexHandler::SelectedSlot %s %d %v %v", data.Email, data.SelectedSlot, slotTime, err)
 		if err != nil {
-			data.ErrorMsg = err.Error()
-			Render(w, "index.html", data)
+			// email errors are shown inline under the email input
+			if _, ok := err.(*tickets.EmailError); ok && data.Guest == nil {
+				data.EmailError = i18n.Message(lang, err)
+			} else {
+				data.ErrorMsg = i18n.Message(lang, err)
+			}
+			RenderLang(w, lang, "index.html", data)
+			return
+		}
+		data.Email = guest.Email
+		if rateLimited(w, r, "book", "ip", clientIP(r), "email", guest.Email, "guest", guestID) {
+			return
+		}
+		// suggest a fix for typos like gmial.com once, booking with the same email again skips the suggestion
+		if data.Guest == nil && r.FormValue("emailchecked") != guest.Email {
+			if suggestion := tickets.SuggestEmail(guest.Email); suggestion != "" {
+				data.EmailSuggestion = suggestion
+				data.EmailChecked = guest.Email
+				RenderLang(w, lang, "index.html", data)
+				return
+			}
+		}
+		guest.Email, err = tickets.Repo.CheckEmail(guest.Email)
+		if err != nil {
+			// email errors are shown inline under the email input
+			if _, ok := err.(*tickets.EmailError); ok && data.Guest == nil {
+				data.EmailError = i18n.Message(lang, err)
+			} else {
+				data.ErrorMsg = i18n.Message(lang, err)
+			}
+			RenderLang(w, lang, "index.html", data)
+			return
+		}
+		err = tickets.Repo.CheckEventCodeEmail(data.EventCode, guest.Email)
+		if err != nil {
+			data.ErrorMsg = i18n.Message(lang, err)
+			RenderLang(w, lang, "index.html", data)
 			return
 		}
 		err = tickets.Repo.CreateGuest(guest)
 		if err != nil {
-			data.ErrorMsg = err.Error()
-			Render(w, "index.html", data)
+			data.ErrorMsg = i18n.Message(lang, err)
+			RenderLang(w, lang, "index.html", data)
 			return
 		}
 
 		// captcha should be used for unvalidated guests
-		captchResp := strings.TrimSpace(r.FormValue("g-recaptcha-response"))
+		captchResp := strings.TrimSpace(r.FormValue(tickets.CAPTCHA.ResponseField()))
 		if (guestID == "" && !guest.Verified) || captchResp != "" {
-			_, err := tickets.CAPTCHAVerify(captchResp, r.RemoteAddr)
-			if err != nil && !tickets.CAPTCHADisabled {
+			err := tickets.CAPTCHA.Verify(captchResp, clientIP(r))
+			if err != nil {
 				data.ErrorMsg = "CAPTCHAVerify error: " + err.Error()
-				Render(w, "index.html", data)
+				RenderLang(w, lang, "index.html", data)
 				return
 			}
 		}
 
-		err = tickets.Repo.AssignTicket(guest, slotTime, data.EventCode)
+		err = tickets.Repo.AssignTickets(guestActor(r, guest.Email), guest, slotTime, data.EventCode, data.Request)
 		if err != nil {
-			data.ErrorMsg = err.Error()
-			Render(w, "index.html", data)
+			data.ErrorMsg = i18n.Message(lang, err)
+			RenderLang(w, lang, "index.html", data)
 			return
 		}
+		// priced tickets are held until they are paid for, the confirmation email is sent once the payment completes
+		if data.Request.TicketType != "" {
+			if _, err := tickets.Repo.GetPendingPayment(guest, slotTime); err == nil {
+				checkoutURL, err := tickets.Repo.StartCheckout(guestActor(r, guest.Email), guest, slotTime)
+				if err != nil {
+					data.ErrorMsg = i18n.Message(lang, err)
+					RenderLang(w, lang, "index.html", data)
+					return
+				}
+				http.Redirect(w, r, checkoutURL, http.StatusSeeOther)
+				return
+			}
+		}
 		// if we have a guest we need to reload it to relect new ticket times
 		if guest.ID != "" {
 			data.Guest, err = tickets.Repo.GetGuest(guest.ID)
 		}
 
 		em := tickets.ConfirmationEmail(*guest, slotTime)
-		err = tickets.Mailer.Send(guest.Email, "Confirm and View your "+config.EventName+" Tickets", em)
+		withTickets := guest
+		if data.Guest != nil {
+			withTickets = data.Guest // has the ticket number for the calendar event
+		}
+		err = tickets.Mailer.SendGuest(*guest, tickets.ConfirmationSubject(*guest, slotTime), em, tickets.ConfirmationAttachments(*withTickets, slotTime)...)
 		if err != nil {
-			data.ErrorMsg = err.Error()
-			Render(w, "index.html", data)
+			data.ErrorMsg = i18n.Message(lang, err)
+			RenderLang(w, lang, "index.html", data)
 			return
 		}
 		data.SentEmailConfirm = true
-		Render(w, "index.html", data)
+		RenderLang(w, lang, "index.html", data)
 		return
 	}
 
 	// render default (GET)
-	Render(w, "index.html", data)
+	RenderLang(w, lang, "index.html", data)
 	return
 
 }
 
+// activeTicketType is true when code is one of the ticket types offered
+func activeTicketType(types []tickets.TicketType, code string) bool {
+	for _, tt := range types {
+		if strings.EqualFold(tt.Code, code) {
+			return true
+		}
+	}
+	return false
+}
+
 func TicketFacesHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Tickets  []tickets.Ticket
@@ -0,0 +1,67 @@
+package views
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blit/advlight/tickets"
+	"github.com/go-chi/chi"
+)
+
+// guestTicket loads the guest and ticket from the guestID and ticketID (see tickets.ParseTicketID) url params
+func guestTicket(r *http.Request) (*tickets.Guest, *tickets.Ticket, error) {
+	guest, err := tickets.Repo.GetGuest(chi.URLParam(r, "guestID"))
+	if err != nil {
+		return nil, nil, err
+	}
+	slot, number, err := tickets.ParseTicketID(chi.URLParam(r, "ticketID"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s is not a valid ticket", chi.URLParam(r, "ticketID"))
+	}
+	if t := guest.FindTicket(slot, number); t != nil {
+		return guest, t, nil
+	}
+	return nil, nil, fmt.Errorf("Sorry, no ticket found.")
+}
+
+// TicketApplePassHandler downloads the ticket as an Apple Wallet pass
+func TicketApplePassHandler(w http.ResponseWriter, r *http.Request) {
+	if tickets.ApplePass == nil {
+		http.NotFound(w, r)
+		return
+	}
+	guest, ticket, err := guestTicket(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	pass, err := tickets.ApplePass.TicketPass(*guest, *ticket)
+	if err != nil {
+		RenderError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.pkpass")
+	w.Header().Set("Content-Disposition", "attachment; filename=ticket.pkpass")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(pass)
+}
+
+// TicketGoogleWalletHandler redirects to a freshly signed Save to Google Wallet link for the ticket
+func TicketGoogleWalletHandler(w http.ResponseWriter, r *http.Request) {
+	if tickets.GooglePass == nil {
+		http.NotFound(w, r)
+		return
+	}
+	guest, ticket, err := guestTicket(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	link, err := tickets.GooglePass.SaveURL(*guest, *ticket, time.Now())
+	if err != nil {
+		RenderError(w, err)
+		return
+	}
+	http.Redirect(w, r, link, http.StatusFound)
+}
@@ -0,0 +1,9 @@
+// Package wwwroot embeds the templates and static files into the binary
+package wwwroot
+
+import "embed"
+
+// FS holds img/ and templates/, dot files (.DS_Store) are left out
+//
+//go:embed img templates
+var FS embed.FS